@@ -1,16 +1,22 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
 	"github.com/grafana/grafana/pkg/api/response"
 	contextmodel "github.com/grafana/grafana/pkg/services/contexthandler/model"
+	"github.com/grafana/grafana/pkg/services/secrets"
 	skv "github.com/grafana/grafana/pkg/services/secrets/kvstore"
+	"github.com/grafana/grafana/pkg/web"
 )
 
 func (hs *HTTPServer) AdminRotateDataEncryptionKeys(c *contextmodel.ReqContext) response.Response {
 	if err := hs.SecretsService.RotateDataKeys(c.Req.Context()); err != nil {
+		if errors.Is(err, secrets.ErrNoKeysToRotate) {
+			return response.Respond(http.StatusOK, "No data encryption keys to rotate")
+		}
 		return response.Error(http.StatusInternalServerError, "Failed to rotate data keys", err)
 	}
 
@@ -25,6 +31,28 @@ func (hs *HTTPServer) AdminReEncryptEncryptionKeys(c *contextmodel.ReqContext) r
 	return response.Respond(http.StatusOK, "Data encryption keys re-encrypted successfully")
 }
 
+func (hs *HTTPServer) AdminGetQuarantinedDataKeys(c *contextmodel.ReqContext) response.Response {
+	quarantine, ok := hs.SecretsService.(secrets.DataKeyQuarantine)
+	if !ok {
+		return response.Error(http.StatusNotImplemented, "Data keys quarantine is not supported", nil)
+	}
+
+	return response.JSON(http.StatusOK, quarantine.QuarantinedDataKeys())
+}
+
+func (hs *HTTPServer) AdminClearDataKeyQuarantine(c *contextmodel.ReqContext) response.Response {
+	quarantine, ok := hs.SecretsService.(secrets.DataKeyQuarantine)
+	if !ok {
+		return response.Error(http.StatusNotImplemented, "Data keys quarantine is not supported", nil)
+	}
+
+	if !quarantine.ClearDataKeyQuarantine(web.Params(c.Req)[":id"]) {
+		return response.Error(http.StatusNotFound, "Data key is not quarantined", nil)
+	}
+
+	return response.Respond(http.StatusOK, "Data key quarantine cleared successfully")
+}
+
 func (hs *HTTPServer) AdminReEncryptSecrets(c *contextmodel.ReqContext) response.Response {
 	success, err := hs.secretsMigrator.ReEncryptSecrets(c.Req.Context())
 	if err != nil {
@@ -568,6 +568,8 @@ func (hs *HTTPServer) registerRoutes() {
 
 		adminRoute.Post("/encryption/rotate-data-keys", reqGrafanaAdmin, routing.Wrap(hs.AdminRotateDataEncryptionKeys))
 		adminRoute.Post("/encryption/reencrypt-data-keys", reqGrafanaAdmin, routing.Wrap(hs.AdminReEncryptEncryptionKeys))
+		adminRoute.Get("/encryption/quarantined-data-keys", reqGrafanaAdmin, routing.Wrap(hs.AdminGetQuarantinedDataKeys))
+		adminRoute.Delete("/encryption/quarantined-data-keys/:id", reqGrafanaAdmin, routing.Wrap(hs.AdminClearDataKeyQuarantine))
 		adminRoute.Post("/encryption/reencrypt-secrets", reqGrafanaAdmin, routing.Wrap(hs.AdminReEncryptSecrets))
 		adminRoute.Post("/encryption/rollback-secrets", reqGrafanaAdmin, routing.Wrap(hs.AdminRollbackSecrets))
 		adminRoute.Post("/encryption/migrate-secrets/to-plugin", reqGrafanaAdmin, routing.Wrap(hs.AdminMigrateSecretsToPlugin))
@@ -29,10 +29,23 @@ type Internal interface {
 	GetDecryptedValue(ctx context.Context, sjd map[string][]byte, key string, fallback string, secret string) string
 }
 
+// Implementation should be implemented for an Internal that can report which implementation
+// it is (e.g. one backed by a FIPS-validated crypto module), so it's logged on startup.
+type Implementation interface {
+	Implementation() string
+}
+
 type Cipher interface {
 	Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error)
 }
 
+// AppendCipher should be implemented for a Cipher that can append the encrypted payload to the
+// given buffer, so callers that need to prefix the encrypted payload (e.g. envelope encryption)
+// can avoid intermediate allocations and copies. It returns the extended buffer.
+type AppendCipher interface {
+	AppendEncrypt(ctx context.Context, dst []byte, payload []byte, secret string) ([]byte, error)
+}
+
 type Decipher interface {
 	Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error)
 }
@@ -6,6 +6,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"io"
+	"slices"
 
 	"github.com/grafana/grafana/pkg/services/encryption"
 	"github.com/grafana/grafana/pkg/util"
@@ -13,7 +14,11 @@ import (
 
 type aesCfbCipher struct{}
 
-func (c aesCfbCipher) Encrypt(_ context.Context, payload []byte, secret string) ([]byte, error) {
+func (c aesCfbCipher) Encrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	return c.AppendEncrypt(ctx, nil, payload, secret)
+}
+
+func (c aesCfbCipher) AppendEncrypt(_ context.Context, dst []byte, payload []byte, secret string) ([]byte, error) {
 	salt, err := util.GetRandomString(encryption.SaltLength)
 	if err != nil {
 		return nil, err
@@ -31,7 +36,11 @@ func (c aesCfbCipher) Encrypt(_ context.Context, payload []byte, secret string)
 
 	// The IV needs to be unique, but not secure. Therefore, it's common to
 	// include it at the beginning of the ciphertext.
-	ciphertext := make([]byte, encryption.SaltLength+aes.BlockSize+len(payload))
+	n := len(dst)
+	dst = slices.Grow(dst, encryption.SaltLength+aes.BlockSize+len(payload))
+	dst = dst[:n+encryption.SaltLength+aes.BlockSize+len(payload)]
+
+	ciphertext := dst[n:]
 	copy(ciphertext[:encryption.SaltLength], salt)
 	iv := ciphertext[encryption.SaltLength : encryption.SaltLength+aes.BlockSize]
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
@@ -41,5 +50,5 @@ func (c aesCfbCipher) Encrypt(_ context.Context, payload []byte, secret string)
 	stream := cipher.NewCFBEncrypter(block, iv)
 	stream.XORKeyStream(ciphertext[encryption.SaltLength+aes.BlockSize:], payload)
 
-	return ciphertext, nil
+	return dst, nil
 }
@@ -6,6 +6,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
 )
 
 func Test_aesCfbCipher(t *testing.T) {
@@ -17,3 +19,21 @@ func Test_aesCfbCipher(t *testing.T) {
 	assert.NotNil(t, encrypted)
 	assert.NotEmpty(t, encrypted)
 }
+
+func Test_aesCfbCipher_AppendEncrypt(t *testing.T) {
+	cipher := aesCfbCipher{}
+	decipher := aesDecipher{algorithm: encryption.AesCfb}
+	ctx := context.Background()
+
+	prefix := []byte("prefix")
+	dst := make([]byte, len(prefix), 128)
+	copy(dst, prefix)
+
+	encrypted, err := cipher.AppendEncrypt(ctx, dst, []byte("grafana"), "1234")
+	require.NoError(t, err)
+	assert.Equal(t, prefix, encrypted[:len(prefix)])
+
+	decrypted, err := decipher.Decrypt(ctx, encrypted[len(prefix):], "1234")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("grafana"), decrypted)
+}
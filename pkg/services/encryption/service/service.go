@@ -8,6 +8,7 @@ import (
 	"fmt"
 
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/infra/tracing"
@@ -66,6 +67,11 @@ func ProvideEncryptionService(
 	return s, nil
 }
 
+// Implementation implements encryption.Implementation.
+func (s *Service) Implementation() string {
+	return "builtin"
+}
+
 func (s *Service) checkEncryptionAlgorithm(algorithm string) error {
 	var err error
 	defer func() {
@@ -177,6 +183,20 @@ func (s *Service) Encrypt(ctx context.Context, payload []byte, secret string) ([
 	ctx, span := s.tracer.Start(ctx, "encryption.service.Encrypt")
 	defer span.End()
 
+	return s.appendEncrypt(ctx, span, nil, payload, secret)
+}
+
+// AppendEncrypt works like Encrypt, but it appends the encrypted payload to the given buffer.
+// If the cipher for the configured algorithm implements encryption.AppendCipher, the payload
+// is encrypted directly into the buffer, with no intermediate allocations.
+func (s *Service) AppendEncrypt(ctx context.Context, dst []byte, payload []byte, secret string) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "encryption.service.AppendEncrypt")
+	defer span.End()
+
+	return s.appendEncrypt(ctx, span, dst, payload, secret)
+}
+
+func (s *Service) appendEncrypt(ctx context.Context, span trace.Span, dst []byte, payload []byte, secret string) ([]byte, error) {
 	var err error
 	defer func() {
 		if err != nil {
@@ -195,19 +215,26 @@ func (s *Service) Encrypt(ctx context.Context, payload []byte, secret string) ([
 
 	span.SetAttributes(attribute.String("encryption.algorithm", algorithm))
 
-	var encrypted []byte
-	encrypted, err = cipher.Encrypt(ctx, payload, secret)
+	dst = append(dst, encryptionAlgorithmDelimiter)
+	dst = base64.RawStdEncoding.AppendEncode(dst, []byte(algorithm))
+	dst = append(dst, encryptionAlgorithmDelimiter)
 
-	prefix := make([]byte, base64.RawStdEncoding.EncodedLen(len([]byte(algorithm)))+2)
-	base64.RawStdEncoding.Encode(prefix[1:], []byte(algorithm))
-	prefix[0] = encryptionAlgorithmDelimiter
-	prefix[len(prefix)-1] = encryptionAlgorithmDelimiter
+	if appender, ok := cipher.(encryption.AppendCipher); ok {
+		dst, err = appender.AppendEncrypt(ctx, dst, payload, secret)
+		if err != nil {
+			return nil, err
+		}
+
+		return dst, nil
+	}
 
-	ciphertext := make([]byte, len(prefix)+len(encrypted))
-	copy(ciphertext, prefix)
-	copy(ciphertext[len(prefix):], encrypted)
+	var encrypted []byte
+	encrypted, err = cipher.Encrypt(ctx, payload, secret)
+	if err != nil {
+		return nil, err
+	}
 
-	return ciphertext, nil
+	return append(dst, encrypted...), nil
 }
 
 func (s *Service) EncryptJsonData(ctx context.Context, kv map[string]string, secret string) (map[string][]byte, error) {
@@ -8,6 +8,7 @@ import (
 
 	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/infra/db"
+	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/services/accesscontrol"
 	"github.com/grafana/grafana/pkg/services/accesscontrol/acimpl"
@@ -25,7 +26,7 @@ import (
 
 func TestReceiverService_GetReceiver(t *testing.T) {
 	sqlStore := db.InitTestDB(t)
-	secretsService := manager.SetupTestService(t, database.ProvideSecretsStore(sqlStore))
+	secretsService := manager.SetupTestService(t, database.ProvideSecretsStore(sqlStore, kvstore.ProvideService(sqlStore)))
 
 	t.Run("service gets receiver from AM config", func(t *testing.T) {
 		sut := createReceiverServiceSut(t, secretsService)
@@ -47,7 +48,7 @@ func TestReceiverService_GetReceiver(t *testing.T) {
 
 func TestReceiverService_GetReceivers(t *testing.T) {
 	sqlStore := db.InitTestDB(t)
-	secretsService := manager.SetupTestService(t, database.ProvideSecretsStore(sqlStore))
+	secretsService := manager.SetupTestService(t, database.ProvideSecretsStore(sqlStore, kvstore.ProvideService(sqlStore)))
 
 	t.Run("service gets receivers from AM config", func(t *testing.T) {
 		sut := createReceiverServiceSut(t, secretsService)
@@ -71,7 +72,7 @@ func TestReceiverService_GetReceivers(t *testing.T) {
 
 func TestReceiverService_DecryptRedact(t *testing.T) {
 	sqlStore := db.InitTestDB(t)
-	secretsService := manager.SetupTestService(t, database.ProvideSecretsStore(sqlStore))
+	secretsService := manager.SetupTestService(t, database.ProvideSecretsStore(sqlStore, kvstore.ProvideService(sqlStore)))
 	ac := acimpl.ProvideAccessControl(featuremgmt.WithFeatures())
 
 	getMethods := []string{"single", "multi"}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+const (
+	reEncryptCheckpointNamespace = "secrets.reencryption"
+
+	// reEncryptCheckpointInterval is the amount of data keys re-encrypted
+	// between two consecutive checkpoints. In case of interruption, at most
+	// that amount of data keys will be re-encrypted again on the next run.
+	reEncryptCheckpointInterval = 100
+
+	// reEncryptCheckpointMaxAge is how long a checkpoint can be resumed after it was
+	// stored. Older ones are ignored, as the data keys may have changed in the meantime.
+	reEncryptCheckpointMaxAge = 24 * time.Hour
+)
+
+// reEncryptCheckpoint identifies the last data key re-encrypted by an
+// interrupted data keys re-encryption, so it can be resumed later.
+//
+// Data keys are re-encrypted in (created, id) order, and the checkpoint
+// only advances past the data keys that were successfully re-encrypted,
+// so every data key before it is known to have been re-encrypted already.
+type reEncryptCheckpoint struct {
+	Provider  secrets.ProviderID `json:"provider"`
+	LastId    string             `json:"lastId"`
+	Created   time.Time          `json:"created"`
+	Processed int                `json:"processed"`
+	Stored    time.Time          `json:"stored"`
+}
+
+// after reports whether the given data key comes after the checkpoint,
+// and therefore still needs to be re-encrypted.
+func (c *reEncryptCheckpoint) after(k *secrets.DataKey) bool {
+	if k.Created.Equal(c.Created) {
+		return k.Id > c.LastId
+	}
+
+	return k.Created.After(c.Created)
+}
+
+// reEncryptCheckpointKey returns the key the checkpoint of a re-encryption of the data keys
+// created before the given time (or all of them, if it's zero) is stored with, so full and
+// partial re-encryptions don't resume nor clear the checkpoints of each other.
+func (ss *SecretsStoreImpl) reEncryptCheckpointKey(olderThan time.Time) string {
+	if olderThan.IsZero() {
+		return ss.table
+	}
+
+	return ss.table + ".older_than"
+}
+
+// getReEncryptCheckpoint returns the checkpoint stored with the given key for the given provider,
+// if any. A checkpoint stored for a different provider is ignored because it belongs to a
+// re-encryption towards another provider, so it cannot be resumed. A checkpoint stored more
+// than reEncryptCheckpointMaxAge ago is ignored too.
+func (ss *SecretsStoreImpl) getReEncryptCheckpoint(ctx context.Context, key string, provider secrets.ProviderID) (*reEncryptCheckpoint, error) {
+	value, exists, err := ss.kv.Get(ctx, key)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var checkpoint reEncryptCheckpoint
+	if err := json.Unmarshal([]byte(value), &checkpoint); err != nil {
+		ss.log.Warn("Ignoring malformed data keys re-encryption checkpoint", "err", err)
+		return nil, nil
+	}
+
+	if checkpoint.Provider != provider {
+		ss.log.Info("Ignoring data keys re-encryption checkpoint for another provider",
+			"checkpoint_provider", checkpoint.Provider,
+			"provider", provider,
+		)
+		return nil, nil
+	}
+
+	if age := time.Since(checkpoint.Stored); age > reEncryptCheckpointMaxAge {
+		ss.log.Info("Ignoring stale data keys re-encryption checkpoint", "age", age)
+		return nil, nil
+	}
+
+	return &checkpoint, nil
+}
+
+func (ss *SecretsStoreImpl) setReEncryptCheckpoint(ctx context.Context, key string, checkpoint *reEncryptCheckpoint) error {
+	checkpoint.Stored = time.Now()
+	value, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	return ss.kv.Set(ctx, key, string(value))
+}
+
+func (ss *SecretsStoreImpl) clearReEncryptCheckpoint(ctx context.Context, key string) error {
+	return ss.kv.Del(ctx, key)
+}
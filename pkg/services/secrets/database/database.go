@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/grafana/grafana/pkg/infra/db"
+	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/services/kmsproviders"
 	"github.com/grafana/grafana/pkg/services/secrets"
@@ -13,13 +14,15 @@ import (
 
 type SecretsStoreImpl struct {
 	db    db.DB
+	kv    *kvstore.NamespacedKVStore
 	log   log.Logger
 	table string
 }
 
-func ProvideSecretsStore(db db.DB) *SecretsStoreImpl {
+func ProvideSecretsStore(db db.DB, kv kvstore.KVStore) *SecretsStoreImpl {
 	store := &SecretsStoreImpl{
 		db:    db,
+		kv:    kvstore.WithNamespace(kv, 0, reEncryptCheckpointNamespace),
 		log:   log.New("secrets.store"),
 		table: "data_keys",
 	}
@@ -27,8 +30,8 @@ func ProvideSecretsStore(db db.DB) *SecretsStoreImpl {
 	return store
 }
 
-func NewSecretsStoreForTable(db db.DB, table string) *SecretsStoreImpl {
-	store := ProvideSecretsStore(db)
+func NewSecretsStoreForTable(db db.DB, kv kvstore.KVStore, table string) *SecretsStoreImpl {
+	store := ProvideSecretsStore(db, kv)
 	store.table = table
 	return store
 }
@@ -64,6 +67,9 @@ func (ss *SecretsStoreImpl) GetCurrentDataKey(ctx context.Context, label string)
 		var err error
 		exists, err = sess.Table(ss.table).
 			Where("label = ? AND active = ?", label, ss.db.GetDialect().BooleanStr(true)).
+			// There may be more than one active data key for the same label
+			// during a data keys rotation overlap, so the newest one is chosen.
+			Desc("created", "name").
 			Get(dataKey)
 		return err
 	})
@@ -88,6 +94,53 @@ func (ss *SecretsStoreImpl) GetAllDataKeys(ctx context.Context) ([]*secrets.Data
 	return result, err
 }
 
+func (ss *SecretsStoreImpl) CountDataKeys(ctx context.Context) (int64, error) {
+	var count int64
+	err := ss.db.WithDbSession(ctx, func(sess *db.Session) error {
+		var err error
+		count, err = sess.Table(ss.table).Count()
+		return err
+	})
+	return count, err
+}
+
+func (ss *SecretsStoreImpl) GetLatestGeneration(ctx context.Context) (int64, bool, error) {
+	var (
+		generation int64
+		disabled   bool
+	)
+
+	err := ss.db.WithDbSession(ctx, func(sess *db.Session) error {
+		var (
+			latest struct {
+				Generation int64
+				Count      int64
+			}
+			err error
+		)
+		_, err = sess.SQL("SELECT COALESCE(MAX(generation), 0) AS generation, COUNT(*) AS count FROM " +
+			ss.db.GetDialect().Quote(ss.table)).Get(&latest)
+		if err != nil || latest.Count == 0 {
+			return err
+		}
+
+		active, err := sess.Table(ss.table).
+			Where("generation = ? AND active = ?", latest.Generation, ss.db.GetDialect().BooleanStr(true)).
+			Count()
+		if err != nil {
+			return err
+		}
+
+		generation, disabled = latest.Generation, active == 0
+		return nil
+	})
+	if err != nil {
+		return 0, false, fmt.Errorf("failed getting latest data keys generation: %w", err)
+	}
+
+	return generation, disabled, nil
+}
+
 func (ss *SecretsStoreImpl) CreateDataKey(ctx context.Context, dataKey *secrets.DataKey) error {
 	if !dataKey.Active {
 		return fmt.Errorf("cannot insert deactivated data keys")
@@ -106,6 +159,33 @@ func (ss *SecretsStoreImpl) CreateDataKey(ctx context.Context, dataKey *secrets.
 	})
 }
 
+// dataKeysBatchSize is the maximum amount of data keys inserted by a single statement,
+// to stay below the limit of parameters per statement of every supported database.
+const dataKeysBatchSize = 100
+
+func (ss *SecretsStoreImpl) CreateDataKeys(ctx context.Context, dataKeys []*secrets.DataKey) error {
+	created := time.Now()
+	for _, dataKey := range dataKeys {
+		if !dataKey.Active {
+			return fmt.Errorf("cannot insert deactivated data keys")
+		}
+
+		dataKey.Created = created
+		dataKey.Updated = created
+	}
+
+	return ss.db.WithTransactionalDbSession(ctx, func(sess *db.Session) error {
+		for start := 0; start < len(dataKeys); start += dataKeysBatchSize {
+			end := min(start+dataKeysBatchSize, len(dataKeys))
+			if _, err := sess.Table(ss.table).Insert(dataKeys[start:end]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
 func (ss *SecretsStoreImpl) DisableDataKeys(ctx context.Context) error {
 	return ss.db.WithTransactionalDbSession(ctx, func(sess *db.Session) error {
 		_, err := sess.Table(ss.table).
@@ -115,6 +195,19 @@ func (ss *SecretsStoreImpl) DisableDataKeys(ctx context.Context) error {
 	})
 }
 
+func (ss *SecretsStoreImpl) DisableDataKey(ctx context.Context, id string) error {
+	if len(id) == 0 {
+		return fmt.Errorf("data key id is missing")
+	}
+
+	return ss.db.WithTransactionalDbSession(ctx, func(sess *db.Session) error {
+		_, err := sess.Table(ss.table).
+			Where("name = ?", id).
+			UseBool("active").Update(&secrets.DataKey{Active: false})
+		return err
+	})
+}
+
 func (ss *SecretsStoreImpl) DeleteDataKey(ctx context.Context, id string) error {
 	if len(id) == 0 {
 		return fmt.Errorf("data key id is missing")
@@ -127,19 +220,86 @@ func (ss *SecretsStoreImpl) DeleteDataKey(ctx context.Context, id string) error
 	})
 }
 
+func (ss *SecretsStoreImpl) UpdateDataKeysProvider(ctx context.Context, from secrets.ProviderID, to secrets.ProviderID) (int64, error) {
+	var updated int64
+	err := ss.db.WithTransactionalDbSession(ctx, func(sess *db.Session) error {
+		var err error
+		updated, err = sess.Table(ss.table).
+			Where("provider = ?", from).
+			Cols("provider", "updated").
+			Update(&secrets.DataKey{Provider: to, Updated: time.Now()})
+		return err
+	})
+
+	return updated, err
+}
+
 func (ss *SecretsStoreImpl) ReEncryptDataKeys(
 	ctx context.Context,
 	providers map[secrets.ProviderID]secrets.Provider,
 	currProvider secrets.ProviderID,
+) error {
+	return ss.reEncryptDataKeys(ctx, providers, currProvider, time.Time{})
+}
+
+func (ss *SecretsStoreImpl) ReEncryptDataKeysOlderThan(
+	ctx context.Context,
+	providers map[secrets.ProviderID]secrets.Provider,
+	currProvider secrets.ProviderID,
+	olderThan time.Time,
+) error {
+	return ss.reEncryptDataKeys(ctx, providers, currProvider, olderThan)
+}
+
+// reEncryptDataKeys re-encrypts the data keys created before the given time (or all of them,
+// if it's zero) with the current provider. Data keys that fail to be re-encrypted are skipped,
+// but the checkpoint doesn't advance past them, so the next re-encryption retries them. Full
+// and partial re-encryptions keep their own checkpoint. See reEncryptCheckpointKey.
+func (ss *SecretsStoreImpl) reEncryptDataKeys(
+	ctx context.Context,
+	providers map[secrets.ProviderID]secrets.Provider,
+	currProvider secrets.ProviderID,
+	olderThan time.Time,
 ) error {
 	keys := make([]*secrets.DataKey, 0)
 	if err := ss.db.WithDbSession(ctx, func(sess *db.Session) error {
-		return sess.Table(ss.table).Find(&keys)
+		query := sess.Table(ss.table)
+		if !olderThan.IsZero() {
+			query = query.Where("created < ?", olderThan)
+		}
+		return query.Asc("created", "name").Find(&keys)
 	}); err != nil {
 		return err
 	}
 
+	checkpointKey := ss.reEncryptCheckpointKey(olderThan)
+	checkpoint, err := ss.getReEncryptCheckpoint(ctx, checkpointKey, currProvider)
+	if err != nil {
+		return err
+	}
+
+	if checkpoint != nil {
+		ss.log.Info("Resuming data keys re-encryption from checkpoint",
+			"last_id", checkpoint.LastId,
+			"processed", checkpoint.Processed,
+			"total", len(keys),
+		)
+	} else {
+		checkpoint = &reEncryptCheckpoint{Provider: currProvider}
+	}
+
+	failed := 0
 	for _, k := range keys {
+		if checkpoint.LastId != "" && !checkpoint.after(k) {
+			continue
+		}
+
+		// Escrow copies are, on purpose, encrypted by their escrow provider.
+		if secrets.IsEscrowDataKeyId(k.Id) {
+			continue
+		}
+
+		reEncrypted := false
 		err := ss.db.WithTransactionalDbSession(ctx, func(sess *db.Session) error {
 			provider, ok := providers[kmsproviders.NormalizeProviderID(k.Provider)]
 			if !ok {
@@ -167,7 +327,7 @@ func (ss *SecretsStoreImpl) ReEncryptDataKeys(
 			// Updating current data key by re-encrypting it with current provider.
 			// Accessing the current provider within providers map should be safe.
 			k.Provider = currProvider
-			k.Label = secrets.KeyLabel(k.Scope, currProvider)
+			k.Label = secrets.ReEncryptedKeyLabel(k, currProvider)
 			k.Updated = time.Now()
 			k.EncryptedData, err = providers[currProvider].Encrypt(ctx, decrypted)
 			if err != nil {
@@ -192,13 +352,38 @@ func (ss *SecretsStoreImpl) ReEncryptDataKeys(
 				return nil
 			}
 
+			reEncrypted = true
 			return nil
 		})
 
 		if err != nil {
 			return err
 		}
+
+		if !reEncrypted {
+			failed++
+		} else if failed == 0 {
+			checkpoint.LastId = k.Id
+			checkpoint.Created = k.Created
+		}
+		checkpoint.Processed++
+
+		if checkpoint.Processed%reEncryptCheckpointInterval == 0 {
+			if err := ss.setReEncryptCheckpoint(ctx, checkpointKey, checkpoint); err != nil {
+				return err
+			}
+
+			ss.log.Info("Data keys re-encryption in progress", "processed", checkpoint.Processed, "total", len(keys))
+		}
+	}
+
+	if failed > 0 {
+		ss.log.Warn("Some data keys couldn't be re-encrypted, the next re-encryption will retry them",
+			"failed", failed,
+			"total", len(keys),
+		)
+		return ss.setReEncryptCheckpoint(ctx, checkpointKey, checkpoint)
 	}
 
-	return nil
+	return ss.clearReEncryptCheckpoint(ctx, checkpointKey)
 }
@@ -0,0 +1,208 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/db"
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/storetest"
+	"github.com/grafana/grafana/pkg/tests/testsuite"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+func TestMain(m *testing.M) {
+	testsuite.Run(m)
+}
+
+func TestSecretsStore_Conformance(t *testing.T) {
+	storetest.StoreConformanceTest(t, func(t *testing.T) secrets.Store {
+		testDB := db.InitTestDB(t)
+		return ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+	})
+}
+
+type countingProvider struct {
+	decrypted []string
+	// failing is the data key that fails to be decrypted, if any.
+	failing string
+}
+
+func (p *countingProvider) Encrypt(_ context.Context, blob []byte) ([]byte, error) {
+	return blob, nil
+}
+
+func (p *countingProvider) Decrypt(_ context.Context, blob []byte) ([]byte, error) {
+	if string(blob) == p.failing {
+		return nil, errors.New("failed to decrypt")
+	}
+	p.decrypted = append(p.decrypted, string(blob))
+	return blob, nil
+}
+
+func TestSecretsStore_GetCurrentDataKey(t *testing.T) {
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	store := ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+
+	t.Run("with multiple active data keys, the newest one should be chosen", func(t *testing.T) {
+		for _, id := range []string{"a", "b"} {
+			require.NoError(t, store.CreateDataKey(ctx, &secrets.DataKey{
+				Active:        true,
+				Id:            id,
+				Label:         "overlap",
+				Provider:      "fake.v1",
+				EncryptedData: []byte(id),
+			}))
+		}
+
+		current, err := store.GetCurrentDataKey(ctx, "overlap")
+		require.NoError(t, err)
+		assert.Equal(t, "b", current.Id)
+	})
+
+	t.Run("disabled data keys should not be chosen", func(t *testing.T) {
+		require.NoError(t, store.DisableDataKey(ctx, "b"))
+
+		current, err := store.GetCurrentDataKey(ctx, "overlap")
+		require.NoError(t, err)
+		assert.Equal(t, "a", current.Id)
+
+		disabled, err := store.GetDataKey(ctx, "b")
+		require.NoError(t, err)
+		assert.False(t, disabled.Active)
+	})
+}
+
+func TestSecretsStore_ReEncryptDataKeys(t *testing.T) {
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	store := ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+
+	const providerID = secrets.ProviderID("fake.v1")
+	provider := &countingProvider{}
+	providers := map[secrets.ProviderID]secrets.Provider{providerID: provider}
+
+	for i := 0; i < 3; i++ {
+		id := util.GenerateShortUID()
+		require.NoError(t, store.CreateDataKey(ctx, &secrets.DataKey{
+			Active:        true,
+			Id:            id,
+			Label:         id,
+			Provider:      providerID,
+			EncryptedData: []byte(id),
+		}))
+	}
+
+	ordered := make([]*secrets.DataKey, 0)
+	require.NoError(t, store.db.WithDbSession(ctx, func(sess *db.Session) error {
+		return sess.Table(store.table).Asc("created", "name").Find(&ordered)
+	}))
+	require.Len(t, ordered, 3)
+
+	fullKey := store.reEncryptCheckpointKey(time.Time{})
+
+	t.Run("without checkpoint, all keys should be re-encrypted", func(t *testing.T) {
+		provider.decrypted = nil
+
+		require.NoError(t, store.ReEncryptDataKeys(ctx, providers, providerID))
+		assert.Len(t, provider.decrypted, 3)
+	})
+
+	t.Run("with checkpoint, re-encryption should resume after it", func(t *testing.T) {
+		provider.decrypted = nil
+
+		require.NoError(t, store.setReEncryptCheckpoint(ctx, fullKey, &reEncryptCheckpoint{
+			Provider:  providerID,
+			LastId:    ordered[1].Id,
+			Created:   ordered[1].Created,
+			Processed: 2,
+		}))
+
+		require.NoError(t, store.ReEncryptDataKeys(ctx, providers, providerID))
+		assert.Equal(t, []string{ordered[2].Id}, provider.decrypted)
+
+		// Once finished, the checkpoint must be cleared.
+		checkpoint, err := store.getReEncryptCheckpoint(ctx, fullKey, providerID)
+		require.NoError(t, err)
+		assert.Nil(t, checkpoint)
+	})
+
+	t.Run("checkpoint for another provider should be ignored", func(t *testing.T) {
+		provider.decrypted = nil
+
+		require.NoError(t, store.setReEncryptCheckpoint(ctx, fullKey, &reEncryptCheckpoint{
+			Provider: "another.v1",
+			LastId:   ordered[1].Id,
+			Created:  ordered[1].Created,
+		}))
+
+		require.NoError(t, store.ReEncryptDataKeys(ctx, providers, providerID))
+		assert.Len(t, provider.decrypted, 3)
+	})
+
+	t.Run("stale checkpoint should be ignored", func(t *testing.T) {
+		provider.decrypted = nil
+
+		value, err := json.Marshal(&reEncryptCheckpoint{
+			Provider: providerID,
+			LastId:   ordered[1].Id,
+			Created:  ordered[1].Created,
+			Stored:   time.Now().Add(-reEncryptCheckpointMaxAge - time.Minute),
+		})
+		require.NoError(t, err)
+		require.NoError(t, store.kv.Set(ctx, fullKey, string(value)))
+
+		require.NoError(t, store.ReEncryptDataKeys(ctx, providers, providerID))
+		assert.Len(t, provider.decrypted, 3)
+	})
+
+	t.Run("failed data keys should be retried by the next re-encryption", func(t *testing.T) {
+		provider.decrypted = nil
+		provider.failing = ordered[1].Id
+
+		require.NoError(t, store.ReEncryptDataKeys(ctx, providers, providerID))
+		assert.Equal(t, []string{ordered[0].Id, ordered[2].Id}, provider.decrypted)
+
+		// The checkpoint must not advance past the failed data key.
+		checkpoint, err := store.getReEncryptCheckpoint(ctx, fullKey, providerID)
+		require.NoError(t, err)
+		require.NotNil(t, checkpoint)
+		assert.Equal(t, ordered[0].Id, checkpoint.LastId)
+
+		provider.decrypted = nil
+		provider.failing = ""
+
+		require.NoError(t, store.ReEncryptDataKeys(ctx, providers, providerID))
+		assert.Equal(t, []string{ordered[1].Id, ordered[2].Id}, provider.decrypted)
+
+		checkpoint, err = store.getReEncryptCheckpoint(ctx, fullKey, providerID)
+		require.NoError(t, err)
+		assert.Nil(t, checkpoint)
+	})
+
+	t.Run("partial re-encryption should not use nor clear the full re-encryption checkpoint", func(t *testing.T) {
+		provider.decrypted = nil
+
+		require.NoError(t, store.setReEncryptCheckpoint(ctx, fullKey, &reEncryptCheckpoint{
+			Provider: providerID,
+			LastId:   ordered[1].Id,
+			Created:  ordered[1].Created,
+		}))
+
+		require.NoError(t, store.ReEncryptDataKeysOlderThan(ctx, providers, providerID, time.Now().Add(time.Hour)))
+		assert.Len(t, provider.decrypted, 3)
+
+		checkpoint, err := store.getReEncryptCheckpoint(ctx, fullKey, providerID)
+		require.NoError(t, err)
+		require.NotNil(t, checkpoint)
+		assert.Equal(t, ordered[1].Id, checkpoint.LastId)
+	})
+}
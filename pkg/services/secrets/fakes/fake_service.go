@@ -40,6 +40,10 @@ func (f FakeSecretsService) GetDecryptedValue(_ context.Context, sjd map[string]
 	return fallback
 }
 
+func (f FakeSecretsService) GetDecryptedValueE(ctx context.Context, sjd map[string][]byte, key, fallback string) (string, error) {
+	return f.GetDecryptedValue(ctx, sjd, key, fallback), nil
+}
+
 func (f FakeSecretsService) RotateDataKeys(_ context.Context) error {
 	return nil
 }
@@ -2,7 +2,9 @@ package fakes
 
 import (
 	"context"
+	"time"
 
+	"github.com/grafana/grafana/pkg/services/kmsproviders"
 	"github.com/grafana/grafana/pkg/services/secrets"
 )
 
@@ -24,13 +26,23 @@ func (f FakeSecretsStore) GetDataKey(_ context.Context, id string) (*secrets.Dat
 }
 
 func (f FakeSecretsStore) GetCurrentDataKey(_ context.Context, label string) (*secrets.DataKey, error) {
+	var current *secrets.DataKey
 	for _, key := range f.store {
-		if key.Label == label && key.Active {
-			return key, nil
+		if key.Label != label || !key.Active {
+			continue
 		}
+
+		if current == nil || key.Created.After(current.Created) ||
+			(key.Created.Equal(current.Created) && key.Id > current.Id) {
+			current = key
+		}
+	}
+
+	if current == nil {
+		return nil, secrets.ErrDataKeyNotFound
 	}
 
-	return nil, secrets.ErrDataKeyNotFound
+	return current, nil
 }
 
 func (f FakeSecretsStore) GetAllDataKeys(_ context.Context) ([]*secrets.DataKey, error) {
@@ -41,11 +53,45 @@ func (f FakeSecretsStore) GetAllDataKeys(_ context.Context) ([]*secrets.DataKey,
 	return result, nil
 }
 
+func (f FakeSecretsStore) CountDataKeys(_ context.Context) (int64, error) {
+	return int64(len(f.store)), nil
+}
+
+func (f FakeSecretsStore) GetLatestGeneration(_ context.Context) (int64, bool, error) {
+	var (
+		generation int64
+		active     bool
+	)
+
+	for _, key := range f.store {
+		switch {
+		case key.Generation > generation:
+			generation, active = key.Generation, key.Active
+		case key.Generation == generation:
+			active = active || key.Active
+		}
+	}
+
+	return generation, len(f.store) > 0 && !active, nil
+}
+
 func (f FakeSecretsStore) CreateDataKey(_ context.Context, dataKey *secrets.DataKey) error {
+	if dataKey.Created.IsZero() {
+		dataKey.Created = time.Now()
+	}
 	f.store[dataKey.Id] = dataKey
 	return nil
 }
 
+func (f FakeSecretsStore) CreateDataKeys(ctx context.Context, dataKeys []*secrets.DataKey) error {
+	for _, dataKey := range dataKeys {
+		if err := f.CreateDataKey(ctx, dataKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (f FakeSecretsStore) DisableDataKeys(_ context.Context) error {
 	for id := range f.store {
 		f.store[id].Active = false
@@ -53,11 +99,58 @@ func (f FakeSecretsStore) DisableDataKeys(_ context.Context) error {
 	return nil
 }
 
+func (f FakeSecretsStore) DisableDataKey(_ context.Context, id string) error {
+	if key, ok := f.store[id]; ok {
+		key.Active = false
+	}
+	return nil
+}
+
 func (f FakeSecretsStore) DeleteDataKey(_ context.Context, id string) error {
 	delete(f.store, id)
 	return nil
 }
 
-func (f FakeSecretsStore) ReEncryptDataKeys(_ context.Context, _ map[secrets.ProviderID]secrets.Provider, _ secrets.ProviderID) error {
+func (f FakeSecretsStore) UpdateDataKeysProvider(_ context.Context, from secrets.ProviderID, to secrets.ProviderID) (int64, error) {
+	var updated int64
+	for _, key := range f.store {
+		if key.Provider == from {
+			key.Provider = to
+			key.Updated = time.Now()
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+func (f FakeSecretsStore) ReEncryptDataKeys(ctx context.Context, providers map[secrets.ProviderID]secrets.Provider, currProvider secrets.ProviderID) error {
+	return f.ReEncryptDataKeysOlderThan(ctx, providers, currProvider, time.Time{})
+}
+
+func (f FakeSecretsStore) ReEncryptDataKeysOlderThan(ctx context.Context, providers map[secrets.ProviderID]secrets.Provider, currProvider secrets.ProviderID, olderThan time.Time) error {
+	for _, k := range f.store {
+		provider, ok := providers[kmsproviders.NormalizeProviderID(k.Provider)]
+		if !ok || secrets.IsEscrowDataKeyId(k.Id) {
+			continue
+		}
+
+		if !olderThan.IsZero() && !k.Created.Before(olderThan) {
+			continue
+		}
+
+		decrypted, err := provider.Decrypt(ctx, k.EncryptedData)
+		if err != nil {
+			return err
+		}
+
+		encrypted, err := providers[currProvider].Encrypt(ctx, decrypted)
+		if err != nil {
+			return err
+		}
+
+		k.Label = secrets.ReEncryptedKeyLabel(k, currProvider)
+		k.Provider = currProvider
+		k.EncryptedData = encrypted
+	}
 	return nil
 }
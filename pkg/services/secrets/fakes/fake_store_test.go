@@ -0,0 +1,14 @@
+package fakes
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/storetest"
+)
+
+func TestFakeSecretsStore(t *testing.T) {
+	storetest.StoreConformanceTest(t, func(t *testing.T) secrets.Store {
+		return NewFakeSecretsStore()
+	})
+}
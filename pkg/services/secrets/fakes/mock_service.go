@@ -132,6 +132,30 @@ func (_m *MockService) GetDecryptedValue(ctx context.Context, sjd map[string][]b
 	return r0
 }
 
+// GetDecryptedValueE provides a mock function with given fields: ctx, sjd, key, fallback
+func (_m *MockService) GetDecryptedValueE(ctx context.Context, sjd map[string][]byte, key string, fallback string) (string, error) {
+	ret := _m.Called(ctx, sjd, key, fallback)
+
+	var r0 string
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, map[string][]byte, string, string) (string, error)); ok {
+		return rf(ctx, sjd, key, fallback)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, map[string][]byte, string, string) string); ok {
+		r0 = rf(ctx, sjd, key, fallback)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, map[string][]byte, string, string) error); ok {
+		r1 = rf(ctx, sjd, key, fallback)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // ReEncryptDataKeys provides a mock function with given fields: ctx
 func (_m *MockService) ReEncryptDataKeys(ctx context.Context) error {
 	ret := _m.Called(ctx)
@@ -0,0 +1,56 @@
+package manager
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// dataKeysAgeCheckInterval is the interval at which the age of
+// the current data keys is checked against the configured maximum.
+const dataKeysAgeCheckInterval = time.Hour
+
+// checkDataKeysAge reports the age of the oldest current data key (see ListScopeKeys)
+// and warns when it exceeds the configured maximum age, so operators are aware that
+// data keys are overdue for rotation. If configured so, data keys are rotated too.
+//
+// Data keys without creation time (e.g. created by old versions) have an unknown age,
+// so they're ignored. If no data key has a known age, the age is reported as NaN.
+func (s *SecretsService) checkDataKeysAge(ctx context.Context) error {
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	var oldest time.Duration
+	known := false
+	for scope, dataKey := range currentDataKeysByScope(dataKeys) {
+		if dataKey.Created.IsZero() {
+			s.log.Debug("Data key age is unknown", "id", dataKey.Id, "scope", scope)
+			continue
+		}
+
+		age := now().Sub(dataKey.Created)
+		if age > s.dataKeysMaxAge {
+			s.log.Warn("Data key is overdue for rotation", "id", dataKey.Id, "scope", scope, "age", age, "max_age", s.dataKeysMaxAge)
+		}
+
+		if !known || age > oldest {
+			oldest, known = age, true
+		}
+	}
+
+	if !known {
+		dataKeyAgeGauge.Set(math.NaN())
+		return nil
+	}
+
+	dataKeyAgeGauge.Set(oldest.Seconds())
+
+	if oldest > s.dataKeysMaxAge && s.dataKeysAutoRotate {
+		s.log.Info("Rotating data keys overdue for rotation", "age", oldest, "max_age", s.dataKeysMaxAge)
+		return s.RotateDataKeys(ctx)
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package manager
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_CheckDataKeysAge(t *testing.T) {
+	restoreTimeNowAfterTestExec(t)
+
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+	svc.dataKeysMaxAge = 90 * 24 * time.Hour
+
+	current := time.Now()
+	now = func() time.Time { return current }
+
+	for _, dataKey := range []*secrets.DataKey{
+		{Id: "old", Scope: "root", Label: "root", Created: current.Add(-100 * 24 * time.Hour)},
+		{Id: "recent", Scope: "org:1", Label: "org:1", Created: current.Add(-24 * time.Hour)},
+		{Id: "unknown", Scope: "user:1", Label: "user:1"},
+	} {
+		dataKey.Active = true
+		dataKey.Provider = svc.currentProviderID
+		require.NoError(t, store.CreateDataKey(ctx, dataKey))
+	}
+
+	t.Run("age of the oldest current data key should be reported", func(t *testing.T) {
+		require.NoError(t, svc.checkDataKeysAge(ctx))
+		assert.Equal(t, (100 * 24 * time.Hour).Seconds(), testutil.ToFloat64(dataKeyAgeGauge))
+
+		// Without auto-rotation, overdue data keys are kept.
+		dataKey, err := store.GetDataKey(ctx, "old")
+		require.NoError(t, err)
+		assert.True(t, dataKey.Active)
+	})
+
+	t.Run("overdue data keys should be rotated if configured so", func(t *testing.T) {
+		svc.dataKeysAutoRotate = true
+
+		require.NoError(t, svc.checkDataKeysAge(ctx))
+
+		dataKey, err := store.GetDataKey(ctx, "old")
+		require.NoError(t, err)
+		assert.False(t, dataKey.Active)
+	})
+
+	t.Run("unknown age should be reported as NaN", func(t *testing.T) {
+		// The rotation above provisioned new data keys, of known age.
+		require.NoError(t, store.DisableDataKeys(ctx))
+
+		dataKey := &secrets.DataKey{
+			Id:       "another",
+			Active:   true,
+			Scope:    "root",
+			Label:    "root",
+			Provider: svc.currentProviderID,
+		}
+		require.NoError(t, store.CreateDataKey(ctx, dataKey))
+
+		// The fake store keeps the given data key, so its creation time can be unset.
+		dataKey.Created = time.Time{}
+
+		require.NoError(t, svc.checkDataKeysAge(ctx))
+		assert.True(t, math.IsNaN(testutil.ToFloat64(dataKeyAgeGauge)))
+	})
+}
@@ -0,0 +1,95 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// EncryptWithAlias works like Encrypt, but the data key used is resolved from the given alias, a
+// stable logical name, so callers don't need to know about concrete data keys while those are
+// rotated beneath the alias. There's a single data key per alias, scope, provider and generation (see
+// CurrentGeneration), whose identifier is secrets.AliasDataKeyId, e.g. "payments@1a2b3c4d@v3". So, a
+// new one is used for the alias every time data keys are rotated, while the previous ones remain
+// available for decryption, and the same alias can be used in as many scopes as needed.
+//
+// As the identifier of the data key is the alias and generation, that's what the envelope key id
+// prefix (i.e. "#<base64(key id)>#") of the payloads encrypted with an alias references: the format
+// is the very same as for any other data key, so Decrypt needs no alias resolution at all, and
+// everything based on data keys identifiers (e.g. escrow copies, ProvidersForKey) works the same.
+//
+// Aliases must be valid data key identifiers, no longer than the generation suffix allows.
+func (s *SecretsService) EncryptWithAlias(ctx context.Context, payload []byte, alias string, opt secrets.EncryptionOptions) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.EncryptWithAlias")
+	defer span.End()
+
+	if s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
+		return nil, fmt.Errorf("encryption with an alias requires envelope encryption to be enabled")
+	}
+
+	if alias == "" || !validDataKeyId(secrets.AliasDataKeyId(alias, "", math.MaxInt64)) || secrets.IsEscrowDataKeyId(alias) {
+		return nil, fmt.Errorf("invalid alias '%s': must be between 1 and %d characters long, without spaces nor control characters",
+			alias, maxDataKeyIdLength-len(secrets.AliasDataKeyId("", "", math.MaxInt64)))
+	}
+
+	return s.encrypt(ctx, payload, opt(), encryptOptions{alias: alias})
+}
+
+// newAliasDataKey returns the data key of the given alias for the current generation, either the
+// existing one, or a new one created with the given provider, label and scope if there's none yet.
+func (s *SecretsService) newAliasDataKey(ctx context.Context, alias string, providerID secrets.ProviderID, label string, scope string) (string, []byte, error) {
+	generation, err := s.CurrentGeneration(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id := secrets.AliasDataKeyId(alias, label, generation)
+	entry, err := s.existingAliasDataKey(ctx, id, label)
+	if err != nil {
+		return "", nil, err
+	}
+	if entry != nil {
+		return entry.id, entry.dataKey, nil
+	}
+
+	createdId, dataKey, err := s.createDataKey(ctx, id, generation, providerID, label, scope)
+	if err == nil {
+		return createdId, dataKey, nil
+	}
+
+	// Another instance may have created it in the meantime.
+	if entry, existingErr := s.existingAliasDataKey(ctx, id, label); entry != nil && existingErr == nil {
+		return entry.id, entry.dataKey, nil
+	}
+
+	return "", nil, err
+}
+
+// existingAliasDataKey returns the data key with the given identifier, if it exists. It fails
+// if it cannot be used as the current data key of the given label anymore, i.e. it's disabled
+// (e.g. superseded) or its label has changed since (e.g. re-encrypted with another provider).
+// As the next generation data keys are identified by their current label, rotating fixes both.
+func (s *SecretsService) existingAliasDataKey(ctx context.Context, id string, label string) (*dataKeyCacheEntry, error) {
+	dataKey, err := s.store.GetDataKey(ctx, id)
+	if errors.Is(err, secrets.ErrDataKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !dataKey.Active {
+		return nil, fmt.Errorf("data key '%s' exists, but is disabled: rotate data keys to start a new generation", id)
+	}
+
+	if dataKey.Label != label {
+		return nil, fmt.Errorf("data key '%s' exists, but is bound to '%s' instead of '%s': rotate data keys to start a new generation",
+			id, dataKey.Label, label)
+	}
+
+	return s.dataKeyById(ctx, id)
+}
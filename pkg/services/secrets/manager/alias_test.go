@@ -0,0 +1,180 @@
+package manager
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/db"
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/database"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_EncryptWithAlias(t *testing.T) {
+	restoreTimeNowAfterTestExec(t)
+
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+
+	plaintext := []byte("grafana")
+
+	aliasId := func(scope string, generation int64) string {
+		return secrets.AliasDataKeyId("payments", secrets.AliasKeyLabel("payments", scope, svc.currentProviderID), generation)
+	}
+
+	encrypt := func(t *testing.T) ([]byte, string) {
+		t.Helper()
+
+		ciphertext, err := svc.EncryptWithAlias(ctx, plaintext, "payments", secrets.WithoutScope())
+		require.NoError(t, err)
+
+		keyId, _, err := decodeEnvelope(ciphertext)
+		require.NoError(t, err)
+
+		return ciphertext, keyId
+	}
+
+	t.Run("invalid aliases should be rejected", func(t *testing.T) {
+		for _, alias := range []string{"", "pay ments", strings.Repeat("a", maxDataKeyIdLength), secrets.EscrowDataKeyId("payments", 0)} {
+			_, err := svc.EncryptWithAlias(ctx, plaintext, alias, secrets.WithoutScope())
+			assert.Error(t, err, alias)
+		}
+	})
+
+	first, firstKeyId := encrypt(t)
+
+	t.Run("payloads should reference the alias and generation", func(t *testing.T) {
+		assert.Equal(t, aliasId("root", 0), firstKeyId)
+
+		_, keyId := encrypt(t)
+		assert.Equal(t, firstKeyId, keyId)
+
+		decrypted, err := svc.Decrypt(ctx, first)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+	})
+
+	t.Run("regular encryption should not use the data key of the alias", func(t *testing.T) {
+		regular, err := svc.Encrypt(ctx, plaintext, secrets.WithoutScope())
+		require.NoError(t, err)
+
+		keyId, _, err := decodeEnvelope(regular)
+		require.NoError(t, err)
+		assert.NotEqual(t, firstKeyId, keyId)
+	})
+
+	t.Run("alias used in another scope should have its own data key", func(t *testing.T) {
+		ciphertext, err := svc.EncryptWithAlias(ctx, plaintext, "payments", secrets.WithScope("org:1"))
+		require.NoError(t, err)
+
+		keyId, _, err := decodeEnvelope(ciphertext)
+		require.NoError(t, err)
+		assert.Equal(t, aliasId("org:1", 0), keyId)
+		assert.NotEqual(t, firstKeyId, keyId)
+
+		dataKey, err := store.GetDataKey(ctx, keyId)
+		require.NoError(t, err)
+		assert.Equal(t, "org:1", dataKey.Scope)
+
+		for _, payload := range [][]byte{first, ciphertext} {
+			decrypted, err := svc.Decrypt(ctx, payload)
+			require.NoError(t, err)
+			assert.Equal(t, plaintext, decrypted)
+		}
+
+		// Both scopes keep using their own data key.
+		_, keyId = encrypt(t)
+		assert.Equal(t, firstKeyId, keyId)
+	})
+
+	t.Run("rotation should move the alias to the next generation", func(t *testing.T) {
+		require.NoError(t, svc.RotateDataKeys(ctx))
+
+		_, keyId := encrypt(t)
+		assert.Equal(t, aliasId("root", 1), keyId)
+
+		decrypted, err := svc.Decrypt(ctx, first)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+	})
+
+	t.Run("rotation with overlap should create the next generation upfront", func(t *testing.T) {
+		svc.rotationOverlap = time.Hour
+		t.Cleanup(func() { svc.rotationOverlap = 0 })
+
+		require.NoError(t, svc.RotateDataKeys(ctx))
+
+		next, err := store.GetDataKey(ctx, aliasId("root", 2))
+		require.NoError(t, err)
+		assert.True(t, next.Active)
+
+		_, keyId := encrypt(t)
+		assert.Equal(t, aliasId("root", 2), keyId)
+
+		// Once the overlap elapses, only the previous generation is disabled.
+		now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+		require.NoError(t, svc.disableSupersededDataKeys(ctx))
+
+		previous, err := store.GetDataKey(ctx, aliasId("root", 1))
+		require.NoError(t, err)
+		assert.False(t, previous.Active)
+
+		next, err = store.GetDataKey(ctx, aliasId("root", 2))
+		require.NoError(t, err)
+		assert.True(t, next.Active)
+	})
+}
+
+func TestSecretsService_EncryptWithAliasReEncryption(t *testing.T) {
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+	svc := SetupTestService(t, store)
+	aliasId := func(scope string, generation int64) string {
+		return secrets.AliasDataKeyId("payments", secrets.AliasKeyLabel("payments", scope, svc.currentProviderID), generation)
+	}
+
+	first, err := svc.EncryptWithAlias(ctx, []byte("grafana"), "payments", secrets.WithoutScope())
+	require.NoError(t, err)
+
+	require.NoError(t, svc.ReEncryptDataKeys(ctx))
+
+	dataKey, err := store.GetDataKey(ctx, aliasId("root", 0))
+	require.NoError(t, err)
+	assert.Equal(t, secrets.AliasKeyLabel("payments", "root", svc.currentProviderID), dataKey.Label)
+
+	// The data key of the alias must still be usable once re-encrypted.
+	second, err := svc.EncryptWithAlias(ctx, []byte("grafana"), "payments", secrets.WithoutScope())
+	require.NoError(t, err)
+
+	for _, payload := range [][]byte{first, second} {
+		keyId, _, err := decodeEnvelope(payload)
+		require.NoError(t, err)
+		assert.Equal(t, aliasId("root", 0), keyId)
+
+		decrypted, err := svc.Decrypt(ctx, payload)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	}
+}
+
+func TestParseAliasDataKeyId(t *testing.T) {
+	id := secrets.AliasDataKeyId("pay@v1", secrets.AliasKeyLabel("pay@v1", "root", "secretKey.v1"), 12)
+	alias, generation, ok := secrets.ParseAliasDataKeyId(id)
+	require.True(t, ok)
+	assert.Equal(t, "pay@v1", alias)
+	assert.Equal(t, int64(12), generation)
+
+	for _, id := range []string{"payments", "@v1", "payments@v1", "payments@1a2b3c4d@v", "payments@1a2b3c4d@vx",
+		"payments@1a2b3c4d@v-1", "payments@1a2b3c4z@v1", "payments#1a2b3c4d@v1", "@1a2b3c4d@v1"} {
+		_, _, ok := secrets.ParseAliasDataKeyId(id)
+		assert.False(t, ok, id)
+	}
+}
@@ -0,0 +1,76 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// InitScopes creates the current data key of each of the given scopes that doesn't have one yet,
+// and stores all of them at once (see secrets.Store.CreateDataKeys), instead of one by one as
+// Encrypt does on demand, so setting up many scopes (e.g. one per tenant) takes a couple of
+// database round trips. It returns the amount of data keys created.
+//
+// Data keys created this way aren't subject to the data keys creation rate limit, as that's
+// meant to stop runaway creation on demand, not deliberate initializations.
+func (s *SecretsService) InitScopes(ctx context.Context, scopes ...string) (int, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.InitScopes")
+	defer span.End()
+
+	if s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
+		return 0, fmt.Errorf("initializing scopes requires envelope encryption to be enabled")
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	existing, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	initialized := make(map[string]struct{}, len(existing))
+	for _, dataKey := range existing {
+		if dataKey.Active {
+			initialized[dataKey.Label] = struct{}{}
+		}
+	}
+
+	generation := dataKeysGeneration(existing)
+
+	var dataKeys []*secrets.DataKey
+	for _, scope := range scopes {
+		if err := s.checkMandatedProvider(scope); err != nil {
+			return 0, err
+		}
+
+		providerID := s.scopeProvider(scope)
+		label := secrets.KeyLabel(scope, providerID)
+		if _, exists := initialized[label]; exists {
+			continue
+		}
+
+		dataKey, _, err := s.newEncryptedDataKey(ctx, providerID, label, scope)
+		if err != nil {
+			return 0, err
+		}
+		dataKey.Generation = generation
+
+		dataKeys = append(dataKeys, dataKey)
+		initialized[label] = struct{}{}
+	}
+
+	if len(dataKeys) == 0 {
+		return 0, nil
+	}
+
+	if err := s.store.CreateDataKeys(ctx, dataKeys); err != nil {
+		return 0, err
+	}
+
+	s.log.Info("Scopes data keys initialized", "scopes", len(scopes), "created", len(dataKeys))
+
+	return len(dataKeys), nil
+}
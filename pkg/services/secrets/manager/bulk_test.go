@@ -0,0 +1,53 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/db"
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/database"
+)
+
+func TestSecretsService_InitScopes(t *testing.T) {
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	store := &countingStore{Store: database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))}
+	svc := SetupTestService(t, store)
+
+	_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("org:1"))
+	require.NoError(t, err)
+	created := store.created
+
+	scopes := []string{"org:1"}
+	for i := 2; i <= 200; i++ {
+		scopes = append(scopes, fmt.Sprintf("org:%d", i))
+	}
+
+	// Scopes already initialized, or repeated, are skipped.
+	n, err := svc.InitScopes(ctx, append(scopes, "org:2")...)
+	require.NoError(t, err)
+	assert.Equal(t, 199, n)
+	assert.Equal(t, created, store.created, "data keys should not be created one by one")
+
+	count, err := store.CountDataKeys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(200), count)
+
+	// Initialized data keys are used on demand.
+	encrypted, err := svc.EncryptNoCreate(ctx, []byte("grafana"), secrets.WithScope("org:200"))
+	require.NoError(t, err)
+
+	decrypted, err := svc.Decrypt(ctx, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("grafana"), decrypted)
+
+	n, err = svc.InitScopes(ctx, scopes...)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
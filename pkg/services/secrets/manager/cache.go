@@ -3,35 +3,73 @@ package manager
 import (
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
 )
 
 type dataKeyCacheEntry struct {
 	id         string
 	label      string
+	scope      string
 	dataKey    []byte
 	active     bool
 	expiration time.Time
+	// cached is when the entry was (last) added to the cache.
+	cached time.Time
+	// created is when the data key was created, zero if unknown.
+	created time.Time
+
+	// refreshing is set while the entry is being refreshed ahead of its expiration.
+	refreshing atomic.Bool
+}
+
+func newDataKeyCacheEntry(dataKey *secrets.DataKey, decrypted []byte) *dataKeyCacheEntry {
+	return &dataKeyCacheEntry{
+		id:      dataKey.Id,
+		label:   dataKey.Label,
+		scope:   dataKey.Scope,
+		dataKey: decrypted,
+		active:  dataKey.Active,
+		created: dataKey.Created,
+	}
 }
 
-func (e dataKeyCacheEntry) expired() bool {
+func (e *dataKeyCacheEntry) expired() bool {
 	return e.expiration.Before(now())
 }
 
+// cacheChurnWindow is how soon after being evicted an entry must be added
+// back to the cache to be considered churn. See dataKeyCache.evictedById.
+const cacheChurnWindow = time.Minute
+
 type dataKeyCache struct {
 	mtx      sync.RWMutex
 	byId     map[string]*dataKeyCacheEntry
 	byLabel  map[string]*dataKeyCacheEntry
 	cacheTTL time.Duration
+
+	// evictedById and evictedByLabel keep track of when the entries were evicted (other than
+	// flushed) from the cache for the last cacheChurnWindow, to detect the ones added back
+	// shortly after, which hints that the TTL is too short or entries are invalidated too often.
+	evictedById    map[string]time.Time
+	evictedByLabel map[string]time.Time
+
+	// current is a snapshot of the last data key used for encryption,
+	// that can be read without locking. See getCurrent for details.
+	current atomic.Pointer[dataKeyCacheEntry]
 }
 
 func newDataKeyCache(ttl time.Duration) *dataKeyCache {
 	return &dataKeyCache{
-		byId:     make(map[string]*dataKeyCacheEntry),
-		byLabel:  make(map[string]*dataKeyCacheEntry),
-		cacheTTL: ttl,
+		byId:           make(map[string]*dataKeyCacheEntry),
+		byLabel:        make(map[string]*dataKeyCacheEntry),
+		cacheTTL:       ttl,
+		evictedById:    make(map[string]time.Time),
+		evictedByLabel: make(map[string]time.Time),
 	}
 }
 
@@ -43,7 +81,7 @@ func (c *dataKeyCache) getById(id string) (*dataKeyCacheEntry, bool) {
 
 	cacheReadsCounter.With(prometheus.Labels{
 		"hit":    strconv.FormatBool(exists),
-		"method": "byId",
+		"method": cacheMethodById,
 	}).Inc()
 
 	if !exists || entry.expired() {
@@ -61,7 +99,7 @@ func (c *dataKeyCache) getByLabel(label string) (*dataKeyCacheEntry, bool) {
 
 	cacheReadsCounter.With(prometheus.Labels{
 		"hit":    strconv.FormatBool(exists),
-		"method": "byLabel",
+		"method": cacheMethodByLabel,
 	}).Inc()
 
 	if !exists || entry.expired() {
@@ -71,22 +109,109 @@ func (c *dataKeyCache) getByLabel(label string) (*dataKeyCacheEntry, bool) {
 	return entry, true
 }
 
+// getCurrent returns the snapshot of the last data key used for encryption, if it
+// matches the given label and it's still valid. It's meant to be used as a fast path
+// for encryption operations, as it doesn't require any lock to be acquired.
+func (c *dataKeyCache) getCurrent(label string) (*dataKeyCacheEntry, bool) {
+	entry := c.current.Load()
+	if entry == nil || entry.label != label || !entry.active || entry.expired() {
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// setCurrent publishes the given entry as the snapshot of the last data key used for
+// encryption. Only entries already cached by label should be published as current.
+func (c *dataKeyCache) setCurrent(entry *dataKeyCacheEntry) {
+	c.current.Store(entry)
+}
+
+// replaceCurrent publishes the given entry as the snapshot of the last data key used for
+// encryption, only if the current snapshot is still the given old one and the given entry
+// is cached by label. It reports whether the snapshot was replaced.
+func (c *dataKeyCache) replaceCurrent(old, entry *dataKeyCacheEntry) bool {
+	c.mtx.RLock()
+	cached := c.byLabel[entry.label] == entry
+	c.mtx.RUnlock()
+
+	return cached && c.current.CompareAndSwap(old, entry)
+}
+
+// retireCurrent removes the given entry from the cache by label, so it's not used for encryption
+// anymore, and publishes the given replacement, if any and cached by label, as the snapshot of the
+// current data key instead of it. The entry is kept by id, as it's still needed for decryption.
+// It reports whether the entry was still the current snapshot.
+func (c *dataKeyCache) retireCurrent(entry, replacement *dataKeyCacheEntry) bool {
+	c.mtx.Lock()
+	if c.byLabel[entry.label] == entry {
+		delete(c.byLabel, entry.label)
+		c.evicted(cacheMethodByLabel, c.evictedByLabel, entry.label, entry, evictionReasonInvalidated)
+	}
+
+	if replacement == nil || c.byLabel[replacement.label] != replacement {
+		replacement = nil
+	}
+	c.updateSizeMetrics()
+	c.updateCurrentAgeMetric()
+	c.mtx.Unlock()
+
+	return c.current.CompareAndSwap(entry, replacement)
+}
+
 func (c *dataKeyCache) addById(entry *dataKeyCacheEntry) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	entry.expiration = now().Add(c.cacheTTL)
+	entry.cached = now()
+	entry.expiration = entry.cached.Add(c.cacheTTL)
 
 	c.byId[entry.id] = entry
+
+	cacheEntriesAddedCounter.WithLabelValues(cacheMethodById).Inc()
+	c.countChurn(cacheMethodById, c.evictedById, entry.id)
+	c.updateSizeMetrics()
 }
 
 func (c *dataKeyCache) addByLabel(entry *dataKeyCacheEntry) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	entry.expiration = now().Add(c.cacheTTL)
+	entry.cached = now()
+	entry.expiration = entry.cached.Add(c.cacheTTL)
 
 	c.byLabel[entry.label] = entry
+
+	cacheEntriesAddedCounter.WithLabelValues(cacheMethodByLabel).Inc()
+	c.countChurn(cacheMethodByLabel, c.evictedByLabel, entry.label)
+	c.updateSizeMetrics()
+	c.updateCurrentAgeMetric()
+}
+
+// invalidate removes the given entry from the cache, wherever it is still cached.
+// It reports whether the entry was cached at all.
+func (c *dataKeyCache) invalidate(entry *dataKeyCacheEntry) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var invalidated bool
+	if c.byId[entry.id] == entry {
+		delete(c.byId, entry.id)
+		c.evicted(cacheMethodById, c.evictedById, entry.id, entry, evictionReasonInvalidated)
+		invalidated = true
+	}
+
+	if c.byLabel[entry.label] == entry {
+		delete(c.byLabel, entry.label)
+		c.evicted(cacheMethodByLabel, c.evictedByLabel, entry.label, entry, evictionReasonInvalidated)
+		invalidated = true
+	}
+
+	c.current.CompareAndSwap(entry, nil)
+	c.updateSizeMetrics()
+	c.updateCurrentAgeMetric()
+
+	return invalidated
 }
 
 func (c *dataKeyCache) removeExpired() {
@@ -96,19 +221,139 @@ func (c *dataKeyCache) removeExpired() {
 	for id, entry := range c.byId {
 		if entry.expired() {
 			delete(c.byId, id)
+			c.evicted(cacheMethodById, c.evictedById, id, entry, evictionReasonTTL)
 		}
 	}
 
 	for label, entry := range c.byLabel {
 		if entry.expired() {
 			delete(c.byLabel, label)
+			c.evicted(cacheMethodByLabel, c.evictedByLabel, label, entry, evictionReasonTTL)
+		}
+	}
+
+	// Evictions older than the churn window aren't relevant anymore.
+	cutoff := now().Add(-cacheChurnWindow)
+	for _, evictions := range []map[string]time.Time{c.evictedById, c.evictedByLabel} {
+		for key, evictedAt := range evictions {
+			if evictedAt.Before(cutoff) {
+				delete(evictions, key)
+			}
 		}
 	}
+
+	c.updateSizeMetrics()
+	c.updateCurrentAgeMetric()
 }
 
 func (c *dataKeyCache) flush() {
 	c.mtx.Lock()
+	cacheEntriesEvictedCounter.WithLabelValues(cacheMethodById, evictionReasonFlush).Add(float64(len(c.byId)))
+	cacheEntriesEvictedCounter.WithLabelValues(cacheMethodByLabel, evictionReasonFlush).Add(float64(len(c.byLabel)))
+	c.observeAges(cacheMethodById, c.byId)
+	c.observeAges(cacheMethodByLabel, c.byLabel)
 	c.byId = make(map[string]*dataKeyCacheEntry)
 	c.byLabel = make(map[string]*dataKeyCacheEntry)
+	c.evictedById = make(map[string]time.Time)
+	c.evictedByLabel = make(map[string]time.Time)
+	c.current.Store(nil)
+	c.updateSizeMetrics()
+	c.updateCurrentAgeMetric()
 	c.mtx.Unlock()
 }
+
+// evicted records the eviction of the given entry, cached with the given key by the given
+// method, for the given reason, to detect churn (see countChurn). It must be called with
+// the lock held. Flushed entries aren't recorded, as flushes are deliberate.
+func (c *dataKeyCache) evicted(method string, evictions map[string]time.Time, key string, entry *dataKeyCacheEntry, reason string) {
+	cacheEntriesEvictedCounter.WithLabelValues(method, reason).Inc()
+	cacheEntriesAgeHistogram.WithLabelValues(method).Observe(now().Sub(entry.cached).Seconds())
+	evictions[key] = now()
+}
+
+// observeAges observes the ages of the given entries, being evicted. It must be called with the lock held.
+func (c *dataKeyCache) observeAges(method string, entries map[string]*dataKeyCacheEntry) {
+	for _, entry := range entries {
+		cacheEntriesAgeHistogram.WithLabelValues(method).Observe(now().Sub(entry.cached).Seconds())
+	}
+}
+
+// countChurn counts the entry cached with the given key by the given method as churn if it was
+// evicted less than cacheChurnWindow ago (see evicted). It must be called with the lock held.
+func (c *dataKeyCache) countChurn(method string, evictions map[string]time.Time, key string) {
+	evictedAt, exists := evictions[key]
+	if !exists {
+		return
+	}
+
+	delete(evictions, key)
+	if now().Sub(evictedAt) < cacheChurnWindow {
+		cacheEntriesChurnCounter.WithLabelValues(method).Inc()
+	}
+}
+
+// updateSizeMetrics must be called with the lock held.
+func (c *dataKeyCache) updateSizeMetrics() {
+	cacheEntriesGauge.WithLabelValues(cacheMethodById).Set(float64(len(c.byId)))
+	cacheEntriesGauge.WithLabelValues(cacheMethodByLabel).Set(float64(len(c.byLabel)))
+}
+
+// updateCurrentAgeMetric reports the age of the oldest data key cached for encryption (i.e. by
+// label) across all the scopes, or zero if there's none whose creation time is known. So, unlike
+// the data key last used, it doesn't flip between the data keys of different scopes. Besides
+// whenever those change, it's called on every cleanup, so the age keeps growing. It must be
+// called with the lock held.
+func (c *dataKeyCache) updateCurrentAgeMetric() {
+	var oldest time.Time
+	for _, entry := range c.byLabel {
+		if entry.active && !entry.created.IsZero() && (oldest.IsZero() || entry.created.Before(oldest)) {
+			oldest = entry.created
+		}
+	}
+
+	if oldest.IsZero() {
+		currentDataKeyAgeGauge.Set(0)
+		return
+	}
+
+	currentDataKeyAgeGauge.Set(now().Sub(oldest).Seconds())
+}
+
+// entriesById returns a snapshot of the entries cached by id.
+func (c *dataKeyCache) entriesById() []*dataKeyCacheEntry {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	entries := make([]*dataKeyCacheEntry, 0, len(c.byId))
+	for _, entry := range c.byId {
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// expiringWithin returns a snapshot of the entries cached by id
+// that aren't expired yet, but will be within the given window.
+func (c *dataKeyCache) expiringWithin(window time.Duration) []*dataKeyCacheEntry {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	deadline := now().Add(window)
+
+	var entries []*dataKeyCacheEntry
+	for _, entry := range c.byId {
+		if !entry.expired() && entry.expiration.Before(deadline) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// size returns the amount of entries in the cache, by id and by label.
+func (c *dataKeyCache) size() (int, int) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	return len(c.byId), len(c.byLabel)
+}
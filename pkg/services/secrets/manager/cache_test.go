@@ -0,0 +1,161 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataKeyCache_Metrics(t *testing.T) {
+	restoreTimeNowAfterTestExec(t)
+
+	cache := newDataKeyCache(time.Minute)
+
+	added := func(method string) float64 {
+		return testutil.ToFloat64(cacheEntriesAddedCounter.WithLabelValues(method))
+	}
+	evicted := func(method, reason string) float64 {
+		return testutil.ToFloat64(cacheEntriesEvictedCounter.WithLabelValues(method, reason))
+	}
+	size := func(method string) float64 {
+		return testutil.ToFloat64(cacheEntriesGauge.WithLabelValues(method))
+	}
+
+	addedById, addedByLabel := added(cacheMethodById), added(cacheMethodByLabel)
+	evictedByTTL, evictedByFlush := evicted(cacheMethodById, evictionReasonTTL), evicted(cacheMethodByLabel, evictionReasonFlush)
+
+	cache.addById(&dataKeyCacheEntry{id: "a"})
+	cache.addById(&dataKeyCacheEntry{id: "b"})
+	cache.addByLabel(&dataKeyCacheEntry{id: "b", label: "b"})
+
+	assert.Equal(t, addedById+2, added(cacheMethodById))
+	assert.Equal(t, addedByLabel+1, added(cacheMethodByLabel))
+	assert.Equal(t, float64(2), size(cacheMethodById))
+	assert.Equal(t, float64(1), size(cacheMethodByLabel))
+
+	// Entries expire after the TTL.
+	now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	cache.removeExpired()
+	now = time.Now
+
+	assert.Equal(t, evictedByTTL+2, evicted(cacheMethodById, evictionReasonTTL))
+	assert.Equal(t, float64(0), size(cacheMethodById))
+	assert.Equal(t, float64(0), size(cacheMethodByLabel))
+
+	cache.addByLabel(&dataKeyCacheEntry{id: "c", label: "c"})
+	cache.flush()
+
+	assert.Equal(t, evictedByFlush+1, evicted(cacheMethodByLabel, evictionReasonFlush))
+	assert.Equal(t, float64(0), size(cacheMethodByLabel))
+}
+
+func TestDataKeyCache_ExpiringWithin(t *testing.T) {
+	restoreTimeNowAfterTestExec(t)
+
+	cache := newDataKeyCache(time.Minute)
+	cache.addById(&dataKeyCacheEntry{id: "a"})
+
+	now = func() time.Time { return time.Now().Add(30 * time.Second) }
+	cache.addById(&dataKeyCacheEntry{id: "b"})
+
+	expiring := cache.expiringWithin(45 * time.Second)
+	assert.Len(t, expiring, 1)
+	assert.Equal(t, "a", expiring[0].id)
+
+	// Expired entries are left to the cleanup.
+	now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	assert.Empty(t, cache.expiringWithin(time.Hour))
+}
+
+func TestDataKeyCache_ChurnMetrics(t *testing.T) {
+	restoreTimeNowAfterTestExec(t)
+
+	cache := newDataKeyCache(time.Minute)
+
+	churn := func() float64 {
+		return testutil.ToFloat64(cacheEntriesChurnCounter.WithLabelValues(cacheMethodById))
+	}
+	ages := func() (uint64, float64) {
+		var m dto.Metric
+		require.NoError(t, cacheEntriesAgeHistogram.WithLabelValues(cacheMethodById).(prometheus.Metric).Write(&m))
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+
+	initialChurn := churn()
+	initialCount, initialSum := ages()
+
+	start := time.Now()
+	now = func() time.Time { return start }
+	entry := &dataKeyCacheEntry{id: "a"}
+	cache.addById(entry)
+	assert.Equal(t, start, entry.cached)
+
+	// Evicted after the TTL, and added back right after.
+	now = func() time.Time { return start.Add(90 * time.Second) }
+	cache.removeExpired()
+
+	count, sum := ages()
+	assert.Equal(t, initialCount+1, count)
+	assert.InDelta(t, initialSum+90, sum, 0.001)
+
+	cache.addById(&dataKeyCacheEntry{id: "a"})
+	assert.Equal(t, initialChurn+1, churn())
+
+	// Evicted again, but added back after the churn window.
+	cache.invalidate(cache.byId["a"])
+	now = func() time.Time { return start.Add(90*time.Second + 2*cacheChurnWindow) }
+	cache.addById(&dataKeyCacheEntry{id: "a"})
+	assert.Equal(t, initialChurn+1, churn())
+
+	// Flushed entries aren't churn.
+	cache.flush()
+	cache.addById(&dataKeyCacheEntry{id: "a"})
+	assert.Equal(t, initialChurn+1, churn())
+}
+
+func TestDataKeyCache_CurrentAgeMetric(t *testing.T) {
+	restoreTimeNowAfterTestExec(t)
+
+	start := time.Now()
+	now = func() time.Time { return start }
+
+	cache := newDataKeyCache(time.Hour)
+	age := func() float64 { return testutil.ToFloat64(currentDataKeyAgeGauge) }
+
+	cache.mtx.Lock()
+	cache.updateCurrentAgeMetric()
+	cache.mtx.Unlock()
+	assert.Zero(t, age())
+
+	entry := &dataKeyCacheEntry{id: "a", label: "a", active: true, created: start.Add(-time.Hour)}
+	cache.addByLabel(entry)
+	cache.setCurrent(entry)
+	assert.Equal(t, time.Hour.Seconds(), age())
+
+	// The age keeps growing on every cleanup.
+	now = func() time.Time { return start.Add(time.Minute) }
+	cache.removeExpired()
+	assert.Equal(t, (time.Hour + time.Minute).Seconds(), age())
+
+	// The oldest data key is reported, whatever the data key last used is.
+	older := &dataKeyCacheEntry{id: "b", label: "b", active: true, created: start.Add(-2 * time.Hour)}
+	cache.addByLabel(older)
+	assert.Equal(t, (2*time.Hour + time.Minute).Seconds(), age())
+
+	cache.setCurrent(older)
+	require.True(t, cache.replaceCurrent(older, entry))
+	assert.Equal(t, (2*time.Hour + time.Minute).Seconds(), age())
+
+	// Data keys of unknown age are ignored.
+	cache.addByLabel(&dataKeyCacheEntry{id: "c", label: "c", active: true})
+	cache.invalidate(older)
+	assert.Equal(t, (time.Hour + time.Minute).Seconds(), age())
+
+	cache.flush()
+	assert.Zero(t, age())
+}
@@ -0,0 +1,98 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/services/kmsproviders"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// DataKeysOperation is a data keys operation that completion callbacks are notified of.
+type DataKeysOperation string
+
+const (
+	DataKeysOperationRotation     DataKeysOperation = "rotation"
+	DataKeysOperationReEncryption DataKeysOperation = "re-encryption"
+)
+
+// DataKeysOperationSummary summarizes a data keys operation completed successfully.
+type DataKeysOperationSummary struct {
+	Operation DataKeysOperation
+	// DataKeys is the amount of data keys affected by the operation: the active ones
+	// for a rotation, and the ones with a configured provider for a re-encryption.
+	DataKeys int
+	// CurrentDataKeys are the identifiers of the new current data keys, by scope.
+	// It's only set for rotations (see RotateDataKeys).
+	CurrentDataKeys map[string]string
+}
+
+// DataKeysOperationCallback is called when a data keys operation completes successfully.
+type DataKeysOperationCallback func(ctx context.Context, summary DataKeysOperationSummary)
+
+// OnDataKeysOperation registers a callback to be called every time RotateDataKeys,
+// ReEncryptDataKeys or ReEncryptDataKeysOlderThan completes successfully, so other
+// services (e.g. caches of decrypted secrets) can react to it. Callbacks are called
+// in the background, once the operation has released its locks, so they may be called
+// concurrently and must not rely on the order in which they're called.
+func (s *SecretsService) OnDataKeysOperation(callback DataKeysOperationCallback) {
+	s.callbacksMtx.Lock()
+	defer s.callbacksMtx.Unlock()
+
+	s.callbacks = append(s.callbacks, callback)
+}
+
+// hasDataKeysOperationCallbacks reports whether there's any callback registered,
+// so the data keys operations summaries are only computed when needed.
+func (s *SecretsService) hasDataKeysOperationCallbacks() bool {
+	s.callbacksMtx.RLock()
+	defer s.callbacksMtx.RUnlock()
+
+	return len(s.callbacks) > 0
+}
+
+// notifyDataKeysOperation calls the registered callbacks with the given summary, each one
+// in its own goroutine, so the caller is never blocked by them. Panicking callbacks are
+// recovered, as they'd otherwise take the whole process down.
+func (s *SecretsService) notifyDataKeysOperation(ctx context.Context, summary DataKeysOperationSummary) {
+	s.callbacksMtx.RLock()
+	callbacks := make([]DataKeysOperationCallback, len(s.callbacks))
+	copy(callbacks, s.callbacks)
+	s.callbacksMtx.RUnlock()
+
+	ctx = context.WithoutCancel(ctx)
+	for _, callback := range callbacks {
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					s.log.Error("Data keys operation callback panicked", "operation", summary.Operation, "error", fmt.Sprint(r))
+				}
+			}()
+
+			callback(ctx, summary)
+		}()
+	}
+}
+
+// countDataKeys returns the amount of stored data keys, escrow copies excluded, that match the given filter.
+func (s *SecretsService) countDataKeys(ctx context.Context, match func(dataKey *secrets.DataKey) bool) (int, error) {
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, dataKey := range dataKeys {
+		if !secrets.IsEscrowDataKeyId(dataKey.Id) && match(dataKey) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// reEncryptable reports whether the given data key would be re-encrypted, i.e. its provider is configured.
+func (s *SecretsService) reEncryptable(dataKey *secrets.DataKey) bool {
+	_, exists := s.providers[kmsproviders.NormalizeProviderID(dataKey.Provider)]
+	return exists
+}
@@ -0,0 +1,75 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_OnDataKeysOperation(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	summaries := make(chan DataKeysOperationSummary, 1)
+	svc.OnDataKeysOperation(func(_ context.Context, summary DataKeysOperationSummary) {
+		summaries <- summary
+	})
+	svc.OnDataKeysOperation(func(context.Context, DataKeysOperationSummary) {
+		panic("broken callback")
+	})
+
+	receive := func(t *testing.T) DataKeysOperationSummary {
+		t.Helper()
+		select {
+		case summary := <-summaries:
+			return summary
+		case <-time.After(time.Second):
+			t.Fatal("callback not called")
+			return DataKeysOperationSummary{}
+		}
+	}
+
+	for _, scope := range []string{"root", "org:1"} {
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope(scope))
+		require.NoError(t, err)
+	}
+
+	t.Run("rotation should be notified", func(t *testing.T) {
+		require.NoError(t, svc.RotateDataKeys(ctx))
+
+		summary := receive(t)
+		assert.Equal(t, DataKeysOperationRotation, summary.Operation)
+		assert.Equal(t, 2, summary.DataKeys)
+		assert.Len(t, summary.CurrentDataKeys, 2)
+	})
+
+	t.Run("rotation with overlap should report the new current data keys", func(t *testing.T) {
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("root"))
+		require.NoError(t, err)
+
+		svc.rotationOverlap = time.Hour
+		t.Cleanup(func() { svc.rotationOverlap = 0 })
+
+		require.NoError(t, svc.RotateDataKeys(ctx))
+
+		summary := receive(t)
+		assert.Equal(t, 2, summary.DataKeys)
+		require.Len(t, summary.CurrentDataKeys, 2)
+
+		id, _, err := svc.currentDataKey(ctx, secrets.KeyLabel("root", svc.currentProviderID), "root", encryptOptions{noCreate: true})
+		require.NoError(t, err)
+		assert.Equal(t, id, summary.CurrentDataKeys["root"])
+	})
+
+	t.Run("re-encryption should be notified", func(t *testing.T) {
+		require.NoError(t, svc.ReEncryptDataKeys(ctx))
+
+		assert.Equal(t, DataKeysOperationSummary{Operation: DataKeysOperationReEncryption, DataKeys: 6}, receive(t))
+	})
+}
@@ -0,0 +1,100 @@
+package manager
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// committedMarker flags the ciphertext of the payloads encrypted with key commitment (see
+// key_commitment), right after the envelope prefix, like deterministicMarker does for
+// deterministic payloads. Payloads without it predate key commitment, so they aren't checked.
+const committedMarker = '^'
+
+const (
+	commitmentLength = sha256.Size
+	// committedOverhead is the length added to the payloads encrypted with key
+	// commitment: the marker, the commitment, the GCM nonce and the GCM tag.
+	committedOverhead = 1 + commitmentLength + 12 + 16
+)
+
+var (
+	errKeyCommitmentMismatch   = errors.New("payload isn't committed to the data key")
+	errCommittedAuthentication = errors.New("committed payload authentication failed")
+)
+
+// keyCommitment returns the commitment to the given data key: a hash from which the data key
+// cannot be recovered, but that no other data key produces. As AES-GCM alone isn't committing
+// (i.e. a ciphertext can be crafted to decrypt successfully under two different keys), checking
+// it before decrypting prevents key-confusion attacks, like partitioning oracles.
+func keyCommitment(dataKey []byte) []byte {
+	return deriveKey(dataKey, "grafana-key-commitment")
+}
+
+// committedAEAD returns the AEAD used to encrypt payloads with key commitment with the given data key.
+func committedAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(dataKey, "grafana-committed-encryption"))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// appendCommitted appends the given plaintext, encrypted with the given
+// data key, to the given buffer, along with the key commitment, as follows:
+//
+//	^<commitment><nonce><ciphertext and tag>
+//
+// The commitment is authenticated as additional data.
+func appendCommitted(dst []byte, dataKey []byte, plaintext []byte) ([]byte, error) {
+	aead, err := committedAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dst = append(dst, committedMarker)
+	n := len(dst)
+	dst = append(dst, keyCommitment(dataKey)...)
+	commitment := dst[n:]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+
+	return aead.Seal(dst, nonce, plaintext, commitment), nil
+}
+
+// openCommitted is the inverse of appendCommitted, for the given ciphertext without the
+// committed marker. The commitment is checked against the given data key before decrypting.
+func openCommitted(dataKey []byte, ciphertext []byte) ([]byte, error) {
+	aead, err := committedAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < commitmentLength+aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("committed payload too short")
+	}
+
+	commitment := ciphertext[:commitmentLength]
+	if !hmac.Equal(commitment, keyCommitment(dataKey)) {
+		return nil, errKeyCommitmentMismatch
+	}
+
+	nonce := ciphertext[commitmentLength : commitmentLength+aead.NonceSize()]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext[commitmentLength+aead.NonceSize():], commitment)
+	if err != nil {
+		return nil, errCommittedAuthentication
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,79 @@
+package manager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_KeyCommitment(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	uncommitted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	svc.keyCommitment = true
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	keyId, ciphertext, err := decodeEnvelope(encrypted)
+	require.NoError(t, err)
+
+	t.Run("committed payloads should be decrypted", func(t *testing.T) {
+		assert.Equal(t, byte(committedMarker), ciphertext[0])
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("payloads without commitment should still be decrypted", func(t *testing.T) {
+		decrypted, err := svc.Decrypt(ctx, uncommitted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("payloads should not be decrypted with another data key", func(t *testing.T) {
+		other, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("user:1"))
+		require.NoError(t, err)
+
+		otherKeyId, _, err := decodeEnvelope(other)
+		require.NoError(t, err)
+		require.NotEqual(t, keyId, otherKeyId)
+
+		_, err = svc.Decrypt(ctx, encodeEnvelope(otherKeyId, ciphertext))
+		assert.ErrorIs(t, err, errKeyCommitmentMismatch)
+	})
+
+	t.Run("altered commitment should fail", func(t *testing.T) {
+		altered := append([]byte{}, ciphertext...)
+		altered[1] ^= 0xff
+
+		_, err := svc.Decrypt(ctx, encodeEnvelope(keyId, altered))
+		assert.ErrorIs(t, err, errKeyCommitmentMismatch)
+	})
+
+	t.Run("altered ciphertext should fail authentication", func(t *testing.T) {
+		altered := append([]byte{}, ciphertext...)
+		altered[len(altered)-1] ^= 0xff
+
+		_, err := svc.Decrypt(ctx, encodeEnvelope(keyId, altered))
+		assert.ErrorIs(t, err, errCommittedAuthentication)
+	})
+
+	t.Run("truncated payloads should fail", func(t *testing.T) {
+		_, err := svc.Decrypt(ctx, encodeEnvelope(keyId, ciphertext[:commitmentLength]))
+		assert.Error(t, err)
+	})
+
+	t.Run("envelope overhead should account for the commitment", func(t *testing.T) {
+		assert.Equal(t, len(encrypted)-len("grafana"), svc.EnvelopeOverhead())
+	})
+}
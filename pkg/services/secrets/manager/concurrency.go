@@ -0,0 +1,135 @@
+package manager
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// newProviderSemaphores returns a semaphore for each of the given providers, limiting
+// the amount of concurrent calls to them to the given maximum. It returns nil if the
+// maximum isn't positive, which means that there's no limit.
+func newProviderSemaphores(providers map[secrets.ProviderID]secrets.Provider, maxConcurrency int) map[secrets.ProviderID]chan struct{} {
+	if maxConcurrency <= 0 {
+		return nil
+	}
+
+	semaphores := make(map[secrets.ProviderID]chan struct{}, len(providers))
+	for id := range providers {
+		semaphores[id] = make(chan struct{}, maxConcurrency)
+	}
+
+	return semaphores
+}
+
+// acquireProvider waits until a call to the given provider is allowed by its concurrency
+// limit, if any, or until the context is done. On success, the returned function must be
+// called to release the acquired slot once the call to the provider is finished.
+func (s *SecretsService) acquireProvider(ctx context.Context, id secrets.ProviderID) (func(), error) {
+	semaphore, limited := s.providerSemaphores[id]
+	if !limited {
+		return func() {}, nil
+	}
+
+	release := func() { <-semaphore }
+
+	// Fast path: there's a slot available, so no need to queue.
+	select {
+	case semaphore <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	queued := providerQueueDepthGauge.WithLabelValues(string(id))
+	queued.Inc()
+	defer queued.Dec()
+
+	select {
+	case semaphore <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acquireDecrypt waits until a call to Decrypt is allowed by the global concurrency limit,
+// if any, or until the context is done, so load spikes (e.g. many dashboards loaded at once)
+// queue up instead of piling up cache misses. On success, the returned function must be
+// called to release the acquired slot once the payload is decrypted.
+func (s *SecretsService) acquireDecrypt(ctx context.Context) (func(), error) {
+	if s.decryptSemaphore == nil {
+		decryptInFlightGauge.Inc()
+		return decryptInFlightGauge.Dec, nil
+	}
+
+	release := func() {
+		decryptInFlightGauge.Dec()
+		<-s.decryptSemaphore
+	}
+
+	start := time.Now()
+	select {
+	case s.decryptSemaphore <- struct{}{}:
+		decryptQueueWaitHistogram.Observe(time.Since(start).Seconds())
+		decryptInFlightGauge.Inc()
+		return release, nil
+	case <-ctx.Done():
+		decryptQueueWaitHistogram.Observe(time.Since(start).Seconds())
+		return nil, ctx.Err()
+	}
+}
+
+// providerEncrypt encrypts the given blob with the given provider, within its concurrency limit.
+func (s *SecretsService) providerEncrypt(ctx context.Context, id secrets.ProviderID, provider secrets.Provider, blob []byte) ([]byte, error) {
+	release, err := s.acquireProvider(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	stopProvider := trackPhase(ctx, providerPhase)
+	encrypted, err := provider.Encrypt(ctx, blob)
+	stopProvider()
+	countProviderOp(id, OpEncrypt, err)
+
+	return encrypted, err
+}
+
+// providerDecrypt decrypts the given blob with the given provider, within its concurrency limit.
+func (s *SecretsService) providerDecrypt(ctx context.Context, id secrets.ProviderID, provider secrets.Provider, blob []byte) ([]byte, error) {
+	release, err := s.acquireProvider(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	stopProvider := trackPhase(ctx, providerPhase)
+	decrypted, err := provider.Decrypt(ctx, blob)
+	stopProvider()
+	countProviderOp(id, OpDecrypt, err)
+
+	return decrypted, err
+}
+
+// countProviderOp counts the outcome of a call to the given provider, so provider
+// failures can be told apart from failures decrypting the payloads themselves.
+func countProviderOp(id secrets.ProviderID, operation string, err error) {
+	providerOpsCounter.With(prometheus.Labels{
+		"success":       strconv.FormatBool(err == nil),
+		"operation":     operation,
+		"provider_kind": providerKind(id),
+	}).Inc()
+}
+
+// providerKind returns the kind of the given provider, for metrics labels.
+func providerKind(id secrets.ProviderID) string {
+	kind, err := id.Kind()
+	if err != nil {
+		return "unknown"
+	}
+	return kind
+}
@@ -0,0 +1,126 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_ProviderConcurrency(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	const providerID = secrets.ProviderID("limited.v1")
+	svc.providerSemaphores = newProviderSemaphores(
+		map[secrets.ProviderID]secrets.Provider{providerID: identityProvider{}}, 1,
+	)
+	queued := func() float64 {
+		return testutil.ToFloat64(providerQueueDepthGauge.WithLabelValues(string(providerID)))
+	}
+
+	t.Run("providers without limit should not wait", func(t *testing.T) {
+		release, err := svc.acquireProvider(ctx, "unlimited.v1")
+		require.NoError(t, err)
+		release()
+	})
+
+	release, err := svc.acquireProvider(ctx, providerID)
+	require.NoError(t, err)
+
+	t.Run("calls over the limit should wait until the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		_, err := svc.providerDecrypt(ctx, providerID, identityProvider{}, []byte("grafana"))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Zero(t, queued())
+	})
+
+	t.Run("queued calls should proceed once a slot is released", func(t *testing.T) {
+		done := make(chan error)
+		go func() {
+			_, err := svc.providerEncrypt(ctx, providerID, identityProvider{}, []byte("grafana"))
+			done <- err
+		}()
+
+		require.Eventually(t, func() bool { return queued() == 1 }, time.Second, time.Millisecond)
+		release()
+
+		require.NoError(t, <-done)
+		assert.Zero(t, queued())
+	})
+}
+
+// failingProvider fails any call.
+type failingProvider struct{}
+
+func (failingProvider) Encrypt(context.Context, []byte) ([]byte, error) {
+	return nil, errors.New("provider unavailable")
+}
+
+func (failingProvider) Decrypt(context.Context, []byte) ([]byte, error) {
+	return nil, errors.New("provider unavailable")
+}
+
+func TestSecretsService_ProviderOpsMetrics(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	ops := func(success, operation string) float64 {
+		return testutil.ToFloat64(providerOpsCounter.WithLabelValues(success, operation, "fakeKms"))
+	}
+	encrypted, decryptFailed := ops("true", OpEncrypt), ops("false", OpDecrypt)
+
+	_, err := svc.providerEncrypt(ctx, "fakeKms.v1", identityProvider{}, []byte("grafana"))
+	require.NoError(t, err)
+
+	_, err = svc.providerDecrypt(ctx, "fakeKms.v1", failingProvider{}, []byte("grafana"))
+	require.Error(t, err)
+
+	assert.Equal(t, encrypted+1, ops("true", OpEncrypt))
+	assert.Equal(t, decryptFailed+1, ops("false", OpDecrypt))
+}
+
+func TestSecretsService_DecryptConcurrency(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+	svc.decryptSemaphore = make(chan struct{}, 1)
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	release, err := svc.acquireDecrypt(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(decryptInFlightGauge))
+
+	t.Run("calls over the limit should wait until the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		_, err := svc.Decrypt(ctx, encrypted)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, float64(1), testutil.ToFloat64(decryptInFlightGauge))
+	})
+
+	t.Run("queued calls should proceed once a slot is released", func(t *testing.T) {
+		done := make(chan error)
+		go func() {
+			_, err := svc.Decrypt(ctx, encrypted)
+			done <- err
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		release()
+
+		require.NoError(t, <-done)
+		assert.Zero(t, testutil.ToFloat64(decryptInFlightGauge))
+	})
+}
@@ -0,0 +1,71 @@
+package manager
+
+import (
+	"context"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/grafana/pkg/apimachinery/identity"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// ctxLogger returns the logger for an operation done on behalf of the given context. On top of the
+// contextual attributes (e.g. the trace id), it includes the requester org, id and login, the same
+// way request loggers do, so encryption failures can be tied to the user action that caused them,
+// and the audit label, if any (see secrets.WithAuditLabel).
+func (s *SecretsService) ctxLogger(ctx context.Context) log.Logger {
+	logger := s.log.FromContext(ctx)
+
+	var attrs []any
+	if requester, err := identity.GetRequester(ctx); err == nil {
+		attrs = append(attrs, "userId", requester.GetID().String(), "orgId", requester.GetOrgID(), "uname", requester.GetLogin())
+	}
+
+	if label := secrets.AuditLabelFromContext(ctx); label != "" {
+		attrs = append(attrs, "audit_label", label)
+	}
+
+	if len(attrs) == 0 {
+		return logger
+	}
+
+	return logger.New(attrs...)
+}
+
+// observeWithExemplar observes the given value, with the trace id of the given context as exemplar
+// if it's sampled, so slow operations can be tied to their traces, along with the audit label, if
+// any. The audit label is left out if the exemplar would be too long otherwise, as Prometheus limits
+// their length. Exemplars are only attached to histograms, never to counters, to keep them scarce.
+func observeWithExemplar(ctx context.Context, observer prometheus.Observer, value float64) {
+	traceID := tracing.TraceIDFromContext(ctx, true)
+	exemplarObserver, ok := observer.(prometheus.ExemplarObserver)
+	if traceID == "" || !ok {
+		observer.Observe(value)
+		return
+	}
+
+	exemplar := prometheus.Labels{"traceID": traceID}
+	if label := secrets.AuditLabelFromContext(ctx); fitsExemplar(exemplar, "audit_label", label) {
+		exemplar["audit_label"] = label
+	}
+
+	exemplarObserver.ObserveWithExemplar(value, exemplar)
+}
+
+// fitsExemplar reports whether the given label can be added to the given exemplar labels,
+// i.e. it's a non-empty, valid UTF-8 value, and the exemplar stays within the Prometheus limit.
+func fitsExemplar(labels prometheus.Labels, name string, value string) bool {
+	if value == "" || !utf8.ValidString(value) {
+		return false
+	}
+
+	runes := utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	for name, value := range labels {
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+
+	return runes <= prometheus.ExemplarMaxRunes
+}
@@ -0,0 +1,164 @@
+package manager
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/grafana/grafana/pkg/apimachinery/identity"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/log/logtest"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+// recordingLogger records the contextual attributes loggers are created with.
+type recordingLogger struct {
+	logtest.Fake
+	attrs []any
+}
+
+func (l *recordingLogger) New(ctx ...any) *log.ConcreteLogger {
+	l.attrs = append(l.attrs, ctx...)
+	return log.NewNopLogger()
+}
+
+func (l *recordingLogger) FromContext(context.Context) log.Logger {
+	return l
+}
+
+func TestSecretsService_ctxLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	svc := &SecretsService{log: logger}
+
+	t.Run("without requester", func(t *testing.T) {
+		svc.ctxLogger(context.Background())
+		assert.Empty(t, logger.attrs)
+	})
+
+	t.Run("with requester", func(t *testing.T) {
+		ctx := identity.WithRequester(context.Background(), &identity.StaticRequester{
+			Namespace: identity.NamespaceUser,
+			UserID:    10,
+			OrgID:     2,
+			Login:     "admin",
+		})
+
+		svc.ctxLogger(ctx)
+		assert.Equal(t, []any{"userId", "user:10", "orgId", int64(2), "uname", "admin"}, logger.attrs)
+	})
+}
+
+// histogramExemplar returns the exemplar of the only observation of the given histogram, if any.
+func histogramExemplar(t *testing.T, histogram prometheus.Histogram) *dto.Exemplar {
+	t.Helper()
+
+	var m dto.Metric
+	require.NoError(t, histogram.Write(&m))
+	require.Equal(t, uint64(1), m.GetHistogram().GetSampleCount())
+
+	for _, bucket := range m.GetHistogram().GetBucket() {
+		if exemplar := bucket.GetExemplar(); exemplar != nil {
+			return exemplar
+		}
+	}
+	return nil
+}
+
+// sampledContext returns a context with a sampled span context of the given trace id.
+func sampledContext(traceID trace.TraceID) context.Context {
+	return trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+	}))
+}
+
+func TestObserveWithExemplar(t *testing.T) {
+	t.Run("without trace context", func(t *testing.T) {
+		histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds"})
+		observeWithExemplar(secrets.WithAuditLabel(context.Background(), "datasource:prometheus"), histogram, 0.01)
+
+		assert.Nil(t, histogramExemplar(t, histogram))
+	})
+
+	t.Run("with trace context", func(t *testing.T) {
+		histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds"})
+
+		traceID := trace.TraceID{1, 2, 3}
+		observeWithExemplar(sampledContext(traceID), histogram, 0.01)
+
+		exemplar := histogramExemplar(t, histogram)
+		require.NotNil(t, exemplar)
+		require.Len(t, exemplar.GetLabel(), 1)
+		assert.Equal(t, "traceID", exemplar.GetLabel()[0].GetName())
+		assert.Equal(t, traceID.String(), exemplar.GetLabel()[0].GetValue())
+		assert.Equal(t, 0.01, exemplar.GetValue())
+	})
+}
+
+func TestSecretsService_AuditLabel(t *testing.T) {
+	assert.Equal(t, context.Background(), secrets.WithAuditLabel(context.Background(), ""), "empty labels should be ignored")
+
+	ctx := secrets.WithAuditLabel(context.Background(), "datasource:prometheus:basic_auth_password")
+
+	t.Run("should be logged", func(t *testing.T) {
+		logger := &recordingLogger{}
+		svc := &SecretsService{log: logger}
+
+		svc.ctxLogger(ctx)
+		assert.Equal(t, []any{"audit_label", "datasource:prometheus:basic_auth_password"}, logger.attrs)
+	})
+
+	t.Run("should be added to exemplars", func(t *testing.T) {
+		histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds"})
+		observeWithExemplar(secrets.WithAuditLabel(sampledContext(trace.TraceID{1, 2, 3}), "datasource:prometheus:basic_auth_password"), histogram, 0.01)
+
+		exemplar := histogramExemplar(t, histogram)
+		require.NotNil(t, exemplar)
+		labels := map[string]string{}
+		for _, label := range exemplar.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		assert.Equal(t, map[string]string{
+			"traceID":     trace.TraceID{1, 2, 3}.String(),
+			"audit_label": "datasource:prometheus:basic_auth_password",
+		}, labels)
+	})
+
+	t.Run("should be left out of exemplars if too long", func(t *testing.T) {
+		histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds"})
+		observeWithExemplar(secrets.WithAuditLabel(sampledContext(trace.TraceID{1, 2, 3}), strings.Repeat("a", prometheus.ExemplarMaxRunes)), histogram, 0.01)
+
+		exemplar := histogramExemplar(t, histogram)
+		require.NotNil(t, exemplar)
+		require.Len(t, exemplar.GetLabel(), 1)
+		assert.Equal(t, "traceID", exemplar.GetLabel()[0].GetName())
+	})
+
+	t.Run("should not affect encryption", func(t *testing.T) {
+		svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+		labelled, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		unlabelled, err := svc.Encrypt(context.Background(), []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		labelledKeyId, _, err := decodeEnvelope(labelled)
+		require.NoError(t, err)
+		unlabelledKeyId, _, err := decodeEnvelope(unlabelled)
+		require.NoError(t, err)
+		assert.Equal(t, unlabelledKeyId, labelledKeyId)
+		assert.NotContains(t, string(labelled), "datasource")
+
+		decrypted, err := svc.Decrypt(context.Background(), labelled)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+}
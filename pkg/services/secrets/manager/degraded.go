@@ -0,0 +1,61 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// runBackgroundProvider runs the given background provider until the context is done. If it
+// fails, the failure is logged and counted, and the provider is marked as degraded, but no error
+// is returned unless background_providers_strict is set: otherwise, a single failing provider
+// would stop the whole secrets service, while the others and the cache can keep serving.
+func (s *SecretsService) runBackgroundProvider(ctx context.Context, id secrets.ProviderID, provider secrets.BackgroundProvider) error {
+	err := provider.Run(ctx)
+	if err == nil || errors.Is(err, context.Canceled) || ctx.Err() != nil {
+		return err
+	}
+
+	backgroundProviderFailuresCounter.WithLabelValues(string(id)).Inc()
+
+	if s.backgroundProvidersStrict {
+		s.log.Error("Background encryption provider failed", "provider", id, "error", err)
+		return err
+	}
+
+	s.log.Error("Background encryption provider failed, marking it as degraded", "provider", id, "error", err)
+	s.markProviderDegraded(id)
+
+	return nil
+}
+
+func (s *SecretsService) markProviderDegraded(id secrets.ProviderID) {
+	s.degradedProvidersMtx.Lock()
+	defer s.degradedProvidersMtx.Unlock()
+
+	if s.degradedProviders == nil {
+		s.degradedProviders = make(map[secrets.ProviderID]struct{})
+	}
+	s.degradedProviders[id] = struct{}{}
+
+	providerDegradedGauge.WithLabelValues(string(id)).Set(1)
+}
+
+// DegradedProviders returns the identifiers of the encryption providers whose
+// background process failed, sorted. They're still used, but may misbehave
+// (e.g. if their background process refreshed their credentials).
+func (s *SecretsService) DegradedProviders() []secrets.ProviderID {
+	s.degradedProvidersMtx.RLock()
+	defer s.degradedProvidersMtx.RUnlock()
+
+	ids := make([]secrets.ProviderID, 0, len(s.degradedProviders))
+	for id := range s.degradedProviders {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
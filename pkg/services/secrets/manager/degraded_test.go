@@ -0,0 +1,62 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+type backgroundProvider struct {
+	fakeProvider
+	err error
+}
+
+func (p *backgroundProvider) Run(ctx context.Context) error {
+	if p.err != nil {
+		return p.err
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+func TestSecretsService_BackgroundProviderFailure(t *testing.T) {
+	setup := func(t *testing.T, strict bool) *SecretsService {
+		svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+		svc.providers = map[secrets.ProviderID]secrets.Provider{
+			"healthy.v1": &backgroundProvider{},
+			"failing.v1": &backgroundProvider{err: errors.New("connection refused")},
+		}
+		svc.backgroundProvidersStrict = strict
+		return svc
+	}
+
+	t.Run("should mark the provider as degraded and keep running", func(t *testing.T) {
+		svc := setup(t, false)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		require.NoError(t, svc.Run(ctx))
+		assert.ErrorIs(t, ctx.Err(), context.DeadlineExceeded)
+		assert.Equal(t, []secrets.ProviderID{"failing.v1"}, svc.DegradedProviders())
+	})
+
+	t.Run("should fail fast if strict", func(t *testing.T) {
+		svc := setup(t, true)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		require.ErrorContains(t, svc.Run(ctx), "connection refused")
+		assert.NoError(t, ctx.Err())
+		assert.Empty(t, svc.DegradedProviders())
+	})
+}
@@ -0,0 +1,176 @@
+package manager
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// deterministicMarker flags the ciphertext of the payloads encrypted with EncryptDeterministic,
+// right after the envelope prefix. It's never the first byte of any ciphertext of the builtin
+// encryption service, as those start with either the algorithm delimiter ('*') or, if older, an
+// alphanumeric salt. Other implementations give no such guarantee, so markers are only used
+// along with the builtin one. See requireBuiltinEncryption.
+const deterministicMarker = '$'
+
+var errDeterministicAuthentication = errors.New("deterministic payload authentication failed")
+
+// EncryptDeterministic works like Encrypt, but the resulting payload is always the same for the
+// same plaintext and data key, so duplicated secrets can be detected without decrypting them.
+// Payloads are decrypted with Decrypt, as usual.
+//
+// Security implications: deterministic encryption leaks whether two payloads hold the same
+// plaintext, which regular encryption never does, so it must only be used when that's
+// acceptable. Also note that payloads are only deterministic while the data key is the
+// same: after a rotation (see RotateDataKeys), the same plaintext is encrypted differently.
+//
+// It uses a synthetic IV (SIV): the IV is an HMAC-SHA256 of the plaintext, and the plaintext is
+// encrypted with AES-256-CTR, both with keys derived from the data key. As the IV is verified on
+// decryption, deterministic payloads are authenticated too.
+func (s *SecretsService) EncryptDeterministic(ctx context.Context, payload []byte, opt secrets.EncryptionOptions) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.EncryptDeterministic")
+	defer span.End()
+
+	if s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
+		return nil, fmt.Errorf("deterministic encryption requires envelope encryption to be enabled")
+	}
+
+	if err := s.requireBuiltinEncryption("deterministic encryption"); err != nil {
+		return nil, err
+	}
+
+	return s.encrypt(ctx, payload, opt(), encryptOptions{deterministic: true})
+}
+
+// requireBuiltinEncryption fails if the encryption service isn't the builtin one, as the ciphertexts
+// of any other implementation may start with a marker (e.g. deterministicMarker) by chance, so the
+// given feature, which relies on them, cannot be told apart on decryption.
+func (s *SecretsService) requireBuiltinEncryption(feature string) error {
+	if !s.builtinEnc {
+		return fmt.Errorf("%s requires the builtin encryption service, got '%s'", feature, encryptionImplementation(s.enc))
+	}
+
+	return nil
+}
+
+// decryptCiphertext decrypts the given ciphertext (i.e. without the envelope prefix) with
+// the given data key, whether it was encrypted deterministically, with expiry, with key
+// commitment, or none of them. Only nil payloads (see EncryptNullable) are decrypted
+// as nil: any other empty plaintext is returned as an empty slice. Markers are only
+// looked for in the ciphertexts of the builtin encryption service.
+func (s *SecretsService) decryptCiphertext(ctx context.Context, ciphertext []byte, dataKey []byte) ([]byte, error) {
+	if s.builtinEnc && len(ciphertext) > 0 && ciphertext[0] == nilMarker {
+		return openNil(dataKey, ciphertext[1:])
+	}
+
+	plaintext, err := s.openCiphertext(ctx, ciphertext, dataKey)
+	if err == nil && plaintext == nil {
+		plaintext = []byte{}
+	}
+
+	return plaintext, err
+}
+
+// openCiphertext decrypts the given ciphertext, which isn't a nil payload, with the given data key.
+func (s *SecretsService) openCiphertext(ctx context.Context, ciphertext []byte, dataKey []byte) ([]byte, error) {
+	if !s.builtinEnc {
+		return s.enc.Decrypt(ctx, ciphertext, string(dataKey))
+	}
+
+	if len(ciphertext) > 0 && ciphertext[0] == deterministicMarker {
+		return openDeterministic(dataKey, ciphertext[1:])
+	}
+
+	if len(ciphertext) > 0 && ciphertext[0] == expiringMarker {
+		return openExpiring(dataKey, ciphertext[1:])
+	}
+
+	if len(ciphertext) > 0 && ciphertext[0] == committedMarker {
+		return openCommitted(dataKey, ciphertext[1:])
+	}
+
+	if err := checkFormatVersion(ciphertext); err != nil {
+		return nil, err
+	}
+
+	return s.enc.Decrypt(ctx, ciphertext, string(dataKey))
+}
+
+// deriveKey derives a 256-bit key for the given purpose from the given data key, so
+// the data key itself is never used directly by more than one encryption scheme.
+func deriveKey(dataKey []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// deterministicKeys derives the encryption and authentication keys
+// used for deterministic encryption from the given data key.
+func deterministicKeys(dataKey []byte) ([]byte, []byte) {
+	return deriveKey(dataKey, "grafana-deterministic-encryption"), deriveKey(dataKey, "grafana-deterministic-authentication")
+}
+
+// syntheticIV returns the IV for the given plaintext, which is its HMAC-SHA256.
+func syntheticIV(macKey []byte, plaintext []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(plaintext)
+	return mac.Sum(nil)[:aes.BlockSize]
+}
+
+// appendDeterministic appends the given plaintext, deterministically
+// encrypted with the given data key, to the given buffer, as follows:
+//
+//	$<IV><ciphertext>
+func appendDeterministic(dst []byte, dataKey []byte, plaintext []byte) ([]byte, error) {
+	encKey, macKey := deterministicKeys(dataKey)
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := syntheticIV(macKey, plaintext)
+
+	dst = append(dst, deterministicMarker)
+	dst = append(dst, iv...)
+
+	n := len(dst)
+	dst = slices.Grow(dst, len(plaintext))[:n+len(plaintext)]
+	cipher.NewCTR(block, iv).XORKeyStream(dst[n:], plaintext)
+
+	return dst, nil
+}
+
+// openDeterministic is the inverse of appendDeterministic,
+// for the given ciphertext without the deterministic marker.
+func openDeterministic(dataKey []byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, fmt.Errorf("deterministic payload too short")
+	}
+
+	encKey, macKey := deterministicKeys(dataKey)
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	iv, ciphertext := ciphertext[:aes.BlockSize], ciphertext[aes.BlockSize:]
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, ciphertext)
+
+	if !hmac.Equal(iv, syntheticIV(macKey, plaintext)) {
+		return nil, errDeterministicAuthentication
+	}
+
+	return plaintext, nil
+}
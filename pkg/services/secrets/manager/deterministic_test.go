@@ -0,0 +1,73 @@
+package manager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_EncryptDeterministic(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	encrypt := func(plaintext string) []byte {
+		t.Helper()
+		encrypted, err := svc.EncryptDeterministic(ctx, []byte(plaintext), secrets.WithoutScope())
+		require.NoError(t, err)
+		return encrypted
+	}
+
+	t.Run("identical plaintexts should produce identical payloads", func(t *testing.T) {
+		assert.Equal(t, encrypt("grafana"), encrypt("grafana"))
+		assert.Equal(t, encrypt(""), encrypt(""))
+	})
+
+	t.Run("different plaintexts should produce different payloads", func(t *testing.T) {
+		assert.NotEqual(t, encrypt("grafana"), encrypt("Grafana"))
+		assert.NotEqual(t, encrypt("grafana"), encrypt("grafana "))
+	})
+
+	t.Run("payloads should be decrypted as usual", func(t *testing.T) {
+		encrypted := encrypt("grafana")
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		keyId, _, err := decodeEnvelope(encrypted)
+		require.NoError(t, err)
+		_, rawDataKey, err := svc.fetchDataKeyById(ctx, keyId)
+		require.NoError(t, err)
+
+		decrypted, err = svc.DecryptWithRawKey(ctx, encrypted, rawDataKey, keyId)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("tampered payloads should fail", func(t *testing.T) {
+		encrypted := encrypt("grafana")
+		encrypted[len(encrypted)-1] ^= 0x01
+
+		_, err := svc.Decrypt(ctx, encrypted)
+		require.ErrorIs(t, err, errDeterministicAuthentication)
+	})
+
+	t.Run("regular encryption should not be deterministic", func(t *testing.T) {
+		a, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		b, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		assert.NotEqual(t, a, b)
+	})
+
+	t.Run("envelope encryption should be required", func(t *testing.T) {
+		svc := SetupDisabledTestService(t, fakes.NewFakeSecretsStore())
+		_, err := svc.EncryptDeterministic(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.Error(t, err)
+	})
+}
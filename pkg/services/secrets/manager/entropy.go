@@ -0,0 +1,119 @@
+package manager
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// randReader is the source of randomness of the data keys. It's
+// only replaced for testing purposes, to fake a broken source.
+var randReader io.Reader = rand.Reader
+
+// maxDataKeyGenerationAttempts is how many times a data key is generated before
+// giving up, if the random source keeps returning degenerate values.
+const maxDataKeyGenerationAttempts = 3
+
+var errWeakRandomSource = errors.New("random source returned degenerate data keys")
+
+// newRandomDataKey generates a new random data key. As a guard against a catastrophic failure of
+// the random source (e.g. returning zeros), which would make data keys predictable, degenerate
+// data keys are discarded and generated again, up to maxDataKeyGenerationAttempts times. If
+// [security.encryption] data_key_min_entropy_bits is set, data keys whose estimated entropy is
+// lower are considered degenerate too. See degenerateDataKey.
+func (s *SecretsService) newRandomDataKey() ([]byte, error) {
+	rawDataKey := make([]byte, dataKeyLength)
+	for attempt := 1; attempt <= maxDataKeyGenerationAttempts; attempt++ {
+		if _, err := io.ReadFull(randReader, rawDataKey); err != nil {
+			return nil, err
+		}
+
+		reason := degenerateDataKey(rawDataKey, s.dataKeyMinEntropyBits)
+		if reason == "" {
+			return rawDataKey, nil
+		}
+
+		dataKeysRejectedCounter.Inc()
+		s.log.Warn("Discarded degenerate data key generated", "reason", reason, "attempt", attempt)
+	}
+
+	clear(rawDataKey)
+
+	return nil, fmt.Errorf("%w, %d times in a row", errWeakRandomSource, maxDataKeyGenerationAttempts)
+}
+
+// degenerateDataKey returns why the given data key is degenerate, i.e. it's unlikely to
+// come from a working random source, or an empty string if it isn't. A data key is
+// degenerate if it's made of a repeated pattern of up to half its length (e.g. all
+// zeros), if its bytes are an arithmetic progression (e.g. 0x00, 0x01, 0x02...), or
+// if its estimated entropy is lower than the given minimum, in bits.
+//
+// The chances of a working random source generating a degenerate data key, with
+// the default minimum of zero, are lower than 2^-64.
+func degenerateDataKey(key []byte, minEntropyBits float64) string {
+	for period := 1; period <= len(key)/2; period++ {
+		if periodic(key, period) {
+			return fmt.Sprintf("repeated pattern of %d byte(s)", period)
+		}
+	}
+
+	if len(key) > 2 && arithmeticProgression(key) {
+		return "arithmetic progression"
+	}
+
+	if minEntropyBits > 0 {
+		if bits := entropyBits(key); bits < minEntropyBits {
+			return fmt.Sprintf("estimated entropy of %.1f bits", bits)
+		}
+	}
+
+	return ""
+}
+
+func periodic(key []byte, period int) bool {
+	for i := period; i < len(key); i++ {
+		if key[i] != key[i-period] {
+			return false
+		}
+	}
+	return true
+}
+
+func arithmeticProgression(key []byte) bool {
+	step := key[1] - key[0]
+	for i := 2; i < len(key); i++ {
+		if key[i]-key[i-1] != step {
+			return false
+		}
+	}
+	return true
+}
+
+// maxEntropyBits is the highest entropy entropyBits can estimate for a data
+// key of the given length, in bits, i.e. length * log2(length).
+func maxEntropyBits(length int) float64 {
+	return float64(length) * math.Log2(float64(length))
+}
+
+// entropyBits estimates the entropy of the given data key, in bits, as the Shannon
+// entropy of its bytes distribution times its length. As it's estimated from the data
+// key itself, it's at most maxEntropyBits(len(key)), e.g. 64 bits for 16 bytes.
+func entropyBits(key []byte) float64 {
+	var counts [256]int
+	for _, b := range key {
+		counts[b]++
+	}
+
+	var bits float64
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(len(key))
+		bits -= float64(count) * math.Log2(p)
+	}
+
+	return bits
+}
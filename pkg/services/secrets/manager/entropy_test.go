@@ -0,0 +1,151 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ini.v1"
+
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/infra/usagestats"
+	encryptionprovider "github.com/grafana/grafana/pkg/services/encryption/provider"
+	encryptionservice "github.com/grafana/grafana/pkg/services/encryption/service"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/kmsproviders/osskmsproviders"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/services/supportbundles/supportbundlestest"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func fakeRandReader(t *testing.T, r io.Reader) {
+	t.Helper()
+
+	previous := randReader
+	randReader = r
+	t.Cleanup(func() { randReader = previous })
+}
+
+func TestSecretsService_NewRandomDataKey(t *testing.T) {
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	t.Run("working random source should generate data keys", func(t *testing.T) {
+		dataKey, err := svc.newRandomDataKey()
+		require.NoError(t, err)
+		assert.Len(t, dataKey, dataKeyLength)
+	})
+
+	t.Run("zero-returning random source should fail", func(t *testing.T) {
+		fakeRandReader(t, zeroReader{})
+		before := testutil.ToFloat64(dataKeysRejectedCounter)
+
+		dataKey, err := svc.newRandomDataKey()
+		require.ErrorIs(t, err, errWeakRandomSource)
+		assert.Nil(t, dataKey)
+		assert.Equal(t, before+maxDataKeyGenerationAttempts, testutil.ToFloat64(dataKeysRejectedCounter))
+
+		_, err = svc.Encrypt(context.Background(), []byte("grafana"), secrets.WithoutScope())
+		require.ErrorIs(t, err, errWeakRandomSource)
+	})
+
+	t.Run("degenerate data key should be generated again", func(t *testing.T) {
+		random := make([]byte, dataKeyLength)
+		for i := range random {
+			random[i] = byte(i * i * 31)
+		}
+		fakeRandReader(t, bytes.NewReader(append(make([]byte, dataKeyLength), random...)))
+
+		dataKey, err := svc.newRandomDataKey()
+		require.NoError(t, err)
+		assert.Equal(t, random, dataKey)
+	})
+
+	t.Run("random source failures should be returned", func(t *testing.T) {
+		fakeRandReader(t, bytes.NewReader(nil))
+
+		_, err := svc.newRandomDataKey()
+		require.Error(t, err)
+		assert.False(t, errors.Is(err, errWeakRandomSource))
+	})
+}
+
+func TestDegenerateDataKey(t *testing.T) {
+	testCases := []struct {
+		name           string
+		key            []byte
+		minEntropyBits float64
+		degenerate     bool
+	}{
+		{name: "all zeros", key: make([]byte, 16), degenerate: true},
+		{name: "repeated pattern", key: []byte("abcdabcdabcdabcd"), degenerate: true},
+		{name: "half-length pattern", key: []byte("0123456701234567"), degenerate: true},
+		{name: "arithmetic progression", key: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, degenerate: true},
+		{name: "wrapping arithmetic progression", key: []byte{250, 2, 10, 18, 26, 34, 42, 50, 58, 66, 74, 82, 90, 98, 106, 114}, degenerate: true},
+		{name: "random-looking", key: []byte("k3Y!p9#Qz7@wL2$m")},
+		{name: "below minimum entropy", key: []byte("aaaaaaaaaaaaaaab"), minEntropyBits: 32, degenerate: true},
+		{name: "above minimum entropy", key: []byte("k3Y!p9#Qz7@wL2$m"), minEntropyBits: 32},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reason := degenerateDataKey(tc.key, tc.minEntropyBits)
+			assert.Equal(t, tc.degenerate, reason != "", reason)
+		})
+	}
+}
+
+func TestProvideSecretsService_DataKeyMinEntropyBits(t *testing.T) {
+	provide := func(t *testing.T, minEntropyBits string) error {
+		raw, err := ini.Load([]byte(`
+		[security]
+		secret_key = sdDkslslld
+
+		[security.encryption]
+		data_key_min_entropy_bits = ` + minEntropyBits))
+		require.NoError(t, err)
+
+		cfg := &setting.Cfg{Raw: raw}
+		features := featuremgmt.WithFeatures()
+
+		encryptionService, err := encryptionservice.ProvideEncryptionService(
+			tracing.InitializeTracerForTest(), encryptionprovider.Provider{}, &usagestats.UsageStatsMock{}, cfg,
+		)
+		require.NoError(t, err)
+
+		_, err = ProvideSecretsService(
+			tracing.InitializeTracerForTest(),
+			fakes.NewFakeSecretsStore(),
+			osskmsproviders.ProvideService(encryptionService, cfg, features),
+			encryptionService,
+			cfg,
+			features,
+			&usagestats.UsageStatsMock{T: t},
+			supportbundlestest.NewFakeBundleService(),
+		)
+		return err
+	}
+
+	t.Run("minimum up to the highest estimable entropy should be accepted", func(t *testing.T) {
+		require.NoError(t, provide(t, "0"))
+		require.NoError(t, provide(t, "64"))
+	})
+
+	t.Run("minimum above the highest estimable entropy should be rejected", func(t *testing.T) {
+		err := provide(t, "64.5")
+		require.Error(t, err)
+		assert.ErrorContains(t, err, "data_key_min_entropy_bits")
+	})
+}
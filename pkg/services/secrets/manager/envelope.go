@@ -0,0 +1,207 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+const (
+	keyIdDelimiter = '#'
+)
+
+var b64 = base64.RawStdEncoding
+
+// keyIdBufferPool holds the scratch buffers used to decode the data key identifiers
+// of the envelope-encrypted payloads, so decrypting doesn't allocate one each time.
+// The buffers never escape decodeEnvelope: the identifier is copied out of them.
+var keyIdBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, maxDataKeyIdLength)
+		return &buf
+	},
+}
+
+// algorithmDelimiter is the first byte of the ciphertexts of the encryption
+// service that are prefixed by their encryption algorithm (e.g. "*aes-gcm*").
+const algorithmDelimiter = '*'
+
+// checkFormatVersion checks that the given ciphertext (i.e. without the envelope prefix) of the
+// builtin encryption service has a format this version understands. It's only called once the
+// ciphertext is known not to start with any of the markers (i.e. nilMarker '~', deterministicMarker
+// '$', expiringMarker '!' and committedMarker '^', in that order, see decryptCiphertext). Any other
+// ciphertext starts with either the algorithm delimiter or an alphanumeric salt, so any other first
+// byte is the marker of a format introduced by a newer version (e.g. read mid-upgrade), which would
+// otherwise be misparsed into garbage.
+func checkFormatVersion(ciphertext []byte) error {
+	if len(ciphertext) == 0 {
+		return nil
+	}
+
+	version := ciphertext[0]
+	if version == algorithmDelimiter || version < utf8.RuneSelf && (unicode.IsLetter(rune(version)) || unicode.IsDigit(rune(version))) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %q", secrets.ErrUnsupportedFormatVersion, version)
+}
+
+// PayloadKind is the kind of encryption an encrypted payload looks like it was encrypted with.
+type PayloadKind string
+
+const (
+	// PayloadKindLegacy is a payload encrypted directly with the secret key (legacy encryption).
+	PayloadKindLegacy PayloadKind = "legacy"
+	// PayloadKindEnvelope is a payload encrypted with a data key (envelope encryption).
+	PayloadKindEnvelope PayloadKind = "envelope"
+	// PayloadKindUnknown is a payload that doesn't look like any of the above, or is ambiguous.
+	PayloadKindUnknown PayloadKind = "unknown"
+)
+
+// legacySaltLength is the length of the alphanumeric salt the builtin encryption
+// service prefixes the payloads encrypted with legacy encryption with.
+const legacySaltLength = 8
+
+// legacyPayloadMinLength is the minimum length of a payload encrypted with legacy
+// encryption: an 8-byte salt followed by, at least, a 16-byte (AES block) IV.
+const legacyPayloadMinLength = legacySaltLength + 16
+
+// ClassifyPayload tells whether the given payload looks like it was encrypted with legacy or
+// envelope encryption, based on its structure and without decrypting it:
+//
+//   - Envelope: the key id delimiter, a valid base64-encoded data key id, the key id delimiter
+//     again, and a non-empty ciphertext (see encodeEnvelope).
+//   - Legacy: a ciphertext of the builtin encryption service: an optional "*<base64 algorithm>*"
+//     prefix, an 8-byte alphanumeric salt and, at least, a 16-byte IV or nonce.
+//   - Unknown: anything else. That includes the ciphertexts of custom encryption implementations,
+//     which cannot be told apart from corrupted payloads by their structure, even if Decrypt may
+//     still be able to decrypt them with legacy encryption.
+func ClassifyPayload(payload []byte) PayloadKind {
+	if len(payload) == 0 {
+		return PayloadKindUnknown
+	}
+
+	if payload[0] == keyIdDelimiter {
+		if _, ciphertext, err := decodeEnvelope(payload); err != nil || len(ciphertext) == 0 {
+			return PayloadKindUnknown
+		}
+
+		return PayloadKindEnvelope
+	}
+
+	if payload[0] == algorithmDelimiter {
+		end := bytes.IndexByte(payload[1:], algorithmDelimiter)
+		if end <= 0 {
+			return PayloadKindUnknown
+		}
+
+		if _, err := b64.DecodeString(string(payload[1 : end+1])); err != nil {
+			return PayloadKindUnknown
+		}
+
+		payload = payload[end+2:]
+	}
+
+	if len(payload) < legacyPayloadMinLength {
+		return PayloadKindUnknown
+	}
+
+	for _, c := range payload[:legacySaltLength] {
+		if c >= utf8.RuneSelf || !unicode.IsLetter(rune(c)) && !unicode.IsDigit(rune(c)) {
+			return PayloadKindUnknown
+		}
+	}
+
+	return PayloadKindLegacy
+}
+
+// encodeEnvelope prefixes the given ciphertext with the base64-encoded
+// identifier of the data key used to encrypt it, as follows:
+//
+//	#<base64(keyId)>#<ciphertext>
+func encodeEnvelope(keyId string, ciphertext []byte) []byte {
+	blob := make([]byte, 0, envelopePrefixLen(keyId)+len(ciphertext))
+	blob = appendEnvelopePrefix(blob, keyId)
+
+	return append(blob, ciphertext...)
+}
+
+// envelopePrefixLen returns the length of the prefix of
+// the payloads encrypted with the given data key.
+func envelopePrefixLen(keyId string) int {
+	return b64.EncodedLen(len(keyId)) + 2
+}
+
+// appendEnvelopePrefix appends the prefix of the payloads
+// encrypted with the given data key to the given buffer.
+func appendEnvelopePrefix(dst []byte, keyId string) []byte {
+	dst = append(dst, keyIdDelimiter)
+	dst = b64.AppendEncode(dst, []byte(keyId))
+
+	return append(dst, keyIdDelimiter)
+}
+
+// validDataKeyId reports whether the given data key identifier looks like one that could
+// have been generated, either by the default generator or by a custom one: at most
+// maxDataKeyIdLength characters long, valid UTF-8, and without spaces nor control characters.
+func validDataKeyId(id string) bool {
+	if len(id) == 0 || len(id) > maxDataKeyIdLength || !utf8.ValidString(id) {
+		return false
+	}
+
+	for _, r := range id {
+		if !unicode.IsGraphic(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decodeEnvelope is the inverse of encodeEnvelope: it extracts the data key
+// identifier and the ciphertext from an envelope-encrypted payload.
+//
+// It must never panic, whatever the input is, because payloads come
+// from storage and may be truncated or otherwise corrupted.
+func decodeEnvelope(payload []byte) (string, []byte, error) {
+	if len(payload) == 0 || payload[0] != keyIdDelimiter {
+		return "", nil, fmt.Errorf("payload is not envelope encrypted")
+	}
+
+	payload = payload[1:]
+	endOfKey := bytes.IndexByte(payload, keyIdDelimiter)
+	if endOfKey == -1 {
+		return "", nil, fmt.Errorf("could not find valid key id in encrypted payload")
+	}
+
+	b64Key := payload[:endOfKey]
+	if b64.DecodedLen(len(b64Key)) > maxDataKeyIdLength {
+		return "", nil, fmt.Errorf("%w: malformed key id in encrypted payload", secrets.ErrInvalidPayloadFormat)
+	}
+
+	buf := keyIdBufferPool.Get().(*[]byte)
+	defer keyIdBufferPool.Put(buf)
+
+	n, err := b64.Decode(*buf, b64Key)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: could not decode key id in encrypted payload: %s", secrets.ErrInvalidPayloadFormat, err)
+	}
+
+	if n == 0 {
+		return "", nil, fmt.Errorf("%w: empty key id in encrypted payload", secrets.ErrInvalidPayloadFormat)
+	}
+
+	// A corrupted key id may still be valid base64, so it's validated
+	// too, to not look up data keys that cannot exist.
+	keyId := string((*buf)[:n])
+	if !validDataKeyId(keyId) {
+		return "", nil, fmt.Errorf("%w: malformed key id in encrypted payload", secrets.ErrInvalidPayloadFormat)
+	}
+
+	return keyId, payload[endOfKey+1:], nil
+}
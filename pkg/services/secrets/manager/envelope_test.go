@@ -0,0 +1,211 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestDecodeEnvelope(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		blob := encodeEnvelope("key-id", []byte("ciphertext"))
+
+		keyId, ciphertext, err := decodeEnvelope(blob)
+		require.NoError(t, err)
+		assert.Equal(t, "key-id", keyId)
+		assert.Equal(t, []byte("ciphertext"), ciphertext)
+	})
+
+	t.Run("empty ciphertext", func(t *testing.T) {
+		keyId, ciphertext, err := decodeEnvelope(encodeEnvelope("key-id", nil))
+		require.NoError(t, err)
+		assert.Equal(t, "key-id", keyId)
+		assert.Empty(t, ciphertext)
+	})
+
+	tcs := map[string][]byte{
+		"empty payload":           {},
+		"legacy payload":          []byte("ciphertext"),
+		"only delimiter":          []byte("#"),
+		"missing end delimiter":   []byte("#a2V5LWlk"),
+		"empty key id":            []byte("##ciphertext"),
+		"invalid base64 key id":   []byte("#!!!#ciphertext"),
+		"truncated base64 key id": []byte("#a#ciphertext"),
+	}
+
+	for name, payload := range tcs {
+		t.Run(name+" should fail", func(t *testing.T) {
+			_, _, err := decodeEnvelope(payload)
+			assert.Error(t, err)
+		})
+	}
+
+	malformed := map[string]string{
+		"garbage key id":       "\x00\xff\x13\x37\xc3\x28",
+		"key id with spaces":   "key id",
+		"key id with newlines": "key-id\n",
+		"too long key id":      strings.Repeat("a", maxDataKeyIdLength+1),
+	}
+
+	for name, keyId := range malformed {
+		t.Run(name+" should fail", func(t *testing.T) {
+			_, _, err := decodeEnvelope(encodeEnvelope(keyId, []byte("ciphertext")))
+			assert.ErrorIs(t, err, secrets.ErrInvalidPayloadFormat)
+		})
+	}
+
+	t.Run("custom key ids should be accepted", func(t *testing.T) {
+		for _, keyId := range []string{"secretKey-1700000000-abcdef", "awskms.v1/key:1", "ключ-1", "a.escrow.0"} {
+			id, _, err := decodeEnvelope(encodeEnvelope(keyId, []byte("ciphertext")))
+			require.NoError(t, err, keyId)
+			assert.Equal(t, keyId, id)
+		}
+	})
+
+	t.Run("longest key id should be accepted", func(t *testing.T) {
+		keyId := strings.Repeat("a", maxDataKeyIdLength)
+		id, _, err := decodeEnvelope(encodeEnvelope(keyId, []byte("ciphertext")))
+		require.NoError(t, err)
+		assert.Equal(t, keyId, id)
+	})
+
+	t.Run("key ids should not be overwritten by later decodings", func(t *testing.T) {
+		first, _, err := decodeEnvelope(encodeEnvelope("first-key-id", []byte("ciphertext")))
+		require.NoError(t, err)
+
+		_, _, err = decodeEnvelope(encodeEnvelope("other-key-id", []byte("ciphertext")))
+		require.NoError(t, err)
+		assert.Equal(t, "first-key-id", first)
+	})
+}
+
+func TestClassifyPayload(t *testing.T) {
+	legacy := []byte{122, 56, 53, 113, 101, 117, 73, 89, 20, 254, 36, 112, 112, 16, 128, 232, 227, 52, 166, 108, 192, 5, 28, 125, 126, 42, 197, 190, 251, 36, 94}
+
+	tcs := map[string]struct {
+		payload  []byte
+		expected PayloadKind
+	}{
+		"empty payload": {
+			payload:  nil,
+			expected: PayloadKindUnknown,
+		},
+		"legacy payload": {
+			payload:  legacy,
+			expected: PayloadKindLegacy,
+		},
+		"legacy payload with algorithm prefix": {
+			payload:  append([]byte("*YWVzLWNmYg*"), legacy...),
+			expected: PayloadKindLegacy,
+		},
+		"legacy payload with malformed algorithm prefix": {
+			payload:  append([]byte("*YWVz#LWNmYg*"), legacy...),
+			expected: PayloadKindUnknown,
+		},
+		"legacy payload with unterminated algorithm prefix": {
+			payload:  append([]byte("*YWVzLWNmYg"), legacy...),
+			expected: PayloadKindUnknown,
+		},
+		"payload without alphanumeric salt": {
+			payload:  append([]byte{0xff}, legacy[1:]...),
+			expected: PayloadKindUnknown,
+		},
+		"too short legacy payload": {
+			payload:  legacy[:legacyPayloadMinLength-1],
+			expected: PayloadKindUnknown,
+		},
+		"envelope payload": {
+			payload:  encodeEnvelope("key-id", legacy),
+			expected: PayloadKindEnvelope,
+		},
+		"envelope payload without ciphertext": {
+			payload:  encodeEnvelope("key-id", nil),
+			expected: PayloadKindUnknown,
+		},
+		"legacy payload starting with the key id delimiter": {
+			payload:  append([]byte{keyIdDelimiter}, legacy[1:]...),
+			expected: PayloadKindUnknown,
+		},
+		"only the key id delimiter": {
+			payload:  []byte{keyIdDelimiter},
+			expected: PayloadKindUnknown,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, ClassifyPayload(tc.payload))
+		})
+	}
+}
+
+func FuzzDecodeEnvelope(f *testing.F) {
+	seeds := [][]byte{
+		{},
+		{keyIdDelimiter},
+		{keyIdDelimiter, keyIdDelimiter},
+		{keyIdDelimiter, keyIdDelimiter, keyIdDelimiter},
+		[]byte("#a#"),
+		[]byte("#a2V5LWlk"),
+		[]byte("#a2V5LWlk#"),
+		[]byte("#a2V5LWlk#ciphertext"),
+		[]byte("#a2V5LWlk==#ciphertext"),
+		[]byte("#\x00\xff#\x00"),
+		encodeEnvelope("key-id", []byte("ciphertext")),
+		encodeEnvelope("", nil),
+	}
+
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		keyId, ciphertext, err := decodeEnvelope(payload)
+		if err != nil {
+			return
+		}
+
+		// Any successfully decoded payload must have a key id, and
+		// re-encoding it must produce an equivalent envelope.
+		require.NotEmpty(t, keyId)
+		require.True(t, bytes.HasSuffix(payload, ciphertext))
+
+		reKeyId, reCiphertext, err := decodeEnvelope(encodeEnvelope(keyId, ciphertext))
+		require.NoError(t, err)
+		assert.Equal(t, keyId, reKeyId)
+		assert.Equal(t, ciphertext, reCiphertext)
+	})
+}
+
+func TestCheckFormatVersion(t *testing.T) {
+	for _, ciphertext := range []string{"", "aSalt123", "Zsalt", "0salt", "*aes-gcm*"} {
+		assert.NoError(t, checkFormatVersion([]byte(ciphertext)), ciphertext)
+	}
+
+	for _, ciphertext := range []string{"%v2", "~", "\x00", "\xff"} {
+		err := checkFormatVersion([]byte(ciphertext))
+		require.ErrorIs(t, err, secrets.ErrUnsupportedFormatVersion, ciphertext)
+	}
+
+	t.Run("payloads of unsupported versions should fail to decrypt", func(t *testing.T) {
+		ctx := context.Background()
+		svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		keyId, ciphertext, err := decodeEnvelope(encrypted)
+		require.NoError(t, err)
+
+		_, err = svc.Decrypt(ctx, encodeEnvelope(keyId, append([]byte("%"), ciphertext...)))
+		require.ErrorIs(t, err, secrets.ErrUnsupportedFormatVersion)
+		assert.Contains(t, err.Error(), "'%'")
+	})
+}
@@ -0,0 +1,188 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/kmsproviders"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// EncryptWithEscrow works like Encrypt, but the data key used to encrypt the payload is also
+// encrypted by each of the given escrow providers, and those escrow copies are stored along
+// with the data key. So, the payload can still be decrypted with any of the escrow copies if
+// the data key cannot be decrypted anymore (e.g. break-glass scenarios where the current
+// encryption provider is lost).
+//
+// Security implications: anyone with access to ANY of the escrow providers (and the database)
+// is able to decrypt the payload, so escrow providers must be, at least, as well protected as
+// the current encryption provider. Escrow copies are never re-encrypted by ReEncryptDataKeys.
+//
+// Payloads encrypted with escrow use dedicated data keys, different from the ones used by
+// Encrypt for the same scope, so escrow is only applied to the payloads that opt in for it.
+func (s *SecretsService) EncryptWithEscrow(
+	ctx context.Context,
+	payload []byte,
+	opt secrets.EncryptionOptions,
+	escrow ...secrets.ProviderID,
+) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.EncryptWithEscrow")
+	defer span.End()
+
+	if s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
+		return nil, fmt.Errorf("encryption with escrow requires envelope encryption to be enabled")
+	}
+
+	if len(escrow) == 0 {
+		return nil, fmt.Errorf("at least one escrow provider is required")
+	}
+
+	normalized := make([]secrets.ProviderID, 0, len(escrow))
+	for _, id := range escrow {
+		id = kmsproviders.NormalizeProviderID(id)
+		if _, exists := s.providers[id]; !exists {
+			return nil, fmt.Errorf("could not find escrow encryption provider '%s'", id)
+		}
+		normalized = append(normalized, id)
+	}
+
+	sort.Slice(normalized, func(i, j int) bool { return normalized[i] < normalized[j] })
+
+	return s.encrypt(ctx, payload, opt(), encryptOptions{escrow: normalized})
+}
+
+// escrowLabelSuffix returns the suffix added to the label of the data keys
+// with escrow copies, so there's a different data key for each set of
+// escrow providers. It returns an empty string if there are no escrow providers.
+func escrowLabelSuffix(escrow []secrets.ProviderID) string {
+	if len(escrow) == 0 {
+		return ""
+	}
+
+	ids := make([]string, 0, len(escrow))
+	for _, id := range escrow {
+		ids = append(ids, string(id))
+	}
+
+	return secrets.EscrowLabelSeparator + strings.Join(ids, ",")
+}
+
+// storeEscrowDataKeys encrypts the given data key with each of the escrow providers,
+// and stores the resulting escrow copies. See secrets.EscrowDataKeyId.
+func (s *SecretsService) storeEscrowDataKeys(ctx context.Context, id string, dataKey []byte, scope string, generation int64, escrow []secrets.ProviderID) error {
+	for n, providerID := range escrow {
+		provider, exists := s.providers[providerID]
+		if !exists {
+			return fmt.Errorf("could not find escrow encryption provider '%s'", providerID)
+		}
+
+		encrypted, err := s.providerEncrypt(ctx, providerID, provider, dataKey)
+		if err != nil {
+			return err
+		}
+
+		escrowId := secrets.EscrowDataKeyId(id, n)
+		if len(escrowId) > maxDataKeyIdLength {
+			return fmt.Errorf("invalid escrow data key id '%s': must be at most %d characters long", escrowId, maxDataKeyIdLength)
+		}
+
+		if err := s.store.CreateDataKey(ctx, &secrets.DataKey{
+			Active:        true,
+			Id:            escrowId,
+			Provider:      providerID,
+			EncryptedData: encrypted,
+			Label:         escrowId,
+			Scope:         scope,
+			Generation:    generation,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// escrowDataKeyById tries to get the data key with the given id from
+// any of its escrow copies, in order, until one of them succeeds.
+func (s *SecretsService) escrowDataKeyById(
+	ctx context.Context,
+	id string,
+	dataKeyById func(ctx context.Context, id string) (*dataKeyCacheEntry, error),
+) (*dataKeyCacheEntry, error) {
+	for n := 0; ; n++ {
+		escrowId := secrets.EscrowDataKeyId(id, n)
+
+		entry, err := dataKeyById(ctx, escrowId)
+		if err == nil {
+			s.log.Warn("Data key decrypted from escrow copy", "id", id, "escrow_id", escrowId)
+			return entry, nil
+		}
+
+		if errors.Is(err, secrets.ErrDataKeyNotFound) {
+			return nil, err
+		}
+
+		s.log.Debug("Failed to get data key from escrow copy", "id", id, "escrow_id", escrowId, "error", err)
+	}
+}
+
+// ProvidersForKey returns the configured encryption providers that could decrypt the data
+// key with the given id: its own provider, followed by the providers of its escrow copies,
+// if any, in the order they're tried by Decrypt. Providers that aren't configured are left
+// out, so an empty result means the data key cannot be decrypted by this instance. It's
+// meant to tell whether a provider can be safely removed from configuration.
+//
+// Only data keys metadata is read, data keys are never decrypted.
+func (s *SecretsService) ProvidersForKey(ctx context.Context, keyId string) ([]secrets.ProviderID, error) {
+	var (
+		result []secrets.ProviderID
+		found  bool
+	)
+
+	add := func(dataKey *secrets.DataKey) {
+		found = true
+
+		id := kmsproviders.NormalizeProviderID(dataKey.Provider)
+		if _, exists := s.providers[id]; !exists {
+			return
+		}
+
+		for _, existing := range result {
+			if existing == id {
+				return
+			}
+		}
+		result = append(result, id)
+	}
+
+	dataKey, err := s.store.GetDataKey(ctx, keyId)
+	switch {
+	case err == nil:
+		add(dataKey)
+	case !errors.Is(err, secrets.ErrDataKeyNotFound):
+		return nil, err
+	}
+
+	if !secrets.IsEscrowDataKeyId(keyId) {
+		for n := 0; ; n++ {
+			escrowCopy, err := s.store.GetDataKey(ctx, secrets.EscrowDataKeyId(keyId, n))
+			if errors.Is(err, secrets.ErrDataKeyNotFound) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			add(escrowCopy)
+		}
+	}
+
+	if !found {
+		return nil, secrets.ErrDataKeyNotFound
+	}
+
+	return result, nil
+}
@@ -0,0 +1,120 @@
+package manager
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// expiringMarker flags the ciphertext of the payloads encrypted with EncryptWithExpiry, right
+// after the envelope prefix, like deterministicMarker does for deterministic payloads.
+const expiringMarker = '!'
+
+const (
+	expiryLength = 8
+	// expiringOverhead is the length added to the payloads encrypted with expiry:
+	// the marker, the expiry, the GCM nonce and the GCM tag.
+	expiringOverhead = 1 + expiryLength + 12 + 16
+)
+
+var errExpiringAuthentication = errors.New("expiring payload authentication failed")
+
+// EncryptWithExpiry works like Encrypt, but Decrypt refuses to decrypt the resulting payload
+// after the given time, failing with secrets.ErrPayloadExpired instead. It's meant for ephemeral
+// secrets (e.g. temporary tokens) that must not be usable anymore, even if not deleted.
+//
+// The expiry is stored in clear in the payload, but it's authenticated: the payload is encrypted
+// with AES-256-GCM, with a key derived from the data key and the expiry as additional data, so
+// it cannot be stripped or altered without decryption failing. Note the expiry is checked against
+// the clock of the instance decrypting the payload.
+func (s *SecretsService) EncryptWithExpiry(ctx context.Context, payload []byte, expireAt time.Time, opt secrets.EncryptionOptions) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.EncryptWithExpiry")
+	defer span.End()
+
+	if s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
+		return nil, fmt.Errorf("encryption with expiry requires envelope encryption to be enabled")
+	}
+
+	if expireAt.IsZero() {
+		return nil, fmt.Errorf("expiry is required")
+	}
+
+	if err := s.requireBuiltinEncryption("encryption with expiry"); err != nil {
+		return nil, err
+	}
+
+	return s.encrypt(ctx, payload, opt(), encryptOptions{expireAt: expireAt})
+}
+
+// expiringAEAD returns the AEAD used to encrypt payloads with expiry with the given data key.
+func expiringAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(dataKey, "grafana-expiring-encryption"))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// appendExpiring appends the given plaintext, encrypted with the given
+// data key and expiry, to the given buffer, as follows:
+//
+//	!<expiry><nonce><ciphertext and tag>
+//
+// Where the expiry is the big-endian Unix time, in seconds.
+func appendExpiring(dst []byte, dataKey []byte, plaintext []byte, expireAt time.Time) ([]byte, error) {
+	aead, err := expiringAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dst = append(dst, expiringMarker)
+	n := len(dst)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(expireAt.Unix()))
+	expiry := dst[n:]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+
+	return aead.Seal(dst, nonce, plaintext, expiry), nil
+}
+
+// openExpiring is the inverse of appendExpiring, for the given ciphertext without the
+// expiring marker. The expiry is only checked once the payload has been authenticated.
+func openExpiring(dataKey []byte, ciphertext []byte) ([]byte, error) {
+	aead, err := expiringAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < expiryLength+aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("expiring payload too short")
+	}
+
+	expiry := ciphertext[:expiryLength]
+	nonce := ciphertext[expiryLength : expiryLength+aead.NonceSize()]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext[expiryLength+aead.NonceSize():], expiry)
+	if err != nil {
+		return nil, errExpiringAuthentication
+	}
+
+	expireAt := time.Unix(int64(binary.BigEndian.Uint64(expiry)), 0)
+	if !now().Before(expireAt) {
+		return nil, fmt.Errorf("%w at %s", secrets.ErrPayloadExpired, expireAt.UTC().Format(time.RFC3339))
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,71 @@
+package manager
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_EncryptWithExpiry(t *testing.T) {
+	restoreTimeNowAfterTestExec(t)
+
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	expireAt := time.Now().Add(time.Hour)
+	encrypted, err := svc.EncryptWithExpiry(ctx, []byte("grafana"), expireAt, secrets.WithoutScope())
+	require.NoError(t, err)
+
+	t.Run("payloads should be decrypted before their expiry", func(t *testing.T) {
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("payloads should not be decrypted after their expiry", func(t *testing.T) {
+		now = func() time.Time { return expireAt.Add(time.Second) }
+		t.Cleanup(func() { now = time.Now })
+
+		_, err := svc.Decrypt(ctx, encrypted)
+		assert.ErrorIs(t, err, secrets.ErrPayloadExpired)
+	})
+
+	t.Run("altered expiry should fail authentication", func(t *testing.T) {
+		keyId, ciphertext, err := decodeEnvelope(encrypted)
+		require.NoError(t, err)
+
+		altered := append([]byte{}, ciphertext...)
+		binary.BigEndian.PutUint64(altered[1:], uint64(expireAt.Add(24*time.Hour).Unix()))
+
+		_, err = svc.Decrypt(ctx, encodeEnvelope(keyId, altered))
+		assert.ErrorIs(t, err, errExpiringAuthentication)
+	})
+
+	t.Run("stripped expiry should not decrypt the payload", func(t *testing.T) {
+		keyId, ciphertext, err := decodeEnvelope(encrypted)
+		require.NoError(t, err)
+
+		decrypted, _ := svc.Decrypt(ctx, encodeEnvelope(keyId, ciphertext[1+expiryLength:]))
+		assert.NotEqual(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("truncated payloads should fail", func(t *testing.T) {
+		keyId, _, err := decodeEnvelope(encrypted)
+		require.NoError(t, err)
+
+		_, err = svc.Decrypt(ctx, encodeEnvelope(keyId, []byte{expiringMarker, 0, 1}))
+		assert.Error(t, err)
+	})
+
+	t.Run("zero expiry should be rejected", func(t *testing.T) {
+		_, err := svc.EncryptWithExpiry(ctx, []byte("grafana"), time.Time{}, secrets.WithoutScope())
+		assert.Error(t, err)
+	})
+}
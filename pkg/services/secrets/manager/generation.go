@@ -0,0 +1,51 @@
+package manager
+
+import (
+	"context"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// CurrentGeneration returns the generation of the current data keys, i.e. the amount of data keys
+// rotations done so far, as recorded in the store. It only ever increases: each rotation increments
+// it, so nodes can compare the generation of the data keys they use against it to tell whether
+// they're behind (e.g. they missed a rotation done by another node) and must refresh them.
+func (s *SecretsService) CurrentGeneration(ctx context.Context) (int64, error) {
+	generation, disabled, err := s.store.GetLatestGeneration(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// See dataKeysGeneration.
+	if disabled {
+		return generation + 1, nil
+	}
+
+	return generation, nil
+}
+
+// dataKeysGeneration returns the current generation, given all the stored data keys. It's the
+// highest generation of any data key, unless all the data keys of that generation are disabled:
+// as that's what a rotation does, the next generation has started then, even if no data key of
+// it has been created yet. Rotations with overlap create the next generation data keys upfront.
+func dataKeysGeneration(dataKeys []*secrets.DataKey) int64 {
+	var (
+		generation int64
+		active     bool
+	)
+
+	for _, dataKey := range dataKeys {
+		switch {
+		case dataKey.Generation > generation:
+			generation, active = dataKey.Generation, dataKey.Active
+		case dataKey.Generation == generation:
+			active = active || dataKey.Active
+		}
+	}
+
+	if len(dataKeys) > 0 && !active {
+		return generation + 1
+	}
+
+	return generation
+}
@@ -0,0 +1,104 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/db"
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/database"
+)
+
+func TestDataKeysGeneration(t *testing.T) {
+	tcs := map[string]struct {
+		dataKeys []*secrets.DataKey
+		expected int64
+	}{
+		"no data keys": {
+			expected: 0,
+		},
+		"active data keys": {
+			dataKeys: []*secrets.DataKey{{Generation: 1}, {Generation: 2, Active: true}},
+			expected: 2,
+		},
+		"partially disabled generation": {
+			dataKeys: []*secrets.DataKey{{Generation: 2}, {Generation: 2, Active: true}},
+			expected: 2,
+		},
+		"fully disabled generation": {
+			dataKeys: []*secrets.DataKey{{Generation: 1, Active: true}, {Generation: 2}, {Generation: 2}},
+			expected: 3,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, dataKeysGeneration(tc.dataKeys))
+		})
+	}
+}
+
+func TestSecretsService_CurrentGeneration(t *testing.T) {
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	svc := SetupTestService(t, database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB)))
+
+	generation := func(t *testing.T) int64 {
+		t.Helper()
+		generation, err := svc.CurrentGeneration(ctx)
+		require.NoError(t, err)
+		return generation
+	}
+
+	dataKeyGeneration := func(t *testing.T) int64 {
+		t.Helper()
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		keyId, _, err := decodeEnvelope(encrypted)
+		require.NoError(t, err)
+
+		dataKey, err := svc.store.GetDataKey(ctx, keyId)
+		require.NoError(t, err)
+		return dataKey.Generation
+	}
+
+	require.Zero(t, generation(t))
+	require.Zero(t, dataKeyGeneration(t))
+
+	t.Run("rotations should increment the generation", func(t *testing.T) {
+		require.NoError(t, svc.RotateDataKeys(ctx))
+		assert.Equal(t, int64(1), generation(t))
+		assert.Equal(t, int64(1), dataKeyGeneration(t))
+
+		require.NoError(t, svc.RotateDataKeys(ctx))
+		assert.Equal(t, int64(2), generation(t))
+		assert.Equal(t, int64(2), dataKeyGeneration(t))
+	})
+
+	t.Run("rotations with overlap should increment the generation", func(t *testing.T) {
+		svc.rotationOverlap = time.Hour
+		t.Cleanup(func() { svc.rotationOverlap = 0 })
+
+		require.NoError(t, svc.RotateDataKeys(ctx))
+		assert.Equal(t, int64(3), generation(t))
+
+		// The superseded data keys are still active during the overlap.
+		dataKeys, err := svc.store.GetAllDataKeys(ctx)
+		require.NoError(t, err)
+
+		active := make(map[int64]int)
+		for _, dataKey := range dataKeys {
+			if dataKey.Active {
+				active[dataKey.Generation]++
+			}
+		}
+		assert.Equal(t, map[int64]int{2: 1, 3: 1}, active)
+	})
+}
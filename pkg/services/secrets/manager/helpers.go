@@ -13,6 +13,7 @@ import (
 	"github.com/grafana/grafana/pkg/services/featuremgmt"
 	"github.com/grafana/grafana/pkg/services/kmsproviders/osskmsproviders"
 	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/supportbundles/supportbundlestest"
 	"github.com/grafana/grafana/pkg/setting"
 )
 
@@ -52,6 +53,7 @@ func setupTestService(tb testing.TB, store secrets.Store, features featuremgmt.F
 		cfg,
 		features,
 		&usagestats.UsageStatsMock{T: tb},
+		supportbundlestest.NewFakeBundleService(),
 	)
 	require.NoError(tb, err)
 
@@ -0,0 +1,119 @@
+package manager
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/grafana/pkg/apimachinery/identity"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// KeyOperation is a data keys lifecycle operation recorded by the key audit sink.
+type KeyOperation string
+
+const (
+	KeyOperationCreate         KeyOperation = "create"
+	KeyOperationRotate         KeyOperation = "rotate"
+	KeyOperationDisable        KeyOperation = "disable"
+	KeyOperationReEncrypt      KeyOperation = "re-encrypt"
+	KeyOperationProviderSwitch KeyOperation = "provider-switch"
+)
+
+// keyOperationSystemActor is the actor of the key operations done without any requester
+// in context, e.g. those triggered by the service itself (automatic rotations, startup).
+const keyOperationSystemActor = "system"
+
+// KeyOperationEvent describes a data keys lifecycle operation. It never holds any
+// key material, neither decrypted nor encrypted, only data keys metadata.
+type KeyOperationEvent struct {
+	Operation KeyOperation
+	Time      time.Time
+	// Actor is the identifier of the requester that triggered the operation,
+	// or "system" if it wasn't triggered on behalf of any requester.
+	Actor string
+
+	// DataKeyId, Label and Scope identify the affected data key, if it's a single one.
+	DataKeyId string
+	Label     string
+	Scope     string
+
+	// Provider is the encryption provider the affected data keys are encrypted with, after the
+	// operation. PreviousProvider is only set for provider switches, to the provider used before.
+	Provider         secrets.ProviderID
+	PreviousProvider secrets.ProviderID
+
+	// DataKeys is the amount of data keys affected by rotations and re-encryptions.
+	DataKeys int
+}
+
+// KeyAuditSink records the data keys lifecycle operations, e.g. into an append-only audit log for
+// compliance. It's called synchronously, once the operation has succeeded, so implementations
+// should be fast. Failures to record an operation are logged, but don't fail the operation.
+type KeyAuditSink interface {
+	RecordKeyOperation(ctx context.Context, event KeyOperationEvent) error
+}
+
+// SetKeyAuditSink replaces the sink where the data keys lifecycle operations are recorded,
+// which defaults to none. The provider switch detected on startup, if any, is recorded
+// into the given sink right away, as it happens before any sink can be set.
+func (s *SecretsService) SetKeyAuditSink(ctx context.Context, sink KeyAuditSink) {
+	s.callbacksMtx.Lock()
+	s.keyAuditSink = sink
+	pending := s.startupKeyOperations
+	s.startupKeyOperations = nil
+	s.callbacksMtx.Unlock()
+
+	for _, event := range pending {
+		s.recordToKeyAuditSink(ctx, sink, event)
+	}
+}
+
+// hasKeyAuditSink reports whether there's a key audit sink set, so the
+// data keys operations summaries are only computed when needed.
+func (s *SecretsService) hasKeyAuditSink() bool {
+	s.callbacksMtx.RLock()
+	defer s.callbacksMtx.RUnlock()
+
+	return s.keyAuditSink != nil
+}
+
+// recordKeyOperation records the given operation, done on behalf of the
+// given context, into the key audit sink, if any.
+func (s *SecretsService) recordKeyOperation(ctx context.Context, event KeyOperationEvent) {
+	s.callbacksMtx.RLock()
+	sink := s.keyAuditSink
+	s.callbacksMtx.RUnlock()
+
+	if sink == nil {
+		return
+	}
+
+	s.recordToKeyAuditSink(ctx, sink, newKeyOperationEvent(ctx, event))
+}
+
+// recordStartupKeyOperation keeps the given operation, done on startup, until
+// a key audit sink is set. See SetKeyAuditSink.
+func (s *SecretsService) recordStartupKeyOperation(ctx context.Context, event KeyOperationEvent) {
+	s.callbacksMtx.Lock()
+	defer s.callbacksMtx.Unlock()
+
+	s.startupKeyOperations = append(s.startupKeyOperations, newKeyOperationEvent(ctx, event))
+}
+
+func (s *SecretsService) recordToKeyAuditSink(ctx context.Context, sink KeyAuditSink, event KeyOperationEvent) {
+	if err := sink.RecordKeyOperation(ctx, event); err != nil {
+		keyAuditFailuresCounter.Inc()
+		s.ctxLogger(ctx).Error("Failed to record data keys operation", "operation", event.Operation, "id", event.DataKeyId, "error", err)
+	}
+}
+
+// newKeyOperationEvent returns the given event, with its time and actor set.
+func newKeyOperationEvent(ctx context.Context, event KeyOperationEvent) KeyOperationEvent {
+	event.Time = now().UTC()
+	event.Actor = keyOperationSystemActor
+	if requester, err := identity.GetRequester(ctx); err == nil {
+		event.Actor = requester.GetID().String()
+	}
+
+	return event
+}
@@ -0,0 +1,132 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/apimachinery/identity"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+type recordingKeyAuditSink struct {
+	mtx    sync.Mutex
+	events []KeyOperationEvent
+	err    error
+}
+
+func (s *recordingKeyAuditSink) RecordKeyOperation(_ context.Context, event KeyOperationEvent) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.events = append(s.events, event)
+	return s.err
+}
+
+func (s *recordingKeyAuditSink) operations() []KeyOperation {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ops := make([]KeyOperation, 0, len(s.events))
+	for _, event := range s.events {
+		ops = append(ops, event.Operation)
+	}
+	return ops
+}
+
+func TestSecretsService_KeyAuditSink(t *testing.T) {
+	ctx := identity.WithRequester(context.Background(), &identity.StaticRequester{
+		Namespace: identity.NamespaceUser,
+		UserID:    10,
+		OrgID:     2,
+		Login:     "admin",
+	})
+
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+	sink := &recordingKeyAuditSink{}
+	svc.SetKeyAuditSink(ctx, sink)
+
+	_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+	require.NoError(t, svc.RotateDataKeys(context.Background()))
+	require.NoError(t, svc.ReEncryptDataKeys(ctx))
+
+	// The rotation creates the new data key before disabling the previous one.
+	require.Equal(t, []KeyOperation{KeyOperationCreate, KeyOperationCreate, KeyOperationRotate, KeyOperationReEncrypt}, sink.operations())
+
+	t.Run("data key creation should be recorded with its metadata and actor", func(t *testing.T) {
+		created := sink.events[0]
+		assert.Equal(t, "user:10", created.Actor)
+		assert.NotEmpty(t, created.DataKeyId)
+		assert.Equal(t, "root", created.Scope)
+		assert.Equal(t, svc.currentProviderID, created.Provider)
+		assert.WithinDuration(t, time.Now(), created.Time, time.Minute)
+	})
+
+	t.Run("operations without requester should be recorded as done by the system", func(t *testing.T) {
+		rotated := sink.events[2]
+		assert.Equal(t, keyOperationSystemActor, rotated.Actor)
+		assert.Equal(t, 1, rotated.DataKeys)
+	})
+
+	t.Run("re-encryption should be recorded with the provider used", func(t *testing.T) {
+		reEncrypted := sink.events[3]
+		assert.Equal(t, svc.currentProviderID, reEncrypted.Provider)
+		assert.Equal(t, 2, reEncrypted.DataKeys)
+	})
+
+	t.Run("failures to record should not fail the operation", func(t *testing.T) {
+		sink.err = errors.New("audit log unavailable")
+		before := testutil.ToFloat64(keyAuditFailuresCounter)
+
+		// Both the creation of the new data key and the rotation itself fail to be recorded.
+		require.NoError(t, svc.RotateDataKeys(ctx))
+		assert.Equal(t, before+2, testutil.ToFloat64(keyAuditFailuresCounter))
+	})
+}
+
+func TestSecretsService_KeyAuditSinkProviderSwitch(t *testing.T) {
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+
+	require.NoError(t, store.CreateDataKey(ctx, &secrets.DataKey{
+		Active:   true,
+		Id:       "old",
+		Label:    "old",
+		Scope:    "root",
+		Provider: "previous.v1",
+		Created:  time.Now(),
+	}))
+
+	// Detected on startup, before any sink is set.
+	require.NoError(t, svc.checkProviderChange(ctx, false))
+
+	sink := &recordingKeyAuditSink{}
+	svc.SetKeyAuditSink(ctx, sink)
+
+	require.Len(t, sink.events, 1)
+	assert.Equal(t, KeyOperationProviderSwitch, sink.events[0].Operation)
+	assert.Equal(t, secrets.ProviderID("previous.v1"), sink.events[0].PreviousProvider)
+	assert.Equal(t, svc.currentProviderID, sink.events[0].Provider)
+
+	// Recorded only once.
+	svc.SetKeyAuditSink(ctx, sink)
+	assert.Len(t, sink.events, 1)
+}
+
+func TestKeyOperationEvent_NoKeyMaterial(t *testing.T) {
+	typ := reflect.TypeOf(KeyOperationEvent{})
+	for i := 0; i < typ.NumField(); i++ {
+		assert.NotEqual(t, reflect.Slice, typ.Field(i).Type.Kind(), "field %s may hold key material", typ.Field(i).Name)
+	}
+}
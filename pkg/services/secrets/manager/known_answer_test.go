@@ -0,0 +1,144 @@
+package manager
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/kmsproviders"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+// Known-answer vectors, encrypted once with the data key and the secret key below. They must keep
+// decrypting to the plaintext below: if any of these tests fails, stored secrets would be broken.
+const (
+	katDataKey   = "0123456789abcdef"
+	katDataKeyId = "kat-key"
+	katSecretKey = "SdlklWklckeLS"
+	katPlaintext = "grafana"
+)
+
+var katVectors = []struct {
+	name   string
+	legacy bool
+	// ciphertext is hex-encoded, without the envelope prefix.
+	ciphertext string
+	// deterministic is whether encrypting the plaintext again must produce the same ciphertext.
+	deterministic bool
+}{
+	{
+		name:       "legacy",
+		legacy:     true,
+		ciphertext: "2a5957567a4c574e6d59672a503930537a4e5132a702a551e88edf07612f4e6e4b2fc99763fddb92749f53",
+	},
+	{
+		name:       "envelope",
+		ciphertext: "2a5957567a4c574e6d59672a737532504a4a6b318f95f86b956a3527abf74d163c4fe84058e117987f0293",
+	},
+	{
+		name:          "envelope deterministic",
+		ciphertext:    "24914a5864542942065149b4fcfdec0f0086401c444225e7",
+		deterministic: true,
+	},
+	{
+		name:       "envelope with expiry",
+		ciphertext: "2100000001b09e190035a624ea644961555c073be9b65220148d404016e624f5eebe163a76d6dca428aeee18",
+	},
+	{
+		name:       "envelope with key commitment",
+		ciphertext: "5e53193f79090e87411b01b36a77f2f9d22cd6c62728a6be8d67a3829d13520fb2013ef3efcb86bba1ec306000554c8211dbef014c03316ba2f3440417b553baf71339d8",
+	},
+}
+
+// setupKnownAnswerTestService returns a service with the known-answer data key stored.
+func setupKnownAnswerTestService(t *testing.T) *SecretsService {
+	t.Helper()
+
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+	require.Equal(t, katSecretKey, svc.cfg.SectionWithEnvOverrides("security").Key("secret_key").Value())
+
+	encrypted, err := svc.providers[kmsproviders.Default].Encrypt(ctx, []byte(katDataKey))
+	require.NoError(t, err)
+	require.NoError(t, store.CreateDataKey(ctx, &secrets.DataKey{
+		Active:        true,
+		Id:            katDataKeyId,
+		Label:         katDataKeyId,
+		Scope:         "root",
+		Provider:      kmsproviders.Default,
+		EncryptedData: encrypted,
+	}))
+
+	return svc
+}
+
+func TestSecretsService_KnownAnswers(t *testing.T) {
+	ctx := context.Background()
+	svc := setupKnownAnswerTestService(t)
+
+	t.Run("envelope prefix", func(t *testing.T) {
+		assert.Equal(t, "#a2F0LWtleQ#ciphertext", string(encodeEnvelope(katDataKeyId, []byte("ciphertext"))))
+	})
+
+	for _, vector := range katVectors {
+		t.Run(vector.name, func(t *testing.T) {
+			ciphertext, err := hex.DecodeString(vector.ciphertext)
+			require.NoError(t, err)
+
+			payload := ciphertext
+			if !vector.legacy {
+				payload = encodeEnvelope(katDataKeyId, ciphertext)
+			}
+
+			decrypted, err := svc.Decrypt(ctx, payload)
+			require.NoError(t, err)
+			assert.Equal(t, katPlaintext, string(decrypted))
+
+			if vector.deterministic {
+				encrypted, err := appendDeterministic(nil, []byte(katDataKey), []byte(katPlaintext))
+				require.NoError(t, err)
+				assert.Equal(t, vector.ciphertext, hex.EncodeToString(encrypted))
+			}
+		})
+	}
+}
+
+func TestSecretsService_FormatsRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	svc := setupKnownAnswerTestService(t)
+
+	encrypters := map[string]func() ([]byte, error){
+		"envelope": func() ([]byte, error) {
+			return svc.Encrypt(ctx, []byte(katPlaintext), secrets.WithoutScope())
+		},
+		"envelope deterministic": func() ([]byte, error) {
+			return svc.EncryptDeterministic(ctx, []byte(katPlaintext), secrets.WithoutScope())
+		},
+		"envelope with expiry": func() ([]byte, error) {
+			return svc.EncryptWithExpiry(ctx, []byte(katPlaintext), time.Now().Add(time.Hour), secrets.WithoutScope())
+		},
+		"envelope with key commitment": func() ([]byte, error) {
+			svc.keyCommitment = true
+			defer func() { svc.keyCommitment = false }()
+			return svc.Encrypt(ctx, []byte(katPlaintext), secrets.WithoutScope())
+		},
+	}
+
+	for name, encrypt := range encrypters {
+		t.Run(name, func(t *testing.T) {
+			encrypted, err := encrypt()
+			require.NoError(t, err)
+			assert.Equal(t, PayloadKindEnvelope, ClassifyPayload(encrypted))
+
+			decrypted, err := svc.Decrypt(ctx, encrypted)
+			require.NoError(t, err)
+			assert.Equal(t, katPlaintext, string(decrypted))
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+)
+
+// defaultSecretKey is the [security] secret_key shipped in conf/defaults.ini, which is public.
+const defaultSecretKey = "SW2YcwTIb9zpOOhoPsMm"
+
+// authenticatedAlgorithmPrefix is the prefix of the payloads encrypted with AES-GCM by the builtin
+// encryption service. Unlike AES-CFB, decrypting them with a wrong secret key fails.
+var authenticatedAlgorithmPrefix = []byte(string(algorithmDelimiter) + b64.EncodeToString([]byte(encryption.AesGcm)) + string(algorithmDelimiter))
+
+var errLegacyFallbackDisabled = errors.New("failed to decrypt a legacy secret: legacy fallback is disabled")
+
+// checkLegacySecretKey warns, or fails if strict, when legacy payloads can be encrypted or decrypted
+// (i.e. envelope encryption is disabled, or the legacy fallback is enabled) but the secret key is
+// empty or the default one. With an empty one, legacy payloads cannot be decrypted, while with the
+// default one, anyone with access to the database can decrypt them.
+func (s *SecretsService) checkLegacySecretKey(envelopeEnabled bool, strict bool) error {
+	if envelopeEnabled && !s.legacyFallback {
+		return nil
+	}
+
+	var problem string
+	switch s.legacySecretKey() {
+	case "":
+		problem = "empty"
+	case defaultSecretKey:
+		problem = "the default one"
+	default:
+		return nil
+	}
+
+	if strict {
+		return fmt.Errorf("legacy secrets can be decrypted, but the secret key is %s: set [security] secret_key, or disable [security.encryption] legacy_fallback", problem)
+	}
+
+	s.log.Warn("Legacy secrets can be decrypted, but the secret key is "+problem+
+		"; set [security] secret_key, or disable [security.encryption] legacy_fallback once all secrets are envelope encrypted",
+		"envelope_encryption", envelopeEnabled)
+
+	return nil
+}
+
+// legacySecretKey returns the [security] secret_key legacy payloads are encrypted and decrypted with.
+// It's read from configuration every time, by both encryption and decryption, so a change at runtime
+// applies to both at once, and they never use different secret keys.
+func (s *SecretsService) legacySecretKey() string {
+	return s.cfg.SectionWithEnvOverrides("security").Key("secret_key").Value()
+}
+
+// legacySecretKeys returns the secret keys legacy payloads may be encrypted with, in the order they're
+// tried by decryption: the current one, the one at startup if it has changed at runtime since, so the
+// payloads encrypted before the change remain decryptable, and the previous ones (previous_secret_keys).
+func (s *SecretsService) legacySecretKeys() []string {
+	current := s.legacySecretKey()
+	secretKeys := []string{current}
+	if s.startupSecretKey != current && !slices.Contains(s.previousSecretKeys, s.startupSecretKey) {
+		secretKeys = append(secretKeys, s.startupSecretKey)
+	}
+
+	return append(secretKeys, s.previousSecretKeys...)
+}
+
+// authenticatedLegacyPayload reports whether the given legacy payload was encrypted with an
+// authenticated algorithm, so it can be tried with several secret keys. See decryptWithSecretKeys.
+func (s *SecretsService) authenticatedLegacyPayload(payload []byte) bool {
+	return s.builtinEnc && bytes.HasPrefix(payload, authenticatedAlgorithmPrefix)
+}
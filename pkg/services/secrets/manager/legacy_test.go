@@ -0,0 +1,148 @@
+package manager
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_CheckLegacySecretKey(t *testing.T) {
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+	secretKey := svc.cfg.Raw.Section("security").Key("secret_key")
+	original := secretKey.Value()
+	t.Cleanup(func() {
+		secretKey.SetValue(original)
+		svc.legacyFallback = true
+	})
+
+	t.Run("custom secret key should pass", func(t *testing.T) {
+		require.NoError(t, svc.checkLegacySecretKey(true, true))
+	})
+
+	for _, value := range []string{"", defaultSecretKey} {
+		secretKey.SetValue(value)
+
+		t.Run("missing or default secret key should fail in strict mode", func(t *testing.T) {
+			assert.Error(t, svc.checkLegacySecretKey(true, true))
+			assert.Error(t, svc.checkLegacySecretKey(false, true))
+			assert.NoError(t, svc.checkLegacySecretKey(true, false))
+		})
+
+		t.Run("missing or default secret key should pass without legacy fallback", func(t *testing.T) {
+			svc.legacyFallback = false
+			defer func() { svc.legacyFallback = true }()
+
+			assert.NoError(t, svc.checkLegacySecretKey(true, true))
+
+			// Unless envelope encryption is disabled, as then secrets are encrypted with it.
+			assert.Error(t, svc.checkLegacySecretKey(false, true))
+		})
+	}
+}
+
+func TestSecretsService_LegacyFallback(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	secretKey := svc.cfg.SectionWithEnvOverrides("security").Key("secret_key").Value()
+	legacy, err := svc.enc.Encrypt(ctx, []byte("grafana"), secretKey)
+	require.NoError(t, err)
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	_, err = svc.Decrypt(ctx, legacy)
+	require.NoError(t, err)
+
+	svc.legacyFallback = false
+
+	_, err = svc.Decrypt(ctx, legacy)
+	assert.ErrorIs(t, err, errLegacyFallbackDisabled)
+
+	_, err = svc.Decrypt(ctx, encrypted)
+	assert.NoError(t, err)
+
+	// Explicit legacy decryption isn't affected.
+	_, err = svc.DecryptLegacy(ctx, legacy, secretKey)
+	assert.NoError(t, err)
+}
+
+func TestSecretsService_LegacySecretKeyChange(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupDisabledTestService(t, fakes.NewFakeSecretsStore())
+	secretKey := svc.cfg.Raw.Section("security").Key("secret_key")
+	original := secretKey.Value()
+	t.Cleanup(func() { secretKey.SetValue(original) })
+
+	payload := []byte("pass")
+
+	t.Run("encryption and decryption should use the same secret key", func(t *testing.T) {
+		// The secret key read by decryption used to differ from the one used by encryption
+		// (setting.Cfg.SecretKey), which isn't even set when the configuration isn't loaded.
+		require.NotEqual(t, svc.cfg.SecretKey, original)
+
+		encrypted, err := svc.Encrypt(ctx, payload, secrets.WithoutScope())
+		require.NoError(t, err)
+
+		decrypted, err := svc.DecryptLegacy(ctx, encrypted, original)
+		require.NoError(t, err)
+		assert.Equal(t, payload, decrypted)
+	})
+
+	// Only payloads encrypted with an authenticated algorithm are tried with
+	// the secret key at startup once changed. See decryptWithSecretKeys.
+	before := encryptLegacyGCM(t, payload, original)
+
+	secretKey.SetValue("changed-secret-key")
+
+	t.Run("new payloads should be encrypted with the changed secret key", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, payload, secrets.WithoutScope())
+		require.NoError(t, err)
+
+		decrypted, err := svc.DecryptLegacy(ctx, encrypted, "changed-secret-key")
+		require.NoError(t, err)
+		assert.Equal(t, payload, decrypted)
+
+		decrypted, err = svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, payload, decrypted)
+	})
+
+	t.Run("payloads encrypted before the change should remain decryptable", func(t *testing.T) {
+		decrypted, err := svc.Decrypt(ctx, before)
+		require.NoError(t, err)
+		assert.Equal(t, payload, decrypted)
+	})
+}
+
+// encryptLegacyGCM encrypts the given payload with AES-GCM, like the builtin encryption service
+// would if it had a cipher for it, as only its decipher is available.
+func encryptLegacyGCM(t *testing.T, payload []byte, secret string) []byte {
+	t.Helper()
+
+	salt := "abcd1234"
+	key, err := encryption.KeyToBytes(secret, salt)
+	require.NoError(t, err)
+
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	require.NoError(t, err)
+
+	encrypted := append([]byte(salt), nonce...)
+	encrypted = gcm.Seal(encrypted, nonce, payload, nil)
+	return append(append([]byte(nil), authenticatedAlgorithmPrefix...), encrypted...)
+}
@@ -0,0 +1,98 @@
+package manager
+
+import (
+	"context"
+	"errors"
+
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+)
+
+// Results of the legacy payloads upgrades, as reported by the encryption_legacy_upgrades_total metric.
+const (
+	legacyUpgradeEnqueued = "enqueued"
+	legacyUpgradeDropped  = "dropped"
+	legacyUpgradeUpgraded = "upgraded"
+	legacyUpgradeFailed   = "failed"
+)
+
+// LegacyUpgradeCallback is called by the legacy upgrade worker with a legacy payload decrypted by
+// Decrypt, which identifies the secret, and the same secret upgraded to envelope encryption. It's
+// meant to replace the stored legacy payload by the upgraded one, if still stored.
+type LegacyUpgradeCallback func(ctx context.Context, legacy []byte, upgraded []byte) error
+
+// OnLegacyUpgrade registers a callback to persist the legacy payloads upgraded in the background.
+// If [security.encryption] legacy_upgrade_queue_size is set, the legacy payloads decrypted by Decrypt
+// are queued, then upgraded by a background worker, and passed to all the registered callbacks.
+//
+// As the same legacy payload may be decrypted, and thus upgraded, several times before the upgraded
+// payload is persisted, callbacks must only replace the stored payload if it's still the legacy one.
+func (s *SecretsService) OnLegacyUpgrade(callback LegacyUpgradeCallback) {
+	s.callbacksMtx.Lock()
+	defer s.callbacksMtx.Unlock()
+
+	s.legacyUpgradeCallbacks = append(s.legacyUpgradeCallbacks, callback)
+}
+
+// enqueueLegacyUpgrade queues the given legacy payload to be upgraded by runLegacyUpgrades. It
+// never blocks: if the queue is full, the payload is dropped, as it'll be queued again the next
+// time it's decrypted. Nothing is queued unless there's any callback to persist the upgrade.
+func (s *SecretsService) enqueueLegacyUpgrade(ctx context.Context, payload []byte) {
+	if s.legacyUpgrades == nil || s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
+		return
+	}
+
+	s.callbacksMtx.RLock()
+	registered := len(s.legacyUpgradeCallbacks) > 0
+	s.callbacksMtx.RUnlock()
+
+	if !registered {
+		return
+	}
+
+	select {
+	case s.legacyUpgrades <- append([]byte(nil), payload...):
+		legacyUpgradesCounter.WithLabelValues(legacyUpgradeEnqueued).Inc()
+	default:
+		legacyUpgradesCounter.WithLabelValues(legacyUpgradeDropped).Inc()
+	}
+}
+
+// runLegacyUpgrades upgrades the queued legacy payloads to envelope encryption, with the
+// current data key of the root scope, and passes them to the registered callbacks, until
+// the context is done. The plaintexts are scrubbed from memory as soon as re-encrypted.
+func (s *SecretsService) runLegacyUpgrades(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case legacy := <-s.legacyUpgrades:
+			if err := s.upgradeLegacy(ctx, legacy); err != nil && !errors.Is(err, context.Canceled) {
+				legacyUpgradesCounter.WithLabelValues(legacyUpgradeFailed).Inc()
+				s.log.Warn("Failed to upgrade legacy secret to envelope encryption", "error", err)
+				continue
+			}
+
+			legacyUpgradesCounter.WithLabelValues(legacyUpgradeUpgraded).Inc()
+		}
+	}
+}
+
+func (s *SecretsService) upgradeLegacy(ctx context.Context, legacy []byte) error {
+	plaintext, upgraded, changed, err := s.DecryptAndUpgrade(ctx, legacy, nil)
+	clear(plaintext)
+	if err != nil || !changed {
+		return err
+	}
+
+	s.callbacksMtx.RLock()
+	callbacks := make([]LegacyUpgradeCallback, len(s.legacyUpgradeCallbacks))
+	copy(callbacks, s.legacyUpgradeCallbacks)
+	s.callbacksMtx.RUnlock()
+
+	var errs []error
+	for _, callback := range callbacks {
+		errs = append(errs, callback(ctx, legacy, upgraded))
+	}
+
+	return errors.Join(errs...)
+}
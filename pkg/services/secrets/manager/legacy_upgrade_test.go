@@ -0,0 +1,96 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_LegacyUpgrades(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T, size int) (*SecretsService, []byte) {
+		t.Helper()
+		svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+		svc.legacyUpgrades = make(chan []byte, size)
+
+		secretKey := svc.cfg.SectionWithEnvOverrides("security").Key("secret_key").Value()
+		legacy, err := svc.enc.Encrypt(ctx, []byte("grafana"), secretKey)
+		require.NoError(t, err)
+
+		return svc, legacy
+	}
+
+	t.Run("legacy payloads decrypted should be upgraded and passed to the callbacks", func(t *testing.T) {
+		svc, legacy := setup(t, 1)
+
+		type upgrade struct{ legacy, upgraded []byte }
+		upgrades := make(chan upgrade, 1)
+		svc.OnLegacyUpgrade(func(_ context.Context, legacy []byte, upgraded []byte) error {
+			upgrades <- upgrade{legacy: legacy, upgraded: upgraded}
+			return nil
+		})
+
+		runCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go svc.runLegacyUpgrades(runCtx)
+
+		decrypted, err := svc.Decrypt(ctx, legacy)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		select {
+		case got := <-upgrades:
+			assert.Equal(t, legacy, got.legacy)
+			assert.Equal(t, PayloadKindEnvelope, ClassifyPayload(got.upgraded))
+
+			decrypted, err := svc.Decrypt(ctx, got.upgraded)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), decrypted)
+		case <-time.After(5 * time.Second):
+			t.Fatal("legacy payload not upgraded")
+		}
+	})
+
+	t.Run("payloads should not be queued without callbacks", func(t *testing.T) {
+		svc, legacy := setup(t, 1)
+
+		_, err := svc.Decrypt(ctx, legacy)
+		require.NoError(t, err)
+		assert.Empty(t, svc.legacyUpgrades)
+	})
+
+	t.Run("envelope encrypted payloads should not be queued", func(t *testing.T) {
+		svc, _ := setup(t, 1)
+		svc.OnLegacyUpgrade(func(context.Context, []byte, []byte) error { return nil })
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		_, err = svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Empty(t, svc.legacyUpgrades)
+	})
+
+	t.Run("payloads should be dropped without blocking when the queue is full", func(t *testing.T) {
+		svc, legacy := setup(t, 1)
+		svc.OnLegacyUpgrade(func(context.Context, []byte, []byte) error { return nil })
+
+		dropped := testutil.ToFloat64(legacyUpgradesCounter.WithLabelValues(legacyUpgradeDropped))
+
+		for i := 0; i < 3; i++ {
+			_, err := svc.Decrypt(ctx, legacy)
+			require.NoError(t, err)
+		}
+
+		assert.Len(t, svc.legacyUpgrades, 1)
+		assert.Equal(t, dropped+2, testutil.ToFloat64(legacyUpgradesCounter.WithLabelValues(legacyUpgradeDropped)))
+	})
+}
@@ -0,0 +1,89 @@
+package manager
+
+import (
+	"context"
+	"errors"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// LegacyUsageReport is the result of ScanLegacyUsage, by source (i.e. the name of the
+// fetcher of encrypted secrets). Like SampleVerifyReport, it never contains any secret material.
+type LegacyUsageReport struct {
+	Sources map[string]PayloadKindsReport `json:"sources"`
+}
+
+// PayloadKindsReport counts the encrypted secrets of a source by kind (see ClassifyPayload),
+// and the ones encrypted with envelope encryption by the scope of their data key.
+type PayloadKindsReport struct {
+	Legacy          int            `json:"legacy"`
+	Envelope        int            `json:"envelope"`
+	Unknown         int            `json:"unknown"`
+	EnvelopeByScope map[string]int `json:"envelopeByScope"`
+}
+
+// ScanLegacyUsage classifies the secrets returned by the registered fetchers (see
+// RegisterEncryptedSecretsFetcher) as legacy or envelope encrypted, without decrypting
+// them, so the migration remaining before retiring the legacy secret key can be quantified.
+// The scope of the envelope encrypted ones is looked up in the store, "unknown" if their
+// data key isn't found.
+func (s *SecretsService) ScanLegacyUsage(ctx context.Context) (LegacyUsageReport, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.ScanLegacyUsage")
+	defer span.End()
+
+	candidates, err := s.fetchEncryptedSecrets(ctx)
+	if err != nil {
+		return LegacyUsageReport{}, err
+	}
+
+	scopes := make(map[string]string)
+	scopeOf := func(payload []byte) (string, error) {
+		keyId, _, err := decodeEnvelope(payload)
+		if err != nil {
+			return "", err
+		}
+
+		if scope, ok := scopes[keyId]; ok {
+			return scope, nil
+		}
+
+		scope := scopeUnknown
+		dataKey, err := s.store.GetDataKey(ctx, keyId)
+		switch {
+		case err == nil:
+			scope = dataKey.Scope
+		case !errors.Is(err, secrets.ErrDataKeyNotFound):
+			return "", err
+		}
+
+		scopes[keyId] = scope
+		return scope, nil
+	}
+
+	report := LegacyUsageReport{Sources: make(map[string]PayloadKindsReport)}
+	for _, candidate := range candidates {
+		source := report.Sources[candidate.source]
+		if source.EnvelopeByScope == nil {
+			source.EnvelopeByScope = make(map[string]int)
+		}
+
+		switch ClassifyPayload(candidate.payload) {
+		case PayloadKindLegacy:
+			source.Legacy++
+		case PayloadKindEnvelope:
+			scope, err := scopeOf(candidate.payload)
+			if err != nil {
+				return LegacyUsageReport{}, err
+			}
+
+			source.Envelope++
+			source.EnvelopeByScope[scope]++
+		default:
+			source.Unknown++
+		}
+
+		report.Sources[candidate.source] = source
+	}
+
+	return report, nil
+}
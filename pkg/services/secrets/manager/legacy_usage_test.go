@@ -0,0 +1,55 @@
+package manager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_ScanLegacyUsage(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	t.Run("without fetchers should fail", func(t *testing.T) {
+		_, err := svc.ScanLegacyUsage(ctx)
+		require.Error(t, err)
+	})
+
+	encrypt := func(scope string) []byte {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope(scope))
+		require.NoError(t, err)
+		return encrypted
+	}
+
+	secretKey := svc.cfg.SectionWithEnvOverrides("security").Key("secret_key").Value()
+	legacy, err := svc.enc.Encrypt(ctx, []byte("grafana"), secretKey)
+	require.NoError(t, err)
+
+	svc.RegisterEncryptedSecretsFetcher("datasources", func(context.Context) ([][]byte, error) {
+		return [][]byte{legacy, legacy, encrypt("root"), encrypt("org:1"), encrypt("org:1")}, nil
+	})
+	svc.RegisterEncryptedSecretsFetcher("plugins", func(context.Context) ([][]byte, error) {
+		return [][]byte{legacy, []byte("#dW5rbm93bg#corrupted"), []byte("corrupted")}, nil
+	})
+
+	report, err := svc.ScanLegacyUsage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, LegacyUsageReport{Sources: map[string]PayloadKindsReport{
+		"datasources": {
+			Legacy:          2,
+			Envelope:        3,
+			EnvelopeByScope: map[string]int{"root": 1, "org:1": 2},
+		},
+		"plugins": {
+			Legacy:          1,
+			Envelope:        1,
+			Unknown:         1,
+			EnvelopeByScope: map[string]int{scopeUnknown: 1},
+		},
+	}}, report)
+}
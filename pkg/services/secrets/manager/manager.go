@@ -1,18 +1,23 @@
 package manager
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
-	"encoding/base64"
+	"crypto/aes"
+	"crypto/sha256"
+	"crypto/subtle"
 	"errors"
 	"fmt"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/infra/tracing"
@@ -21,13 +26,12 @@ import (
 	"github.com/grafana/grafana/pkg/services/featuremgmt"
 	"github.com/grafana/grafana/pkg/services/kmsproviders"
 	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
 	"github.com/grafana/grafana/pkg/setting"
 	"github.com/grafana/grafana/pkg/util"
 )
 
-const (
-	keyIdDelimiter = '#'
-)
+var errJsonDataTooLarge = errors.New("too many entries to decrypt")
 
 var (
 	// now is used for testing purposes,
@@ -42,6 +46,8 @@ type SecretsService struct {
 	cfg        *setting.Cfg
 	features   featuremgmt.FeatureToggles
 	usageStats usagestats.Service
+	// usageStatsOnce makes sure the usage metrics are registered once per service.
+	usageStatsOnce sync.Once
 
 	mtx          sync.Mutex
 	dataKeyCache *dataKeyCache
@@ -50,11 +56,159 @@ type SecretsService struct {
 	providers           map[secrets.ProviderID]secrets.Provider
 	kmsProvidersService kmsproviders.Service
 
+	// providerSemaphores limit the concurrent calls to each provider, if configured.
+	providerSemaphores map[secrets.ProviderID]chan struct{}
+	// decryptSemaphore limits the concurrent calls to Decrypt, if configured.
+	decryptSemaphore chan struct{}
+
 	currentProviderID secrets.ProviderID
 
+	generateDataKeyId DataKeyIdGenerator
+
+	// rotationOverlap is the period during which data keys superseded
+	// by a data keys rotation remain active. See RotateDataKeys.
+	rotationOverlap time.Duration
+	// rotationNoKeysError makes RotateDataKeys fail with secrets.ErrNoKeysToRotate
+	// when there are no active data keys, instead of succeeding without doing anything.
+	rotationNoKeysError bool
+
+	// reconcileInterval is the interval at which the cached current data key
+	// is reconciled with the store. Zero disables it. See ReconcileCurrentKey.
+	reconcileInterval time.Duration
+
+	// credentialsRefreshInterval is the interval at which the credentials
+	// of the secrets.RefreshingProvider providers are refreshed.
+	credentialsRefreshInterval time.Duration
+
+	// warmUpRate is the maximum rate of encryption providers calls per second
+	// while warming up the data keys cache on startup. Zero disables the warm-up.
+	warmUpRate rate.Limit
+
+	// reEncryptRate is the maximum rate of encryption providers calls per second
+	// while re-encrypting the data keys. Zero disables the limit.
+	reEncryptRate rate.Limit
+
+	// inflightDecrypts is the amount of decrypt operations in progress,
+	// used to pause the cache warm-up while there's live decrypt traffic.
+	inflightDecrypts atomic.Int64
+
+	// refreshAheadWindow is how long before its cache expiration the current
+	// data key is refreshed in the background. Zero disables the refresh-ahead.
+	refreshAheadWindow time.Duration
+
+	// prewarmWindow is how long before their cache expiration the data keys cached
+	// by id are refreshed by the cache cleanup. Zero disables the prewarming.
+	prewarmWindow time.Duration
+
+	// dataKeysMaxAge is the maximum age of the current data keys before they're
+	// considered overdue for rotation. Zero disables the check. If dataKeysAutoRotate
+	// is set, overdue data keys are rotated automatically. See checkDataKeysAge.
+	dataKeysMaxAge     time.Duration
+	dataKeysAutoRotate bool
+
+	// keyCreationLimiter limits the rate of data keys creation,
+	// to prevent spikes of calls to the encryption providers.
+	keyCreationLimiter *rate.Limiter
+
+	// previousSecretKeys are the secret keys used before the current one, in order,
+	// that legacy payloads may still be encrypted with. See decryptWithSecretKeys.
+	previousSecretKeys []string
+	// startupSecretKey is the secret key at startup, kept in case it changes at runtime. See legacySecretKeys.
+	startupSecretKey string
+
+	// legacyFallback allows legacy payloads to be decrypted while
+	// envelope encryption is enabled. See checkLegacySecretKey.
+	legacyFallback bool
+
+	// tenantBinding makes DecryptForTenant reject the payloads that
+	// weren't encrypted with a data key bound to the given tenant.
+	tenantBinding bool
+
+	// jsonDataMaxEntries is the maximum amount of entries of the maps
+	// decrypted by DecryptJsonData, unlimited if zero.
+	jsonDataMaxEntries int
+
+	// scopeProviders mandate the provider of the data keys of some scopes. See mandatedProvider.
+	scopeProviders []scopeProviderPolicy
+
+	// keyCommitment makes Encrypt commit the payloads to their data key. See appendCommitted.
+	keyCommitment bool
+
+	// knownScopes are the data key scopes known by this instance, as patterns
+	// (see scopeKnown). If strictScopes is set, decrypt operations reject the
+	// payloads encrypted with data keys of any other scope.
+	knownScopes  []string
+	strictScopes bool
+
+	// lastRotation is the time of the last data keys rotation done by this instance, if any.
+	lastRotation atomic.Pointer[time.Time]
+
+	// callbacks are called when data keys operations complete. See OnDataKeysOperation.
+	callbacks    []DataKeysOperationCallback
+	callbacksMtx sync.RWMutex
+
+	// legacyUpgrades queues the legacy payloads decrypted, to be upgraded to envelope encryption
+	// and passed to the legacyUpgradeCallbacks. It's nil unless configured. See OnLegacyUpgrade.
+	legacyUpgrades         chan []byte
+	legacyUpgradeCallbacks []LegacyUpgradeCallback
+
+	// keyAuditSink records the data keys lifecycle operations, if set. The ones done on startup
+	// are kept in startupKeyOperations until it's set. See SetKeyAuditSink.
+	keyAuditSink         KeyAuditSink
+	startupKeyOperations []KeyOperationEvent
+
+	// builtinEnc is whether enc is the builtin encryption service, whose ciphertexts
+	// format is known, so unsupported format versions can be told apart from them.
+	builtinEnc bool
+
+	// dataKeyMinEntropyBits is the minimum estimated entropy of the
+	// new data keys, in bits. Zero disables it. See newRandomDataKey.
+	dataKeyMinEntropyBits float64
+
+	// quarantine makes decrypting fail fast for the data keys that repeatedly fail
+	// to be decrypted. See data_key_quarantine_threshold and QuarantinedDataKeys.
+	quarantine dataKeyQuarantine
+
+	// canarySize is the size of the canary encrypted by SelfTestProviders.
+	canarySize int
+
+	// backgroundProvidersStrict makes Run fail when a background provider fails,
+	// instead of marking it as degraded. See runBackgroundProvider.
+	backgroundProvidersStrict bool
+	degradedProviders         map[secrets.ProviderID]struct{}
+	degradedProvidersMtx      sync.RWMutex
+
+	// refreshes tracks the refreshes ahead in progress, so they can be waited for. See refreshAhead.
+	refreshes sync.WaitGroup
+
+	// shutdownTimeout is how long Run waits for the background providers to stop on
+	// shutdown before leaving them behind. Zero waits forever. See waitForShutdown.
+	shutdownTimeout time.Duration
+
+	// secretsFetchers provide the encrypted secrets sampled by SampleVerify, by name.
+	secretsFetchers    map[string]EncryptedSecretsFetcher
+	secretsFetchersMtx sync.RWMutex
+
+	// secretsReEncryptors re-encrypt the secrets for RotateDataKeysAndReEncrypt, by name.
+	secretsReEncryptors    map[string]SecretsReEncryptor
+	secretsReEncryptorsMtx sync.RWMutex
+
 	log log.Logger
 }
 
+// maxDataKeyIdLength is the maximum length of a data key identifier,
+// constrained by the data keys table schema.
+const maxDataKeyIdLength = 100
+
+// DataKeyIdGenerator generates the identifier for a new data key that is going to be
+// encrypted by the given provider. Generated identifiers must be collision-resistant,
+// non-empty, no longer than 100 characters, and without spaces nor control characters.
+type DataKeyIdGenerator func(providerID secrets.ProviderID) string
+
+func defaultDataKeyIdGenerator(_ secrets.ProviderID) string {
+	return util.GenerateShortUID()
+}
+
 func ProvideSecretsService(
 	tracer tracing.Tracer,
 	store secrets.Store,
@@ -63,12 +217,12 @@ func ProvideSecretsService(
 	cfg *setting.Cfg,
 	features featuremgmt.FeatureToggles,
 	usageStats usagestats.Service,
+	supportBundles supportbundles.Service,
 ) (*SecretsService, error) {
-	ttl := cfg.SectionWithEnvOverrides("security.encryption").Key("data_keys_cache_ttl").MustDuration(15 * time.Minute)
+	logger := log.New("secrets")
+	ttl := dataKeysCacheTTL(cfg, logger)
 
-	currentProviderID := kmsproviders.NormalizeProviderID(secrets.ProviderID(
-		cfg.SectionWithEnvOverrides("security").Key("encryption_provider").MustString(kmsproviders.Default),
-	))
+	currentProviderID, _ := resolveCurrentProviderID(cfg, logger)
 
 	s := &SecretsService{
 		tracer:              tracer,
@@ -79,8 +233,11 @@ func ProvideSecretsService(
 		kmsProvidersService: kmsProvidersService,
 		dataKeyCache:        newDataKeyCache(ttl),
 		currentProviderID:   currentProviderID,
+		generateDataKeyId:   defaultDataKeyIdGenerator,
+		rotationOverlap:     cfg.SectionWithEnvOverrides("security.encryption").Key("data_keys_rotation_overlap").MustDuration(0),
+		rotationNoKeysError: cfg.SectionWithEnvOverrides("security.encryption").Key("data_keys_rotation_no_keys_error").MustBool(false),
 		features:            features,
-		log:                 log.New("secrets"),
+		log:                 logger,
 	}
 
 	enabled := !features.IsEnabledGlobally(featuremgmt.FlagDisableEnvelopeEncryption)
@@ -96,26 +253,260 @@ func ProvideSecretsService(
 		return nil, fmt.Errorf("missing configuration for current encryption provider %s", currentProviderID)
 	}
 
+	if err := s.validateProviders(context.Background()); err != nil {
+		return nil, err
+	}
+
+	if enabled {
+		strict := cfg.SectionWithEnvOverrides("security.encryption").Key("provider_change_strict").MustBool(false)
+		if err := s.checkProviderChange(context.Background(), strict); err != nil {
+			return nil, err
+		}
+	}
+
+	s.reconcileInterval = cfg.SectionWithEnvOverrides("security.encryption").
+		Key("current_data_key_reconcile_interval").MustDuration(0)
+	s.credentialsRefreshInterval = cfg.SectionWithEnvOverrides("security.encryption").
+		Key("provider_credentials_refresh_interval").MustDuration(15 * time.Minute)
+	s.warmUpRate = rate.Limit(cfg.SectionWithEnvOverrides("security.encryption").
+		Key("data_keys_cache_warmup_rate").MustFloat64(0))
+	s.reEncryptRate = rate.Limit(cfg.SectionWithEnvOverrides("security.encryption").
+		Key("re_encrypt_provider_rate").MustFloat64(0))
+	s.refreshAheadWindow = cfg.SectionWithEnvOverrides("security.encryption").
+		Key("data_keys_cache_refresh_ahead").MustDuration(0)
+	s.prewarmWindow = cfg.SectionWithEnvOverrides("security.encryption").
+		Key("data_keys_cache_prewarm_window").MustDuration(0)
+	s.dataKeysMaxAge = cfg.SectionWithEnvOverrides("security.encryption").
+		Key("data_keys_max_age").MustDuration(0)
+	s.dataKeysAutoRotate = cfg.SectionWithEnvOverrides("security.encryption").
+		Key("data_keys_max_age_auto_rotate").MustBool(false)
+	s.keyCreationLimiter = newKeyCreationLimiter(cfg)
+	s.tenantBinding = cfg.SectionWithEnvOverrides("security.encryption").
+		Key("tenant_binding").MustBool(false)
+	scopeProviders, err := parseScopeProviders(cfg.SectionWithEnvOverrides("security.encryption").
+		Key("scope_providers").Value())
+	if err != nil {
+		return nil, err
+	}
+	s.scopeProviders = scopeProviders
+	for _, policy := range scopeProviders {
+		if _, exists := s.providers[policy.provider]; enabled && !exists {
+			s.log.Warn("Encryption provider mandated for scope is not configured, encryption will fail for it",
+				"scope", policy.pattern, "provider", policy.provider)
+		}
+	}
+
+	s.dataKeyMinEntropyBits = cfg.SectionWithEnvOverrides("security.encryption").Key("data_key_min_entropy_bits").MustFloat64(0)
+	if maxBits := maxEntropyBits(dataKeyLength); s.dataKeyMinEntropyBits > maxBits {
+		// No data key could ever be generated, so encryption would always fail.
+		return nil, fmt.Errorf("invalid data_key_min_entropy_bits %g: must be at most %g for %d-byte data keys",
+			s.dataKeyMinEntropyBits, maxBits, dataKeyLength)
+	}
+	s.quarantine.threshold = cfg.SectionWithEnvOverrides("security.encryption").Key("data_key_quarantine_threshold").MustInt(0)
+	s.quarantine.cooldown = cfg.SectionWithEnvOverrides("security.encryption").Key("data_key_quarantine_cooldown").MustDuration(5 * time.Minute)
+	s.canarySize = cfg.SectionWithEnvOverrides("security.encryption").Key("self_test_canary_size").MustInt(defaultCanarySize)
+	if s.canarySize <= 0 {
+		s.canarySize = defaultCanarySize
+	}
+	if size := cfg.SectionWithEnvOverrides("security.encryption").Key("legacy_upgrade_queue_size").MustInt(0); size > 0 {
+		s.legacyUpgrades = make(chan []byte, size)
+	}
+	if maxConcurrency := cfg.SectionWithEnvOverrides("security.encryption").Key("decrypt_max_concurrency").MustInt(0); maxConcurrency > 0 {
+		s.decryptSemaphore = make(chan struct{}, maxConcurrency)
+	}
+	s.jsonDataMaxEntries = cfg.SectionWithEnvOverrides("security.encryption").
+		Key("json_data_max_entries").MustInt(0)
+	s.keyCommitment = cfg.SectionWithEnvOverrides("security.encryption").
+		Key("key_commitment").MustBool(false)
+	s.legacyFallback = cfg.SectionWithEnvOverrides("security.encryption").
+		Key("legacy_fallback").MustBool(true)
+	s.strictScopes = cfg.SectionWithEnvOverrides("security.encryption").
+		Key("strict_scopes").MustBool(false)
+	s.knownScopes = util.SplitString(cfg.SectionWithEnvOverrides("security.encryption").
+		Key("known_scopes").MustString("root, org:*, user:*"))
+	s.backgroundProvidersStrict = cfg.SectionWithEnvOverrides("security.encryption").
+		Key("background_providers_strict").MustBool(false)
+	s.shutdownTimeout = cfg.SectionWithEnvOverrides("security.encryption").
+		Key("shutdown_timeout").MustDuration(30 * time.Second)
+	s.previousSecretKeys = util.SplitString(cfg.SectionWithEnvOverrides("security.encryption").
+		Key("previous_secret_keys").Value())
+	s.startupSecretKey = s.legacySecretKey()
+	algorithm := cfg.SectionWithEnvOverrides("security.encryption").Key("algorithm").MustString(encryption.AesCfb)
+	if len(s.previousSecretKeys) > 0 && algorithm != encryption.AesGcm {
+		s.log.Warn("Previous secret keys are only tried for legacy secrets encrypted with aes-gcm, others are decrypted with the current secret key only",
+			"algorithm", algorithm)
+	}
+
+	legacyStrict := cfg.SectionWithEnvOverrides("security.encryption").Key("legacy_secret_key_strict").MustBool(false)
+	if err := s.checkLegacySecretKey(enabled, legacyStrict); err != nil {
+		return nil, err
+	}
+
 	if !enabled && currentProviderID != kmsproviders.Default {
 		s.log.Warn("Changing encryption provider requires enabling envelope encryption feature")
 	}
 
 	s.log.Info("Envelope encryption state", "enabled", enabled, "current provider", currentProviderID)
+	s.builtinEnc = encryptionImplementation(enc) == builtinEncryptionImplementation
+	s.log.Info("Encryption implementation", "implementation", encryptionImplementation(enc))
+	if s.keyCommitment {
+		if err := s.requireBuiltinEncryption("key_commitment"); err != nil {
+			return nil, err
+		}
+	}
 
 	s.registerUsageMetrics()
 
+	var instance string
+	if cfg.SectionWithEnvOverrides("security.encryption").Key("metrics_instance_label").MustBool(false) {
+		instance = cfg.InstanceName
+	}
+	registerMetrics(instance)
+
+	supportBundles.RegisterSupportItemCollector(s.supportBundleCollector())
+
+	if enabled && cfg.SectionWithEnvOverrides("security.encryption").Key("data_keys_prefetch").MustBool(false) {
+		if err := s.prefetchCurrentDataKey(context.Background()); err != nil {
+			s.log.Warn("Failed to prefetch current data key", "error", err)
+		}
+	}
+
 	return s, nil
 }
 
+// builtinEncryptionImplementation is the name the builtin encryption service reports itself with.
+const builtinEncryptionImplementation = "builtin"
+
+// encryptionImplementation returns the name of the given encryption implementation,
+// as reported by itself (see encryption.Implementation) or, otherwise, its type.
+func encryptionImplementation(enc encryption.Internal) string {
+	if impl, ok := enc.(encryption.Implementation); ok {
+		return impl.Implementation()
+	}
+
+	return fmt.Sprintf("%T", enc)
+}
+
+// dataKeysCacheTTL returns the effective TTL for the data keys cache, which
+// never drops below the configured minimum unless explicitly allowed, because
+// a (too) short TTL defeats the cache and causes a high frequency of calls
+// to the encryption providers (e.g. KMS).
+func dataKeysCacheTTL(cfg *setting.Cfg, logger log.Logger) time.Duration {
+	sec := cfg.SectionWithEnvOverrides("security.encryption")
+	ttl := sec.Key("data_keys_cache_ttl").MustDuration(15 * time.Minute)
+	minTTL := sec.Key("data_keys_cache_min_ttl").MustDuration(time.Minute)
+	allowBelowMin := sec.Key("data_keys_cache_allow_ttl_below_min").MustBool(false)
+
+	if ttl < minTTL {
+		if allowBelowMin {
+			logger.Warn("Data keys cache TTL is below the recommended minimum, this may cause performance issues",
+				"ttl", ttl, "min_ttl", minTTL)
+		} else {
+			logger.Warn("Data keys cache TTL is below the minimum, using the minimum instead",
+				"ttl", ttl, "min_ttl", minTTL)
+			ttl = minTTL
+		}
+	}
+
+	logger.Info("Data keys cache configured", "ttl", ttl)
+
+	return ttl
+}
+
+const (
+	providerSourceEnv     = "env"
+	providerSourceFile    = "file"
+	providerSourceDefault = "default"
+)
+
+// resolveCurrentProviderID returns the current encryption provider, as configured, along
+// with where it was resolved from: the GF_SECURITY_ENCRYPTION_PROVIDER environment variable
+// takes precedence over the configuration files, which take precedence over the default.
+// Blank values are ignored, so an empty environment variable doesn't mask the files.
+func resolveCurrentProviderID(cfg *setting.Cfg, logger log.Logger) (secrets.ProviderID, string) {
+	const section, key = "security", "encryption_provider"
+
+	id, source := kmsproviders.Default, providerSourceDefault
+	if value := strings.TrimSpace(os.Getenv(setting.EnvKey(section, key))); value != "" {
+		id, source = value, providerSourceEnv
+	} else if sec := cfg.Raw.Section(section); sec.HasKey(key) {
+		if value := strings.TrimSpace(sec.Key(key).Value()); value != "" {
+			id, source = value, providerSourceFile
+		}
+	}
+
+	providerID := kmsproviders.NormalizeProviderID(secrets.ProviderID(id))
+	logger.Info("Current encryption provider resolved", "provider", providerID, "source", source)
+
+	return providerID, source
+}
+
+// newKeyCreationLimiter returns the rate limiter for data keys creation, as configured.
+// Data keys are rarely created in normal operation (i.e. once per scope and rotation),
+// so the limits are only meant to stop runaway creation. A zero rate disables the limit.
+func newKeyCreationLimiter(cfg *setting.Cfg) *rate.Limiter {
+	sec := cfg.SectionWithEnvOverrides("security.encryption")
+	limit := sec.Key("data_keys_creation_rate_limit").MustFloat64(1)
+	burst := sec.Key("data_keys_creation_rate_limit_burst").MustInt(50)
+
+	if limit <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+
+	return rate.NewLimiter(rate.Limit(limit), burst)
+}
+
+// SetDataKeyIdGenerator replaces the function used to generate identifiers
+// for new data keys, which defaults to util.GenerateShortUID.
+func (s *SecretsService) SetDataKeyIdGenerator(generator DataKeyIdGenerator) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.generateDataKeyId = generator
+}
+
 func (s *SecretsService) InitProviders() (err error) {
 	s.pOnce.Do(func() {
 		s.providers, err = s.kmsProvidersService.Provide()
+		if err != nil {
+			return
+		}
+
+		maxConcurrency := s.cfg.SectionWithEnvOverrides("security.encryption").Key("provider_max_concurrency").MustInt(0)
+		s.providerSemaphores = newProviderSemaphores(s.providers, maxConcurrency)
 	})
 
 	return
 }
 
+// validateProviders validates the configuration of all the providers
+// that support it, and reports all the validation errors together.
+func (s *SecretsService) validateProviders(ctx context.Context) error {
+	var errs []error
+	for _, provider := range s.ListProviders() {
+		if p, ok := provider.Provider.(secrets.ValidatingProvider); ok {
+			if err := p.Validate(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("invalid configuration for encryption provider %s: %w", provider.ID, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
 func (s *SecretsService) registerUsageMetrics() {
+	if !s.cfg.SectionWithEnvOverrides("security.encryption").Key("usage_stats_enabled").MustBool(true) {
+		s.log.Debug("Encryption usage stats are disabled")
+		return
+	}
+
+	first := false
+	s.usageStatsOnce.Do(func() { first = true })
+	if !first {
+		s.log.Debug("Encryption usage stats already registered")
+		return
+	}
+
 	s.usageStats.RegisterMetricsFunc(func(ctx context.Context) (map[string]any, error) {
 		usageMetrics := make(map[string]any)
 
@@ -159,17 +550,41 @@ func (s *SecretsService) encryptedWithEnvelopeEncryption(payload []byte) bool {
 	return len(payload) > 0 && payload[0] == keyIdDelimiter
 }
 
-var b64 = base64.RawStdEncoding
-
 func (s *SecretsService) Encrypt(ctx context.Context, payload []byte, opt secrets.EncryptionOptions) ([]byte, error) {
 	ctx, span := s.tracer.Start(ctx, "secretsService.Encrypt")
 	defer span.End()
 
 	// Use legacy encryption service if featuremgmt.FlagDisableEnvelopeEncryption toggle is on
 	if s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
-		return s.enc.Encrypt(ctx, payload, s.cfg.SecretKey)
+		return s.enc.Encrypt(ctx, payload, s.legacySecretKey())
+	}
+
+	// If encryption featuremgmt.FlagEnvelopeEncryption toggle is on, use envelope encryption
+	return s.encrypt(ctx, payload, opt(), encryptOptions{})
+}
+
+// EncryptNoCreate works like Encrypt, but it fails with secrets.ErrNoCurrentKey instead
+// of creating a new data key when there's no current one for the given scope. So, it can
+// be used for dry checks (e.g. to know the size of an encrypted value) without side effects.
+func (s *SecretsService) EncryptNoCreate(ctx context.Context, payload []byte, opt secrets.EncryptionOptions) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.EncryptNoCreate")
+	defer span.End()
+
+	if s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
+		return s.enc.Encrypt(ctx, payload, s.legacySecretKey())
 	}
 
+	return s.encrypt(ctx, payload, opt(), encryptOptions{noCreate: true})
+}
+
+// EncryptWithKeyId encrypts the given payload with the data key identified by the given id,
+// instead of the current one, even if that data key is disabled. It's an escape hatch meant
+// for compatibility writes only (e.g. data that must be read by an older node that only knows
+// about that data key), so Encrypt must be preferred in any other case.
+func (s *SecretsService) EncryptWithKeyId(ctx context.Context, payload []byte, keyId string) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.EncryptWithKeyId")
+	defer span.End()
+
 	var err error
 	defer func() {
 		opsCounter.With(prometheus.Labels{
@@ -178,45 +593,243 @@ func (s *SecretsService) Encrypt(ctx context.Context, payload []byte, opt secret
 		}).Inc()
 	}()
 
-	// If encryption featuremgmt.FlagEnvelopeEncryption toggle is on, use envelope encryption
-	scope := opt()
-	label := secrets.KeyLabel(scope, s.currentProviderID)
+	if s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
+		err = fmt.Errorf("encryption with a specific data key requires envelope encryption to be enabled")
+		return nil, err
+	}
 
-	var id string
-	var dataKey []byte
-	id, dataKey, err = s.currentDataKey(ctx, label, scope)
+	// The data key is always fetched from the database, because the
+	// in-memory cache doesn't keep track of whether it's still active.
+	var dataKey *secrets.DataKey
+	var decrypted []byte
+	dataKey, decrypted, err = s.fetchDataKeyById(ctx, keyId)
+	if err != nil {
+		if errors.Is(err, secrets.ErrDataKeyNotFound) {
+			err = fmt.Errorf("unknown data key '%s': %w", keyId, err)
+		}
+		s.ctxLogger(ctx).Error("Failed to get data key", "error", err, "id", keyId)
+		return nil, err
+	}
+
+	if !dataKey.Active {
+		s.ctxLogger(ctx).Warn("Encrypting with a disabled data key", "id", keyId, "label", dataKey.Label)
+	}
+
+	var encrypted []byte
+	encrypted, err = s.enc.Encrypt(ctx, payload, string(decrypted))
 	if err != nil {
-		s.log.Error("Failed to get current data key", "error", err, "label", label)
+		s.ctxLogger(ctx).Error("Failed to encrypt secret", "error", err)
 		return nil, err
 	}
 
+	return encodeEnvelope(keyId, encrypted), nil
+}
+
+// encryptOptions holds the optional behaviors of envelope encryption operations.
+type encryptOptions struct {
+	// escrow is the list of escrow providers. See EncryptWithEscrow.
+	escrow []secrets.ProviderID
+	// noCreate prevents new data keys from being created. See EncryptNoCreate.
+	noCreate bool
+	// deterministic encrypts the payload deterministically. See EncryptDeterministic.
+	deterministic bool
+	// expireAt is the time after which the payload cannot be decrypted anymore. See EncryptWithExpiry.
+	expireAt time.Time
+	// providers is the ordered list of preferred providers, the current one
+	// if empty. See EncryptWithProviderPreference.
+	providers []secrets.ProviderID
+	// provider is the provider used to encrypt new data keys, the current one if empty.
+	provider secrets.ProviderID
+	// alias is the alias the data key is resolved from. See EncryptWithAlias.
+	alias string
+	// nullable encrypts nil payloads distinctly from empty ones. See EncryptNullable.
+	nullable bool
+}
+
+// pinnable reports whether the encryption can use the data key pinned to the context, if
+// any, i.e. it doesn't need a data key of its own. See PinDataKey.
+func (opts encryptOptions) pinnable() bool {
+	return len(opts.escrow) == 0 && len(opts.providers) == 0 && opts.alias == ""
+}
+
+// encrypt encrypts the given payload with envelope encryption, using the current data key
+// for the given scope. If any escrow provider is given, the data key used is the current
+// one for that set of escrow providers instead. See EncryptWithEscrow for further details.
+func (s *SecretsService) encrypt(ctx context.Context, payload []byte, scope string, opts encryptOptions) (envelope []byte, err error) {
+	start := time.Now()
+	defer func() {
+		observeWithExemplar(ctx, opsDurationHistogram.WithLabelValues(OpEncrypt), time.Since(start).Seconds())
+
+		if err == nil {
+			envelopeOverheadHistogram.Observe(float64(len(envelope) - len(payload)))
+
+			if secrets.AuditLabelFromContext(ctx) != "" {
+				s.ctxLogger(ctx).Info("Secret encrypted", "scope", scope)
+			}
+		}
+
+		opsCounter.With(prometheus.Labels{
+			"success":   strconv.FormatBool(err == nil),
+			"operation": OpEncrypt,
+		}).Inc()
+		scopeOpsCounter.With(prometheus.Labels{
+			"success":   strconv.FormatBool(err == nil),
+			"operation": OpEncrypt,
+			"scope":     scopeKind(scope),
+		}).Inc()
+	}()
+
+	var id string
+	var dataKey []byte
+	if pinned, ok := pinnedDataKeyFromContext(ctx, scope); ok && opts.pinnable() {
+		id, dataKey = pinned.id, pinned.dataKey
+	} else {
+		id, dataKey, err = s.preferredDataKey(ctx, scope, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.nullable && payload == nil {
+		blob := make([]byte, 0, envelopePrefixLen(id)+nilOverhead)
+		stopCipher := trackPhase(ctx, cipherPhase)
+		blob, err = appendNil(appendEnvelopePrefix(blob, id), dataKey)
+		stopCipher()
+		if err != nil {
+			s.ctxLogger(ctx).Error("Failed to encrypt secret", "error", err)
+			return nil, err
+		}
+
+		return blob, nil
+	}
+
+	if opts.deterministic {
+		blob := make([]byte, 0, envelopePrefixLen(id)+1+aes.BlockSize+len(payload))
+		stopCipher := trackPhase(ctx, cipherPhase)
+		blob, err = appendDeterministic(appendEnvelopePrefix(blob, id), dataKey, payload)
+		stopCipher()
+		if err != nil {
+			s.ctxLogger(ctx).Error("Failed to encrypt secret", "error", err)
+			return nil, err
+		}
+
+		return blob, nil
+	}
+
+	if !opts.expireAt.IsZero() {
+		blob := make([]byte, 0, envelopePrefixLen(id)+expiringOverhead+len(payload))
+		stopCipher := trackPhase(ctx, cipherPhase)
+		blob, err = appendExpiring(appendEnvelopePrefix(blob, id), dataKey, payload, opts.expireAt)
+		stopCipher()
+		if err != nil {
+			s.ctxLogger(ctx).Error("Failed to encrypt secret", "error", err)
+			return nil, err
+		}
+
+		return blob, nil
+	}
+
+	if s.keyCommitment {
+		blob := make([]byte, 0, envelopePrefixLen(id)+committedOverhead+len(payload))
+		stopCipher := trackPhase(ctx, cipherPhase)
+		blob, err = appendCommitted(appendEnvelopePrefix(blob, id), dataKey, payload)
+		stopCipher()
+		if err != nil {
+			s.ctxLogger(ctx).Error("Failed to encrypt secret", "error", err)
+			return nil, err
+		}
+
+		return blob, nil
+	}
+
+	// If supported, the payload is encrypted directly into a pre-sized
+	// buffer after the envelope prefix, to avoid intermediate copies.
+	if appender, ok := s.enc.(encryption.AppendCipher); ok {
+		blob := make([]byte, 0, envelopePrefixLen(id)+encryptionOverhead+len(payload))
+		stopCipher := trackPhase(ctx, cipherPhase)
+		blob, err = appender.AppendEncrypt(ctx, appendEnvelopePrefix(blob, id), payload, string(dataKey))
+		stopCipher()
+		if err != nil {
+			s.ctxLogger(ctx).Error("Failed to encrypt secret", "error", err)
+			return nil, err
+		}
+
+		return blob, nil
+	}
+
 	var encrypted []byte
+	stopCipher := trackPhase(ctx, cipherPhase)
 	encrypted, err = s.enc.Encrypt(ctx, payload, string(dataKey))
+	stopCipher()
 	if err != nil {
-		s.log.Error("Failed to encrypt secret", "error", err)
+		s.ctxLogger(ctx).Error("Failed to encrypt secret", "error", err)
 		return nil, err
 	}
 
-	prefix := make([]byte, b64.EncodedLen(len(id))+2)
-	b64.Encode(prefix[1:], []byte(id))
-	prefix[0] = keyIdDelimiter
-	prefix[len(prefix)-1] = keyIdDelimiter
+	return encodeEnvelope(id, encrypted), nil
+}
+
+// encryptionOverhead is an estimate of the bytes added by encryption.Internal
+// to the payloads: algorithm prefix, salt and IV. It's only used to pre-size
+// buffers, so underestimating it only causes an extra allocation.
+const encryptionOverhead = 64
+
+// preferredDataKey returns the current data key for the given scope and the first of the preferred
+// providers (see EncryptWithProviderPreference) it can be looked up or created with, in order.
+// With no preferred providers, it's the current data key for the current provider.
+func (s *SecretsService) preferredDataKey(ctx context.Context, scope string, opts encryptOptions) (string, []byte, error) {
+	if err := s.checkMandatedProvider(scope); err != nil {
+		return "", nil, err
+	}
+
+	providers := opts.providers
+	if providerID, ok := s.mandatedProvider(scope); ok {
+		providers = []secrets.ProviderID{providerID}
+	} else if len(providers) == 0 {
+		providers = []secrets.ProviderID{s.currentProviderID}
+	}
+
+	var err error
+	for i, providerID := range providers {
+		label := secrets.KeyLabel(scope, providerID) + escrowLabelSuffix(opts.escrow)
+		if opts.alias != "" {
+			label = secrets.AliasKeyLabel(opts.alias, scope, providerID)
+		}
+		opts.provider = providerID
+
+		var id string
+		var dataKey []byte
+		id, dataKey, err = s.currentDataKey(ctx, label, scope, opts)
+		if err == nil {
+			return id, dataKey, nil
+		}
 
-	blob := make([]byte, len(prefix)+len(encrypted))
-	copy(blob, prefix)
-	copy(blob[len(prefix):], encrypted)
+		s.ctxLogger(ctx).Error("Failed to get current data key", "error", err, "label", label)
+		if i < len(providers)-1 {
+			s.ctxLogger(ctx).Warn("Falling back to the next preferred encryption provider", "provider", providerID, "next", providers[i+1])
+		}
+	}
 
-	return blob, nil
+	return "", nil, err
 }
 
 // currentDataKey looks up for current data key in cache or database by name, and decrypts it.
 // If there's no current data key in cache nor in database it generates a new random data key,
 // and stores it into both the in-memory cache and database (encrypted by the encryption provider).
-func (s *SecretsService) currentDataKey(ctx context.Context, label string, scope string) (string, []byte, error) {
+func (s *SecretsService) currentDataKey(ctx context.Context, label string, scope string, opts encryptOptions) (string, []byte, error) {
+	// Fast path: most of the times the current data key is the last one used,
+	// so we try to use it directly, without acquiring any lock.
+	if entry, exists := s.dataKeyCache.getCurrent(label); exists {
+		s.refreshAhead(ctx, entry)
+		return entry.id, entry.dataKey, nil
+	}
+
 	// We want only one request fetching current data key at time to
 	// avoid the creation of multiple ones in case there's no one existing.
+	stopLockWait := trackPhase(ctx, lockWaitPhase)
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
+	stopLockWait()
 
 	// We try to fetch the data key, either from cache or database
 	id, dataKey, err := s.dataKeyByLabel(ctx, label)
@@ -226,7 +839,15 @@ func (s *SecretsService) currentDataKey(ctx context.Context, label string, scope
 
 	// If no existing data key was found, create a new one
 	if dataKey == nil {
-		id, dataKey, err = s.newDataKey(ctx, label, scope)
+		if opts.noCreate {
+			return "", nil, secrets.ErrNoCurrentKey
+		}
+
+		if opts.alias != "" {
+			id, dataKey, err = s.newAliasDataKey(ctx, opts.alias, opts.provider, label, scope)
+		} else {
+			id, dataKey, err = s.newDataKey(ctx, opts.provider, label, scope, opts.escrow...)
+		}
 		if err != nil {
 			return "", nil, err
 		}
@@ -235,11 +856,47 @@ func (s *SecretsService) currentDataKey(ctx context.Context, label string, scope
 	return id, dataKey, nil
 }
 
+// refreshAhead refreshes the given cache entry of the current data key in the background
+// when it's about to expire, so encryption operations never block on a cold provider call.
+// There's at most one refresh in progress per entry, tracked by refreshes.
+func (s *SecretsService) refreshAhead(ctx context.Context, entry *dataKeyCacheEntry) {
+	if s.refreshAheadWindow <= 0 || entry.expiration.Sub(now()) > s.refreshAheadWindow {
+		return
+	}
+
+	if !entry.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	s.refreshes.Add(1)
+	go func() {
+		defer s.refreshes.Done()
+
+		dataKey, decrypted, err := s.fetchDataKeyById(ctx, entry.id)
+		if err != nil {
+			s.log.Warn("Failed to refresh current data key ahead of its expiration", "id", entry.id, "error", err)
+			entry.refreshing.Store(false)
+			return
+		}
+
+		// Disabled data keys are left to expire, so the next
+		// encryption operation looks for a new current data key.
+		if !dataKey.Active {
+			return
+		}
+
+		refreshed := s.cacheDataKey(dataKey, decrypted)
+		s.dataKeyCache.replaceCurrent(entry, refreshed)
+	}()
+}
+
 // dataKeyByLabel looks up for data key in cache by label.
 // Otherwise, it fetches it from database, decrypts it and caches it decrypted.
 func (s *SecretsService) dataKeyByLabel(ctx context.Context, label string) (string, []byte, error) {
 	// 0. Get data key from in-memory cache.
 	if entry, exists := s.dataKeyCache.getByLabel(label); exists && entry.active {
+		s.dataKeyCache.setCurrent(entry)
 		return entry.id, entry.dataKey, nil
 	}
 
@@ -253,17 +910,22 @@ func (s *SecretsService) dataKeyByLabel(ctx context.Context, label string) (stri
 	}
 
 	// 2.1 Find the encryption provider.
-	provider, exists := s.providers[kmsproviders.NormalizeProviderID(dataKey.Provider)]
+	providerID := kmsproviders.NormalizeProviderID(dataKey.Provider)
+	provider, exists := s.providers[providerID]
 	if !exists {
 		return "", nil, fmt.Errorf("could not find encryption provider '%s'", dataKey.Provider)
 	}
 
 	// 2.2 Decrypt the data key fetched from the database.
-	decrypted, err := provider.Decrypt(ctx, dataKey.EncryptedData)
+	decrypted, err := s.providerDecrypt(ctx, providerID, provider, dataKey.EncryptedData)
 	if err != nil {
 		return "", nil, err
 	}
 
+	if err := checkDataKeyLength(dataKey, providerID, decrypted); err != nil {
+		return "", nil, err
+	}
+
 	// 3. Store the decrypted data key into the in-memory cache.
 	s.cacheDataKey(dataKey, decrypted)
 
@@ -271,67 +933,291 @@ func (s *SecretsService) dataKeyByLabel(ctx context.Context, label string) (stri
 }
 
 // newDataKey creates a new random data key, encrypts it and stores it into the database and cache.
-func (s *SecretsService) newDataKey(ctx context.Context, label string, scope string) (string, []byte, error) {
-	// 1. Create new data key.
-	dataKey, err := newRandomDataKey()
+// If any escrow provider is given, an escrow copy of the data key is also stored for each of them.
+// The data key is encrypted with the given provider or, if empty, with the current one.
+func (s *SecretsService) newDataKey(ctx context.Context, providerID secrets.ProviderID, label string, scope string, escrow ...secrets.ProviderID) (string, []byte, error) {
+	generation, err := s.CurrentGeneration(ctx)
 	if err != nil {
 		return "", nil, err
 	}
 
-	// 2.1 Find the encryption provider.
-	provider, exists := s.providers[s.currentProviderID]
-	if !exists {
-		return "", nil, fmt.Errorf("could not find encryption provider '%s'", s.currentProviderID)
+	return s.newDataKeyOfGeneration(ctx, generation, providerID, label, scope, escrow...)
+}
+
+// newDataKeyOfGeneration works like newDataKey, but the data key is of the given generation.
+func (s *SecretsService) newDataKeyOfGeneration(
+	ctx context.Context,
+	generation int64,
+	providerID secrets.ProviderID,
+	label string,
+	scope string,
+	escrow ...secrets.ProviderID,
+) (string, []byte, error) {
+	return s.createDataKey(ctx, "", generation, providerID, label, scope, escrow...)
+}
+
+// createDataKey works like newDataKeyOfGeneration, but the data key has the given
+// identifier, unless empty, instead of one generated. See SetDataKeyIdGenerator.
+func (s *SecretsService) createDataKey(
+	ctx context.Context,
+	id string,
+	generation int64,
+	providerID secrets.ProviderID,
+	label string,
+	scope string,
+	escrow ...secrets.ProviderID,
+) (string, []byte, error) {
+	// 0. Check the data keys creation rate.
+	if !s.keyCreationLimiter.Allow() {
+		keyCreationsThrottledCounter.Inc()
+		s.ctxLogger(ctx).Warn("Data key creation throttled", "label", label)
+		return "", nil, secrets.ErrKeyCreationThrottled
 	}
 
-	// 2.2 Encrypt the data key.
-	encrypted, err := provider.Encrypt(ctx, dataKey)
+	return s.createUnthrottledDataKey(ctx, id, generation, providerID, label, scope, escrow...)
+}
+
+// createUnthrottledDataKey works like createDataKey, but the data key isn't subject to the data keys
+// creation rate limit, which is meant to stop runaway creation on demand, not deliberate operations
+// like rotations, which create a data key per scope at once (as InitScopes does).
+func (s *SecretsService) createUnthrottledDataKey(
+	ctx context.Context,
+	id string,
+	generation int64,
+	providerID secrets.ProviderID,
+	label string,
+	scope string,
+	escrow ...secrets.ProviderID,
+) (string, []byte, error) {
+	// 1. Create new data key, encrypted.
+	dbDataKey, dataKey, err := s.newEncryptedDataKey(ctx, providerID, label, scope)
 	if err != nil {
 		return "", nil, err
 	}
+	if id != "" {
+		dbDataKey.Id = id
+	}
+	dbDataKey.Generation = generation
 
-	// 3. Store its encrypted value into the DB.
-	id := util.GenerateShortUID()
-
-	dbDataKey := secrets.DataKey{
-		Active:        true,
-		Id:            id,
-		Provider:      s.currentProviderID,
-		EncryptedData: encrypted,
-		Label:         label,
-		Scope:         scope,
+	// Escrow copies are stored first, so a data key is never
+	// used without all its escrow copies being persisted.
+	if err := s.storeEscrowDataKeys(ctx, dbDataKey.Id, dataKey, scope, generation, escrow); err != nil {
+		return "", nil, err
 	}
 
-	err = s.store.CreateDataKey(ctx, &dbDataKey)
+	// 2. Store its encrypted value into the DB.
+	err = s.store.CreateDataKey(ctx, dbDataKey)
 	if err != nil {
 		return "", nil, err
 	}
 
-	return id, dataKey, nil
+	s.recordKeyOperation(ctx, KeyOperationEvent{
+		Operation: KeyOperationCreate,
+		DataKeyId: dbDataKey.Id,
+		Label:     dbDataKey.Label,
+		Scope:     dbDataKey.Scope,
+		Provider:  dbDataKey.Provider,
+	})
+
+	return dbDataKey.Id, dataKey, nil
 }
 
-func newRandomDataKey() ([]byte, error) {
-	rawDataKey := make([]byte, 16)
-	_, err := rand.Read(rawDataKey)
+// newEncryptedDataKey creates a new random data key, and returns it both ready to be stored, i.e.
+// encrypted with the given provider (or, if empty, with the current one), and decrypted.
+func (s *SecretsService) newEncryptedDataKey(ctx context.Context, providerID secrets.ProviderID, label string, scope string) (*secrets.DataKey, []byte, error) {
+	// 1. Create new data key.
+	dataKey, err := s.newRandomDataKey()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return rawDataKey, nil
-}
 
-func (s *SecretsService) Decrypt(ctx context.Context, payload []byte) ([]byte, error) {
-	ctx, span := s.tracer.Start(ctx, "secretsService.Decrypt")
-	defer span.End()
+	// 2.1 Find the encryption provider.
+	if providerID == "" {
+		providerID = s.currentProviderID
+	}
 
-	var err error
+	provider, exists := s.providers[providerID]
+	if !exists {
+		return nil, nil, fmt.Errorf("could not find encryption provider '%s'", providerID)
+	}
+
+	// 2.2 Encrypt the data key.
+	encrypted, err := s.providerEncrypt(ctx, providerID, provider, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 3. Generate its identifier.
+	id := s.generateDataKeyId(providerID)
+	if !validDataKeyId(id) {
+		return nil, nil, fmt.Errorf("invalid data key id '%s': must be between 1 and %d characters long, without spaces nor control characters", id, maxDataKeyIdLength)
+	}
+
+	return &secrets.DataKey{
+		Active:        true,
+		Id:            id,
+		Provider:      providerID,
+		EncryptedData: encrypted,
+		Label:         label,
+		Scope:         scope,
+	}, dataKey, nil
+}
+
+// dataKeyLength is the length, in bytes, of the data keys.
+const dataKeyLength = 16
+
+func (s *SecretsService) Decrypt(ctx context.Context, payload []byte) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.Decrypt")
+	defer span.End()
+
+	release, err := s.acquireDecrypt(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	decrypted, err := s.decrypt(ctx, payload, s.dataKeyById)
+	if err == nil && !s.encryptedWithEnvelopeEncryption(payload) {
+		s.enqueueLegacyUpgrade(ctx, payload)
+	}
+
+	return decrypted, err
+}
+
+// DecryptNoCache works like Decrypt, but the data key is always fetched from the database
+// and decrypted by its encryption provider, bypassing the in-memory cache. It is meant to
+// be used to verify that a payload can actually be decrypted (e.g. by consistency checks),
+// so a cached data key cannot mask a broken encryption provider.
+//
+// The data keys cache is neither read nor updated, so other callers are not affected.
+func (s *SecretsService) DecryptNoCache(ctx context.Context, payload []byte) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.DecryptNoCache")
+	defer span.End()
+
+	return s.decrypt(ctx, payload, s.dataKeyByIdNoCache)
+}
+
+// VerifyDecrypts decrypts the given payload and reports whether the SHA-256 hash of the
+// resulting plaintext matches the expected one. The plaintext never leaves this method,
+// and it's scrubbed from memory once hashed, so it can be used for integrity audits
+// without exposing the secrets to the verifier.
+func (s *SecretsService) VerifyDecrypts(ctx context.Context, payload []byte, expectedSHA256 [32]byte) (bool, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.VerifyDecrypts")
+	defer span.End()
+
+	decrypted, err := s.decrypt(ctx, payload, s.dataKeyById)
+	if err != nil {
+		return false, err
+	}
+
+	actual := sha256.Sum256(decrypted)
+	clear(decrypted)
+
+	return subtle.ConstantTimeCompare(actual[:], expectedSHA256[:]) == 1, nil
+}
+
+// DecryptWithRawKey decrypts the given envelope encrypted payload with the given (decrypted) data
+// key, without looking it up from the store nor decrypting it with any provider. It's a last-resort
+// tool for break-glass recovery, when the store or the provider are unavailable but the raw data key
+// is known (e.g. escrowed). If keyId isn't empty, the payload must reference that data key.
+func (s *SecretsService) DecryptWithRawKey(ctx context.Context, payload []byte, rawDataKey []byte, keyId string) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.DecryptWithRawKey")
+	defer span.End()
+
+	var err error
 	defer func() {
 		opsCounter.With(prometheus.Labels{
 			"success":   strconv.FormatBool(err == nil),
 			"operation": OpDecrypt,
 		}).Inc()
+	}()
 
-		if err != nil {
-			s.log.Error("Failed to decrypt secret", "error", err)
+	if !s.encryptedWithEnvelopeEncryption(payload) {
+		err = fmt.Errorf("unable to decrypt a payload without envelope encryption with a raw data key")
+		return nil, err
+	}
+
+	var payloadKeyId string
+	payloadKeyId, payload, err = decodeEnvelope(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyId != "" && keyId != payloadKeyId {
+		err = fmt.Errorf("payload encrypted with data key '%s', not '%s'", payloadKeyId, keyId)
+		return nil, err
+	}
+
+	s.ctxLogger(ctx).Warn("Decrypting with a raw data key for recovery, bypassing the store and the encryption providers", "id", payloadKeyId)
+
+	var decrypted []byte
+	decrypted, err = s.decryptCiphertext(ctx, payload, rawDataKey)
+
+	return decrypted, err
+}
+
+// DecryptLegacy decrypts the given legacy (i.e. not envelope encrypted) payload with the given
+// secret key, instead of the one configured for this instance. It's meant to import secrets
+// from another Grafana instance (e.g. migrations), before re-encrypting them locally.
+func (s *SecretsService) DecryptLegacy(ctx context.Context, payload []byte, secretKey string) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.DecryptLegacy")
+	defer span.End()
+
+	var err error
+	defer func() {
+		opsCounter.With(prometheus.Labels{
+			"success":   strconv.FormatBool(err == nil),
+			"operation": OpDecrypt,
+		}).Inc()
+	}()
+
+	if len(payload) == 0 {
+		err = fmt.Errorf("unable to decrypt empty payload")
+		return nil, err
+	}
+
+	if s.encryptedWithEnvelopeEncryption(payload) {
+		err = fmt.Errorf("unable to decrypt an envelope encrypted payload with a secret key")
+		return nil, err
+	}
+
+	var decrypted []byte
+	decrypted, err = s.enc.Decrypt(ctx, payload, secretKey)
+
+	return decrypted, err
+}
+
+func (s *SecretsService) decrypt(
+	ctx context.Context,
+	payload []byte,
+	dataKeyById func(ctx context.Context, id string) (*dataKeyCacheEntry, error),
+) ([]byte, error) {
+	s.inflightDecrypts.Add(1)
+	defer s.inflightDecrypts.Add(-1)
+
+	var err error
+	scope := scopeUnknown
+	start := time.Now()
+	defer func() {
+		observeWithExemplar(ctx, opsDurationHistogram.WithLabelValues(OpDecrypt), time.Since(start).Seconds())
+
+		opsCounter.With(prometheus.Labels{
+			"success":   strconv.FormatBool(err == nil),
+			"operation": OpDecrypt,
+		}).Inc()
+		scopeOpsCounter.With(prometheus.Labels{
+			"success":   strconv.FormatBool(err == nil),
+			"operation": OpDecrypt,
+			"scope":     scope,
+		}).Inc()
+
+		// Quarantined data keys were already logged when quarantined, so
+		// their failures aren't logged as errors again, to not flood logs.
+		switch {
+		case errors.Is(err, secrets.ErrDataKeyQuarantined):
+			s.ctxLogger(ctx).Debug("Failed to decrypt secret", "error", err)
+		case err != nil:
+			s.ctxLogger(ctx).Error("Failed to decrypt secret", "error", err)
 		}
 	}()
 
@@ -349,39 +1235,126 @@ func (s *SecretsService) Decrypt(ctx context.Context, payload []byte) ([]byte, e
 		return nil, err
 	}
 
-	var dataKey []byte
+	var (
+		dataKey []byte
+		keyId   string
+		entry   *dataKeyCacheEntry
+	)
 
 	if !s.encryptedWithEnvelopeEncryption(payload) {
-		secretKey := s.cfg.SectionWithEnvOverrides("security").Key("secret_key").Value()
-		dataKey = []byte(secretKey)
-	} else {
-		payload = payload[1:]
-		endOfKey := bytes.Index(payload, []byte{keyIdDelimiter})
-		if endOfKey == -1 {
-			err = fmt.Errorf("could not find valid key id in encrypted payload")
+		scope = scopeLegacy
+		if !s.legacyFallback && !s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
+			err = errLegacyFallbackDisabled
 			return nil, err
 		}
-		b64Key := payload[:endOfKey]
-		payload = payload[endOfKey+1:]
-		keyId := make([]byte, b64.DecodedLen(len(b64Key)))
-		_, err = b64.Decode(keyId, b64Key)
+
+		secretKeys := s.legacySecretKeys()
+		if len(secretKeys) > 1 {
+			var decrypted []byte
+			decrypted, err = s.decryptWithSecretKeys(ctx, payload, secretKeys)
+			return decrypted, err
+		}
+
+		dataKey = []byte(secretKeys[0])
+	} else {
+		keyId, payload, err = decodeEnvelope(payload)
 		if err != nil {
 			return nil, err
 		}
 
-		dataKey, err = s.dataKeyById(ctx, string(keyId))
+		entry, err = s.lookupQuarantinedDataKey(ctx, keyId, dataKeyById)
 		if err != nil {
-			s.log.Error("Failed to lookup data key by id", "id", string(keyId), "error", err)
+			return nil, err
+		}
+
+		dataKey = entry.dataKey
+		scope = scopeKind(entry.scope)
+
+		if s.strictScopes && !scopeKnown(entry.scope, s.knownScopes) {
+			err = fmt.Errorf("%w: data key '%s' has scope '%s'", secrets.ErrUnknownScope, keyId, entry.scope)
 			return nil, err
 		}
 	}
 
 	var decrypted []byte
-	decrypted, err = s.enc.Decrypt(ctx, payload, string(dataKey))
+	stopCipher := trackPhase(ctx, cipherPhase)
+	decrypted, err = s.decryptCiphertext(ctx, payload, dataKey)
+	stopCipher()
+
+	// The cached data key may be stale or corrupted (e.g. after an incomplete rotation),
+	// so it's invalidated and the decryption is retried once with the data key fetched
+	// again from the database. Data keys that weren't cached, and expired payloads,
+	// are never retried.
+	if err != nil && !errors.Is(err, secrets.ErrPayloadExpired) && entry != nil && s.dataKeyCache.invalidate(entry) {
+		s.ctxLogger(ctx).Warn("Retrying decryption after invalidating cached data key", "id", keyId, "error", err)
+
+		entry, err = s.lookupQuarantinedDataKey(ctx, keyId, dataKeyById)
+		if err == nil {
+			stopCipher := trackPhase(ctx, cipherPhase)
+			decrypted, err = s.decryptCiphertext(ctx, payload, entry.dataKey)
+			stopCipher()
+		}
+
+		decryptRetriesCounter.WithLabelValues(strconv.FormatBool(err == nil)).Inc()
+	}
 
 	return decrypted, err
 }
 
+// decryptWithSecretKeys decrypts the given legacy payload with the first of the given secret keys
+// that works, in order. Only payloads encrypted with an authenticated algorithm (AES-GCM) by the
+// builtin encryption service are tried with more than one secret key, as decrypting them with a
+// wrong one fails. Any other payload (e.g. AES-CFB, the default algorithm) is decrypted with the
+// current secret key only: decrypting it with a wrong one doesn't fail but returns garbage, which
+// cannot be reliably told apart from the actual secret.
+func (s *SecretsService) decryptWithSecretKeys(ctx context.Context, payload []byte, secretKeys []string) ([]byte, error) {
+	if !s.authenticatedLegacyPayload(payload) {
+		stopCipher := trackPhase(ctx, cipherPhase)
+		defer stopCipher()
+
+		return s.enc.Decrypt(ctx, payload, secretKeys[0])
+	}
+
+	var firstErr error
+	for i, secretKey := range secretKeys {
+		stopCipher := trackPhase(ctx, cipherPhase)
+		decrypted, err := s.enc.Decrypt(ctx, payload, secretKey)
+		stopCipher()
+		if err == nil {
+			if i > 0 {
+				s.log.Debug("Legacy payload decrypted with a previous secret key", "index", i-1)
+			}
+			return decrypted, nil
+		}
+
+		if i == 0 {
+			firstErr = err
+		}
+	}
+
+	return nil, firstErr
+}
+
+// lookupDataKey gets the data key with the given id, falling back to any of its
+// escrow copies (see EncryptWithEscrow) before giving up.
+func (s *SecretsService) lookupDataKey(
+	ctx context.Context,
+	keyId string,
+	dataKeyById func(ctx context.Context, id string) (*dataKeyCacheEntry, error),
+) (*dataKeyCacheEntry, error) {
+	entry, err := dataKeyById(ctx, keyId)
+	if err != nil {
+		if escrowEntry, escrowErr := s.escrowDataKeyById(ctx, keyId, dataKeyById); escrowErr == nil {
+			return escrowEntry, nil
+		}
+
+		s.ctxLogger(ctx).Error("Failed to lookup data key by id", "id", keyId, "error", err)
+		return nil, err
+	}
+
+	return entry, nil
+}
+
 func (s *SecretsService) EncryptJsonData(ctx context.Context, kv map[string]string, opt secrets.EncryptionOptions) (map[string][]byte, error) {
 	encrypted := make(map[string][]byte)
 	for key, value := range kv {
@@ -396,6 +1369,10 @@ func (s *SecretsService) EncryptJsonData(ctx context.Context, kv map[string]stri
 }
 
 func (s *SecretsService) DecryptJsonData(ctx context.Context, sjd map[string][]byte) (map[string]string, error) {
+	if err := s.checkJsonDataEntries(sjd); err != nil {
+		return nil, err
+	}
+
 	decrypted := make(map[string]string)
 	for key, data := range sjd {
 		decryptedData, err := s.Decrypt(ctx, data)
@@ -408,77 +1385,486 @@ func (s *SecretsService) DecryptJsonData(ctx context.Context, sjd map[string][]b
 	return decrypted, nil
 }
 
+// checkJsonDataEntries observes the amount of entries of the given map to decrypt and
+// fails if it exceeds the configured maximum, if any, as they're decrypted serially.
+func (s *SecretsService) checkJsonDataEntries(sjd map[string][]byte) error {
+	jsonDataEntriesHistogram.Observe(float64(len(sjd)))
+
+	if s.jsonDataMaxEntries > 0 && len(sjd) > s.jsonDataMaxEntries {
+		return fmt.Errorf("%w: %d entries, at most %d allowed", errJsonDataTooLarge, len(sjd), s.jsonDataMaxEntries)
+	}
+
+	return nil
+}
+
 func (s *SecretsService) GetDecryptedValue(ctx context.Context, sjd map[string][]byte, key, fallback string) string {
+	value, err := s.GetDecryptedValueE(ctx, sjd, key, fallback)
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+func (s *SecretsService) GetDecryptedValueE(ctx context.Context, sjd map[string][]byte, key, fallback string) (string, error) {
 	if value, ok := sjd[key]; ok {
 		decryptedData, err := s.Decrypt(ctx, value)
 		if err != nil {
-			return fallback
+			return "", fmt.Errorf("failed to decrypt value of key '%s': %w", key, err)
 		}
 
-		return string(decryptedData)
+		return string(decryptedData), nil
 	}
 
-	return fallback
+	return fallback, nil
 }
 
 // dataKeyById looks up for data key in cache.
 // Otherwise, it fetches it from database and returns it decrypted.
-func (s *SecretsService) dataKeyById(ctx context.Context, id string) ([]byte, error) {
+func (s *SecretsService) dataKeyById(ctx context.Context, id string) (*dataKeyCacheEntry, error) {
 	// 0. Get decrypted data key from in-memory cache.
 	if entry, exists := s.dataKeyCache.getById(id); exists {
-		return entry.dataKey, nil
+		return entry, nil
 	}
 
+	// 1. Get decrypted data key from database.
+	dataKey, decrypted, err := s.fetchDataKeyById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Store the decrypted data key into the in-memory cache.
+	return s.cacheDataKey(dataKey, decrypted), nil
+}
+
+// dataKeyByIdNoCache fetches the data key from database and returns it decrypted,
+// without looking it up in cache nor caching it.
+func (s *SecretsService) dataKeyByIdNoCache(ctx context.Context, id string) (*dataKeyCacheEntry, error) {
+	dataKey, decrypted, err := s.fetchDataKeyById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDataKeyCacheEntry(dataKey, decrypted), nil
+}
+
+// fetchDataKeyById fetches the data key from database and decrypts it.
+func (s *SecretsService) fetchDataKeyById(ctx context.Context, id string) (*secrets.DataKey, []byte, error) {
 	// 1. Get encrypted data key from database.
 	dataKey, err := s.store.GetDataKey(ctx, id)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// 2.1. Find the encryption provider.
-	provider, exists := s.providers[kmsproviders.NormalizeProviderID(dataKey.Provider)]
+	providerID := kmsproviders.NormalizeProviderID(dataKey.Provider)
+	provider, exists := s.providers[providerID]
 	if !exists {
-		return nil, fmt.Errorf("could not find encryption provider '%s'", dataKey.Provider)
+		return nil, nil, fmt.Errorf("could not find encryption provider '%s'", dataKey.Provider)
 	}
 
-	// 2.2. Encrypt the data key.
-	decrypted, err := provider.Decrypt(ctx, dataKey.EncryptedData)
+	// 2.2. Decrypt the data key.
+	decrypted, err := s.providerDecrypt(ctx, providerID, provider, dataKey.EncryptedData)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// 3. Store the decrypted data key into the in-memory cache.
-	s.cacheDataKey(dataKey, decrypted)
+	if err := checkDataKeyLength(dataKey, providerID, decrypted); err != nil {
+		return nil, nil, err
+	}
 
-	return decrypted, nil
+	return dataKey, decrypted, nil
+}
+
+// checkDataKeyLength checks the given data key was decrypted to the expected length, as a
+// corrupted data key or a wrong provider key may decrypt to garbage of any length, which
+// would only produce garbage later on, when used to decrypt payloads.
+func checkDataKeyLength(dataKey *secrets.DataKey, providerID secrets.ProviderID, decrypted []byte) error {
+	if len(decrypted) == dataKeyLength {
+		return nil
+	}
+
+	dataKeysCorruptedCounter.WithLabelValues(string(providerID)).Inc()
+	return fmt.Errorf("%w: data key '%s' decrypted by provider '%s' to %d bytes, expected %d",
+		secrets.ErrDataKeyCorrupted, dataKey.Id, providerID, len(decrypted), dataKeyLength)
 }
 
 func (s *SecretsService) GetProviders() map[secrets.ProviderID]secrets.Provider {
 	return s.providers
 }
 
+// ListProviders returns the encryption providers sorted by identifier, so they
+// can be iterated in a stable order. See GetProviders for map-based access.
+func (s *SecretsService) ListProviders() []secrets.IdentifiedProvider {
+	providers := make([]secrets.IdentifiedProvider, 0, len(s.providers))
+	for id, p := range s.providers {
+		providers = append(providers, secrets.IdentifiedProvider{ID: id, Provider: p})
+	}
+
+	sort.Slice(providers, func(i, j int) bool { return providers[i].ID < providers[j].ID })
+
+	return providers
+}
+
+// checkProviderChange warns if the current encryption provider differs from the provider of
+// the most recent active data key, as it likely means the current provider was changed, and
+// the existing data keys should be re-encrypted (see ReEncryptDataKeys). In strict mode, it
+// fails instead. Only data keys metadata is read, data keys are never decrypted.
+func (s *SecretsService) checkProviderChange(ctx context.Context, strict bool) error {
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	var latest *secrets.DataKey
+	for _, dataKey := range dataKeys {
+		if !dataKey.Active || secrets.IsEscrowDataKeyId(dataKey.Id) {
+			continue
+		}
+
+		if newerDataKey(dataKey, latest) {
+			latest = dataKey
+		}
+	}
+
+	if latest == nil {
+		return nil
+	}
+
+	previous := kmsproviders.NormalizeProviderID(latest.Provider)
+	if previous == s.currentProviderID {
+		return nil
+	}
+
+	if strict {
+		return fmt.Errorf("current encryption provider changed from '%s' to '%s': data keys must be re-encrypted first", previous, s.currentProviderID)
+	}
+
+	s.log.Warn("Current encryption provider changed, existing data keys should be re-encrypted with it",
+		"previous_provider", previous,
+		"current_provider", s.currentProviderID,
+	)
+
+	s.recordStartupKeyOperation(ctx, KeyOperationEvent{
+		Operation:        KeyOperationProviderSwitch,
+		Provider:         s.currentProviderID,
+		PreviousProvider: previous,
+	})
+
+	return nil
+}
+
+// CanSwitchProvider reports whether the current encryption provider can be safely
+// switched to the given one. Switching is considered unsafe while there are data
+// keys encrypted by any other provider, because those will become unreachable as
+// soon as their provider is removed from configuration. In such case, data keys
+// should be re-encrypted first (see ReEncryptDataKeys).
+//
+// Only data keys metadata is read, data keys are never decrypted.
+func (s *SecretsService) CanSwitchProvider(ctx context.Context, providerID secrets.ProviderID) (bool, string) {
+	providerID = kmsproviders.NormalizeProviderID(providerID)
+
+	if _, exists := s.providers[providerID]; !exists {
+		return false, fmt.Sprintf("encryption provider '%s' is not configured", providerID)
+	}
+
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return false, fmt.Sprintf("failed to read data keys: %s", err)
+	}
+
+	countByProvider := make(map[secrets.ProviderID]int)
+	for _, dataKey := range dataKeys {
+		// Escrow copies are, on purpose, encrypted by their escrow provider.
+		if secrets.IsEscrowDataKeyId(dataKey.Id) {
+			continue
+		}
+
+		if id := kmsproviders.NormalizeProviderID(dataKey.Provider); id != providerID {
+			countByProvider[id]++
+		}
+	}
+
+	if len(countByProvider) == 0 {
+		return true, ""
+	}
+
+	pending := make([]string, 0, len(countByProvider))
+	for id, count := range countByProvider {
+		pending = append(pending, fmt.Sprintf("%d data key(s) encrypted by '%s'", count, id))
+	}
+	sort.Strings(pending)
+
+	return false, fmt.Sprintf(
+		"%s; re-encrypt data keys before switching to '%s', or keep those providers configured",
+		strings.Join(pending, ", "), providerID,
+	)
+}
+
+// RotateDataKeys creates a new data key for every scope with active data keys, and only then
+// disables the data keys that were active before. So, there's never a window without active
+// data keys: if the new data keys cannot be created (e.g. the provider is unavailable), the
+// rotation fails, and the previous data keys remain active and usable.
+// If there are no active data keys, there's nothing to rotate: it either succeeds without
+// doing anything or, if data_keys_rotation_no_keys_error is set, fails with secrets.ErrNoKeysToRotate,
+// so automation can tell both cases apart.
+//
+// If a rotation overlap period is configured, the previous data keys remain active until
+// that period elapses instead. That way, other instances can keep using the data keys they
+// have cached in the meantime, without any window where a disabled data key is used.
 func (s *SecretsService) RotateDataKeys(ctx context.Context) error {
 	s.log.Info("Data keys rotation triggered, acquiring lock...")
 
+	summary, err := s.rotateDataKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.notifyDataKeysOperation(ctx, summary)
+
+	return nil
+}
+
+func (s *SecretsService) rotateDataKeys(ctx context.Context) (DataKeysOperationSummary, error) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	s.log.Info("Data keys rotation started")
-	err := s.store.DisableDataKeys(ctx)
+	s.log.Info("Data keys rotation started", "overlap", s.rotationOverlap)
+
+	summary := DataKeysOperationSummary{Operation: DataKeysOperationRotation}
+
+	var err error
+	if s.rotationNoKeysError || s.hasDataKeysOperationCallbacks() || s.hasKeyAuditSink() {
+		summary.DataKeys, err = s.countDataKeys(ctx, func(dataKey *secrets.DataKey) bool { return dataKey.Active })
+		if err != nil {
+			s.log.Error("Data keys rotation failed", "error", err)
+			return summary, err
+		}
+
+		if summary.DataKeys == 0 && s.rotationNoKeysError {
+			s.log.Info("No active data keys to rotate")
+			return summary, secrets.ErrNoKeysToRotate
+		}
+	}
+
+	var previous []string
+	summary.CurrentDataKeys, previous, err = s.provisionNextDataKeys(ctx)
+	if err == nil && s.rotationOverlap <= 0 {
+		err = s.disableDataKeys(ctx, previous)
+	}
+
 	if err != nil {
 		s.log.Error("Data keys rotation failed", "error", err)
-		return err
+		return summary, err
 	}
 
 	s.dataKeyCache.flush()
+	rotatedAt := now()
+	s.lastRotation.Store(&rotatedAt)
 	s.log.Info("Data keys rotation finished successfully")
 
+	s.recordKeyOperation(ctx, KeyOperationEvent{Operation: KeyOperationRotate, DataKeys: summary.DataKeys})
+
+	return summary, nil
+}
+
+// provisionNextDataKeys creates a new data key for every scope with active data keys, and returns
+// the identifiers of the new data keys, by scope, and the identifiers of the data keys active before,
+// superseded by the new ones. Aliases with an active data key get the data key of the next generation
+// too (see EncryptWithAlias).
+//
+// If any data key fails to be created, the ones already created are disabled, so a failed rotation
+// doesn't leave some scopes with two active data keys, nor retries pile up generations of them.
+func (s *SecretsService) provisionNextDataKeys(ctx context.Context) (current map[string]string, previous []string, err error) {
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scopes := make(map[string]struct{})
+	aliases := make(map[string]*secrets.DataKey)
+	for _, dataKey := range dataKeys {
+		if !dataKey.Active {
+			continue
+		}
+
+		previous = append(previous, dataKey.Id)
+		scopes[dataKey.Scope] = struct{}{}
+		if secrets.IsAliasLabel(dataKey.Label) {
+			aliases[dataKey.Label] = dataKey
+		}
+	}
+
+	// The data keys still active are superseded by the new ones, which are of the next generation.
+	generation := dataKeysGeneration(dataKeys) + 1
+
+	var created []string
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if disableErr := s.disableDataKeys(ctx, created); disableErr != nil {
+			s.log.Error("Failed to disable the data keys created by a failed rotation", "ids", created, "error", disableErr)
+		}
+	}()
+
+	current = make(map[string]string, len(scopes))
+	for scope := range scopes {
+		providerID := s.scopeProvider(scope)
+		id, _, err := s.createUnthrottledDataKey(ctx, "", generation, providerID, secrets.KeyLabel(scope, providerID), scope)
+		if err != nil {
+			return nil, nil, err
+		}
+		created = append(created, id)
+		current[scope] = id
+	}
+
+	for label, dataKey := range aliases {
+		alias, _, ok := secrets.ParseAliasDataKeyId(dataKey.Id)
+		if !ok {
+			continue
+		}
+
+		providerID := kmsproviders.NormalizeProviderID(dataKey.Provider)
+		id, _, err := s.createUnthrottledDataKey(ctx, secrets.AliasDataKeyId(alias, label, generation), generation, providerID, label, dataKey.Scope)
+		if err != nil {
+			return nil, nil, err
+		}
+		created = append(created, id)
+	}
+
+	return current, previous, nil
+}
+
+// disableDataKeys disables the data keys with the given identifiers.
+func (s *SecretsService) disableDataKeys(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		if err := s.store.DisableDataKey(ctx, id); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// disableSupersededDataKeys disables the active data keys that have been superseded
+// by a newer active data key, for the same scope, for longer than the rotation overlap.
+// The data keys of an alias are only superseded by newer ones of the same alias.
+func (s *SecretsService) disableSupersededDataKeys(ctx context.Context) error {
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	newest := make(map[string]*secrets.DataKey)
+	for _, dataKey := range dataKeys {
+		if group := supersedingGroup(dataKey); dataKey.Active && newerDataKey(dataKey, newest[group]) {
+			newest[group] = dataKey
+		}
+	}
+
+	cutoff := now().Add(-s.rotationOverlap)
+	for _, dataKey := range dataKeys {
+		if n := newest[supersedingGroup(dataKey)]; dataKey.Active && n.Id != dataKey.Id && n.Created.Before(cutoff) {
+			s.log.Info("Disabling superseded data key", "id", dataKey.Id, "label", dataKey.Label)
+			if err := s.store.DisableDataKey(ctx, dataKey.Id); err != nil {
+				return err
+			}
+
+			s.recordKeyOperation(ctx, KeyOperationEvent{
+				Operation: KeyOperationDisable,
+				DataKeyId: dataKey.Id,
+				Label:     dataKey.Label,
+				Scope:     dataKey.Scope,
+				Provider:  dataKey.Provider,
+			})
+		}
+	}
+
+	return nil
+}
+
+// supersedingGroup returns the group of data keys that supersede each other: those of the same
+// scope or, for the data keys of an alias, those of the same alias (i.e. with the same label).
+func supersedingGroup(dataKey *secrets.DataKey) string {
+	if secrets.IsAliasLabel(dataKey.Label) {
+		return dataKey.Label
+	}
+
+	return dataKey.Scope
+}
+
+// newerDataKey reports whether a is newer than b, with the same
+// criteria used by the store to choose the current data key.
+func newerDataKey(a, b *secrets.DataKey) bool {
+	if b == nil {
+		return true
+	}
+
+	if a.Created.Equal(b.Created) {
+		return a.Id > b.Id
+	}
+
+	return a.Created.After(b.Created)
+}
+
+// PreflightReEncrypt returns the providers referenced by the stored data keys that aren't
+// configured, so those data keys would be skipped by ReEncryptDataKeys. An empty result means
+// that data keys re-encryption can proceed cleanly. Escrow copies are ignored, as they're never
+// re-encrypted.
+func (s *SecretsService) PreflightReEncrypt(ctx context.Context) ([]secrets.ProviderID, error) {
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := make(map[secrets.ProviderID]struct{})
+	for _, dataKey := range dataKeys {
+		if secrets.IsEscrowDataKeyId(dataKey.Id) {
+			continue
+		}
+
+		id := kmsproviders.NormalizeProviderID(dataKey.Provider)
+		if _, exists := s.providers[id]; !exists {
+			missing[id] = struct{}{}
+		}
+	}
+
+	result := make([]secrets.ProviderID, 0, len(missing))
+	for id := range missing {
+		result = append(result, id)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+
+	return result, nil
+}
+
 func (s *SecretsService) ReEncryptDataKeys(ctx context.Context) error {
 	s.log.Info("Data keys re-encryption triggered")
 
+	return s.reEncryptDataKeys(ctx, s.reEncryptable, func() error {
+		return s.store.ReEncryptDataKeys(ctx, s.reEncryptProviders(), s.currentProviderID)
+	})
+}
+
+// ReEncryptDataKeysOlderThan works like ReEncryptDataKeys, but only the data keys created
+// before the given time are re-encrypted (e.g. those created during a suspected compromise).
+func (s *SecretsService) ReEncryptDataKeysOlderThan(ctx context.Context, t time.Time) error {
+	s.log.Info("Data keys re-encryption triggered", "older_than", t)
+
+	match := func(dataKey *secrets.DataKey) bool {
+		return dataKey.Created.Before(t) && s.reEncryptable(dataKey)
+	}
+
+	return s.reEncryptDataKeys(ctx, match, func() error {
+		return s.store.ReEncryptDataKeysOlderThan(ctx, s.reEncryptProviders(), s.currentProviderID, t)
+	})
+}
+
+// reEncryptDataKeys runs the given re-encryption, and notifies the registered
+// callbacks of the amount of data keys re-encrypted, as matched by the given filter.
+func (s *SecretsService) reEncryptDataKeys(ctx context.Context, match func(dataKey *secrets.DataKey) bool, reEncrypt func() error) error {
 	if s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
 		s.log.Info("Envelope encryption is not enabled but trying to init providers anyway...")
 
@@ -488,7 +1874,16 @@ func (s *SecretsService) ReEncryptDataKeys(ctx context.Context) error {
 		}
 	}
 
-	if err := s.store.ReEncryptDataKeys(ctx, s.providers, s.currentProviderID); err != nil {
+	summary := DataKeysOperationSummary{Operation: DataKeysOperationReEncryption}
+	if s.hasDataKeysOperationCallbacks() || s.hasKeyAuditSink() {
+		var err error
+		if summary.DataKeys, err = s.countDataKeys(ctx, match); err != nil {
+			s.log.Error("Data keys re-encryption failed", "error", err)
+			return err
+		}
+	}
+
+	if err := reEncrypt(); err != nil {
 		s.log.Error("Data keys re-encryption failed", "error", err)
 		return err
 	}
@@ -496,6 +1891,14 @@ func (s *SecretsService) ReEncryptDataKeys(ctx context.Context) error {
 	s.dataKeyCache.flush()
 	s.log.Info("Data keys re-encryption finished successfully")
 
+	s.recordKeyOperation(ctx, KeyOperationEvent{
+		Operation: KeyOperationReEncrypt,
+		Provider:  s.currentProviderID,
+		DataKeys:  summary.DataKeys,
+	})
+
+	s.notifyDataKeysOperation(ctx, summary)
+
 	return nil
 }
 
@@ -505,27 +1908,91 @@ func (s *SecretsService) Run(ctx context.Context) error {
 			MustDuration(time.Minute),
 	)
 
+	// A nil channel blocks forever, so credentials are never
+	// refreshed unless an interval is configured.
+	var refresh <-chan time.Time
+	if s.credentialsRefreshInterval > 0 {
+		ticker := time.NewTicker(s.credentialsRefreshInterval)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+
+	var reconcile <-chan time.Time
+	if s.reconcileInterval > 0 {
+		ticker := time.NewTicker(s.reconcileInterval)
+		defer ticker.Stop()
+		reconcile = ticker.C
+	}
+
+	var ageCheck <-chan time.Time
+	if s.dataKeysMaxAge > 0 {
+		ticker := time.NewTicker(dataKeysAgeCheckInterval)
+		defer ticker.Stop()
+		ageCheck = ticker.C
+	}
+
 	grp, gCtx := errgroup.WithContext(ctx)
 
-	for _, p := range s.providers {
+	var running runningProviders
+	for id, p := range s.providers {
 		if svc, ok := p.(secrets.BackgroundProvider); ok {
+			running.start(id)
 			grp.Go(func() error {
-				return svc.Run(gCtx)
+				defer running.stop(id)
+				return s.runBackgroundProvider(gCtx, id, svc)
 			})
 		}
 	}
 
+	if s.legacyUpgrades != nil {
+		grp.Go(func() error {
+			s.runLegacyUpgrades(gCtx)
+			return nil
+		})
+	}
+
+	if s.warmUpRate > 0 {
+		grp.Go(func() error {
+			if err := s.warmUpCache(gCtx); err != nil && !errors.Is(err, context.Canceled) {
+				s.log.Error("Failed to warm up data keys cache", "error", err)
+			}
+			return nil
+		})
+	}
+
 	for {
 		select {
 		case <-gc.C:
 			s.log.Debug("Removing expired data keys from cache...")
 			s.dataKeyCache.removeExpired()
 			s.log.Debug("Removing expired data keys from cache finished successfully")
+
+			if s.prewarmWindow > 0 {
+				if err := s.prewarmExpiringDataKeys(gCtx); err != nil && !errors.Is(err, context.Canceled) {
+					s.log.Error("Failed to prewarm expiring data keys", "error", err)
+				}
+			}
+
+			if s.rotationOverlap > 0 {
+				if err := s.disableSupersededDataKeys(gCtx); err != nil {
+					s.log.Error("Failed to disable superseded data keys", "error", err)
+				}
+			}
+		case <-refresh:
+			s.refreshProvidersCredentials(gCtx)
+		case <-reconcile:
+			if _, err := s.ReconcileCurrentKey(gCtx); err != nil {
+				s.log.Error("Failed to reconcile current data key", "error", err)
+			}
+		case <-ageCheck:
+			if err := s.checkDataKeysAge(gCtx); err != nil {
+				s.log.Error("Failed to check data keys age", "error", err)
+			}
 		case <-gCtx.Done():
 			s.log.Debug("Grafana is shutting down; stopping...")
 			gc.Stop()
 
-			if err := grp.Wait(); err != nil && !errors.Is(err, context.Canceled) {
+			if err := s.waitForShutdown(grp, &running); err != nil && !errors.Is(err, context.Canceled) {
 				return err
 			}
 
@@ -551,15 +2018,10 @@ func (s *SecretsService) Run(ctx context.Context) error {
 // Look at the comments inline for further details.
 // You can also take a look at the issue below for more context:
 // https://github.com/grafana/grafana-enterprise/issues/4252
-func (s *SecretsService) cacheDataKey(dataKey *secrets.DataKey, decrypted []byte) {
+func (s *SecretsService) cacheDataKey(dataKey *secrets.DataKey, decrypted []byte) *dataKeyCacheEntry {
 	// First, we cache the data key by id, because cache "by id" is
 	// only used by decrypt operations, so no risk of corrupting data.
-	entry := &dataKeyCacheEntry{
-		id:      dataKey.Id,
-		label:   dataKey.Label,
-		dataKey: decrypted,
-		active:  dataKey.Active,
-	}
+	entry := newDataKeyCacheEntry(dataKey, decrypted)
 
 	s.dataKeyCache.addById(entry)
 
@@ -580,4 +2042,30 @@ func (s *SecretsService) cacheDataKey(dataKey *secrets.DataKey, decrypted []byte
 	if dataKey.Created.Before(nowMinusCautionPeriod) {
 		s.dataKeyCache.addByLabel(entry)
 	}
+
+	return entry
+}
+
+// refreshProvidersCredentials refreshes the credentials of every provider that implements
+// secrets.RefreshingProvider. Failures are logged, but they don't stop the refresh of the
+// remaining providers, as the current credentials might still be valid for a while.
+func (s *SecretsService) refreshProvidersCredentials(ctx context.Context) {
+	for _, p := range s.ListProviders() {
+		refresher, ok := p.Provider.(secrets.RefreshingProvider)
+		if !ok {
+			continue
+		}
+
+		err := refresher.RefreshCredentials(ctx)
+		credentialsRefreshCounter.With(prometheus.Labels{
+			"success": strconv.FormatBool(err == nil),
+		}).Inc()
+
+		if err != nil {
+			s.log.Error("Failed to refresh encryption provider credentials", "provider", p.ID, "error", err)
+			continue
+		}
+
+		s.log.Debug("Encryption provider credentials refreshed", "provider", p.ID)
+	}
 }
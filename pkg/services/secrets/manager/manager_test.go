@@ -1,25 +1,39 @@
 package manager
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 	"gopkg.in/ini.v1"
 
 	"github.com/grafana/grafana/pkg/infra/db"
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/infra/tracing"
 	"github.com/grafana/grafana/pkg/infra/usagestats"
+	"github.com/grafana/grafana/pkg/services/encryption"
 	encryptionprovider "github.com/grafana/grafana/pkg/services/encryption/provider"
 	encryptionservice "github.com/grafana/grafana/pkg/services/encryption/service"
 	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/kmsproviders"
 	"github.com/grafana/grafana/pkg/services/kmsproviders/osskmsproviders"
 	"github.com/grafana/grafana/pkg/services/secrets"
 	"github.com/grafana/grafana/pkg/services/secrets/database"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
 	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/supportbundles/supportbundlestest"
 	"github.com/grafana/grafana/pkg/setting"
 	"github.com/grafana/grafana/pkg/tests/testsuite"
 	"github.com/grafana/grafana/pkg/util"
@@ -31,7 +45,7 @@ func TestMain(m *testing.M) {
 
 func TestSecretsService_EnvelopeEncryption(t *testing.T) {
 	testDB := db.InitTestDB(t)
-	store := database.ProvideSecretsStore(testDB)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
 	svc := SetupTestService(t, store)
 	ctx := context.Background()
 
@@ -92,7 +106,7 @@ func TestSecretsService_EnvelopeEncryption(t *testing.T) {
 
 func TestSecretsService_DataKeys(t *testing.T) {
 	testDB := db.InitTestDB(t)
-	store := database.ProvideSecretsStore(testDB)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
 	ctx := context.Background()
 
 	dataKey := &secrets.DataKey{
@@ -171,7 +185,7 @@ func TestSecretsService_DataKeys(t *testing.T) {
 func TestSecretsService_UseCurrentProvider(t *testing.T) {
 	t.Run("When encryption_provider is not specified explicitly, should use 'secretKey' as a current provider", func(t *testing.T) {
 		testDB := db.InitTestDB(t)
-		svc := SetupTestService(t, database.ProvideSecretsStore(testDB))
+		svc := SetupTestService(t, database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB)))
 		assert.Equal(t, secrets.ProviderID("secretKey.v1"), svc.currentProviderID)
 	})
 
@@ -199,7 +213,7 @@ func TestSecretsService_UseCurrentProvider(t *testing.T) {
 		features := featuremgmt.WithFeatures()
 		kms := newFakeKMS(osskmsproviders.ProvideService(encryptionService, cfg, features))
 		testDB := db.InitTestDB(t)
-		secretStore := database.ProvideSecretsStore(testDB)
+		secretStore := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
 
 		secretsService, err := ProvideSecretsService(
 			tracing.InitializeTracerForTest(),
@@ -209,6 +223,7 @@ func TestSecretsService_UseCurrentProvider(t *testing.T) {
 			cfg,
 			features,
 			&usagestats.UsageStatsMock{T: t},
+			supportbundlestest.NewFakeBundleService(),
 		)
 		require.NoError(t, err)
 
@@ -228,6 +243,7 @@ func TestSecretsService_UseCurrentProvider(t *testing.T) {
 			cfg,
 			features,
 			&usagestats.UsageStatsMock{T: t},
+			supportbundlestest.NewFakeBundleService(),
 		)
 		require.NoError(t, err)
 
@@ -273,163 +289,1753 @@ func (f *fakeKMS) Provide() (map[secrets.ProviderID]secrets.Provider, error) {
 	return providers, nil
 }
 
+type validatingProvider struct {
+	fakeProvider
+	err error
+}
+
+func (p *validatingProvider) Validate(_ context.Context) error {
+	return p.err
+}
+
+type staticKMS map[secrets.ProviderID]secrets.Provider
+
+func (k staticKMS) Provide() (map[secrets.ProviderID]secrets.Provider, error) {
+	return k, nil
+}
+
+func TestSecretsService_CheckProviderChange(t *testing.T) {
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+
+	t.Run("without data keys, there's no change", func(t *testing.T) {
+		require.NoError(t, svc.checkProviderChange(ctx, true))
+	})
+
+	createDataKey := func(id string, provider secrets.ProviderID, created time.Time) {
+		require.NoError(t, store.CreateDataKey(ctx, &secrets.DataKey{
+			Active:   true,
+			Id:       id,
+			Label:    id,
+			Scope:    "root",
+			Provider: provider,
+			Created:  created,
+		}))
+	}
+
+	createDataKey("old", "previous.v1", time.Now().Add(-time.Hour))
+	createDataKey("new", svc.currentProviderID, time.Now())
+
+	t.Run("latest data key with the current provider is not a change", func(t *testing.T) {
+		require.NoError(t, svc.checkProviderChange(ctx, true))
+	})
+
+	createDataKey("newer", "previous.v1", time.Now().Add(time.Minute))
+	createDataKey(secrets.EscrowDataKeyId("newest", 0), svc.currentProviderID, time.Now().Add(time.Hour))
+
+	t.Run("provider change should only fail in strict mode", func(t *testing.T) {
+		require.NoError(t, svc.checkProviderChange(ctx, false))
+
+		err := svc.checkProviderChange(ctx, true)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "from 'previous.v1' to 'secretKey.v1'")
+	})
+}
+
+func TestSecretsService_ListProviders(t *testing.T) {
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+	svc.providers["zeta.v1"] = &fakeProvider{}
+	svc.providers["alpha.v1"] = &fakeProvider{}
+
+	ids := make([]secrets.ProviderID, 0, len(svc.providers))
+	for _, p := range svc.ListProviders() {
+		ids = append(ids, p.ID)
+		assert.Equal(t, svc.providers[p.ID], p.Provider)
+	}
+
+	assert.Equal(t, []secrets.ProviderID{"alpha.v1", kmsproviders.Default, "zeta.v1"}, ids)
+}
+
+// stubEncryption is an alternative encryption.Internal implementation,
+// that "encrypts" payloads by prefixing them with the secret.
+type stubEncryption struct{}
+
+func (stubEncryption) Implementation() string {
+	return "stub"
+}
+
+func (stubEncryption) Encrypt(_ context.Context, payload []byte, secret string) ([]byte, error) {
+	return append([]byte(secret+":"), payload...), nil
+}
+
+func (stubEncryption) Decrypt(_ context.Context, payload []byte, secret string) ([]byte, error) {
+	decrypted, ok := bytes.CutPrefix(payload, []byte(secret+":"))
+	if !ok {
+		return nil, errors.New("wrong secret")
+	}
+	return decrypted, nil
+}
+
+func (e stubEncryption) EncryptJsonData(ctx context.Context, kv map[string]string, secret string) (map[string][]byte, error) {
+	encrypted := make(map[string][]byte, len(kv))
+	for key, value := range kv {
+		encrypted[key], _ = e.Encrypt(ctx, []byte(value), secret)
+	}
+	return encrypted, nil
+}
+
+func (e stubEncryption) DecryptJsonData(ctx context.Context, sjd map[string][]byte, secret string) (map[string]string, error) {
+	decrypted := make(map[string]string, len(sjd))
+	for key, value := range sjd {
+		data, err := e.Decrypt(ctx, value, secret)
+		if err != nil {
+			return nil, err
+		}
+		decrypted[key] = string(data)
+	}
+	return decrypted, nil
+}
+
+func (e stubEncryption) GetDecryptedValue(ctx context.Context, sjd map[string][]byte, key, fallback, secret string) string {
+	if data, err := e.Decrypt(ctx, sjd[key], secret); err == nil {
+		return string(data)
+	}
+	return fallback
+}
+
+func TestSecretsService_EncryptionImplementation(t *testing.T) {
+	raw, err := ini.Load([]byte(`
+		[security]
+		secret_key = sdDkslslld`))
+	require.NoError(t, err)
+
+	cfg := &setting.Cfg{Raw: raw}
+	features := featuremgmt.WithFeatures()
+	enc := stubEncryption{}
+
+	svc, err := ProvideSecretsService(
+		tracing.InitializeTracerForTest(),
+		fakes.NewFakeSecretsStore(),
+		osskmsproviders.ProvideService(enc, cfg, features),
+		enc,
+		cfg,
+		features,
+		&usagestats.UsageStatsMock{T: t},
+		supportbundlestest.NewFakeBundleService(),
+	)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	// The payload is encrypted with the stub.
+	_, ciphertext, err := decodeEnvelope(encrypted)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasSuffix(ciphertext, []byte(":grafana")))
+
+	decrypted, err := svc.Decrypt(ctx, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("grafana"), decrypted)
+
+	assert.Equal(t, "stub", encryptionImplementation(enc))
+	assert.Equal(t, "builtin", encryptionImplementation(SetupTestService(t, fakes.NewFakeSecretsStore()).enc))
+	assert.Equal(t, "manager.copyingEncryption", encryptionImplementation(copyingEncryption{}))
+
+	t.Run("ciphertexts starting with a marker should be decrypted by the implementation", func(t *testing.T) {
+		for _, marker := range []byte{nilMarker, deterministicMarker, expiringMarker, committedMarker} {
+			dataKey := []byte{marker, 'k', 'e', 'y'}
+			ciphertext, err := enc.Encrypt(ctx, []byte("grafana"), string(dataKey))
+			require.NoError(t, err)
+
+			decrypted, err := svc.decryptCiphertext(ctx, ciphertext, dataKey)
+			require.NoError(t, err, string(marker))
+			assert.Equal(t, []byte("grafana"), decrypted, string(marker))
+		}
+	})
+
+	t.Run("encryption relying on markers should be refused", func(t *testing.T) {
+		_, err := svc.EncryptDeterministic(ctx, []byte("grafana"), secrets.WithoutScope())
+		assert.ErrorContains(t, err, "requires the builtin encryption service")
+
+		_, err = svc.EncryptWithExpiry(ctx, []byte("grafana"), time.Now().Add(time.Hour), secrets.WithoutScope())
+		assert.ErrorContains(t, err, "requires the builtin encryption service")
+
+		_, err = svc.EncryptNullable(ctx, nil, secrets.WithoutScope())
+		assert.ErrorContains(t, err, "requires the builtin encryption service")
+
+		cfg.Raw.Section("security.encryption").Key("key_commitment").SetValue("true")
+		_, err = ProvideSecretsService(
+			tracing.InitializeTracerForTest(),
+			fakes.NewFakeSecretsStore(),
+			osskmsproviders.ProvideService(enc, cfg, features),
+			enc,
+			cfg,
+			features,
+			&usagestats.UsageStatsMock{T: t},
+			supportbundlestest.NewFakeBundleService(),
+		)
+		assert.ErrorContains(t, err, "key_commitment requires the builtin encryption service")
+	})
+}
+
+func TestSecretsService_ValidateProviders(t *testing.T) {
+	raw, err := ini.Load([]byte(`
+		[security]
+		secret_key = sdDkslslld
+		encryption_provider = valid.v1`))
+	require.NoError(t, err)
+
+	cfg := &setting.Cfg{Raw: raw}
+	features := featuremgmt.WithFeatures()
+
+	encryptionService, err := encryptionservice.ProvideEncryptionService(
+		tracing.InitializeTracerForTest(), encryptionprovider.Provider{}, &usagestats.UsageStatsMock{}, cfg,
+	)
+	require.NoError(t, err)
+
+	provide := func(kms staticKMS) error {
+		testDB := db.InitTestDB(t)
+		_, err := ProvideSecretsService(
+			tracing.InitializeTracerForTest(),
+			database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB)),
+			kms,
+			encryptionService,
+			cfg,
+			features,
+			&usagestats.UsageStatsMock{T: t},
+			supportbundlestest.NewFakeBundleService(),
+		)
+		return err
+	}
+
+	t.Run("valid and non-validating providers should be accepted", func(t *testing.T) {
+		err := provide(staticKMS{
+			"valid.v1":         &validatingProvider{},
+			"nonValidating.v1": &fakeProvider{},
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("all validation errors should be reported", func(t *testing.T) {
+		err := provide(staticKMS{
+			"valid.v1":    &validatingProvider{},
+			"invalidA.v1": &validatingProvider{err: errors.New("missing credentials")},
+			"invalidB.v1": &validatingProvider{err: errors.New("unknown key")},
+		})
+		require.Error(t, err)
+		assert.ErrorContains(t, err, "invalidA.v1: missing credentials")
+		assert.ErrorContains(t, err, "invalidB.v1: unknown key")
+	})
+}
+
+type countingUsageStats struct {
+	*usagestats.UsageStatsMock
+	registered int
+}
+
+func (s *countingUsageStats) RegisterMetricsFunc(fn usagestats.MetricsFunc) {
+	s.registered++
+	s.UsageStatsMock.RegisterMetricsFunc(fn)
+}
+
+// uncomparableUsageStats is a usage stats service that can't be used as a map key.
+type uncomparableUsageStats struct {
+	*usagestats.UsageStatsMock
+	_ []string
+}
+
+func TestSecretsService_RegisterUsageMetrics(t *testing.T) {
+	provide := func(t *testing.T, usageStats usagestats.Service, cfgExtra string) *SecretsService {
+		raw, err := ini.Load([]byte(`
+		[security]
+		secret_key = sdDkslslld
+
+		[security.encryption]
+		` + cfgExtra))
+		require.NoError(t, err)
+
+		cfg := &setting.Cfg{Raw: raw}
+		features := featuremgmt.WithFeatures()
+
+		encryptionService, err := encryptionservice.ProvideEncryptionService(
+			tracing.InitializeTracerForTest(), encryptionprovider.Provider{}, &usagestats.UsageStatsMock{}, cfg,
+		)
+		require.NoError(t, err)
+
+		svc, err := ProvideSecretsService(
+			tracing.InitializeTracerForTest(),
+			fakes.NewFakeSecretsStore(),
+			osskmsproviders.ProvideService(encryptionService, cfg, features),
+			encryptionService,
+			cfg,
+			features,
+			usageStats,
+			supportbundlestest.NewFakeBundleService(),
+		)
+		require.NoError(t, err)
+		return svc
+	}
+
+	t.Run("registering the usage stats twice should register them once", func(t *testing.T) {
+		usageStats := &countingUsageStats{UsageStatsMock: &usagestats.UsageStatsMock{T: t}}
+
+		svc := provide(t, usageStats, "")
+		svc.registerUsageMetrics()
+		assert.Equal(t, 1, usageStats.registered)
+
+		report, err := usageStats.GetUsageReport(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Metrics["stats.encryption.providers.secretKey.count"])
+	})
+
+	t.Run("constructing the service twice should report the state of the last one", func(t *testing.T) {
+		usageStats := &countingUsageStats{UsageStatsMock: &usagestats.UsageStatsMock{T: t}}
+
+		first := provide(t, usageStats, "")
+		second := provide(t, usageStats, "")
+		assert.Equal(t, 2, usageStats.registered)
+
+		second.providers["fakeProvider.v1"] = &fakeProvider{}
+
+		report, err := usageStats.GetUsageReport(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Metrics["stats.encryption.providers.secretKey.count"])
+		assert.Equal(t, 1, report.Metrics["stats.encryption.providers.fakeProvider.count"])
+		assert.NotContains(t, first.providers, secrets.ProviderID("fakeProvider.v1"))
+	})
+
+	t.Run("uncomparable usage stats services should be supported", func(t *testing.T) {
+		usageStats := uncomparableUsageStats{UsageStatsMock: &usagestats.UsageStatsMock{T: t}}
+
+		require.NotPanics(t, func() {
+			provide(t, usageStats, "")
+			provide(t, usageStats, "")
+		})
+	})
+
+	t.Run("disabled usage stats should not be registered", func(t *testing.T) {
+		usageStats := &countingUsageStats{UsageStatsMock: &usagestats.UsageStatsMock{T: t}}
+
+		provide(t, usageStats, "usage_stats_enabled = false")
+		assert.Zero(t, usageStats.registered)
+	})
+}
+
 func TestSecretsService_Run(t *testing.T) {
 	ctx := context.Background()
 	testDB := db.InitTestDB(t)
-	store := database.ProvideSecretsStore(testDB)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+	svc := SetupTestService(t, store)
+
+	t.Run("should stop with no error once the context's finished", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+		defer cancel()
+
+		err := svc.Run(ctx)
+		assert.NoError(t, err)
+	})
+
+	t.Run("should trigger cache clean up", func(t *testing.T) {
+		restoreTimeNowAfterTestExec(t)
+
+		// Encrypt to force data encryption key generation
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		// Ten minutes later (after caution period)
+		// Look SecretsService.cacheDataKey for more details.
+		now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+
+		// Decrypt to ensure data encryption key is cached
+		_, err = svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+
+		// Data encryption key cache should contain one element
+		require.Len(t, svc.dataKeyCache.byId, 1)
+		require.Len(t, svc.dataKeyCache.byLabel, 1)
+
+		// Twenty minutes later (after caution period + cache ttl)
+		now = func() time.Time { return time.Now().Add(20 * time.Minute) }
+
+		ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+		defer cancel()
+
+		err = svc.Run(ctx)
+		require.NoError(t, err)
+
+		// Then, once the ticker has been triggered,
+		// the cleanup process should have happened,
+		// therefore the cache should be empty.
+		require.Len(t, svc.dataKeyCache.byId, 0)
+		require.Len(t, svc.dataKeyCache.byLabel, 0)
+	})
+}
+
+type refreshingProvider struct {
+	fakeProvider
+	refreshed int
+	err       error
+}
+
+func (p *refreshingProvider) RefreshCredentials(_ context.Context) error {
+	p.refreshed++
+	return p.err
+}
+
+func TestSecretsService_RefreshProvidersCredentials(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	healthy := &refreshingProvider{}
+	failing := &refreshingProvider{err: errors.New("token expired")}
+	svc.providers = map[secrets.ProviderID]secrets.Provider{
+		"healthy.v1":       healthy,
+		"failing.v1":       failing,
+		"nonRefreshing.v1": &fakeProvider{},
+	}
+	svc.credentialsRefreshInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	// Failures must not stop the service, nor the refresh of other providers.
+	require.NoError(t, svc.Run(ctx))
+	assert.Greater(t, healthy.refreshed, 1)
+	assert.Greater(t, failing.refreshed, 1)
+}
+
+func TestSecretsService_ReEncryptDataKeys(t *testing.T) {
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+	svc := SetupTestService(t, store)
+
+	// Encrypt to generate data encryption key
+	withoutScope := secrets.WithoutScope()
+	ciphertext, err := svc.Encrypt(ctx, []byte("grafana"), withoutScope)
+	require.NoError(t, err)
+
+	t.Run("existing key should be re-encrypted", func(t *testing.T) {
+		prevDataKeys, err := store.GetAllDataKeys(ctx)
+		require.NoError(t, err)
+		require.Len(t, prevDataKeys, 1)
+
+		err = svc.ReEncryptDataKeys(ctx)
+		require.NoError(t, err)
+
+		reEncryptedDataKeys, err := store.GetAllDataKeys(ctx)
+		require.NoError(t, err)
+		require.Len(t, reEncryptedDataKeys, 1)
+
+		assert.NotEqual(t, prevDataKeys[0].EncryptedData, reEncryptedDataKeys[0].EncryptedData)
+	})
+
+	t.Run("data keys cache should be invalidated", func(t *testing.T) {
+		restoreTimeNowAfterTestExec(t)
+
+		// Ten minutes later (after caution period)
+		// Look SecretsService.cacheDataKey for more details.
+		now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+
+		// Decrypt to ensure data key is cached
+		_, err := svc.Decrypt(ctx, ciphertext)
+		require.NoError(t, err)
+		require.NotEmpty(t, svc.dataKeyCache.byId)
+		require.NotEmpty(t, svc.dataKeyCache.byLabel)
+
+		err = svc.ReEncryptDataKeys(ctx)
+		require.NoError(t, err)
+
+		assert.Empty(t, svc.dataKeyCache.byId)
+		assert.Empty(t, svc.dataKeyCache.byLabel)
+	})
+}
+
+func TestSecretsService_ReEncryptDataKeysOlderThan(t *testing.T) {
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+
+	rawDataKey, err := svc.newRandomDataKey()
+	require.NoError(t, err)
+
+	encrypted, err := svc.providers[kmsproviders.Default].Encrypt(ctx, rawDataKey)
+	require.NoError(t, err)
+
+	for id, created := range map[string]time.Time{
+		"old": time.Now().Add(-48 * time.Hour),
+		"new": time.Now(),
+	} {
+		require.NoError(t, store.CreateDataKey(ctx, &secrets.DataKey{
+			Active:        true,
+			Id:            id,
+			Label:         id,
+			Scope:         "root",
+			Provider:      kmsproviders.Default,
+			EncryptedData: encrypted,
+			Created:       created,
+		}))
+	}
+
+	require.NoError(t, svc.ReEncryptDataKeysOlderThan(ctx, time.Now().Add(-24*time.Hour)))
+
+	old, err := store.GetDataKey(ctx, "old")
+	require.NoError(t, err)
+	assert.NotEqual(t, encrypted, old.EncryptedData)
+
+	recent, err := store.GetDataKey(ctx, "new")
+	require.NoError(t, err)
+	assert.Equal(t, encrypted, recent.EncryptedData)
+
+	// The re-encrypted data key is still the same.
+	_, decrypted, err := svc.fetchDataKeyById(ctx, "old")
+	require.NoError(t, err)
+	assert.Equal(t, rawDataKey, decrypted)
+}
+
+func TestSecretsService_PreflightReEncrypt(t *testing.T) {
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+
+	_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	t.Run("without missing providers, result should be empty", func(t *testing.T) {
+		missing, err := svc.PreflightReEncrypt(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, missing)
+	})
+
+	t.Run("missing providers should be reported once", func(t *testing.T) {
+		for _, dataKey := range []*secrets.DataKey{
+			{Id: "a", Provider: "removedB.v1"},
+			{Id: "b", Provider: "removedA.v1"},
+			{Id: "c", Provider: "removedA.v1"},
+			{Id: secrets.EscrowDataKeyId("a", 0), Provider: "escrow.v1"},
+		} {
+			dataKey.Active = true
+			require.NoError(t, store.CreateDataKey(ctx, dataKey))
+		}
+
+		missing, err := svc.PreflightReEncrypt(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []secrets.ProviderID{"removedA.v1", "removedB.v1"}, missing)
+	})
+}
+
+func TestSecretsService_RotateDataKeys(t *testing.T) {
+	ctx := context.Background()
+
+	activeDataKeys := func(t *testing.T, store secrets.Store) []*secrets.DataKey {
+		t.Helper()
+
+		dataKeys, err := store.GetAllDataKeys(ctx)
+		require.NoError(t, err)
+
+		active := make([]*secrets.DataKey, 0, len(dataKeys))
+		for _, dataKey := range dataKeys {
+			if dataKey.Active {
+				active = append(active, dataKey)
+			}
+		}
+		return active
+	}
+
+	t.Run("without overlap, previous data keys should be disabled once new ones are created", func(t *testing.T) {
+		testDB := db.InitTestDB(t)
+		store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+		svc := SetupTestService(t, store)
+
+		ciphertext, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		prevKeyId, _, err := decodeEnvelope(ciphertext)
+		require.NoError(t, err)
+
+		require.NoError(t, svc.RotateDataKeys(ctx))
+
+		active := activeDataKeys(t, store)
+		require.Len(t, active, 1)
+		assert.NotEqual(t, prevKeyId, active[0].Id)
+
+		// New encryption operations should use the new data key right away.
+		ciphertext, err = svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		keyId, _, err := decodeEnvelope(ciphertext)
+		require.NoError(t, err)
+		assert.Equal(t, active[0].Id, keyId)
+	})
+
+	t.Run("provider failure mid-rotation should keep the previous data keys usable", func(t *testing.T) {
+		store := fakes.NewFakeSecretsStore()
+		svc := SetupTestService(t, store)
+
+		ciphertext, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		prevKeyId, _, err := decodeEnvelope(ciphertext)
+		require.NoError(t, err)
+
+		// The provider can still decrypt the existing data keys, but cannot encrypt new ones.
+		svc.providers[svc.currentProviderID] = encryptFailingProvider{svc.providers[svc.currentProviderID]}
+
+		require.Error(t, svc.RotateDataKeys(ctx))
+
+		active := activeDataKeys(t, store)
+		require.Len(t, active, 1)
+		assert.Equal(t, prevKeyId, active[0].Id)
+
+		svc.dataKeyCache.flush()
+
+		ciphertext, err = svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		keyId, _, err := decodeEnvelope(ciphertext)
+		require.NoError(t, err)
+		assert.Equal(t, prevKeyId, keyId)
+
+		decrypted, err := svc.Decrypt(ctx, ciphertext)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("with overlap, superseded data keys should remain active until it elapses", func(t *testing.T) {
+		restoreTimeNowAfterTestExec(t)
+
+		testDB := db.InitTestDB(t)
+		store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+		svc := SetupTestService(t, store)
+		svc.rotationOverlap = time.Hour
+
+		ciphertext, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		prevKeyId, _, err := decodeEnvelope(ciphertext)
+		require.NoError(t, err)
+
+		// Data keys creation time is stored with seconds precision,
+		// so we wait to guarantee the new data key is the newest one.
+		time.Sleep(time.Second)
+
+		require.NoError(t, svc.RotateDataKeys(ctx))
+		require.Len(t, activeDataKeys(t, store), 2)
+
+		// New encryption operations should use the newest data key.
+		ciphertext, err = svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		keyId, _, err := decodeEnvelope(ciphertext)
+		require.NoError(t, err)
+		assert.NotEqual(t, prevKeyId, keyId)
+
+		// Before the overlap elapses, nothing is disabled.
+		require.NoError(t, svc.disableSupersededDataKeys(ctx))
+		require.Len(t, activeDataKeys(t, store), 2)
+
+		// Once the overlap elapses, only the newest data key remains active.
+		now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+		require.NoError(t, svc.disableSupersededDataKeys(ctx))
+
+		active := activeDataKeys(t, store)
+		require.Len(t, active, 1)
+		assert.Equal(t, keyId, active[0].Id)
+	})
+
+	t.Run("without active data keys, it should do nothing unless configured to fail", func(t *testing.T) {
+		store := fakes.NewFakeSecretsStore()
+		svc := SetupTestService(t, store)
+
+		require.NoError(t, svc.RotateDataKeys(ctx))
+
+		svc.rotationNoKeysError = true
+		require.ErrorIs(t, svc.RotateDataKeys(ctx), secrets.ErrNoKeysToRotate)
+
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		require.NoError(t, svc.RotateDataKeys(ctx))
+		assert.Len(t, activeDataKeys(t, store), 1)
+	})
+
+	initScopes := func(t *testing.T, svc *SecretsService) {
+		t.Helper()
+
+		scopes := make([]string, 0, 60)
+		for i := 1; i <= 60; i++ {
+			scopes = append(scopes, secrets.TenantScope(int64(i)))
+		}
+
+		created, err := svc.InitScopes(ctx, scopes...)
+		require.NoError(t, err)
+		require.Equal(t, 60, created)
+	}
+
+	t.Run("data keys of more scopes than the creation rate limit burst should be rotated", func(t *testing.T) {
+		store := fakes.NewFakeSecretsStore()
+		svc := SetupTestService(t, store)
+		initScopes(t, svc)
+
+		require.NoError(t, svc.RotateDataKeys(ctx))
+
+		active := activeDataKeys(t, store)
+		require.Len(t, active, 60)
+		for _, dataKey := range active {
+			assert.Equal(t, int64(1), dataKey.Generation)
+		}
+	})
+
+	t.Run("data keys created by a failed rotation should be disabled", func(t *testing.T) {
+		store := &failingAfterStore{Store: fakes.NewFakeSecretsStore(), creates: 10}
+		svc := SetupTestService(t, store)
+		initScopes(t, svc)
+
+		require.Error(t, svc.RotateDataKeys(ctx))
+
+		active := activeDataKeys(t, store)
+		require.Len(t, active, 60)
+		for _, dataKey := range active {
+			assert.Equal(t, int64(0), dataKey.Generation)
+		}
+	})
+}
+
+// failingAfterStore fails to create data keys one by one once the given amount of them is created.
+type failingAfterStore struct {
+	secrets.Store
+	creates int
+}
+
+func (s *failingAfterStore) CreateDataKey(ctx context.Context, dataKey *secrets.DataKey) error {
+	if s.creates <= 0 {
+		return errors.New("database is read-only")
+	}
+
+	s.creates--
+	return s.Store.CreateDataKey(ctx, dataKey)
+}
+
+type encryptFailingProvider struct {
+	secrets.Provider
+}
+
+func (encryptFailingProvider) Encrypt(context.Context, []byte) ([]byte, error) {
+	return nil, errors.New("provider unavailable")
+}
+
+func TestSecretsService_CanSwitchProvider(t *testing.T) {
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+	svc := SetupTestService(t, store)
+
+	// Encrypt to generate data encryption key
+	_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	t.Run("switching to an unknown provider should not be allowed", func(t *testing.T) {
+		ok, reason := svc.CanSwitchProvider(ctx, "unknown.v1")
+		assert.False(t, ok)
+		assert.Contains(t, reason, "is not configured")
+	})
+
+	t.Run("switching to the provider used by all data keys should be allowed", func(t *testing.T) {
+		ok, reason := svc.CanSwitchProvider(ctx, svc.currentProviderID)
+		assert.True(t, ok)
+		assert.Empty(t, reason)
+	})
+
+	t.Run("switching with data keys from other providers should not be allowed", func(t *testing.T) {
+		err := store.CreateDataKey(ctx, &secrets.DataKey{
+			Active:        true,
+			Id:            util.GenerateShortUID(),
+			Label:         "test",
+			Provider:      "other.v1",
+			EncryptedData: []byte{0x62, 0xAF, 0xA1, 0x1A},
+		})
+		require.NoError(t, err)
+
+		ok, reason := svc.CanSwitchProvider(ctx, svc.currentProviderID)
+		assert.False(t, ok)
+		assert.Contains(t, reason, "1 data key(s) encrypted by 'other.v1'")
+	})
+}
+
+func TestDataKeysCacheTTL(t *testing.T) {
+	tcs := map[string]struct {
+		cfg      string
+		expected time.Duration
+	}{
+		"default": {
+			cfg:      ``,
+			expected: 15 * time.Minute,
+		},
+		"above the minimum": {
+			cfg:      `data_keys_cache_ttl = 5m`,
+			expected: 5 * time.Minute,
+		},
+		"below the minimum": {
+			cfg:      `data_keys_cache_ttl = 1s`,
+			expected: time.Minute,
+		},
+		"below a custom minimum": {
+			cfg: `data_keys_cache_ttl = 5m
+				data_keys_cache_min_ttl = 10m`,
+			expected: 10 * time.Minute,
+		},
+		"below the minimum, explicitly allowed": {
+			cfg: `data_keys_cache_ttl = 1s
+				data_keys_cache_allow_ttl_below_min = true`,
+			expected: time.Second,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			raw, err := ini.Load([]byte("[security.encryption]\n" + tc.cfg))
+			require.NoError(t, err)
+
+			ttl := dataKeysCacheTTL(&setting.Cfg{Raw: raw}, log.NewNopLogger())
+			assert.Equal(t, tc.expected, ttl)
+		})
+	}
+}
+
+func TestResolveCurrentProviderID(t *testing.T) {
+	tcs := map[string]struct {
+		cfg              string
+		env              string
+		expectedProvider secrets.ProviderID
+		expectedSource   string
+	}{
+		"default": {
+			expectedProvider: kmsproviders.Default,
+			expectedSource:   providerSourceDefault,
+		},
+		"blank in file": {
+			cfg:              `encryption_provider = `,
+			expectedProvider: kmsproviders.Default,
+			expectedSource:   providerSourceDefault,
+		},
+		"from file": {
+			cfg:              `encryption_provider = fakeProvider.v1`,
+			expectedProvider: "fakeProvider.v1",
+			expectedSource:   providerSourceFile,
+		},
+		"from env": {
+			env:              "fakeProvider.v1",
+			expectedProvider: "fakeProvider.v1",
+			expectedSource:   providerSourceEnv,
+		},
+		"env overrides file": {
+			cfg:              `encryption_provider = anotherProvider.v1`,
+			env:              "fakeProvider.v1",
+			expectedProvider: "fakeProvider.v1",
+			expectedSource:   providerSourceEnv,
+		},
+		"blank env doesn't override file": {
+			cfg:              `encryption_provider = fakeProvider.v1`,
+			env:              " ",
+			expectedProvider: "fakeProvider.v1",
+			expectedSource:   providerSourceFile,
+		},
+		"legacy id from env is normalized": {
+			env:              "secretKey",
+			expectedProvider: kmsproviders.Default,
+			expectedSource:   providerSourceEnv,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("GF_SECURITY_ENCRYPTION_PROVIDER", tc.env)
+
+			raw, err := ini.Load([]byte("[security]\n" + tc.cfg))
+			require.NoError(t, err)
+
+			providerID, source := resolveCurrentProviderID(&setting.Cfg{Raw: raw}, log.NewNopLogger())
+			assert.Equal(t, tc.expectedProvider, providerID)
+			assert.Equal(t, tc.expectedSource, source)
+		})
+	}
+}
+
+func TestSecretsService_CurrentDataKeyFastPath(t *testing.T) {
+	restoreTimeNowAfterTestExec(t)
+
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+	svc := SetupTestService(t, store)
+
+	// Encrypt to generate data encryption key
+	_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	// Ten minutes later (after caution period), the data key
+	// is cached by label and can be used through the fast path.
+	// Look SecretsService.cacheDataKey for more details.
+	now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+	svc.dataKeyCache.flush()
+
+	_, err = svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+	_, err = svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+	require.NotNil(t, svc.dataKeyCache.current.Load())
+
+	t.Run("concurrent encryption and rotation should be race-free", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					plaintext := []byte(fmt.Sprintf("secret-%d", j))
+					encrypted, err := svc.Encrypt(ctx, plaintext, secrets.WithoutScope())
+					if !assert.NoError(t, err) {
+						return
+					}
+
+					decrypted, err := svc.Decrypt(ctx, encrypted)
+					if !assert.NoError(t, err) {
+						return
+					}
+					assert.Equal(t, plaintext, decrypted)
+				}
+			}()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				assert.NoError(t, svc.RotateDataKeys(ctx))
+			}
+		}()
+
+		wg.Wait()
+	})
+
+	t.Run("flushing the cache should reset the fast path", func(t *testing.T) {
+		svc.dataKeyCache.flush()
+		assert.Nil(t, svc.dataKeyCache.current.Load())
+	})
+}
+
+func BenchmarkSecretsService_Encrypt(b *testing.B) {
+	ctx := context.Background()
+	testDB := db.InitTestDB(b)
+	svc := SetupTestService(b, database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB)))
+
+	// Ten minutes later (after caution period), so the data key is cached by label.
+	_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(b, err)
+	now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+	b.Cleanup(func() { now = time.Now })
+	svc.dataKeyCache.flush()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// copyingEncryption hides the encryption.AppendCipher implementation,
+// if any, of the wrapped encryption service.
+type copyingEncryption struct {
+	encryption.Internal
+}
+
+func BenchmarkSecretsService_EncryptLarge(b *testing.B) {
+	ctx := context.Background()
+	svc := SetupTestService(b, fakes.NewFakeSecretsStore())
+	payload := make([]byte, 1<<20)
+
+	// Encrypt to generate data encryption key
+	_, err := svc.Encrypt(ctx, payload, secrets.WithoutScope())
+	require.NoError(b, err)
+
+	enc := svc.enc
+	b.Cleanup(func() { svc.enc = enc })
+
+	for _, tc := range []struct {
+		name string
+		enc  encryption.Internal
+	}{
+		{name: "append", enc: enc},
+		{name: "copy", enc: copyingEncryption{enc}},
+	} {
+		svc.enc = tc.enc
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := svc.Encrypt(ctx, payload, secrets.WithoutScope()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// rejectingEncryption fails to decrypt any payload with
+// the secrets rejected by the given function.
+type rejectingEncryption struct {
+	encryption.Internal
+	reject func(secret string) bool
+}
+
+func (e rejectingEncryption) Decrypt(ctx context.Context, payload []byte, secret string) ([]byte, error) {
+	if e.reject(secret) {
+		return nil, errors.New("cipher: message authentication failed")
+	}
+	return e.Internal.Decrypt(ctx, payload, secret)
+}
+
+type countingStore struct {
+	secrets.Store
+	created int
+	fetched int
+}
+
+func (s *countingStore) CreateDataKey(ctx context.Context, dataKey *secrets.DataKey) error {
+	s.created++
+	return s.Store.CreateDataKey(ctx, dataKey)
+}
+
+func (s *countingStore) GetDataKey(ctx context.Context, id string) (*secrets.DataKey, error) {
+	s.fetched++
+	return s.Store.GetDataKey(ctx, id)
+}
+
+func TestSecretsService_CurrentDataKeyRefreshAhead(t *testing.T) {
+	restoreTimeNowAfterTestExec(t)
+
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+	svc := SetupTestService(t, store)
+	svc.refreshAheadWindow = time.Minute
+
+	// Encrypt to generate data encryption key
+	_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	// Ten minutes later (after caution period), the data key
+	// is cached by label and can be used through the fast path.
+	now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+	svc.dataKeyCache.flush()
+
+	for i := 0; i < 2; i++ {
+		_, err = svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+	}
+
+	current := svc.dataKeyCache.current.Load()
+	require.NotNil(t, current)
+
+	t.Run("current data key far from expiring should not be refreshed", func(t *testing.T) {
+		_, err = svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		assert.False(t, current.refreshing.Load())
+		assert.Same(t, current, svc.dataKeyCache.current.Load())
+	})
+
+	t.Run("current data key about to expire should be refreshed in the background", func(t *testing.T) {
+		// Thirty seconds before the cache entry expires.
+		expiration := current.expiration
+		now = func() time.Time { return expiration.Add(-30 * time.Second) }
+
+		_, err = svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		// The refresh must be over before now is restored.
+		svc.refreshes.Wait()
+
+		refreshed := svc.dataKeyCache.current.Load()
+		require.NotSame(t, current, refreshed)
+		assert.Equal(t, current.id, refreshed.id)
+		assert.True(t, refreshed.expiration.After(expiration))
+	})
+}
+
+type failingCreateStore struct {
+	secrets.Store
+}
+
+func (s failingCreateStore) CreateDataKey(_ context.Context, _ *secrets.DataKey) error {
+	return errors.New("database is read-only")
+}
+
+func TestSecretsService_CurrentDataKeyLock(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, failingCreateStore{Store: fakes.NewFakeSecretsStore()})
+
+	t.Run("failing data key creation should release the lock", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			for i := 0; i < 2; i++ {
+				_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+				assert.ErrorContains(t, err, "database is read-only")
+			}
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("deadlock: the lock was not released after a failing data key creation")
+		}
+
+		require.True(t, svc.mtx.TryLock())
+		svc.mtx.Unlock()
+	})
+}
+
+func TestSecretsService_EncryptNoCreate(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{Store: fakes.NewFakeSecretsStore()}
+	svc := SetupTestService(t, store)
+
+	t.Run("without current data key, it should fail with no data key created", func(t *testing.T) {
+		_, err := svc.EncryptNoCreate(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.ErrorIs(t, err, secrets.ErrNoCurrentKey)
+		assert.Zero(t, store.created)
+	})
+
+	t.Run("with current data key, it should encrypt with it", func(t *testing.T) {
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		require.Equal(t, 1, store.created)
+
+		encrypted, err := svc.EncryptNoCreate(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		assert.Equal(t, 1, store.created)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+}
+
+func TestSecretsService_KeyCreationRateLimit(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+	svc.keyCreationLimiter = rate.NewLimiter(rate.Every(time.Hour), 2)
+
+	throttled := testutil.ToFloat64(keyCreationsThrottledCounter)
+
+	for _, scope := range []string{"org:1", "org:2"} {
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope(scope))
+		require.NoError(t, err)
+	}
+
+	t.Run("data key creation over the limit should be throttled", func(t *testing.T) {
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("org:3"))
+		require.ErrorIs(t, err, secrets.ErrKeyCreationThrottled)
+		assert.Equal(t, throttled+1, testutil.ToFloat64(keyCreationsThrottledCounter))
+	})
+
+	t.Run("existing data keys should be used regardless of the limit", func(t *testing.T) {
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("org:1"))
+		require.NoError(t, err)
+	})
+}
+
+func TestSecretsService_DataKeyIdGenerator(t *testing.T) {
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+
+	t.Run("custom generator should be used for new data keys", func(t *testing.T) {
+		svc := SetupTestService(t, store)
+		svc.SetDataKeyIdGenerator(func(providerID secrets.ProviderID) string {
+			kind, _ := providerID.Kind()
+			return fmt.Sprintf("%s-%d-%s", kind, time.Now().Unix(), util.GenerateShortUID())
+		})
+
+		plaintext := []byte("grafana")
+		encrypted, err := svc.Encrypt(ctx, plaintext, secrets.WithScope("user:1"))
+		require.NoError(t, err)
+
+		// We simulate an instance restart, to force the data key to be fetched from database.
+		svc.dataKeyCache.flush()
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+
+		keyId, _, err := decodeEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(keyId, "secretKey-"))
+
+		_, err = store.GetDataKey(ctx, keyId)
+		require.NoError(t, err)
+	})
+
+	t.Run("invalid data key ids should be rejected", func(t *testing.T) {
+		svc := SetupTestService(t, store)
+		svc.SetDataKeyIdGenerator(func(secrets.ProviderID) string {
+			return strings.Repeat("a", maxDataKeyIdLength+1)
+		})
+
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("user:2"))
+		require.Error(t, err)
+	})
+}
+
+func TestSecretsService_DecryptMalformedKeyId(t *testing.T) {
+	store := &countingStore{Store: fakes.NewFakeSecretsStore()}
+	svc := SetupTestService(t, store)
+
+	garbage := []byte{0x00, 0xff, 0x13, 0x37, 0xc3, 0x28, 0x0a, 0x20}
+	payload := encodeEnvelope(string(garbage), []byte("ciphertext"))
+
+	_, err := svc.Decrypt(context.Background(), payload)
+	require.ErrorIs(t, err, secrets.ErrInvalidPayloadFormat)
+	assert.Zero(t, store.fetched, "data keys should not be looked up for malformed key ids")
+}
+
+func TestSecretsService_Decrypt(t *testing.T) {
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+
+	t.Run("empty payload should fail", func(t *testing.T) {
+		svc := SetupTestService(t, store)
+		_, err := svc.Decrypt(context.Background(), []byte(""))
+		require.Error(t, err)
+
+		assert.Equal(t, "unable to decrypt empty payload", err.Error())
+	})
+
+	t.Run("ee encrypted payload with ee disabled should fail", func(t *testing.T) {
+		svc := SetupTestService(t, store)
+		ciphertext, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		svc = SetupDisabledTestService(t, store)
+
+		_, err = svc.Decrypt(ctx, ciphertext)
+		assert.Error(t, err)
+	})
+
+	t.Run("ee encrypted payload with providers initialized should work", func(t *testing.T) {
+		svc := SetupTestService(t, store)
+		ciphertext, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		svc = SetupDisabledTestService(t, store)
+		err = svc.InitProviders()
+		require.NoError(t, err)
+
+		plaintext, err := svc.Decrypt(ctx, ciphertext)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), plaintext)
+	})
+
+	t.Run("ee encrypted payload with ee enabled should work", func(t *testing.T) {
+		svc := SetupTestService(t, store)
+		ciphertext, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		plaintext, err := svc.Decrypt(ctx, ciphertext)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), plaintext)
+	})
+
+	t.Run("legacy payload should always work", func(t *testing.T) {
+		encrypted := []byte{122, 56, 53, 113, 101, 117, 73, 89, 20, 254, 36, 112, 112, 16, 128, 232, 227, 52, 166, 108, 192, 5, 28, 125, 126, 42, 197, 190, 251, 36, 94}
+
+		svc := SetupTestService(t, store)
+		decrypted, err := svc.Decrypt(context.Background(), encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		svc = SetupDisabledTestService(t, store)
+		decrypted, err = svc.Decrypt(context.Background(), encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+}
+
+type identityProvider struct{}
+
+func (identityProvider) Encrypt(_ context.Context, blob []byte) ([]byte, error) {
+	return blob, nil
+}
+
+func (identityProvider) Decrypt(_ context.Context, blob []byte) ([]byte, error) {
+	return blob, nil
+}
+
+func TestSecretsService_EncryptWithEscrow(t *testing.T) {
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
 	svc := SetupTestService(t, store)
+	svc.providers["escrow.v1"] = identityProvider{}
 
-	t.Run("should stop with no error once the context's finished", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
-		defer cancel()
+	plaintext := []byte("grafana")
 
-		err := svc.Run(ctx)
-		assert.NoError(t, err)
+	t.Run("unknown escrow providers should be rejected", func(t *testing.T) {
+		_, err := svc.EncryptWithEscrow(ctx, plaintext, secrets.WithoutScope(), "unknown.v1")
+		require.Error(t, err)
 	})
 
-	t.Run("should trigger cache clean up", func(t *testing.T) {
-		restoreTimeNowAfterTestExec(t)
+	t.Run("payload should be decryptable from the escrow copy", func(t *testing.T) {
+		ciphertext, err := svc.EncryptWithEscrow(ctx, plaintext, secrets.WithoutScope(), "escrow.v1")
+		require.NoError(t, err)
 
-		// Encrypt to force data encryption key generation
-		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		keyId, _, err := decodeEnvelope(ciphertext)
 		require.NoError(t, err)
 
-		// Ten minutes later (after caution period)
-		// Look SecretsService.cacheDataKey for more details.
-		now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+		escrowCopy, err := store.GetDataKey(ctx, secrets.EscrowDataKeyId(keyId, 0))
+		require.NoError(t, err)
+		assert.Equal(t, secrets.ProviderID("escrow.v1"), escrowCopy.Provider)
 
-		// Decrypt to ensure data encryption key is cached
-		_, err = svc.Decrypt(ctx, encrypted)
+		// Regular encryption should not use the data key with escrow copies.
+		regular, err := svc.Encrypt(ctx, plaintext, secrets.WithoutScope())
+		require.NoError(t, err)
+		regularKeyId, _, err := decodeEnvelope(regular)
 		require.NoError(t, err)
+		assert.NotEqual(t, keyId, regularKeyId)
 
-		// Data encryption key cache should contain one element
-		require.Len(t, svc.dataKeyCache.byId, 1)
-		require.Len(t, svc.dataKeyCache.byLabel, 1)
+		// We simulate the loss of the data key, so only the escrow copy remains.
+		require.NoError(t, store.DeleteDataKey(ctx, keyId))
+		svc.dataKeyCache.flush()
 
-		// Twenty minutes later (after caution period + cache ttl)
-		now = func() time.Time { return time.Now().Add(20 * time.Minute) }
+		decrypted, err := svc.Decrypt(ctx, ciphertext)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+	})
+}
 
-		ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
-		defer cancel()
+func TestSecretsService_ProvidersForKey(t *testing.T) {
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+	svc.providers["escrow.v1"] = identityProvider{}
+	svc.providers["escrow.v2"] = identityProvider{}
 
-		err = svc.Run(ctx)
+	t.Run("unknown data key should fail", func(t *testing.T) {
+		_, err := svc.ProvidersForKey(ctx, "unknown")
+		require.ErrorIs(t, err, secrets.ErrDataKeyNotFound)
+	})
+
+	ciphertext, err := svc.EncryptWithEscrow(ctx, []byte("grafana"), secrets.WithoutScope(), "escrow.v2", "escrow.v1")
+	require.NoError(t, err)
+	keyId, _, err := decodeEnvelope(ciphertext)
+	require.NoError(t, err)
+
+	t.Run("data key provider should come first, then escrow providers", func(t *testing.T) {
+		providers, err := svc.ProvidersForKey(ctx, keyId)
 		require.NoError(t, err)
+		assert.Equal(t, []secrets.ProviderID{svc.currentProviderID, "escrow.v1", "escrow.v2"}, providers)
+	})
 
-		// Then, once the ticker has been triggered,
-		// the cleanup process should have happened,
-		// therefore the cache should be empty.
-		require.Len(t, svc.dataKeyCache.byId, 0)
-		require.Len(t, svc.dataKeyCache.byLabel, 0)
+	t.Run("providers not configured should be left out", func(t *testing.T) {
+		delete(svc.providers, "escrow.v1")
+		t.Cleanup(func() { svc.providers["escrow.v1"] = identityProvider{} })
+
+		providers, err := svc.ProvidersForKey(ctx, keyId)
+		require.NoError(t, err)
+		assert.Equal(t, []secrets.ProviderID{svc.currentProviderID, "escrow.v2"}, providers)
+	})
+
+	t.Run("escrow copies should be enough without the data key", func(t *testing.T) {
+		require.NoError(t, store.DeleteDataKey(ctx, keyId))
+
+		providers, err := svc.ProvidersForKey(ctx, keyId)
+		require.NoError(t, err)
+		assert.Equal(t, []secrets.ProviderID{"escrow.v1", "escrow.v2"}, providers)
 	})
 }
 
-func TestSecretsService_ReEncryptDataKeys(t *testing.T) {
+func TestSecretsService_DecryptNoCache(t *testing.T) {
 	ctx := context.Background()
 	testDB := db.InitTestDB(t)
-	store := database.ProvideSecretsStore(testDB)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
 	svc := SetupTestService(t, store)
 
-	// Encrypt to generate data encryption key
-	withoutScope := secrets.WithoutScope()
-	ciphertext, err := svc.Encrypt(ctx, []byte("grafana"), withoutScope)
+	plaintext := []byte("grafana")
+	ciphertext, err := svc.Encrypt(ctx, plaintext, secrets.WithoutScope())
 	require.NoError(t, err)
 
-	t.Run("existing key should be re-encrypted", func(t *testing.T) {
-		prevDataKeys, err := store.GetAllDataKeys(ctx)
+	t.Run("should decrypt without caching the data key", func(t *testing.T) {
+		svc.dataKeyCache.flush()
+
+		decrypted, err := svc.DecryptNoCache(ctx, ciphertext)
 		require.NoError(t, err)
-		require.Len(t, prevDataKeys, 1)
+		assert.Equal(t, plaintext, decrypted)
 
-		err = svc.ReEncryptDataKeys(ctx)
+		assert.Empty(t, svc.dataKeyCache.byId)
+		assert.Empty(t, svc.dataKeyCache.byLabel)
+	})
+
+	t.Run("should not be served from cache", func(t *testing.T) {
+		// Decrypt to ensure data key is cached
+		_, err := svc.Decrypt(ctx, ciphertext)
+		require.NoError(t, err)
+		require.NotEmpty(t, svc.dataKeyCache.byId)
+
+		keyId, _, err := decodeEnvelope(ciphertext)
 		require.NoError(t, err)
+		require.NoError(t, store.DeleteDataKey(ctx, keyId))
 
-		reEncryptedDataKeys, err := store.GetAllDataKeys(ctx)
+		// The cached data key still works for regular decryption...
+		_, err = svc.Decrypt(ctx, ciphertext)
 		require.NoError(t, err)
-		require.Len(t, reEncryptedDataKeys, 1)
 
-		assert.NotEqual(t, prevDataKeys[0].EncryptedData, reEncryptedDataKeys[0].EncryptedData)
+		// ...but not when bypassing the cache.
+		_, err = svc.DecryptNoCache(ctx, ciphertext)
+		require.ErrorIs(t, err, secrets.ErrDataKeyNotFound)
+
+		// And the cache remains untouched.
+		assert.NotEmpty(t, svc.dataKeyCache.byId)
 	})
+}
 
-	t.Run("data keys cache should be invalidated", func(t *testing.T) {
-		restoreTimeNowAfterTestExec(t)
+func TestSecretsService_VerifyDecrypts(t *testing.T) {
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	svc := SetupTestService(t, database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB)))
 
-		// Ten minutes later (after caution period)
-		// Look SecretsService.cacheDataKey for more details.
-		now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+	plaintext := []byte("grafana")
+	ciphertext, err := svc.Encrypt(ctx, plaintext, secrets.WithoutScope())
+	require.NoError(t, err)
 
-		// Decrypt to ensure data key is cached
-		_, err := svc.Decrypt(ctx, ciphertext)
+	t.Run("matching hash", func(t *testing.T) {
+		ok, err := svc.VerifyDecrypts(ctx, ciphertext, sha256.Sum256(plaintext))
 		require.NoError(t, err)
-		require.NotEmpty(t, svc.dataKeyCache.byId)
-		require.NotEmpty(t, svc.dataKeyCache.byLabel)
+		assert.True(t, ok)
+	})
 
-		err = svc.ReEncryptDataKeys(ctx)
+	t.Run("non-matching hash", func(t *testing.T) {
+		ok, err := svc.VerifyDecrypts(ctx, ciphertext, sha256.Sum256([]byte("another")))
 		require.NoError(t, err)
+		assert.False(t, ok)
+	})
 
-		assert.Empty(t, svc.dataKeyCache.byId)
-		assert.Empty(t, svc.dataKeyCache.byLabel)
+	t.Run("undecryptable payload", func(t *testing.T) {
+		ok, err := svc.VerifyDecrypts(ctx, []byte("#invalid#"), sha256.Sum256(plaintext))
+		require.Error(t, err)
+		assert.False(t, ok)
 	})
 }
 
-func TestSecretsService_Decrypt(t *testing.T) {
+func TestSecretsService_DecryptWithRawKey(t *testing.T) {
 	ctx := context.Background()
-	testDB := db.InitTestDB(t)
-	store := database.ProvideSecretsStore(testDB)
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
 
-	t.Run("empty payload should fail", func(t *testing.T) {
-		svc := SetupTestService(t, store)
-		_, err := svc.Decrypt(context.Background(), []byte(""))
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	keyId, _, err := decodeEnvelope(encrypted)
+	require.NoError(t, err)
+	_, rawDataKey, err := svc.fetchDataKeyById(ctx, keyId)
+	require.NoError(t, err)
+
+	// The store is no longer available.
+	require.NoError(t, store.DeleteDataKey(ctx, keyId))
+	svc.dataKeyCache.flush()
+
+	t.Run("payload should be decrypted with the raw data key", func(t *testing.T) {
+		for _, id := range []string{"", keyId} {
+			decrypted, err := svc.DecryptWithRawKey(ctx, encrypted, rawDataKey, id)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), decrypted)
+		}
+	})
+
+	t.Run("mismatching data key id should be rejected", func(t *testing.T) {
+		_, err := svc.DecryptWithRawKey(ctx, encrypted, rawDataKey, "another")
+		require.ErrorContains(t, err, "not 'another'")
+	})
+
+	t.Run("legacy payload should be rejected", func(t *testing.T) {
+		legacy, err := svc.enc.Encrypt(ctx, []byte("grafana"), "secretKey")
+		require.NoError(t, err)
+
+		_, err = svc.DecryptWithRawKey(ctx, legacy, rawDataKey, "")
 		require.Error(t, err)
+	})
+}
 
-		assert.Equal(t, "unable to decrypt empty payload", err.Error())
+func TestSecretsService_DecryptLegacy(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	const anotherSecretKey = "anotherSecretKey"
+	legacy, err := svc.enc.Encrypt(ctx, []byte("grafana"), anotherSecretKey)
+	require.NoError(t, err)
+
+	t.Run("legacy payload should be decrypted with the given secret key", func(t *testing.T) {
+		decrypted, err := svc.DecryptLegacy(ctx, legacy, anotherSecretKey)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		// The instance's secret key cannot decrypt it.
+		decrypted, err = svc.Decrypt(ctx, legacy)
+		require.NoError(t, err)
+		assert.NotEqual(t, []byte("grafana"), decrypted)
 	})
 
-	t.Run("ee encrypted payload with ee disabled should fail", func(t *testing.T) {
-		svc := SetupTestService(t, store)
-		ciphertext, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	t.Run("envelope encrypted payload should be rejected", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
 		require.NoError(t, err)
 
-		svc = SetupDisabledTestService(t, store)
+		_, err = svc.DecryptLegacy(ctx, encrypted, anotherSecretKey)
+		require.ErrorContains(t, err, "envelope encrypted payload")
+	})
+}
 
-		_, err = svc.Decrypt(ctx, ciphertext)
+func TestSecretsService_PreviousSecretKeys(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupDisabledTestService(t, fakes.NewFakeSecretsStore())
+	svc.previousSecretKeys = []string{"newer-secret-key", "older-secret-key"}
+	// Short payloads used to be decrypted with the wrong secret key, when
+	// the garbage returned happened to be valid UTF-8, so they're covered too.
+	payload := []byte("pass")
+
+	for _, secretKey := range []string{"SdlklWklckeLS", "newer-secret-key", "older-secret-key"} {
+		encrypted := encryptLegacyGCM(t, payload, secretKey)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err, secretKey)
+		assert.Equal(t, payload, decrypted, secretKey)
+	}
+
+	t.Run("new payloads should be encrypted with the current secret key", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		decrypted, err := svc.DecryptLegacy(ctx, encrypted, svc.legacySecretKey())
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("payloads encrypted with an unknown secret key should not be decrypted", func(t *testing.T) {
+		_, err := svc.Decrypt(ctx, encryptLegacyGCM(t, payload, "unknown-secret-key"))
 		assert.Error(t, err)
 	})
 
-	t.Run("ee encrypted payload with providers initialized should work", func(t *testing.T) {
-		svc := SetupTestService(t, store)
-		ciphertext, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	t.Run("unauthenticated payloads should only be decrypted with the current secret key", func(t *testing.T) {
+		encrypted, err := svc.enc.Encrypt(ctx, payload, svc.legacySecretKey())
 		require.NoError(t, err)
 
-		svc = SetupDisabledTestService(t, store)
-		err = svc.InitProviders()
+		decrypted, err := svc.Decrypt(ctx, encrypted)
 		require.NoError(t, err)
+		assert.Equal(t, payload, decrypted)
 
-		plaintext, err := svc.Decrypt(ctx, ciphertext)
-		assert.NoError(t, err)
-		assert.Equal(t, []byte("grafana"), plaintext)
+		for i := 0; i < 100; i++ {
+			encrypted, err := svc.enc.Encrypt(ctx, payload, "newer-secret-key")
+			require.NoError(t, err)
+
+			decrypted, _ := svc.Decrypt(ctx, encrypted)
+			require.NotEqual(t, payload, decrypted)
+		}
 	})
+}
 
-	t.Run("ee encrypted payload with ee enabled should work", func(t *testing.T) {
-		svc := SetupTestService(t, store)
-		ciphertext, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+func TestSecretsService_GetDecryptedValueE(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	sjd := map[string][]byte{
+		"valid":   encrypted,
+		"invalid": []byte("#aW52YWxpZA#invalid"),
+	}
+
+	value, err := svc.GetDecryptedValueE(ctx, sjd, "valid", "fallback")
+	require.NoError(t, err)
+	assert.Equal(t, "grafana", value)
+
+	value, err = svc.GetDecryptedValueE(ctx, sjd, "missing", "fallback")
+	require.NoError(t, err)
+	assert.Equal(t, "fallback", value)
+
+	_, err = svc.GetDecryptedValueE(ctx, sjd, "invalid", "fallback")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "key 'invalid'")
+
+	t.Run("lenient method should keep falling back on decryption errors", func(t *testing.T) {
+		assert.Equal(t, "fallback", svc.GetDecryptedValue(ctx, sjd, "invalid", "fallback"))
+	})
+}
+
+func TestSecretsService_DecryptJsonDataMaxEntries(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	sjd, err := svc.EncryptJsonData(ctx, map[string]string{"a": "1", "b": "2", "c": "3"}, secrets.WithoutScope())
+	require.NoError(t, err)
+
+	observed := func() uint64 {
+		var m dto.Metric
+		require.NoError(t, jsonDataEntriesHistogram.Write(&m))
+		return m.GetHistogram().GetSampleCount()
+	}
+
+	t.Run("unlimited by default", func(t *testing.T) {
+		before := observed()
+
+		decrypted, err := svc.DecryptJsonData(ctx, sjd)
 		require.NoError(t, err)
+		assert.Len(t, decrypted, 3)
+		assert.Equal(t, before+1, observed())
+	})
 
-		plaintext, err := svc.Decrypt(ctx, ciphertext)
-		assert.NoError(t, err)
-		assert.Equal(t, []byte("grafana"), plaintext)
+	t.Run("maps above the maximum should be rejected", func(t *testing.T) {
+		svc.jsonDataMaxEntries = 2
+		t.Cleanup(func() { svc.jsonDataMaxEntries = 0 })
+
+		_, err := svc.DecryptJsonData(ctx, sjd)
+		require.ErrorIs(t, err, errJsonDataTooLarge)
+
+		delete(sjd, "c")
+		decrypted, err := svc.DecryptJsonData(ctx, sjd)
+		require.NoError(t, err)
+		assert.Len(t, decrypted, 2)
 	})
+}
 
-	t.Run("legacy payload should always work", func(t *testing.T) {
-		encrypted := []byte{122, 56, 53, 113, 101, 117, 73, 89, 20, 254, 36, 112, 112, 16, 128, 232, 227, 52, 166, 108, 192, 5, 28, 125, 126, 42, 197, 190, 251, 36, 94}
+func TestSecretsService_EncryptWithKeyId(t *testing.T) {
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+	svc := SetupTestService(t, store)
 
-		svc := SetupTestService(t, store)
-		decrypted, err := svc.Decrypt(context.Background(), encrypted)
+	_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	dataKeys, err := store.GetAllDataKeys(ctx)
+	require.NoError(t, err)
+	require.Len(t, dataKeys, 1)
+	keyId := dataKeys[0].Id
+
+	require.NoError(t, svc.RotateDataKeys(ctx))
+
+	t.Run("disabled data key should be used", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithKeyId(ctx, []byte("grafana"), keyId)
+		require.NoError(t, err)
+
+		id, _, err := decodeEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, keyId, id)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
 		require.NoError(t, err)
 		assert.Equal(t, []byte("grafana"), decrypted)
+	})
 
-		svc = SetupDisabledTestService(t, store)
-		decrypted, err = svc.Decrypt(context.Background(), encrypted)
+	t.Run("unknown data key should fail", func(t *testing.T) {
+		_, err := svc.EncryptWithKeyId(ctx, []byte("grafana"), "unknown")
+		require.ErrorIs(t, err, secrets.ErrDataKeyNotFound)
+		assert.Contains(t, err.Error(), "unknown data key 'unknown'")
+	})
+}
+
+// truncatingProvider decrypts any data key to the wrong length.
+type truncatingProvider struct {
+	identityProvider
+}
+
+func (truncatingProvider) Decrypt(_ context.Context, blob []byte) ([]byte, error) {
+	return blob[:len(blob)/2], nil
+}
+
+func TestSecretsService_DataKeyCorrupted(t *testing.T) {
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+	svc.providers["truncating.v1"] = truncatingProvider{}
+
+	rawDataKey, err := svc.newRandomDataKey()
+	require.NoError(t, err)
+
+	require.NoError(t, store.CreateDataKey(ctx, &secrets.DataKey{
+		Active:        true,
+		Id:            "corrupted",
+		Label:         "corrupted-label",
+		Scope:         "root",
+		Provider:      "truncating.v1",
+		EncryptedData: rawDataKey,
+	}))
+
+	corrupted := func() float64 {
+		return testutil.ToFloat64(dataKeysCorruptedCounter.WithLabelValues("truncating.v1"))
+	}
+	before := corrupted()
+
+	_, err = svc.Decrypt(ctx, encodeEnvelope("corrupted", []byte("ciphertext")))
+	require.ErrorIs(t, err, secrets.ErrDataKeyCorrupted)
+
+	_, _, err = svc.dataKeyByLabel(ctx, "corrupted-label")
+	require.ErrorIs(t, err, secrets.ErrDataKeyCorrupted)
+
+	assert.Equal(t, before+2, corrupted())
+}
+
+func TestSecretsService_DecryptRetry(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	keyId, _, err := decodeEnvelope(encrypted)
+	require.NoError(t, err)
+
+	enc := svc.enc
+	t.Cleanup(func() { svc.enc = enc })
+
+	corruptCache := func() {
+		svc.dataKeyCache.addById(&dataKeyCacheEntry{id: keyId, dataKey: []byte("corrupted"), active: true})
+	}
+	retries := func(success string) float64 {
+		return testutil.ToFloat64(decryptRetriesCounter.WithLabelValues(success))
+	}
+
+	t.Run("corrupted cached data key should be invalidated", func(t *testing.T) {
+		corruptCache()
+		svc.enc = rejectingEncryption{Internal: enc, reject: func(secret string) bool { return secret == "corrupted" }}
+		succeeded := retries("true")
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
 		require.NoError(t, err)
 		assert.Equal(t, []byte("grafana"), decrypted)
+		assert.Equal(t, succeeded+1, retries("true"))
+
+		entry, exists := svc.dataKeyCache.getById(keyId)
+		require.True(t, exists)
+		assert.NotEqual(t, []byte("corrupted"), entry.dataKey)
+	})
+
+	t.Run("decryption should be retried only once", func(t *testing.T) {
+		corruptCache()
+		svc.enc = rejectingEncryption{Internal: enc, reject: func(string) bool { return true }}
+		failed := retries("false")
+
+		_, err := svc.Decrypt(ctx, encrypted)
+		require.Error(t, err)
+		assert.Equal(t, failed+1, retries("false"))
+	})
+
+	t.Run("data keys not cached should not be retried", func(t *testing.T) {
+		svc.enc = rejectingEncryption{Internal: enc, reject: func(string) bool { return true }}
+		failed := retries("false")
+
+		_, err := svc.DecryptNoCache(ctx, encrypted)
+		require.Error(t, err)
+		assert.Equal(t, failed, retries("false"))
 	})
 }
 
@@ -530,7 +2136,7 @@ func TestIntegration_SecretsService(t *testing.T) {
 	for name, tc := range tcs {
 		t.Run(name, func(t *testing.T) {
 			testDB := db.InitTestDB(t)
-			svc := SetupTestService(t, database.ProvideSecretsStore(testDB))
+			svc := SetupTestService(t, database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB)))
 
 			// Here's what actually matters and varies on each test: look at the test case name.
 			//
@@ -566,3 +2172,19 @@ func restoreTimeNowAfterTestExec(t *testing.T) {
 	t.Helper()
 	t.Cleanup(func() { now = time.Now })
 }
+
+func BenchmarkSecretsService_Decrypt(b *testing.B) {
+	ctx := context.Background()
+	svc := SetupTestService(b, fakes.NewFakeSecretsStore())
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := svc.Decrypt(ctx, encrypted); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package manager
 
 import (
+	"strings"
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/grafana/grafana/pkg/infra/metrics"
@@ -12,6 +15,37 @@ const (
 	OpDecrypt = "decrypt"
 )
 
+const (
+	cacheMethodById    = "byId"
+	cacheMethodByLabel = "byLabel"
+
+	evictionReasonTTL         = "ttl"
+	evictionReasonFlush       = "flush"
+	evictionReasonInvalidated = "invalidated"
+)
+
+const (
+	scopeRoot    = "root"
+	scopeUser    = "user"
+	scopeOrg     = "org"
+	scopeOther   = "other"
+	scopeLegacy  = "legacy"
+	scopeUnknown = "unknown"
+)
+
+// scopeKind reduces the given scope (e.g. "user:10" or "org:1") to its kind,
+// so it can be used as a metric label without blowing up its cardinality.
+// Scopes of any kind not known in advance are reported as "other".
+func scopeKind(scope string) string {
+	kind, _, _ := strings.Cut(scope, ":")
+	switch kind {
+	case scopeRoot, scopeUser, scopeOrg:
+		return kind
+	default:
+		return scopeOther
+	}
+}
+
 var (
 	opsCounter = metricutil.NewCounterVecStartingAtZero(
 		prometheus.CounterOpts{
@@ -25,6 +59,27 @@ var (
 			"operation": {OpEncrypt, OpDecrypt},
 		},
 	)
+	scopeOpsCounter = metricutil.NewCounterVecStartingAtZero(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_scope_ops_total",
+			Help:      "A counter for encryption operations, by data key scope",
+		},
+		[]string{"success", "operation", "scope"},
+		map[string][]string{
+			"success":   {"true", "false"},
+			"operation": {OpEncrypt, OpDecrypt},
+			"scope":     {scopeRoot, scopeUser, scopeOrg, scopeOther, scopeLegacy, scopeUnknown},
+		},
+	)
+	providerOpsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_provider_ops_total",
+			Help:      "A counter for encryption providers calls, by provider kind",
+		},
+		[]string{"success", "operation", "provider_kind"},
+	)
 	cacheReadsCounter = metricutil.NewCounterVecStartingAtZero(
 		prometheus.CounterOpts{
 			Namespace: metrics.ExporterName,
@@ -37,11 +92,293 @@ var (
 			"method": {"byId", "byName"},
 		},
 	)
+	cacheEntriesAddedCounter = metricutil.NewCounterVecStartingAtZero(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_cache_entries_added_total",
+			Help:      "A counter for entries added to the encryption cache",
+		},
+		[]string{"method"},
+		map[string][]string{
+			"method": {cacheMethodById, cacheMethodByLabel},
+		},
+	)
+	cacheEntriesEvictedCounter = metricutil.NewCounterVecStartingAtZero(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_cache_entries_evicted_total",
+			Help:      "A counter for entries evicted from the encryption cache",
+		},
+		[]string{"method", "reason"},
+		map[string][]string{
+			"method": {cacheMethodById, cacheMethodByLabel},
+			"reason": {evictionReasonTTL, evictionReasonFlush, evictionReasonInvalidated},
+		},
+	)
+	cacheEntriesChurnCounter = metricutil.NewCounterVecStartingAtZero(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_cache_entries_churn_total",
+			Help:      "A counter for entries added back to the encryption cache shortly after being evicted",
+		},
+		[]string{"method"},
+		map[string][]string{
+			"method": {cacheMethodById, cacheMethodByLabel},
+		},
+	)
+	cacheEntriesAgeHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_cache_entries_age_seconds",
+			Help:      "Histogram of the age of the entries evicted from the encryption cache",
+			Buckets:   []float64{1, 10, 30, 60, 300, 600, 900, 1800, 3600},
+		},
+		[]string{"method"},
+	)
+	envelopeOverheadHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_envelope_overhead_bytes",
+			Help:      "Histogram of the bytes added by envelope encryption to the encrypted payloads",
+			Buckets:   []float64{32, 48, 64, 80, 96, 128, 192, 256},
+		},
+	)
+	jsonDataEntriesHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_json_data_entries",
+			Help:      "Histogram of the amount of entries of the secure JSON data maps decrypted",
+			Buckets:   []float64{1, 2, 5, 10, 20, 50, 100, 500, 1000},
+		},
+	)
+	legacyUpgradesCounter = metricutil.NewCounterVecStartingAtZero(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_legacy_upgrades_total",
+			Help:      "A counter for legacy secrets decrypted and queued for upgrade to envelope encryption, by result",
+		},
+		[]string{"result"},
+		map[string][]string{
+			"result": {legacyUpgradeEnqueued, legacyUpgradeDropped, legacyUpgradeUpgraded, legacyUpgradeFailed},
+		},
+	)
+	credentialsRefreshCounter = metricutil.NewCounterVecStartingAtZero(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_provider_credentials_refreshes_total",
+			Help:      "A counter for encryption providers credentials refreshes",
+		},
+		[]string{"success"},
+		map[string][]string{
+			"success": {"true", "false"},
+		},
+	)
+	decryptRetriesCounter = metricutil.NewCounterVecStartingAtZero(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_decrypt_retries_total",
+			Help:      "A counter for decryptions retried after invalidating the cached data key",
+		},
+		[]string{"success"},
+		map[string][]string{
+			"success": {"true", "false"},
+		},
+	)
+	dataKeysCorruptedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_data_keys_corrupted_total",
+			Help:      "A counter for data keys decrypted by an encryption provider to an unexpected length",
+		},
+		[]string{"provider"},
+	)
+	keyCreationsThrottledCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_data_key_creations_throttled_total",
+			Help:      "A counter for data key creations rejected by the rate limiter",
+		},
+	)
+	providerQueueDepthGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_provider_queue_depth",
+			Help:      "The current amount of calls waiting for the encryption provider concurrency limit",
+		},
+		[]string{"provider"},
+	)
+	reEncryptRateGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_re_encrypt_provider_rate_limit",
+			Help:      "The maximum rate of encryption providers calls per second of the last data keys re-encryption, zero if unlimited",
+		},
+	)
+	reEncryptThrottleWaitHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_re_encrypt_throttle_wait_seconds",
+			Help:      "Histogram of the time the data keys re-encryption waited for the providers rate limit",
+			Buckets:   []float64{.001, .01, .05, .1, .5, 1, 5, 10},
+		},
+	)
+	decryptInFlightGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_decrypt_in_flight",
+			Help:      "The current amount of payloads being decrypted",
+		},
+	)
+	opsDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_ops_duration_seconds",
+			Help:      "Histogram of the time spent by encryption operations",
+			Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		},
+		[]string{"operation"},
+	)
+	decryptQueueWaitHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_decrypt_queue_wait_seconds",
+			Help:      "Histogram of the time spent waiting for the decryption concurrency limit",
+			Buckets:   []float64{.0001, .001, .005, .01, .05, .1, .5, 1, 5},
+		},
+	)
+	backgroundProviderFailuresCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_background_provider_failures_total",
+			Help:      "A counter for background encryption providers failures",
+		},
+		[]string{"provider"},
+	)
+	shutdownTimeoutsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_shutdown_timeouts_total",
+			Help:      "A counter for shutdowns that timed out waiting for background encryption providers to stop",
+		},
+	)
+	providerDegradedGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_provider_degraded",
+			Help:      "Whether the encryption provider is degraded (1) after its background process failed",
+		},
+		[]string{"provider"},
+	)
+	dataKeyAgeGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_data_key_age_seconds",
+			Help:      "The age of the oldest current data key, NaN if unknown",
+		},
+	)
+	currentDataKeyAgeGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_current_data_key_age_seconds",
+			Help:      "The age of the oldest data key cached for encryption, across all the scopes, zero if none",
+		},
+	)
+	dataKeysRejectedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_data_keys_rejected_total",
+			Help:      "A counter for degenerate data keys generated by the random source and discarded",
+		},
+	)
+	keyAuditFailuresCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_key_audit_failures_total",
+			Help:      "A counter for data keys operations that failed to be recorded into the key audit sink",
+		},
+	)
+	dataKeysQuarantinedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_data_keys_quarantined_total",
+			Help:      "A counter for data keys quarantined after repeatedly failing to be decrypted",
+		},
+	)
+	dataKeysQuarantineUntrackedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_data_keys_quarantine_untracked_total",
+			Help:      "A counter for failures to decrypt data keys not tracked by the quarantine, as too many data keys are quarantined",
+		},
+	)
+	currentKeyReconciliationsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_current_data_key_reconciliations_total",
+			Help:      "A counter for stale cached current data keys swapped for the current one in the store",
+		},
+	)
+	cacheEntriesGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "encryption_cache_entries",
+			Help:      "The current amount of entries in the encryption cache",
+		},
+		[]string{"method"},
+	)
 )
 
-func init() {
-	prometheus.MustRegister(
+func collectors() []prometheus.Collector {
+	return []prometheus.Collector{
 		opsCounter,
+		scopeOpsCounter,
+		opsDurationHistogram,
+		providerOpsCounter,
 		cacheReadsCounter,
-	)
+		cacheEntriesAddedCounter,
+		cacheEntriesEvictedCounter,
+		cacheEntriesChurnCounter,
+		cacheEntriesAgeHistogram,
+		cacheEntriesGauge,
+		credentialsRefreshCounter,
+		envelopeOverheadHistogram,
+		jsonDataEntriesHistogram,
+		legacyUpgradesCounter,
+		decryptRetriesCounter,
+		dataKeysCorruptedCounter,
+		dataKeyAgeGauge,
+		currentDataKeyAgeGauge,
+		currentKeyReconciliationsCounter,
+		keyAuditFailuresCounter,
+		dataKeysRejectedCounter,
+		dataKeysQuarantinedCounter,
+		dataKeysQuarantineUntrackedCounter,
+		keyCreationsThrottledCounter,
+		providerQueueDepthGauge,
+		reEncryptRateGauge,
+		reEncryptThrottleWaitHistogram,
+		decryptInFlightGauge,
+		decryptQueueWaitHistogram,
+		backgroundProviderFailuresCounter,
+		providerDegradedGauge,
+		shutdownTimeoutsCounter,
+	}
+}
+
+var registerMetricsOnce sync.Once
+
+// registerMetrics registers the encryption metrics into the default registerer. As metrics
+// are global, it's only done once: later calls are ignored. If instance isn't empty, all the
+// metrics are labelled with it (e.g. to tell nodes apart in a cluster).
+func registerMetrics(instance string) {
+	registerMetricsOnce.Do(func() {
+		mustRegisterMetrics(prometheus.DefaultRegisterer, instance)
+	})
+}
+
+func mustRegisterMetrics(registerer prometheus.Registerer, instance string) {
+	if instance != "" {
+		registerer = prometheus.WrapRegistererWith(prometheus.Labels{"instance_name": instance}, registerer)
+	}
+	registerer.MustRegister(collectors()...)
 }
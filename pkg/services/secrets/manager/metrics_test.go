@@ -0,0 +1,57 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScopeKind(t *testing.T) {
+	tcs := map[string]string{
+		"root":          scopeRoot,
+		"user:10":       scopeUser,
+		"org:1":         scopeOrg,
+		"datasource:1":  scopeOther,
+		"":              scopeOther,
+		"user":          scopeUser,
+		"root:whatever": scopeRoot,
+	}
+
+	for scope, expected := range tcs {
+		assert.Equal(t, expected, scopeKind(scope), scope)
+	}
+}
+
+func TestMustRegisterMetrics(t *testing.T) {
+	opsCounter.WithLabelValues("true", OpEncrypt).Inc()
+
+	labelled := func(instance string) bool {
+		registry := prometheus.NewRegistry()
+		mustRegisterMetrics(registry, instance)
+
+		families, err := registry.Gather()
+		require.NoError(t, err)
+
+		var found bool
+		for _, family := range families {
+			if family.GetName() != "grafana_encryption_ops_total" {
+				continue
+			}
+
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() == "instance_name" {
+						found = true
+						assert.Equal(t, instance, label.GetValue())
+					}
+				}
+			}
+		}
+		return found
+	}
+
+	assert.False(t, labelled(""))
+	assert.True(t, labelled("node-1"), "encryption metrics should be labelled with the instance name")
+}
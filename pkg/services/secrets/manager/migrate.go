@@ -0,0 +1,102 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/kmsproviders"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// MigratePayload checks whether the given payload still depends on an encryption provider
+// other than the current one, and if so, it returns the payload re-encrypted with the current
+// data key for its scope, so the payload keeps being decryptable once the configuration of
+// the old provider is removed. The returned bool indicates whether the payload was rewritten.
+//
+// Note that ReEncryptDataKeys re-encrypts data keys in place (the identifiers don't change),
+// so payloads only need to be rewritten when their data keys haven't been re-encrypted yet,
+// or when they were encrypted with the legacy encryption.
+//
+// It fails if the provider of the payload's data key isn't reachable (i.e. configured) anymore.
+func (s *SecretsService) MigratePayload(ctx context.Context, payload []byte) ([]byte, bool, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.MigratePayload")
+	defer span.End()
+
+	if s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
+		return payload, false, nil
+	}
+
+	// Legacy payloads have no scope, so they are migrated to the default one.
+	if !s.encryptedWithEnvelopeEncryption(payload) {
+		migrated, err := s.reEncrypt(ctx, payload, secrets.WithoutScope()())
+		return migrated, err == nil, err
+	}
+
+	keyId, _, err := decodeEnvelope(payload)
+	if err != nil {
+		return nil, false, err
+	}
+
+	dataKey, err := s.store.GetDataKey(ctx, keyId)
+	if err != nil {
+		return nil, false, err
+	}
+
+	providerID := kmsproviders.NormalizeProviderID(dataKey.Provider)
+	if _, exists := s.providers[providerID]; !exists {
+		return nil, false, fmt.Errorf("data key '%s' is encrypted by an unreachable encryption provider '%s'", keyId, providerID)
+	}
+
+	if providerID == s.currentProviderID {
+		return payload, false, nil
+	}
+
+	migrated, err := s.reEncrypt(ctx, payload, dataKey.Scope)
+	return migrated, err == nil, err
+}
+
+// reEncrypt decrypts the given payload and encrypts it again
+// with the current data key for the given scope.
+func (s *SecretsService) reEncrypt(ctx context.Context, payload []byte, scope string) ([]byte, error) {
+	decrypted, err := s.Decrypt(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.encrypt(ctx, decrypted, scope, encryptOptions{})
+}
+
+// NormalizeStoredProviders rewrites the providers of the stored data keys to their normalized
+// form (see kmsproviders.NormalizeProviderID), as data keys written by older versions may use
+// un-normalized identifiers, which provider-based reports and filters wouldn't match. It returns
+// how many data keys were updated. Data keys labels are left as is, so current data keys don't change.
+func (s *SecretsService) NormalizeStoredProviders(ctx context.Context) (int, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.NormalizeStoredProviders")
+	defer span.End()
+
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	drifted := make(map[secrets.ProviderID]secrets.ProviderID)
+	for _, dataKey := range dataKeys {
+		if normalized := kmsproviders.NormalizeProviderID(dataKey.Provider); normalized != dataKey.Provider {
+			drifted[dataKey.Provider] = normalized
+		}
+	}
+
+	var total int
+	for from, to := range drifted {
+		updated, err := s.store.UpdateDataKeysProvider(ctx, from, to)
+		if err != nil {
+			return total, err
+		}
+
+		s.log.Info("Normalized stored data keys provider", "from", from, "to", to, "updated", updated)
+		total += int(updated)
+	}
+
+	return total, nil
+}
@@ -0,0 +1,121 @@
+package manager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/kmsproviders"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_MigratePayload(t *testing.T) {
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+	svc.providers["identity.v1"] = identityProvider{}
+
+	plaintext := []byte("grafana")
+
+	payload, err := svc.Encrypt(ctx, plaintext, secrets.WithScope("org:1"))
+	require.NoError(t, err)
+
+	assertMigrated := func(t *testing.T, migrated []byte) {
+		t.Helper()
+
+		keyId, _, err := decodeEnvelope(migrated)
+		require.NoError(t, err)
+
+		dataKey, err := store.GetDataKey(ctx, keyId)
+		require.NoError(t, err)
+		assert.Equal(t, svc.currentProviderID, dataKey.Provider)
+
+		decrypted, err := svc.Decrypt(ctx, migrated)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+	}
+
+	t.Run("payload with current provider should not be rewritten", func(t *testing.T) {
+		migrated, rewritten, err := svc.MigratePayload(ctx, payload)
+		require.NoError(t, err)
+		assert.False(t, rewritten)
+		assert.Equal(t, payload, migrated)
+	})
+
+	t.Run("payload with previous provider should be rewritten", func(t *testing.T) {
+		svc.currentProviderID = "identity.v1"
+		t.Cleanup(func() { svc.currentProviderID = kmsproviders.Default })
+
+		migrated, rewritten, err := svc.MigratePayload(ctx, payload)
+		require.NoError(t, err)
+		assert.True(t, rewritten)
+		assertMigrated(t, migrated)
+
+		keyId, _, err := decodeEnvelope(migrated)
+		require.NoError(t, err)
+		dataKey, err := store.GetDataKey(ctx, keyId)
+		require.NoError(t, err)
+		assert.Equal(t, "org:1", dataKey.Scope)
+	})
+
+	t.Run("legacy payload should be rewritten", func(t *testing.T) {
+		legacy := []byte{122, 56, 53, 113, 101, 117, 73, 89, 20, 254, 36, 112, 112, 16, 128, 232, 227, 52, 166, 108, 192, 5, 28, 125, 126, 42, 197, 190, 251, 36, 94}
+
+		migrated, rewritten, err := svc.MigratePayload(ctx, legacy)
+		require.NoError(t, err)
+		assert.True(t, rewritten)
+		assertMigrated(t, migrated)
+	})
+
+	t.Run("payload with unreachable provider should fail", func(t *testing.T) {
+		svc.currentProviderID = "identity.v1"
+		delete(svc.providers, kmsproviders.Default)
+		t.Cleanup(func() { svc.currentProviderID = kmsproviders.Default })
+
+		_, rewritten, err := svc.MigratePayload(ctx, payload)
+		require.ErrorContains(t, err, "unreachable encryption provider")
+		assert.False(t, rewritten)
+	})
+}
+
+func TestSecretsService_NormalizeStoredProviders(t *testing.T) {
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	for _, id := range []string{"a", "b"} {
+		require.NoError(t, store.CreateDataKey(ctx, &secrets.DataKey{
+			Active:   true,
+			Id:       id,
+			Label:    secrets.KeyLabel("root", kmsproviders.Legacy),
+			Scope:    "root",
+			Provider: kmsproviders.Legacy,
+		}))
+	}
+
+	updated, err := svc.NormalizeStoredProviders(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, updated)
+
+	dataKeys, err := store.GetAllDataKeys(ctx)
+	require.NoError(t, err)
+	for _, dataKey := range dataKeys {
+		assert.Equal(t, secrets.ProviderID(kmsproviders.Default), dataKey.Provider)
+	}
+
+	t.Run("should be idempotent", func(t *testing.T) {
+		updated, err := svc.NormalizeStoredProviders(ctx)
+		require.NoError(t, err)
+		assert.Zero(t, updated)
+	})
+
+	decrypted, err := svc.Decrypt(ctx, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("grafana"), decrypted)
+}
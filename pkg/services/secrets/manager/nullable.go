@@ -0,0 +1,96 @@
+package manager
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// nilMarker flags the ciphertext of the nil payloads encrypted with EncryptNullable, right
+// after the envelope prefix, like deterministicMarker does for deterministic payloads.
+const nilMarker = '~'
+
+// nilOverhead is the length of the ciphertext of the nil payloads:
+// the marker, the GCM nonce and the GCM tag.
+const nilOverhead = 1 + 12 + 16
+
+var errNilAuthentication = errors.New("nil payload authentication failed")
+
+// EncryptNullable works like Encrypt, but a nil payload is encrypted to a distinct payload that
+// Decrypt returns as nil, while an empty (non-nil) payload is returned as an empty slice. So,
+// callers modeling optional secrets can tell a secret that was never set from an empty one.
+//
+// Nil payloads are authenticated with the data key, like any other payload, so an empty payload
+// cannot be turned into a nil one (or the other way around) without decryption failing.
+func (s *SecretsService) EncryptNullable(ctx context.Context, payload []byte, opt secrets.EncryptionOptions) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.EncryptNullable")
+	defer span.End()
+
+	if s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
+		return nil, fmt.Errorf("nullable encryption requires envelope encryption to be enabled")
+	}
+
+	if err := s.requireBuiltinEncryption("nullable encryption"); err != nil {
+		return nil, err
+	}
+
+	return s.encrypt(ctx, payload, opt(), encryptOptions{nullable: true})
+}
+
+// nilAEAD returns the AEAD used to encrypt nil payloads with the given data key.
+func nilAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(dataKey, "grafana-nil-encryption"))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// appendNil appends a nil payload, encrypted with the
+// given data key, to the given buffer, as follows:
+//
+//	~<nonce><tag>
+func appendNil(dst []byte, dataKey []byte) ([]byte, error) {
+	aead, err := nilAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dst = append(dst, nilMarker)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+
+	return aead.Seal(dst, nonce, nil, []byte{nilMarker}), nil
+}
+
+// openNil is the inverse of appendNil, for the given ciphertext without the nil marker.
+// It returns a nil plaintext once the payload has been authenticated.
+func openNil(dataKey []byte, ciphertext []byte) ([]byte, error) {
+	aead, err := nilAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) != aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("malformed nil payload")
+	}
+
+	nonce := ciphertext[:aead.NonceSize()]
+	if _, err := aead.Open(nil, nonce, ciphertext[aead.NonceSize():], []byte{nilMarker}); err != nil {
+		return nil, errNilAuthentication
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,79 @@
+package manager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_EncryptNullable(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	encryptedNil, err := svc.EncryptNullable(ctx, nil, secrets.WithoutScope())
+	require.NoError(t, err)
+
+	encryptedEmpty, err := svc.EncryptNullable(ctx, []byte{}, secrets.WithoutScope())
+	require.NoError(t, err)
+
+	t.Run("nil payloads should be decrypted as nil", func(t *testing.T) {
+		decrypted, err := svc.Decrypt(ctx, encryptedNil)
+		require.NoError(t, err)
+		assert.Nil(t, decrypted)
+	})
+
+	t.Run("empty payloads should be decrypted as empty", func(t *testing.T) {
+		decrypted, err := svc.Decrypt(ctx, encryptedEmpty)
+		require.NoError(t, err)
+		assert.NotNil(t, decrypted)
+		assert.Empty(t, decrypted)
+	})
+
+	t.Run("empty payloads encrypted with Encrypt should be decrypted as empty", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, nil, secrets.WithoutScope())
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.NotNil(t, decrypted)
+		assert.Empty(t, decrypted)
+	})
+
+	t.Run("non-empty payloads should be decrypted as usual", func(t *testing.T) {
+		encrypted, err := svc.EncryptNullable(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("nil payloads should be authenticated", func(t *testing.T) {
+		keyId, ciphertext, err := decodeEnvelope(encryptedNil)
+		require.NoError(t, err)
+		require.Equal(t, nilOverhead, len(ciphertext))
+
+		altered := append([]byte{}, ciphertext...)
+		altered[len(altered)-1] ^= 0xff
+
+		_, err = svc.Decrypt(ctx, encodeEnvelope(keyId, altered))
+		assert.ErrorIs(t, err, errNilAuthentication)
+	})
+
+	t.Run("truncated nil payloads should fail", func(t *testing.T) {
+		keyId, _, err := decodeEnvelope(encryptedNil)
+		require.NoError(t, err)
+
+		_, err = svc.Decrypt(ctx, encodeEnvelope(keyId, []byte{nilMarker, 0, 1}))
+		assert.Error(t, err)
+	})
+
+	t.Run("nil payloads should be re-encrypted as nil on upgrade", func(t *testing.T) {
+		assert.True(t, ciphertextOptions([]byte{nilMarker}).nullable)
+	})
+}
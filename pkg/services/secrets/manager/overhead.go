@@ -0,0 +1,38 @@
+package manager
+
+import (
+	"context"
+)
+
+// EnvelopeOverhead returns the bytes added by Encrypt to the payloads, for the current data key
+// identifiers scheme (see SetDataKeyIdGenerator) and encryption algorithm: the envelope prefix,
+// plus the algorithm prefix, salt and IV (or nonce and tag) added by the encryption algorithm,
+// or the key commitment, nonce and tag if key commitment is enabled.
+// It's meant for capacity planning: payloads encrypted with EncryptDeterministic or
+// EncryptWithExpiry have a different overhead, and identifiers of custom schemes may vary
+// in length. See also the encryption_envelope_overhead_bytes metric, for the observed one.
+func (s *SecretsService) EnvelopeOverhead() int {
+	s.mtx.Lock()
+	id := s.generateDataKeyId(s.currentProviderID)
+	s.mtx.Unlock()
+
+	if s.keyCommitment {
+		return envelopePrefixLen(id) + committedOverhead
+	}
+
+	// The encryption algorithm overhead is independent of
+	// the secret, so it's measured with a throwaway one.
+	encrypted, err := s.enc.Encrypt(context.Background(), nil, "overhead")
+	if err != nil {
+		s.log.Warn("Failed to measure encryption overhead, using an estimate instead", "error", err)
+		return envelopePrefixLen(id) + encryptionOverhead
+	}
+
+	return envelopePrefixLen(id) + len(encrypted)
+}
+
+// EstimateEncryptedSize returns the estimated size of a payload
+// of the given size once encrypted by Encrypt. See EnvelopeOverhead.
+func (s *SecretsService) EstimateEncryptedSize(payloadSize int) int {
+	return payloadSize + s.EnvelopeOverhead()
+}
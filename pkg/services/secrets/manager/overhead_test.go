@@ -0,0 +1,47 @@
+package manager
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_EnvelopeOverhead(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	overheads := func() (uint64, float64) {
+		var m dto.Metric
+		require.NoError(t, envelopeOverheadHistogram.(prometheus.Metric).Write(&m))
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+	initialCount, initialSum := overheads()
+
+	for _, payload := range []string{"", "grafana", strings.Repeat("grafana", 100)} {
+		encrypted, err := svc.Encrypt(ctx, []byte(payload), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		assert.Equal(t, len(encrypted), svc.EstimateEncryptedSize(len(payload)), payload)
+	}
+
+	count, sum := overheads()
+	assert.Equal(t, initialCount+3, count)
+	assert.Equal(t, initialSum+3*float64(svc.EnvelopeOverhead()), sum)
+
+	t.Run("overhead should follow the data key identifiers scheme", func(t *testing.T) {
+		overhead := svc.EnvelopeOverhead()
+
+		svc.SetDataKeyIdGenerator(func(secrets.ProviderID) string { return strings.Repeat("a", maxDataKeyIdLength) })
+		t.Cleanup(func() { svc.SetDataKeyIdGenerator(defaultDataKeyIdGenerator) })
+
+		assert.Greater(t, svc.EnvelopeOverhead(), overhead)
+	})
+}
@@ -0,0 +1,54 @@
+package manager
+
+import (
+	"context"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+type pinnedDataKeyKey struct{}
+
+// pinnedDataKey is the data key pinned to a context for a scope. See PinDataKey.
+type pinnedDataKey struct {
+	scope   string
+	id      string
+	dataKey []byte
+	parent  *pinnedDataKey
+}
+
+// PinDataKey resolves the current data key for the given scope once, and returns a copy of the given
+// context with it pinned: every encryption done with that context (or any derived from it) for that
+// scope uses the pinned data key, even if data keys are rotated in the meantime. It's meant to be used
+// at the start of a transaction (e.g. sqlstore.InTransaction, which carries the session in the context
+// too) writing many related secrets, so they're all encrypted with the same data key.
+//
+// Encryptions with escrow, aliases or preferred providers don't use the pinned data key, as they
+// resolve data keys of their own. The pinned data key is kept decrypted for as long as the context
+// lives, so the context should not outlive the transaction.
+func (s *SecretsService) PinDataKey(ctx context.Context, opt secrets.EncryptionOptions) (context.Context, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.PinDataKey")
+	defer span.End()
+
+	scope := opt()
+	id, dataKey, err := s.preferredDataKey(ctx, scope, encryptOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := &pinnedDataKey{scope: scope, id: id, dataKey: dataKey}
+	pinned.parent, _ = ctx.Value(pinnedDataKeyKey{}).(*pinnedDataKey)
+
+	return context.WithValue(ctx, pinnedDataKeyKey{}, pinned), nil
+}
+
+// pinnedDataKeyFromContext returns the data key pinned to the given context for the given scope, if any.
+func pinnedDataKeyFromContext(ctx context.Context, scope string) (*pinnedDataKey, bool) {
+	pinned, _ := ctx.Value(pinnedDataKeyKey{}).(*pinnedDataKey)
+	for ; pinned != nil; pinned = pinned.parent {
+		if pinned.scope == scope {
+			return pinned, true
+		}
+	}
+
+	return nil, false
+}
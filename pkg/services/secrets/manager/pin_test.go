@@ -0,0 +1,71 @@
+package manager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_PinDataKey(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	encryptedKeyId := func(t *testing.T, ctx context.Context, opt secrets.EncryptionOptions) string {
+		t.Helper()
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), opt)
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		keyId, _, err := decodeEnvelope(encrypted)
+		require.NoError(t, err)
+
+		return keyId
+	}
+
+	pinnedCtx, err := svc.PinDataKey(ctx, secrets.WithoutScope())
+	require.NoError(t, err)
+	pinned := encryptedKeyId(t, pinnedCtx, secrets.WithoutScope())
+
+	t.Run("pinned data key should be used despite rotations", func(t *testing.T) {
+		require.NoError(t, svc.RotateDataKeys(ctx))
+
+		assert.Equal(t, pinned, encryptedKeyId(t, pinnedCtx, secrets.WithoutScope()))
+		assert.NotEqual(t, pinned, encryptedKeyId(t, ctx, secrets.WithoutScope()))
+	})
+
+	t.Run("other scopes should not use the pinned data key", func(t *testing.T) {
+		assert.NotEqual(t, pinned, encryptedKeyId(t, pinnedCtx, secrets.WithScope("org:1")))
+	})
+
+	t.Run("data keys pinned for several scopes should be kept", func(t *testing.T) {
+		orgCtx, err := svc.PinDataKey(pinnedCtx, secrets.WithScope("org:1"))
+		require.NoError(t, err)
+		org := encryptedKeyId(t, orgCtx, secrets.WithScope("org:1"))
+
+		require.NoError(t, svc.RotateDataKeys(ctx))
+
+		assert.Equal(t, pinned, encryptedKeyId(t, orgCtx, secrets.WithoutScope()))
+		assert.Equal(t, org, encryptedKeyId(t, orgCtx, secrets.WithScope("org:1")))
+	})
+
+	t.Run("encryption with escrow should not use the pinned data key", func(t *testing.T) {
+		svc.providers["escrow.v1"] = identityProvider{}
+		t.Cleanup(func() { delete(svc.providers, "escrow.v1") })
+
+		encrypted, err := svc.EncryptWithEscrow(pinnedCtx, []byte("grafana"), secrets.WithoutScope(), "escrow.v1")
+		require.NoError(t, err)
+
+		keyId, _, err := decodeEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.NotEqual(t, pinned, keyId)
+	})
+}
@@ -0,0 +1,77 @@
+package manager
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/services/kmsproviders"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// scopeProviderPolicy mandates the encryption provider of the data keys of the scopes
+// matching the pattern, as known scopes do (see scopeKnown), regardless of the current one.
+type scopeProviderPolicy struct {
+	pattern  string
+	provider secrets.ProviderID
+}
+
+// parseScopeProviders parses the given comma-separated list of scope providers policies,
+// as <scope pattern>=<provider> pairs (e.g. "pii:*=hsm.v1, org:1=awskms.v1").
+func parseScopeProviders(value string) ([]scopeProviderPolicy, error) {
+	var policies []scopeProviderPolicy
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		pattern, provider, ok := strings.Cut(entry, "=")
+		pattern, provider = strings.TrimSpace(pattern), strings.TrimSpace(provider)
+		if !ok || pattern == "" || provider == "" {
+			return nil, fmt.Errorf("invalid scope provider policy '%s': must be <scope pattern>=<provider>", entry)
+		}
+
+		policies = append(policies, scopeProviderPolicy{
+			pattern:  pattern,
+			provider: kmsproviders.NormalizeProviderID(secrets.ProviderID(provider)),
+		})
+	}
+
+	return policies, nil
+}
+
+// mandatedProvider returns the provider mandated for the given scope by
+// the first scope providers policy matching it, if any.
+func (s *SecretsService) mandatedProvider(scope string) (secrets.ProviderID, bool) {
+	for _, policy := range s.scopeProviders {
+		if scopeKnown(scope, []string{policy.pattern}) {
+			return policy.provider, true
+		}
+	}
+
+	return "", false
+}
+
+// scopeProvider returns the provider the data keys of the given scope
+// must be created with: the mandated one, if any, or the current one.
+func (s *SecretsService) scopeProvider(scope string) secrets.ProviderID {
+	if providerID, ok := s.mandatedProvider(scope); ok {
+		return providerID
+	}
+
+	return s.currentProviderID
+}
+
+// checkMandatedProvider fails with secrets.ErrMandatedProviderNotConfigured
+// if there's a provider mandated for the given scope, but it isn't configured.
+func (s *SecretsService) checkMandatedProvider(scope string) error {
+	providerID, ok := s.mandatedProvider(scope)
+	if !ok {
+		return nil
+	}
+
+	if _, exists := s.providers[providerID]; !exists {
+		return fmt.Errorf("%w: provider '%s' for scope '%s'", secrets.ErrMandatedProviderNotConfigured, providerID, scope)
+	}
+
+	return nil
+}
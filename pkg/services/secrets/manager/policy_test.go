@@ -0,0 +1,92 @@
+package manager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/kmsproviders"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestParseScopeProviders(t *testing.T) {
+	policies, err := parseScopeProviders("pii:*=hsm.v1, org:1 = secretKey")
+	require.NoError(t, err)
+	assert.Equal(t, []scopeProviderPolicy{
+		{pattern: "pii:*", provider: "hsm.v1"},
+		{pattern: "org:1", provider: kmsproviders.Default},
+	}, policies)
+
+	policies, err = parseScopeProviders("")
+	require.NoError(t, err)
+	assert.Empty(t, policies)
+
+	for _, invalid := range []string{"pii:*", "pii:*=", "=hsm.v1"} {
+		_, err := parseScopeProviders(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestSecretsService_ScopeProviders(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+	svc.providers["hsm.v1"] = identityProvider{}
+
+	policies, err := parseScopeProviders("pii:*=hsm.v1, org:9=missing.v1")
+	require.NoError(t, err)
+	svc.scopeProviders = policies
+
+	provider := func(t *testing.T, encrypted []byte) secrets.ProviderID {
+		t.Helper()
+
+		keyId, _, err := decodeEnvelope(encrypted)
+		require.NoError(t, err)
+
+		dataKey, err := svc.store.GetDataKey(ctx, keyId)
+		require.NoError(t, err)
+		return dataKey.Provider
+	}
+
+	t.Run("policied scopes should use the mandated provider", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("pii:1"))
+		require.NoError(t, err)
+		assert.Equal(t, secrets.ProviderID("hsm.v1"), provider(t, encrypted))
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("mandated provider should override preferences", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithProviderPreference(ctx, []byte("grafana"), secrets.WithScope("pii:2"), kmsproviders.Default)
+		require.NoError(t, err)
+		assert.Equal(t, secrets.ProviderID("hsm.v1"), provider(t, encrypted))
+	})
+
+	t.Run("other scopes should use the current provider", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("org:1"))
+		require.NoError(t, err)
+		assert.Equal(t, svc.currentProviderID, provider(t, encrypted))
+	})
+
+	t.Run("unconfigured mandated provider should fail", func(t *testing.T) {
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("org:9"))
+		require.ErrorIs(t, err, secrets.ErrMandatedProviderNotConfigured)
+
+		_, err = svc.InitScopes(ctx, "org:9")
+		require.ErrorIs(t, err, secrets.ErrMandatedProviderNotConfigured)
+	})
+
+	t.Run("scopes should be initialized with the mandated provider", func(t *testing.T) {
+		created, err := svc.InitScopes(ctx, "pii:3")
+		require.NoError(t, err)
+		assert.Equal(t, 1, created)
+
+		dataKey, err := svc.store.GetCurrentDataKey(ctx, secrets.KeyLabel("pii:3", "hsm.v1"))
+		require.NoError(t, err)
+		assert.Equal(t, secrets.ProviderID("hsm.v1"), dataKey.Provider)
+	})
+}
@@ -0,0 +1,46 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/kmsproviders"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// EncryptWithProviderPreference works like Encrypt, but the data key used to encrypt the payload
+// is the current one for the first of the given providers that's available, in order, instead of
+// the current provider. So, if the first provider cannot be used (e.g. the KMS is unreachable),
+// the payload is still encrypted with a data key encrypted by the next one, and so on.
+//
+// The provider that actually encrypted the data key is stored along with it, as usual, so the
+// payload is decrypted with Decrypt, regardless of the current provider.
+func (s *SecretsService) EncryptWithProviderPreference(
+	ctx context.Context,
+	payload []byte,
+	opt secrets.EncryptionOptions,
+	providers ...secrets.ProviderID,
+) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.EncryptWithProviderPreference")
+	defer span.End()
+
+	if s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
+		return nil, fmt.Errorf("encryption with provider preference requires envelope encryption to be enabled")
+	}
+
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("at least one preferred provider is required")
+	}
+
+	normalized := make([]secrets.ProviderID, 0, len(providers))
+	for _, id := range providers {
+		id = kmsproviders.NormalizeProviderID(id)
+		if _, exists := s.providers[id]; !exists {
+			return nil, fmt.Errorf("could not find preferred encryption provider '%s'", id)
+		}
+		normalized = append(normalized, id)
+	}
+
+	return s.encrypt(ctx, payload, opt(), encryptOptions{providers: normalized})
+}
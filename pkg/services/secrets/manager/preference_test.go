@@ -0,0 +1,68 @@
+package manager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_EncryptWithProviderPreference(t *testing.T) {
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+	svc.providers["unavailable.v1"] = failingProvider{}
+	svc.providers["secondary.v1"] = identityProvider{}
+
+	providerOf := func(t *testing.T, encrypted []byte) secrets.ProviderID {
+		t.Helper()
+		keyId, _, err := decodeEnvelope(encrypted)
+		require.NoError(t, err)
+		dataKey, err := store.GetDataKey(ctx, keyId)
+		require.NoError(t, err)
+		return dataKey.Provider
+	}
+
+	t.Run("first available provider should be used", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithProviderPreference(ctx, []byte("grafana"), secrets.WithoutScope(), "secondary.v1", svc.currentProviderID)
+		require.NoError(t, err)
+		assert.Equal(t, secrets.ProviderID("secondary.v1"), providerOf(t, encrypted))
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("unavailable providers should fall back to the next one", func(t *testing.T) {
+		encrypted, err := svc.EncryptWithProviderPreference(ctx, []byte("grafana"), secrets.WithScope("org:1"), "unavailable.v1", "secondary.v1")
+		require.NoError(t, err)
+		assert.Equal(t, secrets.ProviderID("secondary.v1"), providerOf(t, encrypted))
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("no available provider should fail", func(t *testing.T) {
+		_, err := svc.EncryptWithProviderPreference(ctx, []byte("grafana"), secrets.WithoutScope(), "unavailable.v1")
+		assert.ErrorContains(t, err, "provider unavailable")
+	})
+
+	t.Run("unknown providers should be rejected", func(t *testing.T) {
+		_, err := svc.EncryptWithProviderPreference(ctx, []byte("grafana"), secrets.WithoutScope(), "unknown.v1")
+		assert.Error(t, err)
+
+		_, err = svc.EncryptWithProviderPreference(ctx, []byte("grafana"), secrets.WithoutScope())
+		assert.Error(t, err)
+	})
+
+	t.Run("current provider should be used by default", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		assert.Equal(t, svc.currentProviderID, providerOf(t, encrypted))
+	})
+}
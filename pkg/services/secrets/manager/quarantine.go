@@ -0,0 +1,242 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// maxFailingDataKeys is the maximum amount of failing data keys tracked by the quarantine,
+// so payloads referencing many different (e.g. corrupted) data key ids cannot grow it unbounded.
+// Once reached, the data keys that can be forgotten are evicted to make room for new ones.
+const maxFailingDataKeys = 1000
+
+// dataKeyQuarantine tracks the consecutive failures to decrypt each data key and, after
+// threshold of them, quarantines the data key for cooldown, so decrypting the payloads
+// that depend on it fails fast instead of hitting the store and the provider every time.
+// Its zero value is disabled.
+//
+// Data keys that haven't failed for a whole cooldown (see forgettable) are forgotten, at most once
+// per cooldown, so the quarantine doesn't keep track of the data keys that stopped failing forever.
+type dataKeyQuarantine struct {
+	threshold int
+	cooldown  time.Duration
+
+	mtx  sync.Mutex
+	keys map[string]*quarantinedKey
+	// failing is the amount of data keys in keys, so the hot path can
+	// skip the lock while no data key is failing, which is the usual case.
+	failing atomic.Int64
+	// nextSweep is when the forgettable data keys are evicted next. See evictForgettable.
+	nextSweep time.Time
+}
+
+type quarantinedKey struct {
+	failures int
+	// lastFailure is the time of the last failure to decrypt the data key.
+	lastFailure time.Time
+	// until is the end of the quarantine, zero while the data key isn't quarantined.
+	until time.Time
+}
+
+// check fails with secrets.ErrDataKeyQuarantined if the data key with the given id is quarantined.
+// Once its cooldown elapses, the data key is tried again, but a single failure quarantines it again,
+// unless it doesn't fail for another cooldown, after which it's forgotten. See forgettable.
+func (q *dataKeyQuarantine) check(id string) error {
+	if q.threshold <= 0 || q.failing.Load() == 0 {
+		return nil
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if !now().Before(q.nextSweep) {
+		q.evictForgettable()
+	}
+
+	if key, ok := q.keys[id]; ok && now().Before(key.until) {
+		return fmt.Errorf("%w: data key '%s' failed to be decrypted %d times in a row, retrying after %s",
+			secrets.ErrDataKeyQuarantined, id, key.failures, key.until.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// recordFailure records a failure to decrypt the data key with the given id, and reports whether
+// the data key has been quarantined because of it, and whether it's tracked at all: if there are
+// already maxFailingDataKeys data keys tracked, and all of them are quarantined, it isn't.
+func (q *dataKeyQuarantine) recordFailure(id string) (bool, bool) {
+	if q.threshold <= 0 {
+		return false, true
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	key, ok := q.keys[id]
+	if !ok {
+		if len(q.keys) >= maxFailingDataKeys {
+			q.evictForgettable()
+		}
+		if len(q.keys) >= maxFailingDataKeys && !q.evictOldest() {
+			return false, false
+		}
+		if q.keys == nil {
+			q.keys = make(map[string]*quarantinedKey)
+		}
+		key = &quarantinedKey{}
+		q.keys[id] = key
+		q.failing.Add(1)
+	}
+
+	key.failures++
+	key.lastFailure = now()
+	if key.failures < q.threshold {
+		return false, true
+	}
+
+	key.until = key.lastFailure.Add(q.cooldown)
+	return true, true
+}
+
+// forgettable reports whether the given data key hasn't failed for a whole cooldown since the end
+// of its last quarantine, if ever quarantined, or since its last failure otherwise. So, quarantined
+// data keys are only forgotten once they've had a whole cooldown to be tried again.
+func (q *dataKeyQuarantine) forgettable(key *quarantinedKey, at time.Time) bool {
+	since := key.lastFailure
+	if !key.until.IsZero() {
+		since = key.until
+	}
+
+	return !at.Before(since.Add(q.cooldown))
+}
+
+// evictForgettable stops tracking the data keys that can be forgotten. It must be called with the lock held.
+func (q *dataKeyQuarantine) evictForgettable() {
+	at := now()
+	for id, key := range q.keys {
+		if q.forgettable(key, at) {
+			delete(q.keys, id)
+		}
+	}
+
+	q.failing.Store(int64(len(q.keys)))
+	q.nextSweep = at.Add(q.cooldown)
+}
+
+// evictOldest stops tracking the data key that failed the longest ago, among those that aren't
+// quarantined, and reports whether there was any. It must be called with the lock held.
+func (q *dataKeyQuarantine) evictOldest() bool {
+	at := now()
+
+	var (
+		oldestId string
+		oldest   *quarantinedKey
+	)
+	for id, key := range q.keys {
+		if at.Before(key.until) {
+			continue
+		}
+		if oldest == nil || key.lastFailure.Before(oldest.lastFailure) {
+			oldestId, oldest = id, key
+		}
+	}
+
+	if oldest == nil {
+		return false
+	}
+
+	delete(q.keys, oldestId)
+	q.failing.Add(-1)
+	return true
+}
+
+// recordSuccess resets the failures of the data key with the given id.
+func (q *dataKeyQuarantine) recordSuccess(id string) {
+	if q.threshold <= 0 || q.failing.Load() == 0 {
+		return
+	}
+
+	q.remove(id)
+}
+
+// remove stops tracking the data key with the given id, and returns it, if it was tracked.
+func (q *dataKeyQuarantine) remove(id string) (*quarantinedKey, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	key, ok := q.keys[id]
+	if ok {
+		delete(q.keys, id)
+		q.failing.Add(-1)
+	}
+
+	return key, ok
+}
+
+// QuarantinedDataKeys returns the data keys currently quarantined, sorted by id, for diagnostic
+// purposes. See data_key_quarantine_threshold.
+func (s *SecretsService) QuarantinedDataKeys() []secrets.QuarantinedDataKey {
+	s.quarantine.mtx.Lock()
+	defer s.quarantine.mtx.Unlock()
+
+	quarantined := make([]secrets.QuarantinedDataKey, 0)
+	for id, key := range s.quarantine.keys {
+		if now().Before(key.until) {
+			quarantined = append(quarantined, secrets.QuarantinedDataKey{Id: id, Failures: key.failures, Until: key.until})
+		}
+	}
+
+	sort.Slice(quarantined, func(i, j int) bool { return quarantined[i].Id < quarantined[j].Id })
+
+	return quarantined
+}
+
+// ClearDataKeyQuarantine lifts the quarantine of the data key with the given id, if any, and
+// resets its failures, so it's tried again right away (e.g. once the provider has been fixed).
+// It reports whether the data key was quarantined.
+func (s *SecretsService) ClearDataKeyQuarantine(keyId string) bool {
+	key, ok := s.quarantine.remove(keyId)
+	return ok && now().Before(key.until)
+}
+
+// lookupQuarantinedDataKey looks up the data key with the given id, like lookupDataKey, unless it's
+// quarantined, and keeps track of the outcome. Failures due to the context being done are ignored,
+// as they say nothing about the data key.
+func (s *SecretsService) lookupQuarantinedDataKey(
+	ctx context.Context,
+	keyId string,
+	dataKeyById func(ctx context.Context, id string) (*dataKeyCacheEntry, error),
+) (*dataKeyCacheEntry, error) {
+	if err := s.quarantine.check(keyId); err != nil {
+		return nil, err
+	}
+
+	entry, err := s.lookupDataKey(ctx, keyId, dataKeyById)
+	if err == nil {
+		s.quarantine.recordSuccess(keyId)
+		return entry, nil
+	}
+
+	if ctx.Err() != nil {
+		return entry, err
+	}
+
+	switch quarantined, tracked := s.quarantine.recordFailure(keyId); {
+	case quarantined:
+		dataKeysQuarantinedCounter.Inc()
+		s.ctxLogger(ctx).Warn("Data key quarantined after repeatedly failing to be decrypted",
+			"id", keyId, "cooldown", s.quarantine.cooldown, "error", err)
+	case !tracked:
+		dataKeysQuarantineUntrackedCounter.Inc()
+		s.ctxLogger(ctx).Debug("Failing data key not tracked, as too many data keys are quarantined",
+			"id", keyId, "max", maxFailingDataKeys)
+	}
+
+	return entry, err
+}
@@ -0,0 +1,176 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+// countingProvider counts the calls to Decrypt of the wrapped provider.
+type countingProvider struct {
+	secrets.Provider
+	decrypts atomic.Int64
+}
+
+func (p *countingProvider) Decrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	p.decrypts.Add(1)
+	return p.Provider.Decrypt(ctx, blob)
+}
+
+func TestSecretsService_DataKeyQuarantine(t *testing.T) {
+	restoreTimeNowAfterTestExec(t)
+
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+	svc.quarantine.threshold = 3
+	svc.quarantine.cooldown = time.Minute
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+	keyId, _, err := decodeEnvelope(encrypted)
+	require.NoError(t, err)
+
+	working := svc.providers[svc.currentProviderID]
+	provider := &countingProvider{Provider: failingProvider{}}
+	svc.providers[svc.currentProviderID] = provider
+	svc.dataKeyCache.flush()
+
+	t.Run("data keys should be quarantined after consecutive failures", func(t *testing.T) {
+		before := testutil.ToFloat64(dataKeysQuarantinedCounter)
+
+		for i := 0; i < 3; i++ {
+			_, err := svc.Decrypt(ctx, encrypted)
+			require.Error(t, err)
+			assert.NotErrorIs(t, err, secrets.ErrDataKeyQuarantined)
+		}
+		assert.Equal(t, before+1, testutil.ToFloat64(dataKeysQuarantinedCounter))
+
+		calls := provider.decrypts.Load()
+		_, err := svc.Decrypt(ctx, encrypted)
+		assert.ErrorIs(t, err, secrets.ErrDataKeyQuarantined)
+		assert.Equal(t, calls, provider.decrypts.Load(), "quarantined data keys should fail fast")
+
+		quarantined := svc.QuarantinedDataKeys()
+		require.Len(t, quarantined, 1)
+		assert.Equal(t, keyId, quarantined[0].Id)
+		assert.Equal(t, 3, quarantined[0].Failures)
+	})
+
+	t.Run("data keys should be tried again after the cooldown", func(t *testing.T) {
+		now = func() time.Time { return time.Now().Add(90 * time.Second) }
+		t.Cleanup(func() { now = time.Now })
+
+		assert.Empty(t, svc.QuarantinedDataKeys())
+
+		calls := provider.decrypts.Load()
+		_, err := svc.Decrypt(ctx, encrypted)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, secrets.ErrDataKeyQuarantined)
+		assert.Greater(t, provider.decrypts.Load(), calls)
+
+		// A single failure after the cooldown quarantines the data key again.
+		_, err = svc.Decrypt(ctx, encrypted)
+		assert.ErrorIs(t, err, secrets.ErrDataKeyQuarantined)
+	})
+
+	t.Run("clearing the quarantine should try the data key again right away", func(t *testing.T) {
+		provider.Provider = working
+
+		assert.True(t, svc.ClearDataKeyQuarantine(keyId))
+		assert.False(t, svc.ClearDataKeyQuarantine(keyId))
+		assert.Empty(t, svc.QuarantinedDataKeys())
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("successes should reset the failures", func(t *testing.T) {
+		provider.Provider = failingProvider{}
+		svc.dataKeyCache.flush()
+
+		for i := 0; i < 2; i++ {
+			_, err := svc.Decrypt(ctx, encrypted)
+			require.Error(t, err)
+		}
+
+		provider.Provider = working
+		_, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+
+		provider.Provider = failingProvider{}
+		svc.dataKeyCache.flush()
+
+		_, err = svc.Decrypt(ctx, encrypted)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, secrets.ErrDataKeyQuarantined)
+		assert.Empty(t, svc.QuarantinedDataKeys())
+	})
+
+	t.Run("data keys should never be quarantined if disabled", func(t *testing.T) {
+		svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+		var quarantine secrets.DataKeyQuarantine = svc
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		svc.providers[svc.currentProviderID] = failingProvider{}
+		svc.dataKeyCache.flush()
+
+		for i := 0; i < 10; i++ {
+			_, err := svc.Decrypt(ctx, encrypted)
+			require.Error(t, err)
+			assert.NotErrorIs(t, err, secrets.ErrDataKeyQuarantined)
+		}
+		assert.Empty(t, quarantine.QuarantinedDataKeys())
+	})
+}
+
+func TestDataKeyQuarantine_Eviction(t *testing.T) {
+	restoreTimeNowAfterTestExec(t)
+
+	start := time.Now()
+	at := func(d time.Duration) { now = func() time.Time { return start.Add(d) } }
+	at(0)
+
+	q := &dataKeyQuarantine{threshold: 1, cooldown: time.Minute}
+	for i := 0; i < maxFailingDataKeys; i++ {
+		quarantined, tracked := q.recordFailure(fmt.Sprintf("key-%d", i))
+		require.True(t, quarantined)
+		require.True(t, tracked)
+	}
+
+	t.Run("failures should not be tracked while all the tracked data keys are quarantined", func(t *testing.T) {
+		quarantined, tracked := q.recordFailure("extra")
+		assert.False(t, quarantined)
+		assert.False(t, tracked)
+		assert.Equal(t, int64(maxFailingDataKeys), q.failing.Load())
+	})
+
+	t.Run("the oldest data key whose quarantine ended should be evicted once full", func(t *testing.T) {
+		at(90 * time.Second)
+
+		quarantined, tracked := q.recordFailure("extra")
+		assert.True(t, quarantined)
+		assert.True(t, tracked)
+		assert.Equal(t, int64(maxFailingDataKeys), q.failing.Load())
+		assert.ErrorIs(t, q.check("extra"), secrets.ErrDataKeyQuarantined)
+	})
+
+	t.Run("data keys that stopped failing should be forgotten", func(t *testing.T) {
+		at(5 * time.Minute)
+
+		require.NoError(t, q.check("extra"))
+		assert.Equal(t, int64(0), q.failing.Load())
+		assert.Empty(t, q.keys)
+	})
+}
@@ -0,0 +1,70 @@
+package manager
+
+import (
+	"context"
+	"errors"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// ReconcileCurrentKey checks whether the cached current data key (i.e. the last one used for
+// encryption) is still the current one in the store, as it's stale when the data keys were
+// rotated by another node. If it isn't, it swaps the cached one, under the data keys lock, for
+// the one in the store, if any, so encryption operations don't keep using a superseded data key
+// until it expires from the cache. It reports whether the current data key changed.
+//
+// It's called periodically, if [security.encryption] current_data_key_reconcile_interval is set.
+//
+// The superseded data key is dropped from the cache for encryption, but it's neither scrubbed
+// nor dropped for decryption: payloads encrypted with it must keep being decryptable, and
+// concurrent encryption operations may still be using it, as they don't take any lock.
+func (s *SecretsService) ReconcileCurrentKey(ctx context.Context) (bool, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.ReconcileCurrentKey")
+	defer span.End()
+
+	entry := s.dataKeyCache.current.Load()
+	if entry == nil {
+		return false, nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// The current data key may have changed while waiting for the lock.
+	if s.dataKeyCache.current.Load() != entry {
+		return false, nil
+	}
+
+	stored, err := s.store.GetCurrentDataKey(ctx, entry.label)
+	switch {
+	case errors.Is(err, secrets.ErrDataKeyNotFound):
+		stored = nil
+	case err != nil:
+		return false, err
+	case stored.Id == entry.id:
+		return false, nil
+	}
+
+	var replacement *dataKeyCacheEntry
+	if stored != nil {
+		dataKey, decrypted, err := s.fetchDataKeyById(ctx, stored.Id)
+		if err != nil {
+			return false, err
+		}
+		replacement = s.cacheDataKey(dataKey, decrypted)
+	}
+
+	if !s.dataKeyCache.retireCurrent(entry, replacement) {
+		return false, nil
+	}
+
+	currentKeyReconciliationsCounter.Inc()
+
+	current := ""
+	if stored != nil {
+		current = stored.Id
+	}
+	s.log.Info("Reconciled stale current data key", "label", entry.label, "previous", entry.id, "current", current)
+
+	return true, nil
+}
@@ -0,0 +1,113 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/db"
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/database"
+)
+
+func TestSecretsService_ReconcileCurrentKey(t *testing.T) {
+	restoreTimeNowAfterTestExec(t)
+
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+
+	// Two instances sharing the same store.
+	svc := SetupTestService(t, store)
+	other := SetupTestService(t, store)
+
+	t.Run("without current data key there's nothing to reconcile", func(t *testing.T) {
+		changed, err := svc.ReconcileCurrentKey(ctx)
+		require.NoError(t, err)
+		assert.False(t, changed)
+	})
+
+	// Encrypt to generate data encryption key
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	// Ten minutes later (after caution period), the data key
+	// is cached by label and used as the current one.
+	now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+	svc.dataKeyCache.flush()
+
+	for i := 0; i < 2; i++ {
+		_, err = svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+	}
+	current := svc.dataKeyCache.current.Load()
+	require.NotNil(t, current)
+
+	t.Run("up-to-date current data key should be kept", func(t *testing.T) {
+		changed, err := svc.ReconcileCurrentKey(ctx)
+		require.NoError(t, err)
+		assert.False(t, changed)
+		assert.Same(t, current, svc.dataKeyCache.current.Load())
+	})
+
+	t.Run("current data key disabled by another instance should be retired", func(t *testing.T) {
+		before := testutil.ToFloat64(currentKeyReconciliationsCounter)
+		require.NoError(t, store.DisableDataKeys(ctx))
+
+		changed, err := svc.ReconcileCurrentKey(ctx)
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.Nil(t, svc.dataKeyCache.current.Load())
+		assert.Equal(t, before+1, testutil.ToFloat64(currentKeyReconciliationsCounter))
+
+		_, exists := svc.dataKeyCache.getByLabel(current.label)
+		assert.False(t, exists)
+
+		// Payloads encrypted with the retired data key are still decryptable.
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		// And a new data key is used for encryption.
+		_, err = svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		dataKeys, err := store.GetAllDataKeys(ctx)
+		require.NoError(t, err)
+		assert.Len(t, dataKeys, 2)
+	})
+
+	t.Run("current data key superseded by another instance should be swapped", func(t *testing.T) {
+		svc.dataKeyCache.flush()
+		for i := 0; i < 2; i++ {
+			_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+			require.NoError(t, err)
+		}
+		current := svc.dataKeyCache.current.Load()
+		require.NotNil(t, current)
+
+		require.NoError(t, other.RotateDataKeys(ctx))
+		_, err = other.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		stored, err := store.GetCurrentDataKey(ctx, current.label)
+		require.NoError(t, err)
+		require.NotEqual(t, current.id, stored.Id)
+
+		changed, err := svc.ReconcileCurrentKey(ctx)
+		require.NoError(t, err)
+		assert.True(t, changed)
+
+		replacement := svc.dataKeyCache.current.Load()
+		require.NotNil(t, replacement)
+		assert.Equal(t, stored.Id, replacement.id)
+
+		changed, err = svc.ReconcileCurrentKey(ctx)
+		require.NoError(t, err)
+		assert.False(t, changed)
+	})
+}
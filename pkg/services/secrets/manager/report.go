@@ -0,0 +1,308 @@
+package manager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/kmsproviders"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/supportbundles"
+)
+
+// EncryptionConfigReport describes the effective encryption configuration,
+// for diagnostic purposes. It must never contain any secret material,
+// like data keys or providers credentials.
+type EncryptionConfigReport struct {
+	CurrentProvider           secrets.ProviderID   `json:"currentProvider"`
+	EnvelopeEncryptionEnabled bool                 `json:"envelopeEncryptionEnabled"`
+	Providers                 []secrets.ProviderID `json:"providers"`
+	ProvidersByKind           map[string]int       `json:"providersByKind"`
+	DegradedProviders         []secrets.ProviderID `json:"degradedProviders"`
+	Cache                     CacheReport          `json:"cache"`
+	DataKeys                  DataKeysReport       `json:"dataKeys"`
+}
+
+type CacheReport struct {
+	TTL            string `json:"ttl"`
+	EntriesById    int    `json:"entriesById"`
+	EntriesByLabel int    `json:"entriesByLabel"`
+}
+
+type DataKeysReport struct {
+	Total      int                        `json:"total"`
+	Active     int                        `json:"active"`
+	Escrow     int                        `json:"escrow"`
+	ByProvider map[secrets.ProviderID]int `json:"byProvider"`
+}
+
+// ConfigReport assembles a report of the effective encryption configuration.
+// Only identifiers, settings and counts are reported, never key bytes nor credentials.
+func (s *SecretsService) ConfigReport(ctx context.Context) (EncryptionConfigReport, error) {
+	report := EncryptionConfigReport{
+		CurrentProvider:           s.currentProviderID,
+		EnvelopeEncryptionEnabled: !s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption),
+		Providers:                 make([]secrets.ProviderID, 0, len(s.providers)),
+		ProvidersByKind:           make(map[string]int),
+		DegradedProviders:         s.DegradedProviders(),
+		DataKeys: DataKeysReport{
+			ByProvider: make(map[secrets.ProviderID]int),
+		},
+	}
+
+	for _, p := range s.ListProviders() {
+		report.Providers = append(report.Providers, p.ID)
+
+		kind, err := p.ID.Kind()
+		if err != nil {
+			return EncryptionConfigReport{}, err
+		}
+		report.ProvidersByKind[kind]++
+	}
+
+	report.Cache.TTL = s.dataKeyCache.cacheTTL.String()
+	report.Cache.EntriesById, report.Cache.EntriesByLabel = s.dataKeyCache.size()
+
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return EncryptionConfigReport{}, err
+	}
+
+	for _, dataKey := range dataKeys {
+		report.DataKeys.Total++
+		if dataKey.Active {
+			report.DataKeys.Active++
+		}
+		if secrets.IsEscrowDataKeyId(dataKey.Id) {
+			report.DataKeys.Escrow++
+		}
+		report.DataKeys.ByProvider[dataKey.Provider]++
+	}
+
+	return report, nil
+}
+
+// ProviderDescription describes a configured encryption provider. Like EncryptionConfigReport,
+// it must never contain any secret material, like providers credentials.
+type ProviderDescription struct {
+	ID           secrets.ProviderID           `json:"id"`
+	Kind         string                       `json:"kind"`
+	Current      bool                         `json:"current"`
+	Degraded     bool                         `json:"degraded"`
+	Capabilities secrets.ProviderCapabilities `json:"capabilities"`
+}
+
+// DescribeProviders describes the configured encryption providers, sorted by identifier,
+// including their capabilities (see secrets.CapableProvider).
+func (s *SecretsService) DescribeProviders() ([]ProviderDescription, error) {
+	degraded := make(map[secrets.ProviderID]bool)
+	for _, id := range s.DegradedProviders() {
+		degraded[id] = true
+	}
+
+	providers := s.ListProviders()
+	descriptions := make([]ProviderDescription, 0, len(providers))
+	for _, p := range providers {
+		kind, err := p.ID.Kind()
+		if err != nil {
+			return nil, err
+		}
+
+		descriptions = append(descriptions, ProviderDescription{
+			ID:           p.ID,
+			Kind:         kind,
+			Current:      p.ID == s.currentProviderID,
+			Degraded:     degraded[p.ID],
+			Capabilities: providerCapabilities(p.Provider),
+		})
+	}
+
+	return descriptions, nil
+}
+
+// providerCapabilities returns the capabilities of the given provider,
+// none unless it reports them. See secrets.CapableProvider.
+func providerCapabilities(provider secrets.Provider) secrets.ProviderCapabilities {
+	if capable, ok := provider.(secrets.CapableProvider); ok {
+		return capable.Capabilities()
+	}
+
+	return secrets.ProviderCapabilities{}
+}
+
+// ConfigFingerprint returns a stable fingerprint (a SHA-256 hash) of the effective encryption
+// configuration: the current provider, whether envelope encryption is enabled, the encryption
+// implementation and algorithm, the payloads format and the data keys length. It changes when any
+// of them does, so fingerprints can be compared across nodes to detect configuration drift.
+// Like ConfigReport, it only relies on identifiers and settings, never on secret material.
+func (s *SecretsService) ConfigFingerprint() string {
+	format := "default"
+	if s.keyCommitment {
+		format = "key-committed"
+	}
+
+	algorithm := s.cfg.SectionWithEnvOverrides("security.encryption").Key("algorithm").MustString(encryption.AesCfb)
+
+	h := sha256.New()
+	for _, field := range [][2]string{
+		{"provider", string(s.currentProviderID)},
+		{"envelope", strconv.FormatBool(!s.features.IsEnabledGlobally(featuremgmt.FlagDisableEnvelopeEncryption))},
+		{"implementation", encryptionImplementation(s.enc)},
+		{"algorithm", algorithm},
+		{"format", format},
+		{"key_length", strconv.Itoa(dataKeyLength)},
+	} {
+		fmt.Fprintf(h, "%s=%q\n", field[0], field[1])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ListScopeKeys returns the identifier of the current data key of each scope with, at least,
+// one active data key. Data keys used for encryption with escrow (see EncryptWithEscrow) and
+// their escrow copies are not considered, as they're never used by Encrypt.
+func (s *SecretsService) ListScopeKeys(ctx context.Context) (map[string]string, error) {
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	current := currentDataKeysByScope(dataKeys)
+	scopeKeys := make(map[string]string, len(current))
+	for scope, dataKey := range current {
+		scopeKeys[scope] = dataKey.Id
+	}
+
+	return scopeKeys, nil
+}
+
+// currentDataKeysByScope returns the current data key of each scope among the given ones.
+// See ListScopeKeys for the criteria.
+func currentDataKeysByScope(dataKeys []*secrets.DataKey) map[string]*secrets.DataKey {
+	current := make(map[string]*secrets.DataKey)
+	for _, dataKey := range dataKeys {
+		if !dataKey.Active || secrets.IsEscrowDataKeyId(dataKey.Id) ||
+			strings.Contains(dataKey.Label, secrets.EscrowLabelSeparator) {
+			continue
+		}
+
+		if newerDataKey(dataKey, current[dataKey.Scope]) {
+			current[dataKey.Scope] = dataKey
+		}
+	}
+
+	return current
+}
+
+// EncryptionRuntimeStats describes the live state of the encryption, for the admin stats.
+// Like EncryptionConfigReport, it must never contain any secret material.
+type EncryptionRuntimeStats struct {
+	CurrentProvider secrets.ProviderID `json:"currentProvider"`
+	CacheHits       int64              `json:"cacheHits"`
+	CacheMisses     int64              `json:"cacheMisses"`
+	CacheHitRatio   float64            `json:"cacheHitRatio"`
+	DataKeys        int64              `json:"dataKeys"`
+	LastRotation    *time.Time         `json:"lastRotation,omitempty"`
+}
+
+// RuntimeStats assembles the live encryption stats. Cache reads are process-wide, as they're
+// taken from the encryption metrics, and the last rotation is only known if it was done by this
+// instance since it started.
+func (s *SecretsService) RuntimeStats(ctx context.Context) (EncryptionRuntimeStats, error) {
+	dataKeys, err := s.store.CountDataKeys(ctx)
+	if err != nil {
+		return EncryptionRuntimeStats{}, err
+	}
+
+	stats := EncryptionRuntimeStats{
+		CurrentProvider: s.currentProviderID,
+		DataKeys:        dataKeys,
+		LastRotation:    s.lastRotation.Load(),
+	}
+
+	for _, method := range []string{cacheMethodById, cacheMethodByLabel} {
+		stats.CacheHits += int64(counterValue(cacheReadsCounter.WithLabelValues("true", method)))
+		stats.CacheMisses += int64(counterValue(cacheReadsCounter.WithLabelValues("false", method)))
+	}
+
+	if reads := stats.CacheHits + stats.CacheMisses; reads > 0 {
+		stats.CacheHitRatio = float64(stats.CacheHits) / float64(reads)
+	}
+
+	return stats, nil
+}
+
+// counterValue returns the current value of the given counter.
+func counterValue(counter prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := counter.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
+
+func (s *SecretsService) supportBundleCollector() supportbundles.Collector {
+	return supportbundles.Collector{
+		UID:               "encryption-config",
+		DisplayName:       "Encryption configuration",
+		Description:       "Effective encryption configuration, without any secret material",
+		IncludedByDefault: false,
+		Default:           true,
+		Fn: func(ctx context.Context) (*supportbundles.SupportItem, error) {
+			report, err := s.ConfigReport(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			bytes, err := json.MarshalIndent(report, "", " ")
+			if err != nil {
+				return nil, err
+			}
+
+			return &supportbundles.SupportItem{
+				Filename:  "encryption-config.json",
+				FileBytes: bytes,
+			}, nil
+		},
+	}
+}
+
+// InUseProviderKinds returns the kinds of the encryption providers in use, sorted, i.e. referenced
+// by any stored data key, whether active or not, escrow copies included, and whether configured or
+// not. It's meant for usage reporting and license enforcement, so, unlike ConfigReport, it doesn't
+// account for providers configured but never used. Only data keys metadata is read.
+func (s *SecretsService) InUseProviderKinds(ctx context.Context) ([]string, error) {
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	kinds := make([]string, 0)
+	for _, dataKey := range dataKeys {
+		kind, err := kmsproviders.NormalizeProviderID(dataKey.Provider).Kind()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := seen[kind]; !ok {
+			seen[kind] = struct{}{}
+			kinds = append(kinds, kind)
+		}
+	}
+
+	sort.Strings(kinds)
+
+	return kinds, nil
+}
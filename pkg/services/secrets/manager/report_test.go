@@ -0,0 +1,207 @@
+package manager
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/kmsproviders"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_ConfigReport(t *testing.T) {
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+
+	_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	report, err := svc.ConfigReport(ctx)
+	require.NoError(t, err)
+
+	assert.Equal(t, secrets.ProviderID(kmsproviders.Default), report.CurrentProvider)
+	assert.True(t, report.EnvelopeEncryptionEnabled)
+	assert.Equal(t, []secrets.ProviderID{kmsproviders.Default}, report.Providers)
+	assert.Equal(t, map[string]int{"secretKey": 1}, report.ProvidersByKind)
+	assert.Equal(t, "5m0s", report.Cache.TTL)
+	assert.Equal(t, DataKeysReport{
+		Total:      1,
+		Active:     1,
+		ByProvider: map[secrets.ProviderID]int{kmsproviders.Default: 1},
+	}, report.DataKeys)
+
+	t.Run("support bundle should not contain any key material", func(t *testing.T) {
+		item, err := svc.supportBundleCollector().Fn(ctx)
+		require.NoError(t, err)
+
+		dataKeys, err := store.GetAllDataKeys(ctx)
+		require.NoError(t, err)
+		require.Len(t, dataKeys, 1)
+
+		_, decrypted, err := svc.fetchDataKeyById(ctx, dataKeys[0].Id)
+		require.NoError(t, err)
+
+		for _, secret := range [][]byte{decrypted, dataKeys[0].EncryptedData} {
+			assert.NotContains(t, string(item.FileBytes), string(secret))
+			assert.NotContains(t, string(item.FileBytes), base64.StdEncoding.EncodeToString(secret))
+		}
+	})
+}
+
+type capableProvider struct {
+	identityProvider
+}
+
+func (capableProvider) Capabilities() secrets.ProviderCapabilities {
+	return secrets.ProviderCapabilities{NativeRotation: true, Remote: true}
+}
+
+func TestSecretsService_DescribeProviders(t *testing.T) {
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+	svc.providers["capable.v1"] = capableProvider{}
+	svc.markProviderDegraded("capable.v1")
+
+	descriptions, err := svc.DescribeProviders()
+	require.NoError(t, err)
+
+	assert.Equal(t, []ProviderDescription{
+		{
+			ID:           "capable.v1",
+			Kind:         "capable",
+			Degraded:     true,
+			Capabilities: secrets.ProviderCapabilities{NativeRotation: true, Remote: true},
+		},
+		{
+			ID:      kmsproviders.Default,
+			Kind:    "secretKey",
+			Current: true,
+		},
+	}, descriptions)
+}
+
+func TestSecretsService_InUseProviderKinds(t *testing.T) {
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+	svc.providers["awskms.v1"] = identityProvider{}
+
+	kinds, err := svc.InUseProviderKinds(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, kinds, "configured providers without data keys should not be in use")
+
+	_, err = svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	for _, dataKey := range []*secrets.DataKey{
+		{Id: "legacy", Label: "legacy", Provider: kmsproviders.Legacy},
+		{Id: "disabled", Label: "disabled", Provider: "vault.v1"},
+		{Id: "vault-2", Label: "vault-2", Provider: "vault.v2", Active: true},
+	} {
+		require.NoError(t, store.CreateDataKey(ctx, dataKey))
+	}
+
+	kinds, err = svc.InUseProviderKinds(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"secretKey", "vault"}, kinds)
+}
+
+func TestSecretsService_ConfigFingerprint(t *testing.T) {
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	fingerprint := svc.ConfigFingerprint()
+	assert.Len(t, fingerprint, 64)
+	assert.Equal(t, fingerprint, SetupTestService(t, fakes.NewFakeSecretsStore()).ConfigFingerprint(), "should be stable")
+
+	secretKey := svc.cfg.SectionWithEnvOverrides("security").Key("secret_key").Value()
+	assert.NotContains(t, fingerprint, secretKey)
+
+	t.Run("should change with the current provider", func(t *testing.T) {
+		svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+		svc.currentProviderID = "fakeProvider.v1"
+		assert.NotEqual(t, fingerprint, svc.ConfigFingerprint())
+	})
+
+	t.Run("should change with the payloads format", func(t *testing.T) {
+		svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+		svc.keyCommitment = true
+		assert.NotEqual(t, fingerprint, svc.ConfigFingerprint())
+	})
+
+	t.Run("should change with the envelope encryption toggle", func(t *testing.T) {
+		svc := SetupDisabledTestService(t, fakes.NewFakeSecretsStore())
+		assert.NotEqual(t, fingerprint, svc.ConfigFingerprint())
+	})
+}
+
+func TestSecretsService_ListScopeKeys(t *testing.T) {
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+	svc.providers["escrow.v1"] = identityProvider{}
+
+	for _, scope := range []string{"root", "org:1"} {
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope(scope))
+		require.NoError(t, err)
+	}
+
+	_, err := svc.EncryptWithEscrow(ctx, []byte("grafana"), secrets.WithScope("user:1"), "escrow.v1")
+	require.NoError(t, err)
+
+	current := func(label string) string {
+		dataKey, err := store.GetCurrentDataKey(ctx, label)
+		require.NoError(t, err)
+		return dataKey.Id
+	}
+
+	scopeKeys, err := svc.ListScopeKeys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"root":  current(secrets.KeyLabel("root", svc.currentProviderID)),
+		"org:1": current(secrets.KeyLabel("org:1", svc.currentProviderID)),
+	}, scopeKeys)
+
+	t.Run("scopes without active data keys should not be listed", func(t *testing.T) {
+		require.NoError(t, store.DisableDataKeys(ctx))
+
+		scopeKeys, err := svc.ListScopeKeys(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, scopeKeys)
+	})
+}
+
+func TestSecretsService_RuntimeStats(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	// The data key is cached by id.
+	_, err = svc.Decrypt(ctx, encrypted)
+	require.NoError(t, err)
+
+	before, err := svc.RuntimeStats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, secrets.ProviderID(kmsproviders.Default), before.CurrentProvider)
+	assert.Equal(t, int64(1), before.DataKeys)
+	assert.Nil(t, before.LastRotation)
+
+	// Then, it's read from the cache.
+	_, err = svc.Decrypt(ctx, encrypted)
+	require.NoError(t, err)
+
+	require.NoError(t, svc.RotateDataKeys(ctx))
+
+	after, err := svc.RuntimeStats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, before.CacheHits+1, after.CacheHits)
+	assert.InDelta(t, float64(after.CacheHits)/float64(after.CacheHits+after.CacheMisses), after.CacheHitRatio, 1e-9)
+	require.NotNil(t, after.LastRotation)
+	assert.WithinDuration(t, time.Now(), *after.LastRotation, time.Minute)
+}
@@ -0,0 +1,129 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// secretsReEncryptProgressInterval is every how many secrets the
+// progress of RotateDataKeysAndReEncrypt is logged, per store.
+const secretsReEncryptProgressInterval = 100
+
+// SecretReEncryptFunc re-encrypts the given payload with the current data key for its scope, if
+// not encrypted with it already. It returns the re-encrypted payload (the given one if not changed),
+// and whether it was changed, in which case the caller must replace the stored payload with it.
+type SecretReEncryptFunc func(ctx context.Context, payload []byte) ([]byte, bool, error)
+
+// SecretsReEncryptor walks the encrypted secrets stored by a service (e.g. data sources secure JSON
+// data), re-encrypting each of them with the given function, and storing the changed ones. It should
+// keep going when a secret fails to be re-encrypted, as failures are counted by the given function.
+type SecretsReEncryptor func(ctx context.Context, reEncrypt SecretReEncryptFunc) error
+
+// SecretsReEncryptReport is the result of RotateDataKeysAndReEncrypt, by store name.
+type SecretsReEncryptReport struct {
+	Stores map[string]SecretsStoreReEncryptReport `json:"stores"`
+}
+
+// SecretsStoreReEncryptReport is the result of RotateDataKeysAndReEncrypt for a store.
+type SecretsStoreReEncryptReport struct {
+	ReEncrypted int    `json:"reEncrypted"`
+	Unchanged   int    `json:"unchanged"`
+	Failed      int    `json:"failed"`
+	Error       string `json:"error,omitempty"`
+}
+
+// RegisterSecretsReEncryptor registers a re-encryptor of the secrets stored by a service under
+// the given name, which identifies the store in the RotateDataKeysAndReEncrypt report. Registering
+// a re-encryptor under an already registered name replaces it.
+func (s *SecretsService) RegisterSecretsReEncryptor(name string, reEncryptor SecretsReEncryptor) {
+	s.secretsReEncryptorsMtx.Lock()
+	defer s.secretsReEncryptorsMtx.Unlock()
+
+	if s.secretsReEncryptors == nil {
+		s.secretsReEncryptors = make(map[string]SecretsReEncryptor)
+	}
+	s.secretsReEncryptors[name] = reEncryptor
+}
+
+// RotateDataKeysAndReEncrypt rotates the data keys, like RotateDataKeys, and then synchronously
+// re-encrypts all the secrets of the registered stores with the new data keys, so the rotation is
+// complete when it returns: no secret is encrypted with the previous data keys anymore. Stores are
+// walked in name order, and the progress is logged.
+//
+// It's meant for instances small enough to afford re-encrypting all their secrets at once. Larger
+// ones should rather rely on on-read migration (see DecryptAndUpgrade) after RotateDataKeys.
+func (s *SecretsService) RotateDataKeysAndReEncrypt(ctx context.Context) (SecretsReEncryptReport, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.RotateDataKeysAndReEncrypt")
+	defer span.End()
+
+	// Secrets may still need to be re-encrypted (e.g. legacy ones) when there are no data keys.
+	if err := s.RotateDataKeys(ctx); err != nil && !errors.Is(err, secrets.ErrNoKeysToRotate) {
+		return SecretsReEncryptReport{}, err
+	}
+
+	s.secretsReEncryptorsMtx.RLock()
+	names := make([]string, 0, len(s.secretsReEncryptors))
+	reEncryptors := make(map[string]SecretsReEncryptor, len(s.secretsReEncryptors))
+	for name, reEncryptor := range s.secretsReEncryptors {
+		names = append(names, name)
+		reEncryptors[name] = reEncryptor
+	}
+	s.secretsReEncryptorsMtx.RUnlock()
+
+	sort.Strings(names)
+
+	report := SecretsReEncryptReport{Stores: make(map[string]SecretsStoreReEncryptReport, len(names))}
+	var errs []error
+	for _, name := range names {
+		storeReport, err := s.reEncryptSecrets(ctx, name, reEncryptors[name])
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return report, ctxErr
+			}
+
+			storeReport.Error = err.Error()
+			errs = append(errs, fmt.Errorf("re-encrypting secrets of '%s': %w", name, err))
+		}
+		report.Stores[name] = storeReport
+
+		s.log.Info("Secrets re-encryption finished",
+			"store", name,
+			"re_encrypted", storeReport.ReEncrypted,
+			"unchanged", storeReport.Unchanged,
+			"failed", storeReport.Failed,
+		)
+	}
+
+	return report, errors.Join(errs...)
+}
+
+func (s *SecretsService) reEncryptSecrets(ctx context.Context, name string, reEncryptor SecretsReEncryptor) (SecretsStoreReEncryptReport, error) {
+	var report SecretsStoreReEncryptReport
+
+	err := reEncryptor(ctx, func(ctx context.Context, payload []byte) ([]byte, bool, error) {
+		plaintext, upgraded, changed, err := s.DecryptAndUpgrade(ctx, payload, nil)
+		clear(plaintext)
+
+		switch {
+		case err != nil:
+			report.Failed++
+			s.log.Warn("Failed to re-encrypt secret", "store", name, "error", err)
+		case changed:
+			report.ReEncrypted++
+		default:
+			report.Unchanged++
+		}
+
+		if processed := report.ReEncrypted + report.Unchanged + report.Failed; processed%secretsReEncryptProgressInterval == 0 {
+			s.log.Info("Secrets re-encryption progress", "store", name, "processed", processed)
+		}
+
+		return upgraded, changed, err
+	})
+
+	return report, err
+}
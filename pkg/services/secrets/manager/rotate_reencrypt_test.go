@@ -0,0 +1,66 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_RotateDataKeysAndReEncrypt(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	keyIdOf := func(t *testing.T, payload []byte) string {
+		t.Helper()
+		keyId, _, err := decodeEnvelope(payload)
+		require.NoError(t, err)
+		return keyId
+	}
+
+	stored := make(map[string][]byte)
+	for _, name := range []string{"a", "b"} {
+		encrypted, err := svc.Encrypt(ctx, []byte(name), secrets.WithScope("org:1"))
+		require.NoError(t, err)
+		stored[name] = encrypted
+	}
+	previous := keyIdOf(t, stored["a"])
+	stored["corrupted"] = []byte("corrupted")
+
+	svc.RegisterSecretsReEncryptor("datasources", func(ctx context.Context, reEncrypt SecretReEncryptFunc) error {
+		for name, payload := range stored {
+			reEncrypted, changed, err := reEncrypt(ctx, payload)
+			if err == nil && changed {
+				stored[name] = reEncrypted
+			}
+		}
+		return nil
+	})
+	svc.RegisterSecretsReEncryptor("failing", func(context.Context, SecretReEncryptFunc) error {
+		return errors.New("store unavailable")
+	})
+
+	report, err := svc.RotateDataKeysAndReEncrypt(ctx)
+	require.ErrorContains(t, err, "store unavailable")
+	assert.Equal(t, SecretsReEncryptReport{Stores: map[string]SecretsStoreReEncryptReport{
+		"datasources": {ReEncrypted: 2, Failed: 1},
+		"failing":     {Error: "store unavailable"},
+	}}, report)
+
+	for _, name := range []string{"a", "b"} {
+		assert.NotEqual(t, previous, keyIdOf(t, stored[name]))
+
+		decrypted, err := svc.Decrypt(ctx, stored[name])
+		require.NoError(t, err)
+		assert.Equal(t, []byte(name), decrypted)
+	}
+
+	dataKey, err := svc.store.GetDataKey(ctx, previous)
+	require.NoError(t, err)
+	assert.False(t, dataKey.Active)
+}
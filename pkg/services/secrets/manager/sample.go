@@ -0,0 +1,139 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// EncryptedSecretsFetcher returns the encrypted payloads of the secrets stored by a service
+// (e.g. data sources secure JSON data), so they can be sampled by SampleVerify.
+type EncryptedSecretsFetcher func(ctx context.Context) ([][]byte, error)
+
+// SampleVerifyReport is the result of SampleVerify. Like VerifyReport,
+// it must never contain any secret material.
+type SampleVerifyReport struct {
+	Sampled   int                   `json:"sampled"`
+	Succeeded int                   `json:"succeeded"`
+	Failed    int                   `json:"failed"`
+	Failures  []SampleVerifyFailure `json:"failures"`
+}
+
+// SampleVerifyFailure is a sampled secret that couldn't be decrypted by SampleVerify.
+type SampleVerifyFailure struct {
+	Source string `json:"source"`
+	Error  string `json:"error"`
+}
+
+type sampledSecret struct {
+	source  string
+	payload []byte
+}
+
+// RegisterEncryptedSecretsFetcher registers a fetcher of encrypted secrets under the given name,
+// which identifies the source of the failures reported by SampleVerify. Registering a fetcher
+// under an already registered name replaces it.
+func (s *SecretsService) RegisterEncryptedSecretsFetcher(name string, fetcher EncryptedSecretsFetcher) {
+	s.secretsFetchersMtx.Lock()
+	defer s.secretsFetchersMtx.Unlock()
+
+	if s.secretsFetchers == nil {
+		s.secretsFetchers = make(map[string]EncryptedSecretsFetcher)
+	}
+	s.secretsFetchers[name] = fetcher
+}
+
+// SampleVerify decrypts a random sample of, at most, n of the secrets returned by the registered
+// fetchers, and reports how many of them could be decrypted. Unlike Verify, which only checks the
+// data keys, it exercises the whole decryption path with real secrets, so it catches systemic issues
+// like a wrong provider or corrupted payloads. The decrypted secrets are scrubbed from memory as soon
+// as they're decrypted, and never leave this method.
+func (s *SecretsService) SampleVerify(ctx context.Context, n int) (SampleVerifyReport, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.SampleVerify")
+	defer span.End()
+
+	if n <= 0 {
+		return SampleVerifyReport{}, fmt.Errorf("invalid sample size %d: must be positive", n)
+	}
+
+	candidates, err := s.fetchEncryptedSecrets(ctx)
+	if err != nil {
+		return SampleVerifyReport{}, err
+	}
+
+	// Partial Fisher-Yates shuffle: only the first n candidates are sampled.
+	n = min(n, len(candidates))
+	for i := 0; i < n; i++ {
+		j := i + rand.Intn(len(candidates)-i)
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+
+	report := SampleVerifyReport{Failures: make([]SampleVerifyFailure, 0)}
+	for _, candidate := range candidates[:n] {
+		if err := ctx.Err(); err != nil {
+			return SampleVerifyReport{}, err
+		}
+
+		report.Sampled++
+
+		decrypted, err := s.decrypt(ctx, candidate.payload, s.dataKeyById)
+		clear(decrypted)
+
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return SampleVerifyReport{}, ctxErr
+			}
+
+			report.Failed++
+			report.Failures = append(report.Failures, SampleVerifyFailure{
+				Source: candidate.source,
+				Error:  err.Error(),
+			})
+			continue
+		}
+
+		report.Succeeded++
+	}
+
+	if report.Failed > 0 {
+		s.log.Warn("Encrypted secrets sample verification found failures", "sampled", report.Sampled, "failed", report.Failed)
+	}
+
+	return report, nil
+}
+
+// fetchEncryptedSecrets returns the non-empty encrypted secrets returned by all the registered fetchers.
+func (s *SecretsService) fetchEncryptedSecrets(ctx context.Context) ([]sampledSecret, error) {
+	s.secretsFetchersMtx.RLock()
+	names := make([]string, 0, len(s.secretsFetchers))
+	fetchers := make(map[string]EncryptedSecretsFetcher, len(s.secretsFetchers))
+	for name, fetcher := range s.secretsFetchers {
+		names = append(names, name)
+		fetchers[name] = fetcher
+	}
+	s.secretsFetchersMtx.RUnlock()
+
+	if len(names) == 0 {
+		return nil, errors.New("no encrypted secrets fetcher registered")
+	}
+
+	sort.Strings(names)
+
+	var sampled []sampledSecret
+	for _, name := range names {
+		payloads, err := fetchers[name](ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch encrypted secrets from '%s': %w", name, err)
+		}
+
+		for _, payload := range payloads {
+			if len(payload) > 0 {
+				sampled = append(sampled, sampledSecret{source: name, payload: payload})
+			}
+		}
+	}
+
+	return sampled, nil
+}
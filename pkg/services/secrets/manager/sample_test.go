@@ -0,0 +1,84 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_SampleVerify(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	payloads := make([][]byte, 0, 5)
+	for i := 0; i < 5; i++ {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+		payloads = append(payloads, encrypted)
+	}
+
+	t.Run("without fetchers should fail", func(t *testing.T) {
+		_, err := svc.SampleVerify(ctx, 10)
+		require.Error(t, err)
+	})
+
+	t.Run("invalid sample size should fail", func(t *testing.T) {
+		_, err := svc.SampleVerify(ctx, 0)
+		require.Error(t, err)
+	})
+
+	svc.RegisterEncryptedSecretsFetcher("datasources", func(context.Context) ([][]byte, error) {
+		return append(payloads, nil), nil
+	})
+
+	t.Run("all the secrets should be sampled if there are fewer than requested", func(t *testing.T) {
+		report, err := svc.SampleVerify(ctx, 10)
+		require.NoError(t, err)
+		assert.Equal(t, 5, report.Sampled)
+		assert.Equal(t, 5, report.Succeeded)
+		assert.Zero(t, report.Failed)
+		assert.Empty(t, report.Failures)
+	})
+
+	t.Run("only the requested amount of secrets should be sampled", func(t *testing.T) {
+		report, err := svc.SampleVerify(ctx, 2)
+		require.NoError(t, err)
+		assert.Equal(t, 2, report.Sampled)
+		assert.Equal(t, 2, report.Succeeded)
+	})
+
+	t.Run("undecryptable secrets should be reported by source", func(t *testing.T) {
+		svc.RegisterEncryptedSecretsFetcher("plugins", func(context.Context) ([][]byte, error) {
+			return [][]byte{[]byte("#dW5rbm93bg#corrupted")}, nil
+		})
+		t.Cleanup(func() {
+			svc.secretsFetchersMtx.Lock()
+			delete(svc.secretsFetchers, "plugins")
+			svc.secretsFetchersMtx.Unlock()
+		})
+
+		report, err := svc.SampleVerify(ctx, 10)
+		require.NoError(t, err)
+		assert.Equal(t, 6, report.Sampled)
+		assert.Equal(t, 5, report.Succeeded)
+		assert.Equal(t, 1, report.Failed)
+		require.Len(t, report.Failures, 1)
+		assert.Equal(t, "plugins", report.Failures[0].Source)
+		assert.NotContains(t, report.Failures[0].Error, "grafana")
+	})
+
+	t.Run("fetcher errors should fail", func(t *testing.T) {
+		svc.RegisterEncryptedSecretsFetcher("failing", func(context.Context) ([][]byte, error) {
+			return nil, errors.New("database is down")
+		})
+
+		_, err := svc.SampleVerify(ctx, 10)
+		require.ErrorContains(t, err, "database is down")
+	})
+}
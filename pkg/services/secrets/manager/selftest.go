@@ -0,0 +1,73 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"sort"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// defaultCanarySize is the size of the canary encrypted by SelfTestProviders, unless configured
+// otherwise. It's the size of the data keys, which is what providers encrypt in real usage.
+const defaultCanarySize = dataKeyLength
+
+var errCanaryMismatch = errors.New("decrypted canary differs from the encrypted one")
+
+// ProviderSelfTestResult is the result of SelfTestProviders for a provider. Error is empty on success.
+type ProviderSelfTestResult struct {
+	Provider secrets.ProviderID `json:"provider"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// SelfTestProviders encrypts a random canary with each configured provider and decrypts it back,
+// so misconfigured providers are caught before any data key is encrypted with them. Results are
+// sorted by provider. The size of the canary is configured by [security.encryption] self_test_canary_size,
+// so it can mirror the payloads encrypted by the providers of a deployment.
+func (s *SecretsService) SelfTestProviders(ctx context.Context) ([]ProviderSelfTestResult, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.SelfTestProviders")
+	defer span.End()
+
+	canary := make([]byte, s.canarySize)
+	if _, err := rand.Read(canary); err != nil {
+		return nil, err
+	}
+
+	results := make([]ProviderSelfTestResult, 0, len(s.providers))
+	for id, provider := range s.providers {
+		err := s.selfTestProvider(ctx, id, provider, canary)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+
+		result := ProviderSelfTestResult{Provider: id}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Provider < results[j].Provider })
+
+	return results, nil
+}
+
+func (s *SecretsService) selfTestProvider(ctx context.Context, id secrets.ProviderID, provider secrets.Provider, canary []byte) error {
+	encrypted, err := s.providerEncrypt(ctx, id, provider, canary)
+	if err != nil {
+		return err
+	}
+
+	decrypted, err := s.providerDecrypt(ctx, id, provider, encrypted)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(canary, decrypted) {
+		return errCanaryMismatch
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package manager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_SelfTestProviders(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+	svc.providers = map[secrets.ProviderID]secrets.Provider{
+		"ok.v1":         identityProvider{},
+		"failing.v1":    failingProvider{},
+		"truncating.v1": truncatingProvider{},
+	}
+
+	results, err := svc.SelfTestProviders(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []ProviderSelfTestResult{
+		{Provider: "failing.v1", Error: "provider unavailable"},
+		{Provider: "ok.v1"},
+		{Provider: "truncating.v1", Error: errCanaryMismatch.Error()},
+	}, results)
+
+	t.Run("should stop once the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := svc.SelfTestProviders(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
@@ -0,0 +1,84 @@
+package manager
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// runningProviders tracks the background providers still running,
+// so the ones that don't stop on shutdown can be reported.
+type runningProviders struct {
+	mtx sync.Mutex
+	ids map[secrets.ProviderID]struct{}
+}
+
+func (r *runningProviders) start(id secrets.ProviderID) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.ids == nil {
+		r.ids = make(map[secrets.ProviderID]struct{})
+	}
+	r.ids[id] = struct{}{}
+}
+
+func (r *runningProviders) stop(id secrets.ProviderID) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	delete(r.ids, id)
+}
+
+// list returns the identifiers of the background providers still running, sorted.
+func (r *runningProviders) list() []secrets.ProviderID {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	ids := make([]secrets.ProviderID, 0, len(r.ids))
+	for id := range r.ids {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+// waitForShutdown waits for the background tasks of Run, and the refreshes ahead in progress
+// (see refreshAhead), to stop, for up to the configured shutdown timeout, if any. Background providers may not honor the context cancellation, and
+// a stuck one mustn't prevent Grafana from shutting down: once the timeout fires, the providers
+// still running are logged and left behind, and no error is returned.
+func (s *SecretsService) waitForShutdown(grp *errgroup.Group, running *runningProviders) error {
+	wait := func() error {
+		err := grp.Wait()
+		s.refreshes.Wait()
+		return err
+	}
+
+	if s.shutdownTimeout <= 0 {
+		return wait()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- wait()
+	}()
+
+	timer := time.NewTimer(s.shutdownTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		shutdownTimeoutsCounter.Inc()
+		s.log.Error("Timed out waiting for background encryption providers to stop, leaving them behind",
+			"timeout", s.shutdownTimeout, "providers", running.list())
+		return nil
+	}
+}
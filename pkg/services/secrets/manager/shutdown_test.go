@@ -0,0 +1,63 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+// stuckProvider is a background provider that doesn't honor the context cancellation.
+type stuckProvider struct {
+	fakeProvider
+	stop chan struct{}
+}
+
+func (p *stuckProvider) Run(context.Context) error {
+	<-p.stop
+	return nil
+}
+
+func TestSecretsService_ShutdownTimeout(t *testing.T) {
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+	stuck := &stuckProvider{stop: make(chan struct{})}
+	t.Cleanup(func() { close(stuck.stop) })
+
+	svc.providers = map[secrets.ProviderID]secrets.Provider{
+		"healthy.v1": &backgroundProvider{},
+		"stuck.v1":   stuck,
+	}
+	svc.shutdownTimeout = 50 * time.Millisecond
+
+	timeouts := testutil.ToFloat64(shutdownTimeoutsCounter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- svc.Run(ctx) }()
+	cancel()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run blocked by stuck background provider")
+	}
+
+	assert.Equal(t, timeouts+1, testutil.ToFloat64(shutdownTimeoutsCounter))
+}
+
+func TestRunningProviders(t *testing.T) {
+	var running runningProviders
+	running.start("b.v1")
+	running.start("a.v1")
+	running.start("c.v1")
+	running.stop("c.v1")
+
+	assert.Equal(t, []secrets.ProviderID{"a.v1", "b.v1"}, running.list())
+}
@@ -0,0 +1,72 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// DecryptForTenant works like Decrypt, but if tenant binding is enabled, it also checks
+// the payload was encrypted with a data key bound to the given tenant (see secrets.WithTenant),
+// so a payload of one tenant isn't decrypted on behalf of another one by mistake. In such case,
+// payloads encrypted with legacy encryption or with data keys of any other scope are rejected too.
+//
+// Note the binding is a store-level check, not a cryptographic one: it compares the given tenant
+// with the scope stored along with the data key, which isn't authenticated by the ciphertext. So,
+// it guards against mixing up the secrets of different tenants, but not against anyone who can
+// modify the data keys table (e.g. by changing the scope of a data key).
+func (s *SecretsService) DecryptForTenant(ctx context.Context, payload []byte, orgID int64) ([]byte, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.DecryptForTenant")
+	defer span.End()
+
+	if s.tenantBinding {
+		if err := s.checkTenant(ctx, payload, orgID); err != nil {
+			s.log.Error("Failed to decrypt secret for tenant", "org_id", orgID, "error", err)
+			return nil, err
+		}
+	}
+
+	return s.decrypt(ctx, payload, s.dataKeyById)
+}
+
+// checkTenant checks the given payload was encrypted with a data key whose stored scope is the
+// one of the given tenant.
+func (s *SecretsService) checkTenant(ctx context.Context, payload []byte, orgID int64) error {
+	if !s.encryptedWithEnvelopeEncryption(payload) {
+		return fmt.Errorf("%w %d: payload not envelope encrypted", secrets.ErrTenantMismatch, orgID)
+	}
+
+	keyId, _, err := decodeEnvelope(payload)
+	if err != nil {
+		return err
+	}
+
+	entry, err := s.lookupDataKey(ctx, keyId, s.dataKeyById)
+	if err != nil {
+		return err
+	}
+
+	if entry.scope != secrets.TenantScope(orgID) {
+		return fmt.Errorf("%w %d: data key '%s' has scope '%s'", secrets.ErrTenantMismatch, orgID, keyId, entry.scope)
+	}
+
+	return nil
+}
+
+// scopeKnown reports whether the given scope matches any of the given known scopes. Known
+// scopes ending with "*" match any scope with the same prefix (e.g. "org:*" matches "org:1").
+func scopeKnown(scope string, known []string) bool {
+	for _, pattern := range known {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(scope, prefix) {
+			return true
+		}
+
+		if pattern == scope {
+			return true
+		}
+	}
+
+	return false
+}
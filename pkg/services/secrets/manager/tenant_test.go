@@ -0,0 +1,118 @@
+package manager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_DecryptForTenant(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	encrypt := func(opt secrets.EncryptionOptions) []byte {
+		t.Helper()
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), opt)
+		require.NoError(t, err)
+		return encrypted
+	}
+
+	org1, org2, root := encrypt(secrets.WithTenant(1)), encrypt(secrets.WithTenant(2)), encrypt(secrets.WithoutScope())
+	legacy, err := svc.enc.Encrypt(ctx, []byte("grafana"), "SdlklWklckeLS")
+	require.NoError(t, err)
+
+	t.Run("tenants should not share data keys", func(t *testing.T) {
+		id1, _, err := decodeEnvelope(org1)
+		require.NoError(t, err)
+		id2, _, err := decodeEnvelope(org2)
+		require.NoError(t, err)
+		require.NotEqual(t, id1, id2)
+
+		_, key1, err := svc.fetchDataKeyById(ctx, id1)
+		require.NoError(t, err)
+		_, key2, err := svc.fetchDataKeyById(ctx, id2)
+		require.NoError(t, err)
+		assert.NotEqual(t, key1, key2)
+
+		dataKey, _, err := svc.fetchDataKeyById(ctx, id1)
+		require.NoError(t, err)
+		assert.Equal(t, "org:1", dataKey.Scope)
+	})
+
+	t.Run("without tenant binding, any payload should be decrypted", func(t *testing.T) {
+		for _, payload := range [][]byte{org1, org2, root, legacy} {
+			decrypted, err := svc.DecryptForTenant(ctx, payload, 1)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), decrypted)
+		}
+	})
+
+	t.Run("with tenant binding, only the tenant payloads should be decrypted", func(t *testing.T) {
+		svc.tenantBinding = true
+		t.Cleanup(func() { svc.tenantBinding = false })
+
+		decrypted, err := svc.DecryptForTenant(ctx, org1, 1)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		decrypted, err = svc.DecryptForTenant(ctx, org2, 2)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+
+		for name, payload := range map[string][]byte{"other tenant": org2, "root": root, "legacy": legacy} {
+			_, err := svc.DecryptForTenant(ctx, payload, 1)
+			assert.ErrorIs(t, err, secrets.ErrTenantMismatch, name)
+		}
+	})
+}
+
+func TestScopeKnown(t *testing.T) {
+	known := []string{"root", "org:*"}
+
+	for scope, expected := range map[string]bool{
+		"root":   true,
+		"org:1":  true,
+		"user:1": false,
+		"rooted": false,
+		"":       false,
+	} {
+		assert.Equal(t, expected, scopeKnown(scope, known), scope)
+	}
+}
+
+func TestSecretsService_StrictScopes(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+	svc.knownScopes = []string{"root", "org:*"}
+
+	encrypted := make(map[string][]byte)
+	for _, scope := range []string{"root", "org:1", "user:1"} {
+		payload, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope(scope))
+		require.NoError(t, err)
+		encrypted[scope] = payload
+	}
+
+	t.Run("unknown scopes should be allowed by default", func(t *testing.T) {
+		_, err := svc.Decrypt(ctx, encrypted["user:1"])
+		require.NoError(t, err)
+	})
+
+	t.Run("unknown scopes should be rejected in strict mode", func(t *testing.T) {
+		svc.strictScopes = true
+		t.Cleanup(func() { svc.strictScopes = false })
+
+		for _, scope := range []string{"root", "org:1"} {
+			decrypted, err := svc.Decrypt(ctx, encrypted[scope])
+			require.NoError(t, err, scope)
+			assert.Equal(t, []byte("grafana"), decrypted)
+		}
+
+		_, err := svc.Decrypt(ctx, encrypted["user:1"])
+		assert.ErrorIs(t, err, secrets.ErrUnknownScope)
+	})
+}
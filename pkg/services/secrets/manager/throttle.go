@@ -0,0 +1,62 @@
+package manager
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// throttledProvider is an encryption provider whose calls are rate-limited, so the data keys
+// re-encryption stays within the encryption providers quotas (e.g. KMS requests per second).
+type throttledProvider struct {
+	secrets.Provider
+	limiter *rate.Limiter
+}
+
+func (p throttledProvider) Encrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	if err := p.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return p.Provider.Encrypt(ctx, blob)
+}
+
+func (p throttledProvider) Decrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	if err := p.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return p.Provider.Decrypt(ctx, blob)
+}
+
+func (p throttledProvider) wait(ctx context.Context) error {
+	start := time.Now()
+	err := p.limiter.Wait(ctx)
+	reEncryptThrottleWaitHistogram.Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+// reEncryptProviders returns the encryption providers to re-encrypt the data keys with. If
+// [security.encryption] re_encrypt_provider_rate is set, their calls are rate-limited, all of
+// them together, to that rate. Only calls to the providers are limited, not the database writes.
+func (s *SecretsService) reEncryptProviders() map[secrets.ProviderID]secrets.Provider {
+	reEncryptRateGauge.Set(float64(s.reEncryptRate))
+
+	if s.reEncryptRate <= 0 {
+		return s.providers
+	}
+
+	s.log.Info("Data keys re-encryption rate-limited", "rate", float64(s.reEncryptRate))
+
+	limiter := rate.NewLimiter(s.reEncryptRate, 1)
+	providers := make(map[secrets.ProviderID]secrets.Provider, len(s.providers))
+	for id, provider := range s.providers {
+		providers[id] = throttledProvider{Provider: provider, limiter: limiter}
+	}
+
+	return providers
+}
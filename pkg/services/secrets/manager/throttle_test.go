@@ -0,0 +1,59 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_ReEncryptProviders(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	t.Run("providers should not be throttled without rate", func(t *testing.T) {
+		providers := svc.reEncryptProviders()
+		assert.Equal(t, svc.providers, providers)
+		assert.Zero(t, testutil.ToFloat64(reEncryptRateGauge))
+	})
+
+	t.Run("providers calls should be throttled, all together", func(t *testing.T) {
+		svc.reEncryptRate = rate.Limit(20)
+		t.Cleanup(func() { svc.reEncryptRate = 0 })
+
+		providers := svc.reEncryptProviders()
+		require.Len(t, providers, len(svc.providers))
+		assert.Equal(t, float64(20), testutil.ToFloat64(reEncryptRateGauge))
+
+		start := time.Now()
+		for _, provider := range providers {
+			encrypted, err := provider.Encrypt(ctx, []byte("grafana"))
+			require.NoError(t, err)
+			_, err = provider.Decrypt(ctx, encrypted)
+			require.NoError(t, err)
+		}
+		// The first call is allowed by the burst, the others wait 50ms each.
+		assert.GreaterOrEqual(t, time.Since(start), time.Duration(2*len(providers)-1)*40*time.Millisecond)
+	})
+
+	t.Run("data keys should still be re-encrypted when throttled", func(t *testing.T) {
+		svc.reEncryptRate = rate.Limit(100)
+		t.Cleanup(func() { svc.reEncryptRate = 0 })
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+		require.NoError(t, err)
+
+		require.NoError(t, svc.ReEncryptDataKeys(ctx))
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+}
@@ -0,0 +1,85 @@
+package manager
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// OperationTimings is the time spent by each phase of a single encrypt or decrypt
+// operation, for performance debugging. Phases not gone through are zero.
+type OperationTimings struct {
+	// LockWait is the time spent waiting for the lock that serializes
+	// the lookup (and creation) of the current data key.
+	LockWait time.Duration
+	// Provider is the time spent by the encryption providers (e.g. KMS),
+	// encrypting or decrypting data keys.
+	Provider time.Duration
+	// Cipher is the time spent encrypting or decrypting the payload itself.
+	Cipher time.Duration
+	// Total is the time spent by the whole operation.
+	Total time.Duration
+}
+
+// timingsRecorder accumulates the time spent by each phase of an operation.
+// It's safe for concurrent use, as providers may be called in the background
+// (e.g. refresh-ahead) with the context of the operation.
+type timingsRecorder struct {
+	lockWait atomic.Int64
+	provider atomic.Int64
+	cipher   atomic.Int64
+}
+
+type timingsRecorderKey struct{}
+
+// trackPhase starts timing a phase of the operation in progress, if it's being timed
+// (see EncryptWithTimings), and returns the function that stops it. Otherwise, it
+// returns a no-op function, so there's no overhead when timings are disabled.
+func trackPhase(ctx context.Context, phase func(r *timingsRecorder) *atomic.Int64) func() {
+	r, ok := ctx.Value(timingsRecorderKey{}).(*timingsRecorder)
+	if !ok {
+		return func() {}
+	}
+
+	start := time.Now()
+	return func() {
+		phase(r).Add(int64(time.Since(start)))
+	}
+}
+
+func lockWaitPhase(r *timingsRecorder) *atomic.Int64 { return &r.lockWait }
+func providerPhase(r *timingsRecorder) *atomic.Int64 { return &r.provider }
+func cipherPhase(r *timingsRecorder) *atomic.Int64   { return &r.cipher }
+
+// timed runs the given operation with a context that records its timings.
+func timed[T any](ctx context.Context, operation func(ctx context.Context) (T, error)) (T, OperationTimings, error) {
+	r := &timingsRecorder{}
+	start := time.Now()
+
+	result, err := operation(context.WithValue(ctx, timingsRecorderKey{}, r))
+
+	return result, OperationTimings{
+		LockWait: time.Duration(r.lockWait.Load()),
+		Provider: time.Duration(r.provider.Load()),
+		Cipher:   time.Duration(r.cipher.Load()),
+		Total:    time.Since(start),
+	}, err
+}
+
+// EncryptWithTimings works like Encrypt, but it also returns the time spent by each phase
+// of the operation, to tell whether lock contention or providers latency dominates.
+func (s *SecretsService) EncryptWithTimings(ctx context.Context, payload []byte, opt secrets.EncryptionOptions) ([]byte, OperationTimings, error) {
+	return timed(ctx, func(ctx context.Context) ([]byte, error) {
+		return s.Encrypt(ctx, payload, opt)
+	})
+}
+
+// DecryptWithTimings works like Decrypt, but it also returns the time spent by each phase
+// of the operation, to tell whether lock contention or providers latency dominates.
+func (s *SecretsService) DecryptWithTimings(ctx context.Context, payload []byte) ([]byte, OperationTimings, error) {
+	return timed(ctx, func(ctx context.Context) ([]byte, error) {
+		return s.Decrypt(ctx, payload)
+	})
+}
@@ -0,0 +1,65 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/kmsproviders"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+// slowProvider delays every call to the wrapped provider.
+type slowProvider struct {
+	secrets.Provider
+	delay time.Duration
+}
+
+func (p slowProvider) Encrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	time.Sleep(p.delay)
+	return p.Provider.Encrypt(ctx, blob)
+}
+
+func (p slowProvider) Decrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	time.Sleep(p.delay)
+	return p.Provider.Decrypt(ctx, blob)
+}
+
+func TestSecretsService_OperationTimings(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	const delay = 20 * time.Millisecond
+	svc.providers[kmsproviders.Default] = slowProvider{Provider: svc.providers[kmsproviders.Default], delay: delay}
+
+	// A new data key is created, so the provider is called.
+	encrypted, timings, err := svc.EncryptWithTimings(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, timings.Provider, delay)
+	assert.Positive(t, timings.Cipher)
+	assert.GreaterOrEqual(t, timings.Total, timings.Provider+timings.Cipher)
+
+	t.Run("decrypt should be timed", func(t *testing.T) {
+		svc.dataKeyCache.flush()
+
+		decrypted, timings, err := svc.DecryptWithTimings(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+		assert.GreaterOrEqual(t, timings.Provider, delay)
+		assert.Positive(t, timings.Cipher)
+		assert.Zero(t, timings.LockWait)
+	})
+
+	t.Run("lock wait should be timed", func(t *testing.T) {
+		svc.mtx.Lock()
+		time.AfterFunc(delay, svc.mtx.Unlock)
+
+		_, timings, err := svc.EncryptWithTimings(ctx, []byte("grafana"), secrets.WithScope("org:1"))
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, timings.LockWait, delay/2)
+	})
+}
@@ -0,0 +1,101 @@
+package manager
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/db"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+)
+
+// DecryptAndUpgrade decrypts the given payload and, unless it's already encrypted with the current
+// data key for its scope, encrypts it again with that one, so callers can persist the upgraded payload
+// in the same transaction they read it (i.e. on-read migration). It returns the plaintext, the upgraded
+// payload (the given one if not changed), and whether it was changed.
+//
+// If a session is given, any data key created to upgrade the payload is stored within its transaction,
+// the same way it'd be if the context was obtained from db.DB.InTransaction. So, if the transaction is
+// rolled back, no payload references a data key that doesn't exist.
+//
+// Legacy payloads are upgraded to the root scope. Deterministic payloads and payloads with expiry keep
+// being so (see EncryptDeterministic and EncryptWithExpiry), while payloads encrypted with escrow copies
+// are never upgraded, as they'd lose them.
+func (s *SecretsService) DecryptAndUpgrade(ctx context.Context, payload []byte, sess *db.Session) ([]byte, []byte, bool, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.DecryptAndUpgrade")
+	defer span.End()
+
+	if sess != nil {
+		ctx = context.WithValue(ctx, sqlstore.ContextSessionKey{}, sess)
+	}
+
+	plaintext, err := s.decrypt(ctx, payload, s.dataKeyById)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if s.features.IsEnabled(ctx, featuremgmt.FlagDisableEnvelopeEncryption) {
+		return plaintext, payload, false, nil
+	}
+
+	scope := secrets.WithoutScope()()
+	var opts encryptOptions
+
+	if s.encryptedWithEnvelopeEncryption(payload) {
+		keyId, ciphertext, err := decodeEnvelope(payload)
+		if err != nil {
+			return nil, nil, false, err
+		}
+
+		entry, err := s.lookupDataKey(ctx, keyId, s.dataKeyById)
+		if err != nil {
+			return nil, nil, false, err
+		}
+
+		if strings.Contains(entry.label, secrets.EscrowLabelSeparator) {
+			return plaintext, payload, false, nil
+		}
+
+		scope = entry.scope
+		if s.builtinEnc {
+			opts = ciphertextOptions(ciphertext)
+		}
+
+		currentId, _, err := s.currentDataKey(ctx, secrets.KeyLabel(scope, s.scopeProvider(scope)), scope, encryptOptions{noCreate: true})
+		if err == nil && currentId == keyId {
+			return plaintext, payload, false, nil
+		}
+	}
+
+	upgraded, err := s.encrypt(ctx, plaintext, scope, opts)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	return plaintext, upgraded, true, nil
+}
+
+// ciphertextOptions returns the options the given ciphertext (i.e. without the envelope prefix)
+// was encrypted with, so it can be encrypted again the same way.
+func ciphertextOptions(ciphertext []byte) encryptOptions {
+	var opts encryptOptions
+	if len(ciphertext) == 0 {
+		return opts
+	}
+
+	switch ciphertext[0] {
+	case deterministicMarker:
+		opts.deterministic = true
+	case nilMarker:
+		opts.nullable = true
+	case expiringMarker:
+		if len(ciphertext) >= 1+expiryLength {
+			opts.expireAt = time.Unix(int64(binary.BigEndian.Uint64(ciphertext[1:1+expiryLength])), 0)
+		}
+	}
+
+	return opts
+}
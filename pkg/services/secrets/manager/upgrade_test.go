@@ -0,0 +1,104 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/infra/db"
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/database"
+)
+
+func TestSecretsService_DecryptAndUpgrade(t *testing.T) {
+	ctx := context.Background()
+	testDB := db.InitTestDB(t)
+	store := database.ProvideSecretsStore(testDB, kvstore.ProvideService(testDB))
+	svc := SetupTestService(t, store)
+
+	keyIdOf := func(t *testing.T, payload []byte) string {
+		t.Helper()
+		keyId, _, err := decodeEnvelope(payload)
+		require.NoError(t, err)
+		return keyId
+	}
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("org:1"))
+	require.NoError(t, err)
+
+	t.Run("payloads encrypted with the current data key should not change", func(t *testing.T) {
+		plaintext, upgraded, changed, err := svc.DecryptAndUpgrade(ctx, encrypted, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), plaintext)
+		assert.Equal(t, encrypted, upgraded)
+		assert.False(t, changed)
+	})
+
+	t.Run("payloads encrypted with a previous data key should be upgraded", func(t *testing.T) {
+		require.NoError(t, svc.RotateDataKeys(ctx))
+
+		plaintext, upgraded, changed, err := svc.DecryptAndUpgrade(ctx, encrypted, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), plaintext)
+		assert.True(t, changed)
+		assert.NotEqual(t, keyIdOf(t, encrypted), keyIdOf(t, upgraded))
+
+		dataKey, err := store.GetDataKey(ctx, keyIdOf(t, upgraded))
+		require.NoError(t, err)
+		assert.Equal(t, "org:1", dataKey.Scope)
+
+		decrypted, err := svc.Decrypt(ctx, upgraded)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+
+	t.Run("legacy payloads should be upgraded", func(t *testing.T) {
+		secretKey := svc.cfg.SectionWithEnvOverrides("security").Key("secret_key").Value()
+		legacy, err := svc.enc.Encrypt(ctx, []byte("grafana"), secretKey)
+		require.NoError(t, err)
+
+		plaintext, upgraded, changed, err := svc.DecryptAndUpgrade(ctx, legacy, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), plaintext)
+		assert.True(t, changed)
+		assert.Equal(t, PayloadKindEnvelope, ClassifyPayload(upgraded))
+	})
+
+	t.Run("payloads with expiry should keep it", func(t *testing.T) {
+		expiring, err := svc.EncryptWithExpiry(ctx, []byte("grafana"), time.Now().Add(time.Hour), secrets.WithoutScope())
+		require.NoError(t, err)
+		require.NoError(t, svc.RotateDataKeys(ctx))
+
+		_, upgraded, changed, err := svc.DecryptAndUpgrade(ctx, expiring, nil)
+		require.NoError(t, err)
+		require.True(t, changed)
+
+		_, ciphertext, err := decodeEnvelope(upgraded)
+		require.NoError(t, err)
+		assert.Equal(t, byte(expiringMarker), ciphertext[0])
+	})
+
+	t.Run("data keys created within a rolled back transaction should not be persisted", func(t *testing.T) {
+		// Rotations provision new data keys, so there must be no active data key at all.
+		require.NoError(t, store.DisableDataKeys(ctx))
+		svc.dataKeyCache.flush()
+
+		var upgraded []byte
+		errRollback := errors.New("rollback")
+		err := testDB.WithTransactionalDbSession(ctx, func(sess *db.Session) error {
+			var err error
+			_, upgraded, _, err = svc.DecryptAndUpgrade(ctx, encrypted, sess)
+			require.NoError(t, err)
+			return errRollback
+		})
+		require.ErrorIs(t, err, errRollback)
+
+		_, err = store.GetDataKey(ctx, keyIdOf(t, upgraded))
+		assert.ErrorIs(t, err, secrets.ErrDataKeyNotFound)
+	})
+}
@@ -0,0 +1,184 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// valueType is the type marker of the values encrypted by EncryptValue,
+// based on the kind of JSON value they're serialized to.
+type valueType string
+
+const (
+	valueTypeString valueType = "string"
+	valueTypeNumber valueType = "number"
+	valueTypeBool   valueType = "bool"
+	valueTypeObject valueType = "object"
+	valueTypeArray  valueType = "array"
+	valueTypeNull   valueType = "null"
+)
+
+// typedValue is the plaintext of the payloads encrypted by EncryptValue.
+type typedValue struct {
+	Type  valueType       `json:"t"`
+	Value json.RawMessage `json:"v"`
+}
+
+var errInvalidValueTarget = errors.New("decrypt value target must be a non-nil pointer")
+
+// EncryptValue serializes the given value as JSON and encrypts it, along with a type
+// marker, so DecryptValue can validate that the target matches the encrypted value.
+func (s *SecretsService) EncryptValue(ctx context.Context, v any, opt secrets.EncryptionOptions) ([]byte, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize value: %w", err)
+	}
+
+	payload, err := json.Marshal(typedValue{Type: jsonValueType(raw), Value: raw})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Encrypt(ctx, payload, opt)
+}
+
+// DecryptValue decrypts the given payload, encrypted by EncryptValue, and deserializes
+// the value into dst, which must be a non-nil pointer to a type that matches the type
+// of the encrypted value (e.g. a number cannot be decrypted into a string).
+func (s *SecretsService) DecryptValue(ctx context.Context, payload []byte, dst any) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errInvalidValueTarget
+	}
+
+	value, err := s.decryptTypedValue(ctx, payload)
+	if err != nil {
+		return err
+	}
+
+	if expected, ok := targetValueType(rv.Type().Elem()); ok && value.Type != valueTypeNull && value.Type != expected {
+		return fmt.Errorf("cannot decrypt value of type %s into %s", value.Type, rv.Type().Elem())
+	}
+
+	return json.Unmarshal(value.Value, dst)
+}
+
+// EncryptTypedJsonData works like EncryptJsonData, but for values of any type: each value is
+// encrypted with EncryptValue, so its type is preserved, instead of having to be stringified.
+// The resulting map must be decrypted with DecryptTypedJsonData.
+func (s *SecretsService) EncryptTypedJsonData(ctx context.Context, kv map[string]any, opt secrets.EncryptionOptions) (map[string][]byte, error) {
+	encrypted := make(map[string][]byte, len(kv))
+	for key, value := range kv {
+		encryptedData, err := s.EncryptValue(ctx, value, opt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt value of key '%s': %w", key, err)
+		}
+
+		encrypted[key] = encryptedData
+	}
+	return encrypted, nil
+}
+
+// DecryptTypedJsonData decrypts the given map, encrypted by EncryptTypedJsonData. Values are
+// deserialized as by encoding/json into an interface value, except for numbers, which are
+// returned as json.Number so integers don't lose precision: strings as string, booleans as
+// bool, objects as map[string]any, arrays as []any and nulls as nil. Structs are returned
+// as objects, and byte slices as base64 strings, as that's how they're serialized.
+func (s *SecretsService) DecryptTypedJsonData(ctx context.Context, sjd map[string][]byte) (map[string]any, error) {
+	if err := s.checkJsonDataEntries(sjd); err != nil {
+		return nil, err
+	}
+
+	decrypted := make(map[string]any, len(sjd))
+	for key, data := range sjd {
+		value, err := s.decryptTypedValue(ctx, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt value of key '%s': %w", key, err)
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(value.Value))
+		dec.UseNumber()
+
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("failed to deserialize value of key '%s': %w", key, err)
+		}
+
+		decrypted[key] = v
+	}
+	return decrypted, nil
+}
+
+// decryptTypedValue decrypts the given payload, encrypted by EncryptValue, and deserializes its typed value.
+func (s *SecretsService) decryptTypedValue(ctx context.Context, payload []byte) (typedValue, error) {
+	decrypted, err := s.Decrypt(ctx, payload)
+	if err != nil {
+		return typedValue{}, err
+	}
+
+	var value typedValue
+	if err := json.Unmarshal(decrypted, &value); err != nil {
+		return typedValue{}, fmt.Errorf("failed to deserialize typed value: %w", err)
+	}
+
+	return value, nil
+}
+
+// jsonValueType returns the type of the given serialized JSON value.
+func jsonValueType(raw []byte) valueType {
+	switch raw[0] {
+	case '"':
+		return valueTypeString
+	case 't', 'f':
+		return valueTypeBool
+	case 'n':
+		return valueTypeNull
+	case '{':
+		return valueTypeObject
+	case '[':
+		return valueTypeArray
+	default:
+		return valueTypeNumber
+	}
+}
+
+// targetValueType returns the type of JSON value the given Go type is deserialized
+// from. It reports false when it cannot be known in advance (e.g. interfaces or
+// types with custom deserialization), so the target isn't validated.
+func targetValueType(t reflect.Type) (valueType, bool) {
+	if t.Implements(reflect.TypeFor[json.Unmarshaler]()) ||
+		reflect.PointerTo(t).Implements(reflect.TypeFor[json.Unmarshaler]()) {
+		return "", false
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return targetValueType(t.Elem())
+	case reflect.String:
+		return valueTypeString, true
+	case reflect.Bool:
+		return valueTypeBool, true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return valueTypeNumber, true
+	case reflect.Struct, reflect.Map:
+		return valueTypeObject, true
+	case reflect.Slice:
+		// Byte slices are serialized as base64 strings.
+		if t.Elem().Kind() == reflect.Uint8 {
+			return valueTypeString, true
+		}
+		return valueTypeArray, true
+	case reflect.Array:
+		return valueTypeArray, true
+	default:
+		return "", false
+	}
+}
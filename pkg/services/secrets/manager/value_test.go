@@ -0,0 +1,129 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_EncryptValue(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	type credentials struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+	}
+
+	roundTrip := func(t *testing.T, v any, dst any) {
+		t.Helper()
+
+		encrypted, err := svc.EncryptValue(ctx, v, secrets.WithoutScope())
+		require.NoError(t, err)
+		require.NoError(t, svc.DecryptValue(ctx, encrypted, dst))
+	}
+
+	t.Run("values should round-trip", func(t *testing.T) {
+		var i int
+		roundTrip(t, 42, &i)
+		assert.Equal(t, 42, i)
+
+		var b bool
+		roundTrip(t, true, &b)
+		assert.True(t, b)
+
+		var s string
+		roundTrip(t, "grafana", &s)
+		assert.Equal(t, "grafana", s)
+
+		var c credentials
+		roundTrip(t, credentials{User: "admin", Password: "secret"}, &c)
+		assert.Equal(t, credentials{User: "admin", Password: "secret"}, c)
+
+		var l []string
+		roundTrip(t, []string{"a", "b"}, &l)
+		assert.Equal(t, []string{"a", "b"}, l)
+
+		var ts time.Time
+		created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		roundTrip(t, created, &ts)
+		assert.True(t, created.Equal(ts))
+
+		var a any
+		roundTrip(t, map[string]any{"a": 1.0}, &a)
+		assert.Equal(t, map[string]any{"a": 1.0}, a)
+	})
+
+	t.Run("mismatching target should be rejected", func(t *testing.T) {
+		encrypted, err := svc.EncryptValue(ctx, 42, secrets.WithoutScope())
+		require.NoError(t, err)
+
+		var s string
+		require.ErrorContains(t, svc.DecryptValue(ctx, encrypted, &s), "cannot decrypt value of type number into string")
+	})
+
+	t.Run("non-pointer target should be rejected", func(t *testing.T) {
+		encrypted, err := svc.EncryptValue(ctx, 42, secrets.WithoutScope())
+		require.NoError(t, err)
+
+		var i int
+		require.ErrorIs(t, svc.DecryptValue(ctx, encrypted, i), errInvalidValueTarget)
+		require.ErrorIs(t, svc.DecryptValue(ctx, encrypted, nil), errInvalidValueTarget)
+	})
+}
+
+func TestSecretsService_EncryptTypedJsonData(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	encrypted, err := svc.EncryptTypedJsonData(ctx, map[string]any{
+		"password": "grafana",
+		"port":     int64(9007199254740993),
+		"ratio":    0.5,
+		"tls":      true,
+		"headers":  map[string]string{"X-Api-Key": "secret"},
+		"scopes":   []string{"read", "write"},
+		"empty":    nil,
+	}, secrets.WithoutScope())
+	require.NoError(t, err)
+
+	t.Run("types should be preserved", func(t *testing.T) {
+		decrypted, err := svc.DecryptTypedJsonData(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]any{
+			"password": "grafana",
+			"port":     json.Number("9007199254740993"),
+			"ratio":    json.Number("0.5"),
+			"tls":      true,
+			"headers":  map[string]any{"X-Api-Key": "secret"},
+			"scopes":   []any{"read", "write"},
+			"empty":    nil,
+		}, decrypted)
+	})
+
+	t.Run("values should be decryptable one by one", func(t *testing.T) {
+		var port int64
+		require.NoError(t, svc.DecryptValue(ctx, encrypted["port"], &port))
+		assert.Equal(t, int64(9007199254740993), port)
+	})
+
+	t.Run("values not encrypted as typed should fail", func(t *testing.T) {
+		plain, err := svc.EncryptJsonData(ctx, map[string]string{"password": "grafana"}, secrets.WithoutScope())
+		require.NoError(t, err)
+
+		_, err = svc.DecryptTypedJsonData(ctx, plain)
+		require.ErrorContains(t, err, "failed to decrypt value of key 'password'")
+	})
+
+	t.Run("unserializable values should fail", func(t *testing.T) {
+		_, err := svc.EncryptTypedJsonData(ctx, map[string]any{"fn": func() {}}, secrets.WithoutScope())
+		require.ErrorContains(t, err, "failed to encrypt value of key 'fn'")
+	})
+}
@@ -0,0 +1,120 @@
+package manager
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"sort"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// Kinds of discrepancies reported by Verify.
+const (
+	// DiscrepancyMissing is a cached data key that's not in the store anymore.
+	DiscrepancyMissing = "missing"
+	// DiscrepancyUndecryptable is a stored data key that cannot be decrypted by its provider.
+	DiscrepancyUndecryptable = "undecryptable"
+	// DiscrepancyCacheMismatch is a cached data key that differs from the stored one.
+	DiscrepancyCacheMismatch = "cache-mismatch"
+)
+
+// VerifyReport is the result of Verify. Like EncryptionConfigReport,
+// it must never contain any secret material.
+type VerifyReport struct {
+	Checked       int                  `json:"checked"`
+	Discrepancies []DataKeyDiscrepancy `json:"discrepancies"`
+}
+
+// DataKeyDiscrepancy is an inconsistency found by Verify for a data key.
+type DataKeyDiscrepancy struct {
+	Id    string `json:"id"`
+	Kind  string `json:"kind"`
+	Error string `json:"error,omitempty"`
+}
+
+// Verify checks the consistency of the whole encryption subsystem: each active data key in the
+// store must be decryptable by its provider and, if cached, match the cached one, and each cached
+// data key must still be in the store. Discrepancies are reported per data key, sorted by id.
+//
+// It's safe to run on a live system: data keys are decrypted without going through the cache,
+// calls to the providers are subject to their concurrency limits, and they're paused while there's
+// live decrypt traffic (like the cache warm-up). It stops as soon as the context is done.
+func (s *SecretsService) Verify(ctx context.Context) (VerifyReport, error) {
+	ctx, span := s.tracer.Start(ctx, "secretsService.Verify")
+	defer span.End()
+
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	cached := make(map[string]*dataKeyCacheEntry)
+	for _, entry := range s.dataKeyCache.entriesById() {
+		cached[entry.id] = entry
+	}
+
+	report := VerifyReport{Discrepancies: make([]DataKeyDiscrepancy, 0)}
+	stored := make(map[string]struct{}, len(dataKeys))
+
+	for _, dataKey := range dataKeys {
+		stored[dataKey.Id] = struct{}{}
+
+		if !dataKey.Active {
+			continue
+		}
+
+		if err := s.yieldToDecrypts(ctx); err != nil {
+			return VerifyReport{}, err
+		}
+
+		report.Checked++
+
+		_, decrypted, err := s.fetchDataKeyById(ctx, dataKey.Id)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return VerifyReport{}, ctxErr
+			}
+
+			report.Discrepancies = append(report.Discrepancies, DataKeyDiscrepancy{
+				Id:    dataKey.Id,
+				Kind:  DiscrepancyUndecryptable,
+				Error: err.Error(),
+			})
+			continue
+		}
+
+		if entry, ok := cached[dataKey.Id]; ok && subtle.ConstantTimeCompare(entry.dataKey, decrypted) != 1 {
+			report.Discrepancies = append(report.Discrepancies, DataKeyDiscrepancy{
+				Id:   dataKey.Id,
+				Kind: DiscrepancyCacheMismatch,
+			})
+		}
+	}
+
+	for id := range cached {
+		if _, ok := stored[id]; ok {
+			continue
+		}
+
+		// The data key may have been created after the store was read.
+		if _, err := s.store.GetDataKey(ctx, id); !errors.Is(err, secrets.ErrDataKeyNotFound) {
+			continue
+		}
+
+		report.Discrepancies = append(report.Discrepancies, DataKeyDiscrepancy{
+			Id:   id,
+			Kind: DiscrepancyMissing,
+		})
+	}
+
+	sort.Slice(report.Discrepancies, func(i, j int) bool {
+		return report.Discrepancies[i].Id < report.Discrepancies[j].Id
+	})
+
+	if len(report.Discrepancies) > 0 {
+		s.log.Warn("Encryption verification found discrepancies", "checked", report.Checked, "discrepancies", len(report.Discrepancies))
+	}
+
+	return report, nil
+}
@@ -0,0 +1,68 @@
+package manager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+)
+
+func TestSecretsService_Verify(t *testing.T) {
+	ctx := context.Background()
+	store := fakes.NewFakeSecretsStore()
+	svc := SetupTestService(t, store)
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	keyId, _, err := decodeEnvelope(encrypted)
+	require.NoError(t, err)
+
+	t.Run("consistent subsystem should have no discrepancies", func(t *testing.T) {
+		report, err := svc.Verify(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Checked)
+		assert.Empty(t, report.Discrepancies)
+	})
+
+	t.Run("discrepancies should be reported per data key", func(t *testing.T) {
+		require.NoError(t, store.CreateDataKey(ctx, &secrets.DataKey{
+			Active:        true,
+			Id:            "b-undecryptable",
+			Label:         "b-undecryptable",
+			Scope:         "root",
+			Provider:      "removed.v1",
+			EncryptedData: []byte("encrypted"),
+		}))
+		require.NoError(t, store.CreateDataKey(ctx, &secrets.DataKey{
+			Id:       "c-inactive",
+			Label:    "c-inactive",
+			Scope:    "root",
+			Provider: "removed.v1",
+		}))
+
+		svc.dataKeyCache.addById(&dataKeyCacheEntry{id: keyId, dataKey: []byte("corrupted"), active: true})
+		svc.dataKeyCache.addById(&dataKeyCacheEntry{id: "a-missing", dataKey: []byte("missing"), active: true})
+
+		report, err := svc.Verify(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 2, report.Checked)
+
+		kinds := make(map[string]string, len(report.Discrepancies))
+		errs := make(map[string]string, len(report.Discrepancies))
+		for _, discrepancy := range report.Discrepancies {
+			kinds[discrepancy.Id] = discrepancy.Kind
+			errs[discrepancy.Id] = discrepancy.Error
+		}
+		assert.Equal(t, map[string]string{
+			"a-missing":       DiscrepancyMissing,
+			"b-undecryptable": DiscrepancyUndecryptable,
+			keyId:             DiscrepancyCacheMismatch,
+		}, kinds)
+		assert.Contains(t, errs["b-undecryptable"], "removed.v1")
+	})
+}
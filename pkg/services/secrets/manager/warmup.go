@@ -0,0 +1,147 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// warmUpYieldInterval is how long the cache warm-up waits
+// before checking again whether live decrypt traffic is over.
+const warmUpYieldInterval = 10 * time.Millisecond
+
+// warmUpCache pre-loads the active data keys into the in-memory cache, so
+// the first decrypt operations after startup don't need to call the encryption
+// providers (e.g. KMS). Calls to the providers are rate-limited by the configured
+// rate, and paused while there's live decrypt traffic, so the warm-up never
+// competes with foreground requests. It stops as soon as the context is done.
+func (s *SecretsService) warmUpCache(ctx context.Context) error {
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	limiter := rate.NewLimiter(s.warmUpRate, 1)
+
+	var warmed int
+	for _, dataKey := range dataKeys {
+		if !dataKey.Active || secrets.IsEscrowDataKeyId(dataKey.Id) {
+			continue
+		}
+
+		if _, exists := s.dataKeyCache.getById(dataKey.Id); exists {
+			continue
+		}
+
+		if err := s.yieldToDecrypts(ctx); err != nil {
+			return err
+		}
+
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+
+		if _, err := s.dataKeyById(ctx, dataKey.Id); err != nil {
+			s.log.Warn("Failed to warm up data key", "id", dataKey.Id, "error", err)
+			continue
+		}
+
+		warmed++
+	}
+
+	s.log.Debug("Data keys cache warm-up finished", "warmed", warmed)
+
+	return nil
+}
+
+// ExpiringCachedDataKeys returns the identifiers, sorted, of the data keys cached for decryption
+// that are going to expire from the cache within the given window, e.g. to check what the
+// prewarming (see prewarmExpiringDataKeys) is going to refresh. Expired ones aren't included.
+func (s *SecretsService) ExpiringCachedDataKeys(window time.Duration) []string {
+	entries := s.dataKeyCache.expiringWithin(window)
+
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// prewarmExpiringDataKeys refreshes the data keys cached by id that are about to expire (see
+// prewarmWindow), so decrypt operations don't need to call the encryption providers when they
+// do. Unlike refreshAhead, it isn't limited to the current data keys: inactive data keys are
+// refreshed too, as they're still used to decrypt. Like the warm-up, it yields to live decrypt
+// traffic. There's at most one refresh in progress per entry.
+func (s *SecretsService) prewarmExpiringDataKeys(ctx context.Context) error {
+	var prewarmed int
+	for _, entry := range s.dataKeyCache.expiringWithin(s.prewarmWindow) {
+		if err := s.yieldToDecrypts(ctx); err != nil {
+			return err
+		}
+
+		if !entry.refreshing.CompareAndSwap(false, true) {
+			continue
+		}
+
+		dataKey, decrypted, err := s.fetchDataKeyById(ctx, entry.id)
+		if err != nil {
+			s.log.Warn("Failed to prewarm data key ahead of its expiration", "id", entry.id, "error", err)
+			entry.refreshing.Store(false)
+			continue
+		}
+
+		refreshed := s.cacheDataKey(dataKey, decrypted)
+		s.dataKeyCache.replaceCurrent(entry, refreshed)
+		prewarmed++
+	}
+
+	s.log.Debug("Expiring data keys prewarming finished", "prewarmed", prewarmed)
+
+	return nil
+}
+
+// yieldToDecrypts blocks until there are no decrypt operations in flight.
+func (s *SecretsService) yieldToDecrypts(ctx context.Context) error {
+	for s.inflightDecrypts.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(warmUpYieldInterval):
+		}
+	}
+
+	return ctx.Err()
+}
+
+// prefetchCurrentDataKey loads the current data key of the root scope or, if there's
+// none yet, creates it, so the first encrypt operation after startup doesn't need to.
+func (s *SecretsService) prefetchCurrentDataKey(ctx context.Context) error {
+	scope := secrets.WithoutScope()()
+	providerID := s.scopeProvider(scope)
+	label := secrets.KeyLabel(scope, providerID)
+
+	id, _, err := s.currentDataKey(ctx, label, scope, encryptOptions{noCreate: true})
+	if err == nil {
+		s.log.Info("Prefetched existing current data key", "id", id)
+		return nil
+	}
+
+	if !errors.Is(err, secrets.ErrNoCurrentKey) {
+		return err
+	}
+
+	id, _, err = s.currentDataKey(ctx, label, scope, encryptOptions{provider: providerID})
+	if err != nil {
+		return err
+	}
+
+	s.log.Info("Prefetched newly created current data key", "id", id)
+	return nil
+}
@@ -0,0 +1,165 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+	"gopkg.in/ini.v1"
+
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/infra/usagestats"
+	encryptionprovider "github.com/grafana/grafana/pkg/services/encryption/provider"
+	encryptionservice "github.com/grafana/grafana/pkg/services/encryption/service"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/kmsproviders/osskmsproviders"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/services/supportbundles/supportbundlestest"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+func TestSecretsService_WarmUpCache(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, fakes.NewFakeSecretsStore())
+	svc.warmUpRate = rate.Inf
+
+	for _, scope := range []string{"root", "org:1", "user:1"} {
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope(scope))
+		require.NoError(t, err)
+	}
+
+	t.Run("active data keys should be cached", func(t *testing.T) {
+		svc.dataKeyCache.flush()
+
+		require.NoError(t, svc.warmUpCache(ctx))
+		assert.Len(t, svc.dataKeyCache.byId, 3)
+	})
+
+	t.Run("cancelled warm-up should stop", func(t *testing.T) {
+		svc.dataKeyCache.flush()
+
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		require.ErrorIs(t, svc.warmUpCache(ctx), context.Canceled)
+		assert.Empty(t, svc.dataKeyCache.byId)
+	})
+
+	t.Run("warm-up should yield to live decrypt traffic", func(t *testing.T) {
+		svc.dataKeyCache.flush()
+
+		svc.inflightDecrypts.Add(1)
+		defer svc.inflightDecrypts.Add(-1)
+
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		require.ErrorIs(t, svc.warmUpCache(ctx), context.DeadlineExceeded)
+		assert.Empty(t, svc.dataKeyCache.byId)
+	})
+}
+
+func TestSecretsService_PrewarmExpiringDataKeys(t *testing.T) {
+	restoreTimeNowAfterTestExec(t)
+
+	ctx := context.Background()
+	store := &countingStore{Store: fakes.NewFakeSecretsStore()}
+	svc := SetupTestService(t, store)
+	svc.prewarmWindow = time.Minute
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	keyId, _, err := decodeEnvelope(encrypted)
+	require.NoError(t, err)
+
+	// Decrypt to cache the data key by id.
+	_, err = svc.Decrypt(ctx, encrypted)
+	require.NoError(t, err)
+
+	entry, exists := svc.dataKeyCache.getById(keyId)
+	require.True(t, exists)
+
+	t.Run("data keys not about to expire should be left as is", func(t *testing.T) {
+		assert.Empty(t, svc.ExpiringCachedDataKeys(svc.prewarmWindow))
+
+		fetched := store.fetched
+		require.NoError(t, svc.prewarmExpiringDataKeys(ctx))
+		assert.Equal(t, fetched, store.fetched)
+	})
+
+	t.Run("data keys about to expire should be refreshed", func(t *testing.T) {
+		now = func() time.Time { return entry.expiration.Add(-30 * time.Second) }
+		assert.Equal(t, []string{keyId}, svc.ExpiringCachedDataKeys(svc.prewarmWindow))
+
+		fetched := store.fetched
+		require.NoError(t, svc.prewarmExpiringDataKeys(ctx))
+		assert.Equal(t, fetched+1, store.fetched)
+
+		refreshed, exists := svc.dataKeyCache.getById(keyId)
+		require.True(t, exists)
+		assert.NotSame(t, entry, refreshed)
+		assert.True(t, refreshed.expiration.After(entry.expiration))
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+		assert.Equal(t, fetched+1, store.fetched)
+	})
+}
+
+func TestSecretsService_PrefetchCurrentDataKey(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{Store: fakes.NewFakeSecretsStore()}
+	svc := SetupTestService(t, store)
+
+	require.NoError(t, svc.prefetchCurrentDataKey(ctx))
+	require.Equal(t, 1, store.created)
+
+	// The existing data key is loaded instead.
+	require.NoError(t, svc.prefetchCurrentDataKey(ctx))
+	require.Equal(t, 1, store.created)
+
+	_, err := svc.EncryptNoCreate(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+}
+
+func TestProvideSecretsService_PrefetchCurrentDataKey(t *testing.T) {
+	raw, err := ini.Load([]byte(`
+		[security]
+		secret_key = sdDkslslld
+
+		[security.encryption]
+		data_keys_prefetch = true`))
+	require.NoError(t, err)
+
+	cfg := &setting.Cfg{Raw: raw}
+
+	encryptionService, err := encryptionservice.ProvideEncryptionService(
+		tracing.InitializeTracerForTest(), encryptionprovider.Provider{}, &usagestats.UsageStatsMock{}, cfg,
+	)
+	require.NoError(t, err)
+
+	provide := func(features featuremgmt.FeatureToggles) *countingStore {
+		store := &countingStore{Store: fakes.NewFakeSecretsStore()}
+		_, err := ProvideSecretsService(
+			tracing.InitializeTracerForTest(),
+			store,
+			osskmsproviders.ProvideService(encryptionService, cfg, features),
+			encryptionService,
+			cfg,
+			features,
+			&usagestats.UsageStatsMock{T: t},
+			supportbundlestest.NewFakeBundleService(),
+		)
+		require.NoError(t, err)
+		return store
+	}
+
+	assert.Equal(t, 1, provide(featuremgmt.WithFeatures()).created)
+	assert.Zero(t, provide(featuremgmt.WithFeatures(featuremgmt.FlagDisableEnvelopeEncryption)).created)
+}
@@ -29,20 +29,43 @@ type Service interface {
 	DecryptJsonData(ctx context.Context, sjd map[string][]byte) (map[string]string, error)
 
 	GetDecryptedValue(ctx context.Context, sjd map[string][]byte, key, fallback string) string
+	// GetDecryptedValueE works like GetDecryptedValue, but the fallback is only returned
+	// when the key is missing, so decryption errors are surfaced instead of masked.
+	GetDecryptedValueE(ctx context.Context, sjd map[string][]byte, key, fallback string) (string, error)
 
 	RotateDataKeys(ctx context.Context) error
 	ReEncryptDataKeys(ctx context.Context) error
 }
 
-// Store defines methods to interact with secrets storage
+// Store defines methods to interact with secrets storage.
+//
+// Implementations other than the SQL one (e.g. backed by an external secret store)
+// can be verified with storetest.StoreConformanceTest. Note that ReEncryptDataKeys
+// is expected to be resumable, so implementations are responsible for keeping
+// track of their own progress (e.g. with checkpoints) in case of interruption.
 type Store interface {
 	GetDataKey(ctx context.Context, id string) (*DataKey, error)
 	GetCurrentDataKey(ctx context.Context, label string) (*DataKey, error)
 	GetAllDataKeys(ctx context.Context) ([]*DataKey, error)
+	CountDataKeys(ctx context.Context) (int64, error)
+	// GetLatestGeneration returns the highest generation of the data keys stored, and whether
+	// all the data keys of that generation are disabled. It returns zero and false if there
+	// isn't any data key.
+	GetLatestGeneration(ctx context.Context) (int64, bool, error)
 	CreateDataKey(ctx context.Context, dataKey *DataKey) error
+	// CreateDataKeys creates all the given data keys at once, with as few
+	// round trips as possible: either all of them are created, or none.
+	CreateDataKeys(ctx context.Context, dataKeys []*DataKey) error
 	DisableDataKeys(ctx context.Context) error
+	DisableDataKey(ctx context.Context, id string) error
 	DeleteDataKey(ctx context.Context, id string) error
+	// UpdateDataKeysProvider replaces the provider of all the data keys stored with
+	// the given one, and returns how many were updated. Their labels are left as is.
+	UpdateDataKeysProvider(ctx context.Context, from ProviderID, to ProviderID) (int64, error)
 	ReEncryptDataKeys(ctx context.Context, providers map[ProviderID]Provider, currProvider ProviderID) error
+	// ReEncryptDataKeysOlderThan works like ReEncryptDataKeys, but only for
+	// the data keys created before the given time.
+	ReEncryptDataKeysOlderThan(ctx context.Context, providers map[ProviderID]Provider, currProvider ProviderID, olderThan time.Time) error
 }
 
 // Provider is a key encryption key provider for envelope encryption
@@ -64,15 +87,83 @@ func (id ProviderID) Kind() (string, error) {
 	return parts[0], nil
 }
 
+// IdentifiedProvider is an encryption provider along with its identifier.
+type IdentifiedProvider struct {
+	ID       ProviderID
+	Provider Provider
+}
+
 func KeyLabel(scope string, providerID ProviderID) string {
 	return fmt.Sprintf("%s/%s@%s", time.Now().Format("2006-01-02"), scope, providerID)
 }
 
+// AliasKeyLabel returns the label of the data keys resolved from the given alias. Unlike KeyLabel,
+// it has no date, as a new data key is only created for an alias when the generation changes.
+func AliasKeyLabel(alias string, scope string, providerID ProviderID) string {
+	return fmt.Sprintf("%s%s/%s@%s", AliasLabelPrefix, alias, scope, providerID)
+}
+
+// ReEncryptedKeyLabel returns the label of the given data key once re-encrypted by the given
+// provider, keeping its alias (see AliasKeyLabel) and its escrow providers, if any.
+func ReEncryptedKeyLabel(dataKey *DataKey, providerID ProviderID) string {
+	label := KeyLabel(dataKey.Scope, providerID)
+	if alias, _, ok := ParseAliasDataKeyId(dataKey.Id); ok && IsAliasLabel(dataKey.Label) {
+		label = AliasKeyLabel(alias, dataKey.Scope, providerID)
+	}
+
+	if _, escrow, _ := strings.Cut(dataKey.Label, EscrowLabelSeparator); escrow != "" {
+		label += EscrowLabelSeparator + escrow
+	}
+
+	return label
+}
+
 // BackgroundProvider should be implemented for a provider that has a task that needs to be run in the background.
 type BackgroundProvider interface {
 	Run(ctx context.Context) error
 }
 
+// ProviderCapabilities describes the features an encryption provider supports beyond Encrypt and
+// Decrypt, so the features relying on them can be used when available, and skipped otherwise.
+type ProviderCapabilities struct {
+	// NativeRotation is whether the provider rotates its own keys (e.g. a KMS with automatic key
+	// rotation), while keeping the blobs encrypted with the previous ones decryptable.
+	NativeRotation bool `json:"nativeRotation"`
+	// Rewrap is whether the provider can re-encrypt the blobs it encrypted without exposing them.
+	Rewrap bool `json:"rewrap"`
+	// BatchWrap is whether the provider can encrypt several blobs in a single call.
+	BatchWrap bool `json:"batchWrap"`
+	// Remote is whether the provider calls a remote service, so its calls are slow and may fail transiently.
+	Remote bool `json:"remote"`
+}
+
+// CapableProvider should be implemented for a provider that reports its capabilities.
+// Providers that don't are assumed to support none of them.
+type CapableProvider interface {
+	Capabilities() ProviderCapabilities
+}
+
+// ValidatingProvider should be implemented for a provider that can validate its own configuration
+// (e.g. credentials are present, key is resolvable), so misconfigurations are surfaced at startup.
+type ValidatingProvider interface {
+	Validate(ctx context.Context) error
+}
+
+// RefreshingProvider should be implemented for a provider whose credentials expire (e.g. short-lived
+// tokens), so they are periodically refreshed and long-lived instances remain authenticated.
+type RefreshingProvider interface {
+	RefreshCredentials(ctx context.Context) error
+}
+
+// DataKeyQuarantine should be implemented for a service that quarantines the data keys that
+// repeatedly fail to be decrypted, so the quarantine can be inspected and cleared by admins.
+type DataKeyQuarantine interface {
+	QuarantinedDataKeys() []QuarantinedDataKey
+	// ClearDataKeyQuarantine lifts the quarantine of the data key with the given id, if any,
+	// and reports whether it was quarantined.
+	ClearDataKeyQuarantine(keyId string) bool
+}
+
 // Migrator is responsible for secrets migrations like re-encrypting or rolling back secrets.
 type Migrator interface {
 	// ReEncryptSecrets decrypts and re-encrypts the secrets with most recent
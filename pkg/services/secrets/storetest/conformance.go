@@ -0,0 +1,244 @@
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// prefixProvider is a reversible, non-secure provider that
+// just prefixes the payloads with its name, so tests can tell
+// which provider encrypted a data key.
+type prefixProvider string
+
+func (p prefixProvider) Encrypt(_ context.Context, blob []byte) ([]byte, error) {
+	return append([]byte(p), blob...), nil
+}
+
+func (p prefixProvider) Decrypt(_ context.Context, blob []byte) ([]byte, error) {
+	return bytes.TrimPrefix(blob, []byte(p)), nil
+}
+
+// StoreConformanceTest verifies that a secrets.Store implementation behaves as expected
+// by the secrets service, so any implementation (e.g. backed by an external secret store)
+// can be used interchangeably. The given function must return a new, empty store.
+func StoreConformanceTest(t *testing.T, newStore func(t *testing.T) secrets.Store) {
+	ctx := context.Background()
+
+	dataKey := func(id, label string) *secrets.DataKey {
+		return &secrets.DataKey{
+			Active:        true,
+			Id:            id,
+			Label:         label,
+			Scope:         "root",
+			Provider:      "a.v1",
+			EncryptedData: []byte("a.v1:" + id),
+		}
+	}
+
+	t.Run("getting unknown data key should fail with not found", func(t *testing.T) {
+		store := newStore(t)
+
+		_, err := store.GetDataKey(ctx, "unknown")
+		require.ErrorIs(t, err, secrets.ErrDataKeyNotFound)
+
+		_, err = store.GetCurrentDataKey(ctx, "unknown")
+		require.ErrorIs(t, err, secrets.ErrDataKeyNotFound)
+	})
+
+	t.Run("created data key should be retrievable", func(t *testing.T) {
+		store := newStore(t)
+		require.NoError(t, store.CreateDataKey(ctx, dataKey("a", "root/a.v1")))
+
+		got, err := store.GetDataKey(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, "a", got.Id)
+		assert.Equal(t, "root/a.v1", got.Label)
+		assert.Equal(t, "root", got.Scope)
+		assert.Equal(t, secrets.ProviderID("a.v1"), got.Provider)
+		assert.Equal(t, []byte("a.v1:a"), got.EncryptedData)
+		assert.True(t, got.Active)
+	})
+
+	t.Run("data keys created in batch should be retrievable", func(t *testing.T) {
+		store := newStore(t)
+
+		batch := make([]*secrets.DataKey, 0, 150)
+		for i := 0; i < cap(batch); i++ {
+			id := fmt.Sprintf("batch-%d", i)
+			batch = append(batch, dataKey(id, "root/"+id))
+		}
+		require.NoError(t, store.CreateDataKeys(ctx, batch))
+
+		count, err := store.CountDataKeys(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(batch)), count)
+
+		got, err := store.GetCurrentDataKey(ctx, "root/batch-149")
+		require.NoError(t, err)
+		assert.Equal(t, "batch-149", got.Id)
+		assert.Equal(t, []byte("a.v1:batch-149"), got.EncryptedData)
+	})
+
+	t.Run("current data key should be the newest active one", func(t *testing.T) {
+		store := newStore(t)
+		for _, id := range []string{"a", "b"} {
+			require.NoError(t, store.CreateDataKey(ctx, dataKey(id, "root/a.v1")))
+		}
+		require.NoError(t, store.CreateDataKey(ctx, dataKey("c", "another")))
+
+		current, err := store.GetCurrentDataKey(ctx, "root/a.v1")
+		require.NoError(t, err)
+		assert.Equal(t, "b", current.Id)
+
+		require.NoError(t, store.DisableDataKey(ctx, "b"))
+
+		current, err = store.GetCurrentDataKey(ctx, "root/a.v1")
+		require.NoError(t, err)
+		assert.Equal(t, "a", current.Id)
+	})
+
+	t.Run("data keys should be listed and counted", func(t *testing.T) {
+		store := newStore(t)
+		for _, id := range []string{"a", "b", "c"} {
+			require.NoError(t, store.CreateDataKey(ctx, dataKey(id, id)))
+		}
+
+		all, err := store.GetAllDataKeys(ctx)
+		require.NoError(t, err)
+		ids := make([]string, 0, len(all))
+		for _, k := range all {
+			ids = append(ids, k.Id)
+		}
+		assert.ElementsMatch(t, []string{"a", "b", "c"}, ids)
+
+		count, err := store.CountDataKeys(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), count)
+	})
+
+	t.Run("latest generation should be the highest one of any data key", func(t *testing.T) {
+		store := newStore(t)
+
+		generation, disabled, err := store.GetLatestGeneration(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), generation)
+		assert.False(t, disabled)
+
+		for i, id := range []string{"a", "b", "c"} {
+			key := dataKey(id, id)
+			key.Generation = int64(i / 2)
+			require.NoError(t, store.CreateDataKey(ctx, key))
+		}
+
+		generation, disabled, err = store.GetLatestGeneration(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), generation)
+		assert.False(t, disabled)
+
+		require.NoError(t, store.DisableDataKey(ctx, "c"))
+
+		generation, disabled, err = store.GetLatestGeneration(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), generation)
+		assert.True(t, disabled)
+	})
+
+	t.Run("disabled data keys should be kept but not be current", func(t *testing.T) {
+		store := newStore(t)
+		for _, id := range []string{"a", "b"} {
+			require.NoError(t, store.CreateDataKey(ctx, dataKey(id, id)))
+		}
+
+		require.NoError(t, store.DisableDataKeys(ctx))
+
+		for _, id := range []string{"a", "b"} {
+			got, err := store.GetDataKey(ctx, id)
+			require.NoError(t, err)
+			assert.False(t, got.Active)
+
+			_, err = store.GetCurrentDataKey(ctx, id)
+			require.ErrorIs(t, err, secrets.ErrDataKeyNotFound)
+		}
+	})
+
+	t.Run("deleted data key should not be retrievable", func(t *testing.T) {
+		store := newStore(t)
+		require.NoError(t, store.CreateDataKey(ctx, dataKey("a", "a")))
+		require.NoError(t, store.DeleteDataKey(ctx, "a"))
+
+		_, err := store.GetDataKey(ctx, "a")
+		require.ErrorIs(t, err, secrets.ErrDataKeyNotFound)
+	})
+
+	t.Run("data keys provider should be updated", func(t *testing.T) {
+		store := newStore(t)
+		for _, id := range []string{"a", "b"} {
+			require.NoError(t, store.CreateDataKey(ctx, dataKey(id, id)))
+		}
+		other := dataKey("c", "c")
+		other.Provider = "c.v1"
+		require.NoError(t, store.CreateDataKey(ctx, other))
+
+		updated, err := store.UpdateDataKeysProvider(ctx, "a.v1", "b.v1")
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), updated)
+
+		for id, provider := range map[string]secrets.ProviderID{"a": "b.v1", "b": "b.v1", "c": "c.v1"} {
+			got, err := store.GetDataKey(ctx, id)
+			require.NoError(t, err)
+			assert.Equal(t, provider, got.Provider)
+			assert.Equal(t, id, got.Label)
+		}
+	})
+
+	t.Run("re-encrypted data keys should be encrypted by the current provider", func(t *testing.T) {
+		store := newStore(t)
+		require.NoError(t, store.CreateDataKey(ctx, dataKey("a", secrets.KeyLabel("root", "a.v1"))))
+
+		providers := map[secrets.ProviderID]secrets.Provider{
+			"a.v1": prefixProvider("a.v1:"),
+			"b.v1": prefixProvider("b.v1:"),
+		}
+		require.NoError(t, store.ReEncryptDataKeys(ctx, providers, "b.v1"))
+
+		got, err := store.GetDataKey(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, secrets.ProviderID("b.v1"), got.Provider)
+		assert.Equal(t, secrets.KeyLabel("root", "b.v1"), got.Label)
+		assert.Equal(t, []byte("b.v1:a"), got.EncryptedData)
+
+		current, err := store.GetCurrentDataKey(ctx, secrets.KeyLabel("root", "b.v1"))
+		require.NoError(t, err)
+		assert.Equal(t, "a", current.Id)
+	})
+
+	t.Run("only data keys older than the given time should be re-encrypted", func(t *testing.T) {
+		store := newStore(t)
+		require.NoError(t, store.CreateDataKey(ctx, dataKey("a", secrets.KeyLabel("root", "a.v1"))))
+
+		providers := map[secrets.ProviderID]secrets.Provider{
+			"a.v1": prefixProvider("a.v1:"),
+			"b.v1": prefixProvider("b.v1:"),
+		}
+		require.NoError(t, store.ReEncryptDataKeysOlderThan(ctx, providers, "b.v1", time.Now().Add(-time.Hour)))
+
+		got, err := store.GetDataKey(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, secrets.ProviderID("a.v1"), got.Provider)
+
+		require.NoError(t, store.ReEncryptDataKeysOlderThan(ctx, providers, "b.v1", time.Now().Add(time.Hour)))
+
+		got, err = store.GetDataKey(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, secrets.ProviderID("b.v1"), got.Provider)
+		assert.Equal(t, []byte("b.v1:a"), got.EncryptedData)
+	})
+}
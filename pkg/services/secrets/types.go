@@ -1,12 +1,49 @@
 package secrets
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var ErrDataKeyNotFound = errors.New("data key not found")
 
+var ErrNoCurrentKey = errors.New("no current data key")
+
+var ErrKeyCreationThrottled = errors.New("data key creation throttled")
+
+var ErrInvalidPayloadFormat = errors.New("invalid payload format")
+
+var ErrDataKeyCorrupted = errors.New("data key corrupted")
+
+var ErrTenantMismatch = errors.New("payload not encrypted for tenant")
+
+var ErrUnknownScope = errors.New("unknown data key scope")
+
+var ErrPayloadExpired = errors.New("payload expired")
+
+var ErrMandatedProviderNotConfigured = errors.New("encryption provider mandated for the scope is not configured")
+
+var ErrUnsupportedFormatVersion = errors.New("unsupported payload format version")
+
+var ErrNoKeysToRotate = errors.New("no active data keys to rotate")
+
+var ErrDataKeyQuarantined = errors.New("data key quarantined")
+
+// QuarantinedDataKey is a data key that repeatedly failed to be decrypted, so decrypting
+// the payloads encrypted with it fails fast with ErrDataKeyQuarantined until Until.
+type QuarantinedDataKey struct {
+	Id string `json:"id"`
+	// Failures is the amount of consecutive failures to decrypt the data key.
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
 type DataKey struct {
 	Active        bool
 	Id            string `xorm:"name"` // renaming the col in the db itself would break backward compatibility with 8.5.x
@@ -16,6 +53,70 @@ type DataKey struct {
 	EncryptedData []byte
 	Created       time.Time
 	Updated       time.Time
+	// Generation is the amount of data keys rotations done before the data key was created,
+	// so nodes can tell whether the data keys they use are stale. See manager.CurrentGeneration.
+	Generation int64
+}
+
+// EscrowLabelSeparator separates the label of a data key with escrow copies
+// from the list of escrow providers it has copies for.
+const EscrowLabelSeparator = "+escrow="
+
+const escrowDataKeyIdInfix = ".escrow."
+
+// EscrowDataKeyId returns the identifier of the n-th escrow copy of the data key with the given id.
+// Escrow copies hold the very same data key, but encrypted by an escrow provider.
+func EscrowDataKeyId(id string, n int) string {
+	return fmt.Sprintf("%s%s%d", id, escrowDataKeyIdInfix, n)
+}
+
+// IsEscrowDataKeyId reports whether the given data key identifier belongs to an escrow copy.
+func IsEscrowDataKeyId(id string) bool {
+	return strings.Contains(id, escrowDataKeyIdInfix)
+}
+
+// AliasLabelPrefix prefixes the label of the data keys resolved from an alias. See AliasKeyLabel.
+const AliasLabelPrefix = "alias:"
+
+const (
+	aliasDataKeyIdInfix = "@v"
+	// aliasLabelHashLength is the length of the hash of the label in the identifiers
+	// of the data keys resolved from an alias: the separator and 8 hex characters.
+	aliasLabelHashLength = 1 + 8
+)
+
+// AliasDataKeyId returns the identifier of the data key of the given alias, label (see AliasKeyLabel)
+// and generation, so payloads encrypted with an alias reference the alias and generation instead of a
+// random id, e.g. "payments@1a2b3c4d@v3". The label is included as a short hash, so the same alias can
+// be used in different scopes, and with different providers, each with its own data key.
+func AliasDataKeyId(alias string, label string, generation int64) string {
+	sum := sha256.Sum256([]byte(label))
+	return fmt.Sprintf("%s@%s%s%d", alias, hex.EncodeToString(sum[:4]), aliasDataKeyIdInfix, generation)
+}
+
+// ParseAliasDataKeyId is the inverse of AliasDataKeyId, but the hash of the label cannot be reversed.
+// It reports whether the given identifier has the format of a data key resolved from an alias.
+func ParseAliasDataKeyId(id string) (alias string, generation int64, ok bool) {
+	i := strings.LastIndex(id, aliasDataKeyIdInfix)
+	if i <= aliasLabelHashLength || id[i-aliasLabelHashLength] != '@' {
+		return "", 0, false
+	}
+
+	if _, err := hex.DecodeString(id[i-aliasLabelHashLength+1 : i]); err != nil {
+		return "", 0, false
+	}
+
+	generation, err := strconv.ParseInt(id[i+len(aliasDataKeyIdInfix):], 10, 64)
+	if err != nil || generation < 0 {
+		return "", 0, false
+	}
+
+	return id[:i-aliasLabelHashLength], generation, true
+}
+
+// IsAliasLabel reports whether the given label belongs to a data key resolved from an alias.
+func IsAliasLabel(label string) bool {
+	return strings.HasPrefix(label, AliasLabelPrefix)
 }
 
 type EncryptionOptions func() string
@@ -35,3 +136,34 @@ func WithScope(scope string) EncryptionOptions {
 		return scope
 	}
 }
+
+// WithTenant uses a data key for encryption bound to the given tenant (i.e., org),
+// so different tenants never share data keys.
+func WithTenant(orgID int64) EncryptionOptions {
+	return WithScope(TenantScope(orgID))
+}
+
+type auditLabelKey struct{}
+
+// WithAuditLabel returns a copy of the given context carrying the given audit label, which records
+// why secrets are encrypted (e.g. "datasource:prometheus:basic_auth_password"). It's emitted in the
+// encryption logs and metrics exemplars, but it's neither stored in the payloads nor affects the
+// encryption in any way (e.g. the data key used), unlike EncryptionOptions. Empty labels are ignored.
+func WithAuditLabel(ctx context.Context, label string) context.Context {
+	if label == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, auditLabelKey{}, label)
+}
+
+// AuditLabelFromContext returns the audit label carried by the given context, if any. See WithAuditLabel.
+func AuditLabelFromContext(ctx context.Context) string {
+	label, _ := ctx.Value(auditLabelKey{}).(string)
+	return label
+}
+
+// TenantScope returns the scope of the data keys bound to the given tenant (i.e., org).
+func TenantScope(orgID int64) string {
+	return fmt.Sprintf("org:%d", orgID)
+}
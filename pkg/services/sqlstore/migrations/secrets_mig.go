@@ -73,4 +73,14 @@ func addSecretsMigration(mg *migrator.Migrator) {
 	))
 
 	// --------------------
+
+	mg.AddMigration("add generation column into data_keys", migrator.NewAddColumnMigration(
+		dataKeysV1,
+		&migrator.Column{
+			Name:     "generation",
+			Type:     migrator.DB_BigInt,
+			Default:  "0",
+			Nullable: false,
+		},
+	))
 }
@@ -14,6 +14,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/services/login"
 	"github.com/grafana/grafana/pkg/services/login/authinfoimpl"
 	"github.com/grafana/grafana/pkg/services/secrets/database"
@@ -171,7 +172,7 @@ func TestIntegrationIndexViewAnalytics(t *testing.T) {
 				OrgID:    1,
 			})
 
-			secretsService := secretsManager.SetupTestService(t, database.ProvideSecretsStore(store))
+			secretsService := secretsManager.SetupTestService(t, database.ProvideSecretsStore(store, kvstore.ProvideService(store)))
 			authInfoStore := authinfoimpl.ProvideStore(store, secretsService)
 
 			// insert user_auth relationship